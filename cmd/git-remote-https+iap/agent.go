@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/adohkan/git-remote-https-iap/internal/iap"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var (
+	// only used in agentCmd
+	agentSocket string
+
+	agentCmd = &cobra.Command{
+		Use:   "agent",
+		Short: "Hold tokens in memory, so that they never touch disk",
+		Long: `Hold tokens in memory, so that they never touch disk.
+
+The agent runs in the foreground and serves tokens and refresh tokens on a unix socket,
+only accessible by the user. Other invocations use it when iap.credentialStore is set to
+'agent', or when GIT_IAP_AGENT_SOCK points to its socket.
+Tokens are forgotten when the agent stops: the next git command logs in again.`,
+		Args: cobra.NoArgs,
+		Run:  agent,
+	}
+)
+
+func init() {
+	agentCmd.Flags().StringVar(&agentSocket, "socket", "", "Socket to listen on (default: GIT_IAP_AGENT_SOCK, or a socket in XDG_RUNTIME_DIR)")
+
+	rootCmd.AddCommand(agentCmd)
+}
+
+func agent(cmd *cobra.Command, args []string) {
+	if agentSocket == "" {
+		agentSocket = iap.AgentSocket()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	log.Info().Msgf("%s agent: listening on %s", binaryName, agentSocket)
+	if err := iap.ServeAgent(ctx, agentSocket); err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+	log.Info().Msgf("%s agent: stopping", binaryName)
+}
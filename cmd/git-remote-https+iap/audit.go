@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/adohkan/git-remote-https-iap/internal/iap"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var (
+	// only used in auditShowCmd
+	auditHost  string
+	auditSince time.Duration
+
+	auditCmd = &cobra.Command{
+		Use:   "audit",
+		Short: "Review when and how tokens were minted and used on this machine",
+		Long: `Review when and how tokens were minted and used on this machine.
+
+Every login, silent refresh and use of a token is appended to an audit log in the
+storage directory. Set iap.audit to false to disable it.`,
+	}
+
+	auditShowCmd = &cobra.Command{
+		Use:   "show",
+		Short: "Print the audit log",
+		Args:  cobra.NoArgs,
+		Run:   auditShow,
+	}
+)
+
+func init() {
+	auditShowCmd.Flags().StringVar(&auditHost, "host", "", "Only show events of this host")
+	auditShowCmd.Flags().DurationVar(&auditSince, "since", 0, "Only show events more recent than this duration, e.g. 24h")
+
+	auditCmd.AddCommand(auditShowCmd)
+	rootCmd.AddCommand(auditCmd)
+}
+
+func auditShow(cmd *cobra.Command, args []string) {
+	events, err := iap.ReadAuditLog()
+	if err != nil {
+		log.Fatal().Msgf("Could not read %s: %s", iap.AuditFile(), err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tEVENT\tHOST\tACCOUNT\tEXPIRES")
+	for _, e := range events {
+		if auditHost != "" && !strings.Contains(e.Host, auditHost) {
+			continue
+		}
+		if auditSince > 0 && e.Time.Before(time.Now().Add(-auditSince)) {
+			continue
+		}
+
+		expires := "-"
+		if e.ExpiresAt != nil {
+			expires = e.ExpiresAt.Local().Format(time.RFC3339)
+		}
+		account := e.Account
+		if account == "" {
+			account = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", e.Time.Local().Format(time.RFC3339), e.Event, e.Host, account, expires)
+	}
+	w.Flush()
+}
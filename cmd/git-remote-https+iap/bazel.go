@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/adohkan/git-remote-https-iap/internal/iap"
+)
+
+// bazelRemoteHeader returns the --remote_header option of bazel sending the token to the remote cache or
+// executor at scope, which bazel sends both over gRPC and HTTP
+func bazelRemoteHeader(scope string, auth *iap.AuthState) string {
+	parts := strings.SplitN(printableHeader(scope, auth), ": ", 2)
+	return fmt.Sprintf("--remote_header=%s=%s", parts[0], parts[1])
+}
+
+func printBazel(scope string, auth *iap.AuthState) {
+	fmt.Println(bazelRemoteHeader(scope, auth))
+}
+
+// withBazelRemoteHeader returns the bazel command line with the --remote_header option added after its command,
+// e.g. build, as the options before it are the startup options of bazel
+func withBazelRemoteHeader(command []string, option string) []string {
+	args := append([]string{}, command...)
+	for i := 1; i < len(args); i++ {
+		if !strings.HasPrefix(args[i], "-") {
+			return append(args[:i+1], append([]string{option}, args[i+1:]...)...)
+		}
+	}
+	return append(args, option)
+}
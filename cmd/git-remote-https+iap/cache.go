@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/adohkan/git-remote-https-iap/internal/iap"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var (
+	// only used in cacheExportCmd and cacheImportCmd
+	cacheFile, cachePassphraseFile string
+
+	cacheCmd = &cobra.Command{
+		Use:   "cache",
+		Short: "Move cached tokens between machines",
+		Long: `Move cached tokens between machines.
+
+'cache export' bundles the cookies and refresh tokens of configured hosts, encrypted with a
+passphrase, so that short-lived CI runners or devcontainers can be seeded with 'cache import'
+instead of logging in interactively. The passphrase is read from --passphrase-file or
+GIT_IAP_CACHE_PASSPHRASE; when exporting without one, a random passphrase is generated and printed.`,
+	}
+
+	cacheExportCmd = &cobra.Command{
+		Use:   "export",
+		Short: "Write an encrypted bundle of cached tokens",
+		Args:  cobra.NoArgs,
+		Run:   cacheExport,
+	}
+
+	cacheImportCmd = &cobra.Command{
+		Use:   "import",
+		Short: "Save the tokens of an encrypted bundle, for hosts configured on this machine",
+		Args:  cobra.NoArgs,
+		Run:   cacheImport,
+	}
+)
+
+func init() {
+	cacheExportCmd.Flags().StringVarP(&cacheFile, "output", "o", "", "File to write the bundle to (default: stdout)")
+	cacheImportCmd.Flags().StringVarP(&cacheFile, "input", "i", "", "File to read the bundle from (default: stdin)")
+	for _, c := range []*cobra.Command{cacheExportCmd, cacheImportCmd} {
+		c.Flags().StringVar(&cachePassphraseFile, "passphrase-file", "", "File holding the passphrase of the bundle")
+	}
+
+	cacheCmd.AddCommand(cacheExportCmd)
+	cacheCmd.AddCommand(cacheImportCmd)
+	rootCmd.AddCommand(cacheCmd)
+}
+
+// readPassphrase returns the passphrase of --passphrase-file or GIT_IAP_CACHE_PASSPHRASE, if any
+func readPassphrase() string {
+	if cachePassphraseFile != "" {
+		data, err := os.ReadFile(cachePassphraseFile)
+		if err != nil {
+			log.Fatal().Msgf("Could not read passphrase: %s", err)
+		}
+		return strings.TrimSpace(string(data))
+	}
+	return os.Getenv(iap.BundlePassphraseEnvVariable)
+}
+
+func cacheExport(cmd *cobra.Command, args []string) {
+	passphrase := readPassphrase()
+	if passphrase == "" {
+		random := make([]byte, 24)
+		if _, err := io.ReadFull(rand.Reader, random); err != nil {
+			log.Fatal().Msg(err.Error())
+		}
+		passphrase = base64.RawURLEncoding.EncodeToString(random)
+		// stderr, as stdout may carry the bundle
+		fmt.Fprintf(os.Stderr, "Passphrase of the bundle: %s\n", passphrase)
+	}
+
+	data, err := iap.ExportCache(passphrase)
+	if err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+
+	if cacheFile == "" {
+		os.Stdout.Write(data)
+		return
+	}
+	if err := os.WriteFile(cacheFile, data, 0600); err != nil {
+		log.Fatal().Msgf("Could not write %s: %s", cacheFile, err)
+	}
+}
+
+func cacheImport(cmd *cobra.Command, args []string) {
+	var data []byte
+	var err error
+	if cacheFile == "" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(cacheFile)
+	}
+	if err != nil {
+		log.Fatal().Msgf("Could not read bundle: %s", err)
+	}
+
+	imported, err := iap.ImportCache(data, readPassphrase())
+	for _, domain := range imported {
+		inform(os.Stdout, "Imported %s\n", domain)
+	}
+	if err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	_url "net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/adohkan/git-remote-https-iap/internal/iap"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// environment of GitHub Actions jobs allowed to request OIDC tokens, with the id-token: write permission
+	githubTokenRequestURLEnv   = "ACTIONS_ID_TOKEN_REQUEST_URL"
+	githubTokenRequestTokenEnv = "ACTIONS_ID_TOKEN_REQUEST_TOKEN"
+
+	// githubCredentialsFile is the Workload Identity Federation config written by setup-github, in CacheDir
+	githubCredentialsFile = "github-actions-credentials.json"
+)
+
+var (
+	// only used in ciSetupGithubCmd
+	workloadIdentityProvider, ciServiceAccount string
+
+	ciCmd = &cobra.Command{
+		Use:   "ci",
+		Short: "Set up IAP access in CI jobs",
+	}
+
+	ciSetupGithubCmd = &cobra.Command{
+		Use:   "setup-github",
+		Short: "Configure git for an IAP host in a GitHub Actions job, with Workload Identity Federation",
+		Long: `Configure git for an IAP host in a GitHub Actions job, with Workload Identity Federation.
+
+The OIDC token of the job, which needs the 'id-token: write' permission, is exchanged for the credentials
+of a service account, which mints the IAP token. The host is configured as with 'configure', and the
+token is cached, so that the next steps of the job clone and fetch with plain git:
+
+  - run: git-remote-https+iap ci setup-github --repoURL https://git.domain.acme --clientID $IAP_CLIENT_ID
+      --workload-identity-provider projects/123/locations/global/workloadIdentityPools/github/providers/github
+      --service-account git-reader@project.iam.gserviceaccount.com`,
+		Args: cobra.NoArgs,
+		Run:  ciSetupGithub,
+	}
+)
+
+func init() {
+	ciSetupGithubCmd.Flags().StringVar(&repoURL, "repoURL", "", "URL of the git repository to configure (required)")
+	ciSetupGithubCmd.MarkFlagRequired("repoURL")
+	ciSetupGithubCmd.Flags().StringVar(&clientID, "clientID", "", "OAuth Client ID of the IAP instance (required)")
+	ciSetupGithubCmd.MarkFlagRequired("clientID")
+	ciSetupGithubCmd.Flags().StringVar(&workloadIdentityProvider, "workload-identity-provider", "", "Full name of the provider of the workload identity pool trusting GitHub, projects/<number>/locations/global/workloadIdentityPools/<pool>/providers/<provider> (required)")
+	ciSetupGithubCmd.MarkFlagRequired("workload-identity-provider")
+	ciSetupGithubCmd.Flags().StringVar(&ciServiceAccount, "service-account", "", "Email of the service account impersonated to mint IAP tokens (required)")
+	ciSetupGithubCmd.MarkFlagRequired("service-account")
+
+	ciCmd.AddCommand(ciSetupGithubCmd)
+	rootCmd.AddCommand(ciCmd)
+}
+
+func ciSetupGithub(cmd *cobra.Command, args []string) {
+	requestURL, requestToken := os.Getenv(githubTokenRequestURLEnv), os.Getenv(githubTokenRequestTokenEnv)
+	if requestURL == "" || requestToken == "" {
+		log.Fatal().Msgf("%s is not set: run in a GitHub Actions job with the 'id-token: write' permission", githubTokenRequestURLEnv)
+	}
+
+	credentialsFile := filepath.Join(iap.CacheDir(), githubCredentialsFile)
+	if err := writeGithubCredentials(credentialsFile, requestURL, requestToken); err != nil {
+		log.Fatal().Msgf("Could not write %s: %s", credentialsFile, err)
+	}
+
+	configureIAP(cmd, args)
+	repo, err := _url.Parse(repoURL)
+	if err != nil {
+		log.Fatal().Msgf("Could not parse %s: %s", repoURL, err)
+	}
+	setConfig(fmt.Sprintf("https://%s", iap.CanonicalHost(repo)), "iap", "keyFile", credentialsFile)
+
+	auth := handleIAPAuthCookieFor(repoURL, iap.AuthOptions{})
+	// keeps the token out of the logs of later steps
+	fmt.Printf("::add-mask::%s\n", auth.RawToken)
+	log.Info().Msgf("Configured %s for %s", repoURL, ciServiceAccount)
+}
+
+// writeGithubCredentials writes the Workload Identity Federation config reading the OIDC token of the job from
+// the url GitHub gives it, with the audience expected by the provider
+// see: https://cloud.google.com/iam/docs/workload-identity-federation-with-deployment-pipelines#github-actions
+func writeGithubCredentials(path, requestURL, requestToken string) error {
+	audience := "//iam.googleapis.com/" + workloadIdentityProvider
+	config := map[string]interface{}{
+		"type":                              "external_account",
+		"audience":                          audience,
+		"subject_token_type":                "urn:ietf:params:oauth:token-type:jwt",
+		"token_url":                         "https://sts.googleapis.com/v1/token",
+		"service_account_impersonation_url": fmt.Sprintf("https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/%s:generateAccessToken", ciServiceAccount),
+		"credential_source": map[string]interface{}{
+			"url":     fmt.Sprintf("%s&audience=%s", requestURL, _url.QueryEscape("https://iam.googleapis.com/"+workloadIdentityProvider)),
+			"headers": map[string]string{"Authorization": "Bearer " + requestToken},
+			"format":  map[string]string{"type": "json", "subject_token_field_name": "value"},
+		},
+	}
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	path = iap.ExpandHome(path)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/adohkan/git-remote-https-iap/internal/iap"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var credentialCmd = &cobra.Command{
+	Use:   "credential get|store|erase",
+	Short: "Act as a git credential helper, providing IAP tokens to plain https:// remotes",
+	Long: `Act as a git credential helper, providing IAP tokens to plain https:// remotes.
+
+Configure it with 'configure --mode credential', or:
+
+  git config --global credential.https://git.domain.acme.helper "!git-remote-https+iap credential"
+
+Tokens are sent as an Authorization bearer, which requires git 2.46 or later.
+'store' is ignored, as tokens are cached by the helper itself, and 'erase' deletes the cached token.`,
+	Args:      cobra.ExactValidArgs(1),
+	ValidArgs: []string{"get", "store", "erase"},
+	Run:       credential,
+}
+
+func init() {
+	rootCmd.AddCommand(credentialCmd)
+}
+
+// readCredentialRequest parses the key=value lines git writes to credential helpers
+// see: https://git-scm.com/docs/git-credential#IOFMT
+func readCredentialRequest() (map[string]string, []string) {
+	request := map[string]string{}
+	var capabilities []string
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if parts[0] == "capability[]" {
+			capabilities = append(capabilities, parts[1])
+			continue
+		}
+		request[parts[0]] = parts[1]
+	}
+	return request, capabilities
+}
+
+func credential(cmd *cobra.Command, args []string) {
+	request, capabilities := readCredentialRequest()
+	if request["protocol"] != iap.TransportScheme(request["host"]) || request["host"] == "" {
+		log.Debug().Msgf("[credential] Ignoring request for %s://%s", request["protocol"], request["host"])
+		return
+	}
+	url := fmt.Sprintf("%s://%s/%s", request["protocol"], request["host"], request["path"])
+	log.Debug().Msgf("%s credential %s %s", binaryName, args[0], url)
+
+	switch args[0] {
+	case "get":
+		credentialGet(url, capabilities)
+	case "erase":
+		scope, err := toAuthScope(url)
+		if err != nil {
+			log.Fatal().Msgf("Could not convert %s in https://: %s", url, err)
+		}
+		if err := iap.DeleteCookie(scope); err != nil {
+			log.Fatal().Msg(err.Error())
+		}
+	}
+}
+
+func credentialGet(url string, capabilities []string) {
+	authtype := false
+	for _, c := range capabilities {
+		authtype = authtype || c == "authtype"
+	}
+	if !authtype {
+		// older git versions only send usernames and passwords, which IAP does not accept
+		log.Error().Msg("Sending IAP tokens as a git credential helper requires git 2.46 or later")
+		return
+	}
+
+	auth := handleIAPAuthCookieFor(url, iap.AuthOptions{})
+
+	fmt.Println("capability[]=authtype")
+	fmt.Println("authtype=Bearer")
+	fmt.Printf("credential=%s\n", auth.RawToken)
+	if auth.Cookie.Claims.ExpiresAt != 0 {
+		// lets git drop the token from its own caches when it expires
+		fmt.Printf("password_expiry_utc=%d\n", time.Unix(auth.Cookie.Claims.ExpiresAt, 0).Unix())
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/adohkan/git-remote-https-iap/internal/iap"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var (
+	// only used in daemonCmd
+	daemonInterval, daemonMargin time.Duration
+
+	daemonCmd = &cobra.Command{
+		Use:   "daemon",
+		Short: "Keep tokens of all configured hosts fresh in the background",
+		Long: `Keep tokens of all configured hosts fresh in the background.
+
+The daemon runs in the foreground, which suits systemd user services and launchd agents.
+It never starts an interactive login: hosts whose refresh token is missing or revoked
+are reported, and need a regular 'check' to log in again.`,
+		Args: cobra.NoArgs,
+		Run:  daemon,
+	}
+)
+
+func init() {
+	daemonCmd.Flags().DurationVar(&daemonInterval, "interval", 5*time.Minute, "How often tokens are checked")
+	daemonCmd.Flags().DurationVar(&daemonMargin, "margin", 15*time.Minute, "Refresh tokens expiring within this duration")
+
+	rootCmd.AddCommand(daemonCmd)
+}
+
+func daemon(cmd *cobra.Command, args []string) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	log.Info().Msgf("%s daemon: refreshing tokens every %s", binaryName, daemonInterval)
+	ticker := time.NewTicker(daemonInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, domain := range iap.ConfiguredDomains() {
+			refreshInBackground(domain, daemonMargin)
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Info().Msgf("%s daemon: stopping", binaryName)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refreshInBackground renews the token of a domain when it expires within margin, without user interaction
+func refreshInBackground(domain string, margin time.Duration) error {
+	auth, err := iap.ReadAuthState(domain)
+	if err == nil && time.Unix(auth.Cookie.Claims.ExpiresAt, 0).After(time.Now().Add(margin+auth.Cookie.ClockSkew)) {
+		log.Debug().Msgf("[refreshInBackground] Token for %s still valid until %s", domain, time.Unix(auth.Cookie.Claims.ExpiresAt, 0))
+		return nil
+	}
+
+	if _, err := iap.NewAuth(domain, iap.AuthOptions{NonInteractive: true}); err != nil {
+		log.Error().Msgf("Could not refresh token for %s: %s", domain, err)
+		return err
+	}
+	log.Info().Msgf("Refreshed token for %s", domain)
+	return nil
+}
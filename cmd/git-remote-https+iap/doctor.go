@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	_url "net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/adohkan/git-remote-https-iap/internal/git"
+	"github.com/adohkan/git-remote-https-iap/internal/iap"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor [url]",
+	Short: "Diagnose the configuration of a url, or of every configured host",
+	Long: `Diagnose the configuration of a url, or of every configured host: the helpers and protocols,
+the iap.* keys, the insteadOf rules, the cookie file, the credential helpers, the cached token
+and the reachability of IAP. Each failed check comes with a suggestion to fix it.`,
+	Args: cobra.MaximumNArgs(1),
+	Run:  doctor,
+}
+
+func init() {
+	rootCmd.AddCommand(doctorCmd)
+}
+
+// diagnosis prints the results of checks, or collects them for the --json output
+type diagnosis struct {
+	Failed bool          `json:"failed"`
+	Checks []doctorCheck `json:"checks"`
+
+	// domain is the auth scope being diagnosed, if any
+	domain string
+}
+
+// doctorCheck is the result of a check, whose Status is ok, warn or fail
+type doctorCheck struct {
+	Domain  string `json:"domain,omitempty"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	Fix     string `json:"fix,omitempty"`
+}
+
+func (d *diagnosis) ok(format string, args ...interface{}) {
+	d.report("ok", "", fmt.Sprintf(format, args...))
+}
+
+func (d *diagnosis) warn(fix, format string, args ...interface{}) {
+	d.report("warn", fix, fmt.Sprintf(format, args...))
+}
+
+func (d *diagnosis) fail(fix, format string, args ...interface{}) {
+	d.Failed = true
+	d.report("fail", fix, fmt.Sprintf(format, args...))
+}
+
+func (d *diagnosis) report(status, fix, message string) {
+	if jsonOutput {
+		d.Checks = append(d.Checks, doctorCheck{Domain: d.domain, Status: status, Message: message, Fix: fix})
+		return
+	}
+	label := status
+	if status == "fail" {
+		label = "FAIL"
+	}
+	fmt.Printf("  %-5s %s\n", label, message)
+	if fix != "" {
+		fmt.Printf("        fix: %s\n", fix)
+	}
+}
+
+func doctor(cmd *cobra.Command, args []string) {
+	d := &diagnosis{Checks: []doctorCheck{}}
+
+	// git reads, and configure writes, the files of these variables since 2.32 only
+	for _, env := range []string{git.GlobalConfigEnv, git.SystemConfigEnv} {
+		if path := os.Getenv(env); path != "" && !git.VersionAtLeast(2, 32) {
+			d.warn("upgrade git, or unset it", "%s=%s is ignored by git versions older than 2.32", env, path)
+		}
+	}
+
+	domains := iap.ConfiguredDomains()
+	if len(args) == 1 {
+		scope, err := toAuthScope(withScheme(args[0]))
+		if err != nil {
+			log.Fatal().Msgf("Could not convert %s in https://: %s", args[0], err)
+		}
+		domains = []string{scope}
+	}
+	if len(domains) == 0 {
+		if !jsonOutput {
+			fmt.Println("No host is configured for IAP")
+		}
+		d.fail(fmt.Sprintf("%s configure --repoURL https://git.domain.acme --clientID ...", binaryName), "no iap.clientID in git config")
+	}
+
+	for _, domain := range domains {
+		if !jsonOutput {
+			fmt.Println(domain)
+		}
+		d.domain = domain
+		diagnose(d, domain)
+	}
+	if jsonOutput {
+		writeJSON(d)
+	}
+	if d.Failed {
+		os.Exit(1)
+	}
+}
+
+// diagnose runs the checks of an auth scope
+func diagnose(d *diagnosis, domain string) {
+	u, err := _url.Parse(domain)
+	if err != nil {
+		d.fail("", "invalid url %s: %s", domain, err)
+		return
+	}
+	base := fmt.Sprintf("%s://%s", u.Scheme, iap.CanonicalHost(u))
+
+	provider := git.ConfigTryGetURLMatch("iap.provider", domain)
+	if clientID := git.ConfigTryGetURLMatch("iap.clientID", domain); clientID != "" {
+		d.ok("iap.clientID is %s", clientID)
+	} else if provider != "" && provider != iap.ProviderGoogle {
+		d.ok("iap.clientID is not set, the audience of tokens is not checked")
+	} else {
+		d.fail(fmt.Sprintf("%s configure --repoURL %s --clientID ...", binaryName, domain), "iap.clientID is not set")
+	}
+	switch {
+	case provider == iap.ProviderAzure && git.ConfigTryGetURLMatch("iap.helperID", domain) == "":
+		d.fail(fmt.Sprintf("%s configure --provider azure --repoURL %s --helperID ...", binaryName, domain), "iap.helperID is not set, Azure AD requires a public client application")
+	case provider == iap.ProviderOIDC && git.ConfigTryGetURLMatch("iap.issuer", domain) == "":
+		d.fail(fmt.Sprintf("%s configure --provider generic-oidc --repoURL %s --issuer ... --helperID ...", binaryName, domain), "iap.issuer is not set")
+	case provider != "" && provider != iap.ProviderGoogle:
+		d.ok("tokens are obtained from the %s provider", provider)
+	case git.ConfigTryGetURLMatch("iap.helperID", domain) != "":
+		d.ok("iap.helperID is set")
+	case iap.BuiltinHelperID != "":
+		d.ok("the helper embedded in this build is used")
+	case git.ConfigTryGetURLMatch("iap.keyFile", domain) != "" || git.ConfigTryGetURLMatch("iap.tokenCommand", domain) != "":
+		d.ok("tokens are obtained without a browser")
+	default:
+		d.warn(fmt.Sprintf("%s configure --repoURL %s --helperID ...", binaryName, domain), "iap.helperID is not set, application default credentials are used")
+	}
+
+	credentialHelper := diagnoseCredentialHelpers(d, base)
+	aliases := diagnoseInsteadOf(d, base, credentialHelper)
+	for _, alias := range aliases {
+		diagnoseHelper(d, alias)
+	}
+
+	path, cookieErr := iap.CheckCookieFile(domain)
+	switch err := cookieErr; {
+	case err != nil && path == "":
+		d.fail(fmt.Sprintf("%s configure --repoURL %s ...", binaryName, domain), "no cookie file: %s", err)
+	case err != nil:
+		d.fail("fix the permissions of the directory, or configure another http.cookieFile", "cookie file %s is not writable: %s", path, err)
+	case path == "":
+		d.ok("tokens are kept in %s", iap.StoreName(domain, iap.StoreKindCookie))
+	default:
+		d.ok("cookie file %s is writable", path)
+	}
+
+	// reading the token requires its cookie file
+	if cookieErr == nil {
+		diagnoseToken(d, domain)
+	}
+
+	switch protected, err := iap.ProbeIAP(base); {
+	case err != nil:
+		d.fail("check the network, proxy and DNS settings", "%s is unreachable: %s", base, err)
+	case !protected:
+		d.warn("", "%s does not look protected by IAP", base)
+	default:
+		d.ok("%s is protected by IAP", base)
+	}
+}
+
+// diagnoseCredentialHelpers reports the credential helpers of a host, and returns the one of this binary, if any
+func diagnoseCredentialHelpers(d *diagnosis, base string) string {
+	var ours string
+	for _, config := range git.ConfigGetRegexp(`^credential\..*helper$`) {
+		name, value := config[0], config[1]
+		url := strings.TrimSuffix(strings.TrimPrefix(name, "credential."), ".helper")
+		if url != "helper" && url != name && !hasHost(url, strings.SplitN(base, "://", 2)[1]) {
+			continue
+		}
+		if strings.HasPrefix(value, "!git-remote-") && strings.HasSuffix(value, " credential") {
+			ours = value
+			continue
+		}
+		d.ok("credential helper '%s' also applies, e.g. to backend credentials", value)
+	}
+
+	if ours != "" {
+		if git.VersionAtLeast(2, 46) {
+			d.ok("credential helper '%s'", ours)
+		} else {
+			d.fail("upgrade git, or configure --mode insteadOf", "credential helper '%s' requires git 2.46 or later", ours)
+		}
+	}
+	return ours
+}
+
+// diagnoseInsteadOf checks the rules rewriting the https:// urls of a host, and returns the helpers they rewrite to
+func diagnoseInsteadOf(d *diagnosis, base, credentialHelper string) []string {
+	var aliases []string
+	for _, rule := range insteadOfRules(base) {
+		aliases = append(aliases, rule.HelperName)
+	}
+
+	extraHeader := git.ConfigTryGetURLMatch("iap.cookieStore", base) == iap.StoreExtraHeader
+	switch {
+	case len(aliases) == 0 && (credentialHelper != "" || extraHeader):
+		d.ok("%s remotes are not rewritten", base)
+	case len(aliases) == 0:
+		d.fail(fmt.Sprintf("git config --global url.https+iap://%s.insteadOf %s", strings.SplitN(base, "://", 2)[1], base), "%s remotes are not rewritten to the helper", base)
+	case len(aliases) > 1:
+		d.warn("keep a single url.<helper>://host.insteadOf rule", "%s is rewritten to several helpers: %s", base, strings.Join(aliases, ", "))
+	default:
+		d.ok("%s remotes are rewritten to %s://", base, aliases[0])
+	}
+	if len(aliases) > 0 && credentialHelper != "" {
+		d.warn("keep either the insteadOf rule or the credential helper, see configure --mode", "both an insteadOf rule and a credential helper are configured")
+	}
+	return aliases
+}
+
+// diagnoseHelper checks that the helper of a protocol is installed
+func diagnoseHelper(d *diagnosis, protocol string) {
+	helper := fmt.Sprintf("git-remote-%s", protocol)
+	if path, err := exec.LookPath(helper); err != nil {
+		d.fail(fmt.Sprintf("%s install %s --link", binaryName, protocol), "%s is not in PATH", helper)
+	} else {
+		d.ok("%s is %s", helper, path)
+	}
+
+	if allow := git.ConfigTryGet(fmt.Sprintf("protocol.%s.allow", protocol)); allow == "always" {
+		d.ok("protocol %s is allowed", protocol)
+	} else {
+		d.fail(fmt.Sprintf("%s install %s", binaryName, protocol), "protocol %s is not allowed, e.g. for submodules", protocol)
+	}
+}
+
+// diagnoseToken checks the cached token of a domain
+func diagnoseToken(d *diagnosis, domain string) {
+	auth, err := iap.ReadAuthState(domain)
+	switch {
+	case err != nil:
+		d.warn(fmt.Sprintf("%s check %s", binaryName, domain), "no valid token: %s", err)
+	case auth.Cookie.Expired():
+		d.warn(fmt.Sprintf("%s check %s", binaryName, domain), "token expired at %s", time.Unix(auth.Cookie.Claims.ExpiresAt, 0))
+	default:
+		d.ok("token valid until %s", time.Unix(auth.Cookie.Claims.ExpiresAt, 0))
+	}
+}
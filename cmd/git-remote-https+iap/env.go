@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adohkan/git-remote-https-iap/internal/iap"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var envCmd = &cobra.Command{
+	Use:   "env [url]",
+	Short: "Refresh token for remote url if needed, then print it as export lines of a shell",
+	Long: `Refresh token for remote url if needed, then print it as export lines of a shell, for eval
+in scripts and wrappers, e.g. of the http backend of Terraform:
+
+  eval "$(git-remote-https+iap env https://git.domain.acme)"
+
+  IAP_TOKEN             the raw token
+  IAP_AUTH_HEADER       the header sending it, as selected by iap.authHeader
+  IAP_COOKIE            the cookie sending it, in the "name=value" form of a Cookie header
+  IAP_TOKEN_EXPIRY      the expiry of the token, in RFC 3339
+  IAP_TOKEN_EXPIRES_AT  the expiry of the token, in seconds since the epoch`,
+	Args: cobra.ExactArgs(1),
+	Run:  printEnv,
+}
+
+func init() {
+	envCmd.Flags().StringVar(&keyFile, "key-file", "", "Service account JSON key or workload identity federation config used instead of the browser flow")
+	envCmd.Flags().StringVar(&impersonateServiceAccount, "impersonate-service-account", "", "Email of a service account to authenticate as, using your own credentials")
+
+	rootCmd.AddCommand(envCmd)
+}
+
+func printEnv(cmd *cobra.Command, args []string) {
+	url := args[0]
+	log.Debug().Msgf("%s env %s", binaryName, url)
+
+	auth := handleIAPAuthCookieFor(url, iap.AuthOptions{
+		KeyFile:                   keyFile,
+		ImpersonateServiceAccount: impersonateServiceAccount,
+	})
+	scope, err := toAuthScope(url)
+	if err != nil {
+		log.Fatal().Msgf("Could not resolve the auth scope of %s: %s", url, err)
+	}
+
+	header := iap.AuthHeader(scope, auth.RawToken)
+	cookie := fmt.Sprintf("%s=%s", iap.CookieName(scope), auth.RawToken)
+	// the tokens of sharded sessions are their cookies, see ALB
+	if strings.HasPrefix(header, "Cookie: ") {
+		cookie = strings.TrimPrefix(header, "Cookie: ")
+	}
+
+	vars := [][2]string{
+		{"IAP_TOKEN", auth.RawToken},
+		{"IAP_AUTH_HEADER", header},
+		{"IAP_COOKIE", cookie},
+	}
+	if expiresAt := auth.Cookie.Claims.ExpiresAt; expiresAt != 0 {
+		vars = append(vars,
+			[2]string{"IAP_TOKEN_EXPIRY", time.Unix(expiresAt, 0).UTC().Format(time.RFC3339)},
+			[2]string{"IAP_TOKEN_EXPIRES_AT", strconv.FormatInt(expiresAt, 10)},
+		)
+	}
+	for _, v := range vars {
+		fmt.Printf("export %s=%s\n", v[0], shellQuote(v[1]))
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/cobra/doc"
+)
+
+// docsName names the binary in generated docs, as binaryName is however it was invoked
+const docsName = "git-remote-https+iap"
+
+var (
+	// only used in genDocsCmd
+	genDocsDir string
+
+	genDocsCmd = &cobra.Command{
+		Use:   "gen-docs man|markdown",
+		Short: "Generate man pages or markdown docs of every command",
+		Long: `Generate a man page (section 1) or a markdown page for every command, with its synopsis,
+description, flags and related commands, for distributions to ship along with the binary.`,
+		Hidden:    true,
+		Args:      cobra.MatchAll(cobra.ExactArgs(1), cobra.OnlyValidArgs),
+		ValidArgs: []string{"man", "markdown"},
+		Run:       genDocs,
+	}
+)
+
+func init() {
+	genDocsCmd.Flags().StringVar(&genDocsDir, "dir", ".", "Directory to write the docs to")
+	rootCmd.AddCommand(genDocsCmd)
+}
+
+func genDocs(cmd *cobra.Command, args []string) {
+	if err := os.MkdirAll(genDocsDir, 0755); err != nil {
+		log.Fatal().Msgf("Could not create %s: %s", genDocsDir, err)
+	}
+
+	// name the commands after the installed binary, and keep the pages reproducible
+	rootCmd.Use = fmt.Sprintf("%s remote url", docsName)
+	rootCmd.DisableAutoGenTag = true
+
+	var err error
+	if args[0] == "man" {
+		err = doc.GenManTree(rootCmd, &doc.GenManHeader{
+			Section: "1",
+			Source:  strings.TrimSpace(docsName + " " + version),
+			Manual:  "User Commands",
+		}, genDocsDir)
+	} else {
+		err = doc.GenMarkdownTree(rootCmd, genDocsDir)
+	}
+	if err != nil {
+		log.Fatal().Msgf("Could not write the %s pages to %s: %s", args[0], genDocsDir, err)
+	}
+	inform(os.Stdout, "Wrote the %s pages to %s\n", args[0], genDocsDir)
+}
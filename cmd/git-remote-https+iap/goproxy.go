@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	_url "net/url"
+	"os"
+	"strings"
+
+	"github.com/adohkan/git-remote-https-iap/internal/iap"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var (
+	// only used in goproxyCmd
+	goproxyListen string
+
+	goproxyCmd = &cobra.Command{
+		Use:   "goproxy url",
+		Short: "Run a local GOPROXY forwarding to a Go module proxy behind IAP",
+		Long: `Run a local GOPROXY forwarding to a Go module proxy behind IAP, e.g. Athens or Artifactory,
+with the IAP token of url, which is configured like a git host.
+
+Unlike the proxy command, it needs no CA: go talks plain http to it, and it talks https to url.
+The proxy runs in the foreground, and logs in when a token can not be refreshed.
+
+As any user of the machine can connect to the proxy, its password, random unless set with
+GIT_IAP_PROXY_SECRET, prefixes the path of GOPROXY: http://127.0.0.1:8119/<password>, as go
+refuses to send credentials over plain http.
+
+Private modules are not in the checksum database of sum.golang.org: list their paths in
+GONOSUMDB, e.g. GONOSUMDB=git.domain.acme, rather than in GOPRIVATE, which also bypasses GOPROXY.`,
+		Args: cobra.ExactArgs(1),
+		Run:  goproxy,
+	}
+)
+
+func init() {
+	goproxyCmd.Flags().StringVar(&goproxyListen, "listen", "127.0.0.1:8119", "Address to listen on, which should stay local: requests get the tokens of the user")
+
+	rootCmd.AddCommand(goproxyCmd)
+}
+
+// goproxyHandler forwards the requests of go to the module proxy at upstream
+type goproxyHandler struct {
+	upstream *_url.URL
+	proxy    *iapProxy
+	// secret is the password prefixing the paths requested by go
+	secret string
+}
+
+func goproxy(cmd *cobra.Command, args []string) {
+	upstream, err := _url.Parse(iap.FromIAPScheme(args[0]))
+	if err != nil || upstream.Host == "" {
+		log.Fatal().Msgf("Invalid module proxy url '%s'", args[0])
+	}
+	upstream.Scheme = "https"
+	upstream.Path = strings.TrimSuffix(upstream.Path, "/")
+	if scope, err := toAuthScope(upstream.String()); err != nil || !iap.Configured(scope) {
+		log.Fatal().Msgf("%s is not configured, run: %s configure --repoURL %s", upstream, binaryName, upstream)
+	}
+
+	listener, err := net.Listen("tcp", goproxyListen)
+	if err != nil {
+		log.Fatal().Msgf("Could not listen on %s: %s", goproxyListen, err)
+	}
+
+	secret := localProxySecret()
+	inform(os.Stderr, "%s goproxy: forwarding http://%s to %s\n\n", binaryName, listener.Addr(), upstream)
+	// the password is the result of the command, printed even with --quiet
+	fmt.Fprintf(os.Stderr, "  export GOPROXY=http://%s/%s\n\n", listener.Addr(), secret)
+	inform(os.Stderr, "Private modules are not in the checksum database: list their paths in GONOSUMDB, rather than GOPRIVATE, which bypasses GOPROXY.\n\n")
+	serveUntilSignal(listener, &goproxyHandler{upstream: upstream, proxy: &iapProxy{transport: newProxyTransport()}, secret: secret}, "goproxy")
+}
+
+func (g *goproxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/"+g.secret)
+	if subtle.ConstantTimeCompare([]byte(r.URL.Path[:len(r.URL.Path)-len(path)]), []byte("/"+g.secret)) != 1 || !strings.HasPrefix(path, "/") {
+		http.Error(w, "The password of the proxy is missing from GOPROXY, see its output", http.StatusNotFound)
+		return
+	}
+
+	req := r.Clone(r.Context())
+	req.URL.Scheme, req.URL.Host = g.upstream.Scheme, g.upstream.Host
+	req.URL.Path = g.upstream.Path + path
+	req.URL.RawPath = ""
+	// the Host header is that of the upstream, not of the local listener
+	req.Host = ""
+
+	log.Debug().Msgf("[goproxy] %s %s", req.Method, req.URL)
+	g.proxy.forward(w, req)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/adohkan/git-remote-https-iap/internal/git"
+	"github.com/adohkan/git-remote-https-iap/internal/iap"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	// only used in configureCmd
+	includeIf, includeFile string
+)
+
+func init() {
+	configureCmd.Flags().StringVar(&includeIf, "includeIf", "", "Write the config to a file included by the global git config under this condition only, e.g. \"gitdir:~/work/\"")
+	configureCmd.Flags().StringVar(&includeFile, "includeFile", "", "File written with --includeIf, by default one per host in ~/.config/git/gcp-iap/")
+}
+
+// configureIncludeFile makes configure write to the file included with --includeIf, instead of the
+// git config of --scope
+func configureIncludeFile(host string) {
+	if configureScope != git.ScopeGlobal {
+		log.Fatal().Msg("--includeIf is only supported with the global --scope, that includes the file")
+	}
+	if includeFile == "" {
+		includeFile = iap.ConfigFragment(host)
+	}
+
+	// git expands ~ in the paths of its config, not in those of its arguments
+	path := iap.ExpandHome(includeFile)
+	if !configureDryRun {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			log.Fatal().Msgf("Could not create the directory of %s: %s", includeFile, err)
+		}
+	}
+	configureScope = git.ScopeFile(path)
+}
+
+// includeConfig makes the global git config include the file of configure under the --includeIf condition, once
+func includeConfig() {
+	name := fmt.Sprintf("includeIf.%s.path", includeIf)
+	if configureDryRun {
+		current, err := git.ConfigGetAllScoped(name, git.ScopeGlobal)
+		if err != nil {
+			log.Fatal().Msg(err.Error())
+		}
+		for _, value := range current {
+			if value == includeFile {
+				fmt.Printf("= %s = %s (unchanged)\n", name, includeFile)
+				return
+			}
+		}
+		fmt.Printf("+ %s = %s\n", name, includeFile)
+		return
+	}
+
+	// a condition may include several files, only this one is replaced
+	if err := git.ReplaceGlobalConfig(name, includeFile, fmt.Sprintf("^%s$", regexp.QuoteMeta(includeFile))); err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+	log.Info().Msgf("%s is included by %s under the condition %s", includeFile, git.GlobalConfigFile(), includeIf)
+}
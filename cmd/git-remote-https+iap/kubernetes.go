@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/adohkan/git-remote-https-iap/internal/iap"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// execInfoEnv is set by kubectl for its exec plugins, with the apiVersion it expects
+	execInfoEnv = "KUBERNETES_EXEC_INFO"
+
+	defaultExecCredentialAPIVersion = "client.authentication.k8s.io/v1"
+
+	// defaultSecretName is the name of the Secret printed with --format k8s-secret, unless --name is set
+	defaultSecretName = "git-iap-cookie"
+)
+
+// execCredential is the ExecCredential of Kubernetes exec plugins, printed with --format exec-credential
+// see: https://kubernetes.io/docs/reference/access-authn-authz/authentication/#client-go-credential-plugins
+type execCredential struct {
+	APIVersion string               `json:"apiVersion"`
+	Kind       string               `json:"kind"`
+	Status     execCredentialStatus `json:"status"`
+}
+
+type execCredentialStatus struct {
+	Token               string `json:"token"`
+	ExpirationTimestamp string `json:"expirationTimestamp,omitempty"`
+}
+
+// printExecCredential prints a token as an ExecCredential of the apiVersion kubectl asked for, expiring
+// with the token so that kubectl runs the plugin again, e.g. to refresh it
+func printExecCredential(auth *iap.AuthState) {
+	credential := execCredential{
+		APIVersion: execCredentialAPIVersion(),
+		Kind:       "ExecCredential",
+		Status:     execCredentialStatus{Token: auth.RawToken},
+	}
+	if auth.Cookie.Claims.ExpiresAt != 0 {
+		credential.Status.ExpirationTimestamp = time.Unix(auth.Cookie.Claims.ExpiresAt, 0).UTC().Format(time.RFC3339)
+	}
+	if err := json.NewEncoder(os.Stdout).Encode(credential); err != nil {
+		log.Fatal().Msgf("Could not print the ExecCredential: %s", err)
+	}
+}
+
+// execCredentialAPIVersion returns the apiVersion of the ExecCredential kubectl sent, if any
+func execCredentialAPIVersion() string {
+	var info struct {
+		APIVersion string `json:"apiVersion"`
+	}
+	if err := json.Unmarshal([]byte(os.Getenv(execInfoEnv)), &info); err == nil && info.APIVersion != "" {
+		return info.APIVersion
+	}
+	return defaultExecCredentialAPIVersion
+}
+
+// printK8sSecret prints a Secret holding the token, as the cookie file of git under the "cookie" key,
+// and raw under the "token" key, e.g. for http.cookieFile of in-cluster jobs
+func printK8sSecret(name string, auth *iap.AuthState) {
+	fmt.Printf(`apiVersion: v1
+kind: Secret
+metadata:
+  name: %s
+type: Opaque
+data:
+  cookie: %s
+  token: %s
+`, name, base64.StdEncoding.EncodeToString([]byte(auth.Cookie.CookieJar(auth.RawToken))), base64.StdEncoding.EncodeToString([]byte(auth.RawToken)))
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/adohkan/git-remote-https-iap/internal/iap"
+	"github.com/adohkan/git-remote-https-iap/internal/lfs"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var (
+	// only used in configureCmd
+	configureLFS bool
+
+	lfsCmd = &cobra.Command{
+		Use:   "lfs",
+		Short: "Act as a git-lfs transfer agent, sending LFS objects through IAP",
+		Long: `Act as a git-lfs standalone custom transfer agent, sending LFS objects through IAP.
+
+It is started by git-lfs, once configured with 'configure --lfs'.`,
+		Args: cobra.NoArgs,
+		Run:  lfsAgent,
+	}
+)
+
+func init() {
+	configureCmd.Flags().BoolVar(&configureLFS, "lfs", false, "Send git-lfs objects through IAP, with a custom transfer agent")
+	rootCmd.AddCommand(lfsCmd)
+}
+
+func lfsAgent(cmd *cobra.Command, args []string) {
+	auth := func(endpoint string) string {
+		c := handleIAPAuthCookieFor(endpoint, iap.AuthOptions{})
+		return iap.AuthHeader(endpoint, c.RawToken)
+	}
+	if err := lfs.Serve(os.Stdin, os.Stdout, auth); err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+}
+
+// configureLFSAgent registers the transfer agent, and makes it the only one of the LFS servers of https
+func configureLFSAgent(https string) {
+	agent := fmt.Sprintf("customtransfer.%s", lfs.AgentName)
+	setConfig(agent, "lfs", "path", fmt.Sprintf("git-remote-%s", helperName))
+	setConfig(agent, "lfs", "args", "lfs")
+	setConfig(agent, "lfs", "concurrent", "false")
+	setConfig(https, "lfs", "standalonetransferagent", lfs.AgentName)
+}
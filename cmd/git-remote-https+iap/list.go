@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	_url "net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/adohkan/git-remote-https-iap/internal/git"
+	"github.com/adohkan/git-remote-https-iap/internal/iap"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the configured hosts and their settings",
+	Long: `List the hosts configured for IAP in git config, with their helperID, clientID, provider,
+cookie file and the insteadOf rules rewriting their urls to the helper, to review what configure
+has written over time. Secrets are not printed.`,
+	Args: cobra.NoArgs,
+	Run:  list,
+}
+
+func init() {
+	rootCmd.AddCommand(listCmd)
+}
+
+// hostConfig is the configuration of an auth scope, as written by configure
+type hostConfig struct {
+	URL        string          `json:"url"`
+	ClientID   string          `json:"clientID,omitempty"`
+	HelperID   string          `json:"helperID,omitempty"`
+	Provider   string          `json:"provider,omitempty"`
+	CookieFile string          `json:"cookieFile,omitempty"`
+	InsteadOf  []insteadOfRule `json:"insteadOf,omitempty"`
+}
+
+// insteadOfRule is a url.<URL>.insteadOf config, rewriting InsteadOf to URL, whose scheme is the helperName
+type insteadOfRule struct {
+	URL        string `json:"url"`
+	InsteadOf  string `json:"insteadOf"`
+	HelperName string `json:"helperName"`
+}
+
+func list(cmd *cobra.Command, args []string) {
+	hosts := []hostConfig{}
+	for _, domain := range iap.ConfiguredDomains() {
+		u, err := _url.Parse(domain)
+		if err != nil {
+			log.Warn().Msgf("Skipping invalid url %s: %s", domain, err)
+			continue
+		}
+		hosts = append(hosts, hostConfig{
+			URL:        domain,
+			ClientID:   git.ConfigTryGetURLMatch("iap.clientID", domain),
+			HelperID:   git.ConfigTryGetURLMatch("iap.helperID", domain),
+			Provider:   git.ConfigTryGetURLMatch("iap.provider", domain),
+			CookieFile: git.ConfigTryGetURLMatch("http.cookieFile", domain),
+			InsteadOf:  insteadOfRules(fmt.Sprintf("%s://%s", u.Scheme, iap.CanonicalHost(u))),
+		})
+	}
+
+	if jsonOutput {
+		writeJSON(hosts)
+		return
+	}
+
+	if len(hosts) == 0 {
+		inform(os.Stderr, "No host is configured for IAP, see %s configure\n", binaryName)
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "URL\tPROVIDER\tCLIENT ID\tHELPER ID\tHELPER NAME\tCOOKIE FILE\tINSTEADOF")
+	for _, h := range hosts {
+		var helperNames, rules []string
+		for _, rule := range h.InsteadOf {
+			helperNames = append(helperNames, rule.HelperName)
+			rules = append(rules, fmt.Sprintf("%s <- %s", rule.URL, rule.InsteadOf))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", h.URL, orDash(h.Provider), orDash(h.ClientID), orDash(h.HelperID),
+			orDash(strings.Join(helperNames, ", ")), orDash(h.CookieFile), orDash(strings.Join(rules, ", ")))
+	}
+	w.Flush()
+}
+
+// insteadOfRules returns the rules rewriting the urls of base, e.g. https://git.domain.acme, to helpers
+func insteadOfRules(base string) []insteadOfRule {
+	var rules []insteadOfRule
+	for _, config := range git.ConfigGetRegexp(`^url\..*\.insteadof$`) {
+		name, value := config[0], config[1]
+		if value != base {
+			continue
+		}
+		url := strings.TrimSuffix(strings.TrimPrefix(name, "url."), ".insteadof")
+		rules = append(rules, insteadOfRule{URL: url, InsteadOf: value, HelperName: strings.SplitN(url, "://", 2)[0]})
+	}
+	return rules
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
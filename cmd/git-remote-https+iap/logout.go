@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/adohkan/git-remote-https-iap/internal/iap"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var (
+	// only used in logoutCmd
+	logoutAll, logoutRevoke bool
+
+	logoutCmd = &cobra.Command{
+		Use:   "logout [host]",
+		Short: "Delete the cached token of a host and revoke its refresh token",
+		Long: `Delete the cached token of a host and revoke its refresh token.
+
+With --all, every cookie of the storage directory and of configured hosts is deleted,
+e.g. when switching organizations. Cookie files of other tools, such as ~/.gitcookies, are left untouched. Refresh tokens are only revoked with --revoke.`,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if logoutAll {
+				return cobra.NoArgs(cmd, args)
+			}
+			if logoutRevoke {
+				return fmt.Errorf("--revoke only applies with --all, logging out of a host always revokes its refresh token")
+			}
+			return cobra.ExactArgs(1)(cmd, args)
+		},
+		Run: logout,
+	}
+)
+
+func init() {
+	logoutCmd.Flags().BoolVar(&logoutAll, "all", false, "Delete the cookies of all hosts")
+	logoutCmd.Flags().BoolVar(&logoutRevoke, "revoke", false, "With --all, also revoke and forget the refresh tokens of configured hosts")
+
+	rootCmd.AddCommand(logoutCmd)
+}
+
+func logout(cmd *cobra.Command, args []string) {
+	if logoutAll {
+		logoutEverywhere()
+		return
+	}
+
+	url, err := toHTTPSBaseDomain(withScheme(args[0]))
+	if err != nil {
+		log.Fatal().Msgf("Could not convert %s in https://: %s", args[0], err)
+	}
+	log.Debug().Msgf("%s logout %s", binaryName, url)
+
+	if err := iap.Logout(url); err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+	inform(os.Stdout, "Logged out of %s\n", url)
+}
+
+// logoutEverywhere purges all cookies, then revokes refresh tokens when asked to
+func logoutEverywhere() {
+	failed := false
+
+	if logoutRevoke {
+		for _, url := range iap.ConfiguredDomains() {
+			if err := iap.Logout(url); err != nil {
+				log.Error().Msg(err.Error())
+				failed = true
+				continue
+			}
+			inform(os.Stdout, "Logged out of %s\n", url)
+		}
+	}
+
+	deleted, err := iap.PurgeCookies()
+	for _, d := range deleted {
+		inform(os.Stdout, "Deleted %s\n", d)
+	}
+	if err != nil {
+		log.Error().Msg(err.Error())
+		failed = true
+	}
+
+	if failed {
+		log.Fatal().Msg("Some credentials could not be deleted")
+	}
+}
+
+// withScheme lets users type a bare host where a url is expected
+func withScheme(addr string) string {
+	if !strings.Contains(addr, "://") {
+		return fmt.Sprintf("https://%s", addr)
+	}
+	return addr
+}
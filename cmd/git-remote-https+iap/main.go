@@ -1,21 +1,54 @@
 package main
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
+	"io"
 	_url "net/url"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"text/tabwriter"
 	"time"
 
 	"github.com/adohkan/git-remote-https-iap/internal/git"
 	"github.com/adohkan/git-remote-https-iap/internal/iap"
+	"github.com/adohkan/git-remote-https-iap/internal/redact"
+	"github.com/adohkan/git-remote-https-iap/internal/smarthttp"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
+	"golang.org/x/oauth2/google"
 )
 
 const (
+	// modes of configure
+	modeInsteadOf   = "insteadOf"
+	modeCredential  = "credential"
+	modeExtraHeader = "extraHeader"
+
+	// formats of print
+	formatToken     = "token"
+	formatCookieJar = "cookiejar"
+	formatExecCred  = "exec-credential"
+	formatHeader    = "header"
+	formatCurl      = "curl"
+	formatJSON      = "json"
+	formatNpmrc     = "npmrc"
+	formatPip       = "pip"
+	// formatNetrc is refused, as tools reading ~/.netrc send the token as a Basic password, which IAP rejects
+	formatNetrc     = "netrc"
+	formatBazel     = "bazel"
+	formatK8sSecret = "k8s-secret"
+
+	// defaultRemote is the remote whose url check uses when none is given
+	defaultRemote = "origin"
+
 	// DebugEnvVariable is the name of the environment variable that needs to be set in order to enable debug logging
 	DebugEnvVariable = "GIT_IAP_VERBOSE"
 	DebugEnv         = "DEBUG"
@@ -23,14 +56,46 @@ const (
 
 var (
 	binaryName = os.Args[0]
-	version    string
+	// set by the Makefile
+	version, commit, buildDate string
+
+	// global flags
+	jsonOutput bool
+	verbosity  int
+	quiet      bool
+
+	// tokens obtained by this process, by auth scope
+	authStatesMu sync.Mutex
+	authStates   = map[string]*iap.AuthState{}
 
 	// only used in configureCmd
 	repoURL, helperID, helperSecret, clientID string
 	helperName                                string
+	helperSecretFile                          string
+	helperSecretStdin                         bool
+	clientJSON                                string
+	configureMode                             string
+	configureScope                            string
+	pathPrefix                                string
+	configureDryRun                           bool
+	allowInsecureHTTP                         bool
+	provider                                  string
+	azureTenant                               string
+	issuer                                    string
+
+	// only used in installProtocolCmd
+	installLink bool
 
 	// Only used in checkcmd
-	forcebrowser bool
+	forcebrowser, noBrowser, selectAccount, checkAll bool
+
+	// only used in checkCmd and printCmd
+	keyFile, impersonateServiceAccount string
+
+	// only used in printCmd
+	printFormat, secretName string
+	printClaims             bool
+	printProxy              string
 
 	rootCmd = &cobra.Command{
 		Use:   fmt.Sprintf("%s remote url", binaryName),
@@ -41,13 +106,13 @@ var (
 
 	versionCmd = &cobra.Command{
 		Use:   "version",
-		Short: "Print version number",
+		Short: "Print version number, with the commit, date, Go version and platform of the build",
 		Run:   printVersion,
 	}
 
 	installProtocolCmd = &cobra.Command{
-		Use:   "install",
-		Short: "Install protocol in Git config",
+		Use:   "install [protocol...]",
+		Short: "Install protocols in Git config, by default the one of this binary's name",
 		Run:   installGitProtocol,
 	}
 
@@ -58,38 +123,84 @@ var (
 	}
 
 	checkCmd = &cobra.Command{
-		Use:   "check [url]",
+		Use:   "check [url|remote]",
 		Short: "Refresh token for remote url if needed, then exit",
-		Run:   check,
+		Long: `Refresh token for remote url if needed, then exit.
+
+Inside a repository, the url may be the name of a remote, and defaults to that of origin.
+With --all, the tokens of every configured host are refreshed, logging in when needed, and the command
+fails when any host could not be refreshed.`,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if checkAll {
+				return cobra.NoArgs(cmd, args)
+			}
+			return nil
+		},
+		Run: check,
 	}
 
 	printCmd = &cobra.Command{
-		Use:   "print [url]",
+		Use:   "print url|remote",
 		Short: "Refresh token for remote url if needed, then print to stdout",
-		Run:   print,
+		Long: `Refresh token for remote url if needed, then print to stdout.
+
+Inside a repository, the url may be the name of a remote, e.g. origin.`,
+		Args: cobra.ExactArgs(1),
+		Run:  print,
 	}
 )
 
 func init() {
+	rootCmd.PersistentFlags().CountVarP(&verbosity, "verbose", "v", "Log informational messages, and debug ones with -vv, like GIT_IAP_VERBOSE=1")
+	rootCmd.PersistentFlags().BoolVarP(&quiet, "quiet", "q", false, "Only print errors and the results of commands, e.g. in provisioning scripts")
+	cobra.OnInitialize(setLogLevel)
+	rootCmd.PersistentFlags().BoolVar(&jsonOutput, "json", false, "Print the results of version, status, list, whoami, check and doctor as JSON, for scripts and IDEs")
+
 	rootCmd.AddCommand(versionCmd)
 	rootCmd.AddCommand(installProtocolCmd)
+	installProtocolCmd.Flags().BoolVar(&installLink, "link", false, "Link this binary as the helper of each protocol, e.g. git-remote-iap, next to it")
 	rootCmd.AddCommand(checkCmd)
 	rootCmd.AddCommand(printCmd)
 
 	configureCmd.Flags().StringVar(&repoURL, "repoURL", "", "URL of the git repository to configure (required)")
 	configureCmd.MarkFlagRequired("repoURL")
-	configureCmd.Flags().StringVar(&helperID, "helperID", "", "OAuth Client ID for the helper (required)")
-	configureCmd.MarkFlagRequired("helperID")
-	configureCmd.Flags().StringVar(&helperSecret, "helperSecret", "", "OAuth Client Secret for the helper (required)")
-	configureCmd.MarkFlagRequired("helperSecret")
-	configureCmd.Flags().StringVar(&clientID, "clientID", "", "OAuth Client ID of the IAP instance (required)")
-	configureCmd.MarkFlagRequired("clientID")
+	configureCmd.Flags().StringVar(&helperID, "helperID", "", "OAuth Client ID for the helper (omit to use application default credentials)")
+	configureCmd.Flags().StringVar(&helperSecret, "helperSecret", "", "OAuth Client Secret for the helper, visible in the process list: prefer --helperSecret-file or the prompt")
+	configureCmd.Flags().StringVar(&helperSecretFile, "helperSecret-file", "", "File holding the OAuth Client Secret for the helper")
+	configureCmd.Flags().BoolVar(&helperSecretStdin, "helperSecret-stdin", false, "Read the OAuth Client Secret for the helper from stdin")
+	configureCmd.Flags().StringVar(&clientJSON, "client-json", "", "OAuth client file of the helper, e.g. client_secret_xxx.json as downloaded from the Google Cloud console, instead of --helperID and its secret")
+	configureCmd.Flags().StringVar(&clientID, "clientID", "", "OAuth Client ID of the IAP instance (required for Google's IAP), or the audience of the tokens of other providers")
 	configureCmd.Flags().StringVar(&helperName, "helperName", "https+iap", "Name of the gitremote-helper, for example \"iap\" if PATH has a git-remote-iap binary")
+	configureCmd.Flags().StringVar(&configureScope, "scope", git.ScopeGlobal, "Git config written to: \"global\", \"local\" to the current repository, or \"worktree\"")
+	configureCmd.Flags().StringVar(&provider, "provider", iap.ProviderGoogle, "Identity-aware proxy of the host: \"google\", \"cloudflare\" for Cloudflare Access, whose --clientID is the AUD tag of the application, \"pomerium\", \"oauth2-proxy\", \"aws-alb\", \"azure\" for Azure AD Application Proxy, whose --clientID is the App ID URI of the application and --helperID a public client, \"generic-oidc\" for the tokens of the --issuer, or the name of an external provider, a git-remote-iap-provider-<name> in PATH")
+	configureCmd.Flags().StringVar(&azureTenant, "azureTenant", "", "Azure AD tenant of the Application Proxy application, e.g. contoso.onmicrosoft.com, with --provider azure")
+	configureCmd.Flags().StringVar(&issuer, "issuer", "", "OpenID Connect issuer, e.g. https://keycloak.domain.acme/realms/acme, with --provider generic-oidc")
+	configureCmd.Flags().BoolVar(&allowInsecureHTTP, "allowInsecureHTTP", false, "Accept an http:// --repoURL, e.g. of a local IAP emulator, to which tokens are sent unencrypted")
+	configureCmd.Flags().StringVar(&pathPrefix, "pathPrefix", "", "Path prefix of the host protected by this IAP instance, for hosts serving several of them")
+	configureCmd.Flags().BoolVar(&configureDryRun, "dry-run", false, "Print the git config that would be written, and how it differs from the current one, without writing it")
+	configureCmd.Flags().StringVar(&configureMode, "mode", modeInsteadOf, "How git gets tokens for https:// remotes: \"insteadOf\" rewrites them to the remote helper, \"credential\" uses a credential helper (git >= 2.46), \"extraHeader\" keeps the token in http.extraHeader, refreshed by check or daemon")
 
 	checkCmd.Flags().BoolVarP(&forcebrowser, "forcebrowser", "f", false, "Forces browser refresh flow")
+	checkCmd.Flags().BoolVar(&selectAccount, "select-account", false, "Show the account chooser during the browser flow, implies --forcebrowser")
+	checkCmd.Flags().BoolVar(&checkAll, "all", false, "Refresh the tokens of all configured hosts, and print a summary")
+	checkCmd.Flags().BoolVar(&noBrowser, "no-browser", false, "Print the authorization URL and read the authorization code from the terminal, instead of opening a browser")
+	checkCmd.Flags().StringVar(&keyFile, "key-file", "", "Service account JSON key or workload identity federation config used instead of the browser flow")
+	printCmd.Flags().StringVar(&keyFile, "key-file", "", "Service account JSON key or workload identity federation config used instead of the browser flow")
+	checkCmd.Flags().StringVar(&impersonateServiceAccount, "impersonate-service-account", "", "Email of a service account to authenticate as, using your own credentials")
+	printCmd.Flags().StringVar(&impersonateServiceAccount, "impersonate-service-account", "", "Email of a service account to authenticate as, using your own credentials")
+	printCmd.Flags().StringVar(&printFormat, "format", formatToken, "Output format: \"token\", \"header\" for the header line sending it, \"curl\" for the arguments of curl, \"json\" for the token with its expiry and claims, \"npmrc\" or \"pip\" for the registry config of npm, or of pip through the local proxy, \"bazel\" for the --remote_header option of bazel, \"k8s-secret\" for a Kubernetes Secret of the cookie file, \"cookiejar\" for a Netscape cookie file, e.g. for curl -b, or \"exec-credential\" for a kubectl exec plugin. There is no \"netrc\" format, as IAP rejects tokens sent as basic authentication passwords: use the proxy command for such tools")
+	printCmd.Flags().BoolVar(&printClaims, "claims", false, "Also print the decoded header and claims of the token to stderr, e.g. to debug its audience or expiry")
+	printCmd.Flags().StringVar(&secretName, "name", defaultSecretName, "Name of the Secret printed with --format k8s-secret")
+	printCmd.Flags().StringVar(&printProxy, "proxy", defaultProxyListen, "Address of the local proxy in the pip.conf printed with --format pip")
 
 	rootCmd.AddCommand(configureCmd)
 
+	// defaults of the helper, below the git config of each host
+	git.DefaultsFile = iap.ConfigFile()
+
+	// never let credentials reach the logs
+	log.Logger = log.Output(redact.NewWriter(os.Stderr))
+
 	// set log level
 	zerolog.SetGlobalLevel(zerolog.ErrorLevel)
 	if debug, _ := strconv.ParseBool(os.Getenv(DebugEnvVariable)); debug {
@@ -100,6 +211,27 @@ func init() {
 	}
 }
 
+// setLogLevel raises the level selected by the environment with -v and -vv, or lowers it to errors with --quiet
+func setLogLevel() {
+	switch {
+	case quiet && verbosity > 0:
+		log.Fatal().Msg("--quiet and --verbose are mutually exclusive")
+	case quiet:
+		zerolog.SetGlobalLevel(zerolog.ErrorLevel)
+	case verbosity >= 2:
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	case verbosity == 1 && zerolog.GlobalLevel() > zerolog.InfoLevel:
+		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	}
+}
+
+// inform prints a message about what a command did, rather than its result, unless --quiet is given
+func inform(w io.Writer, format string, args ...interface{}) {
+	if !quiet {
+		fmt.Fprintf(w, format, args...)
+	}
+}
+
 func main() {
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
@@ -111,110 +243,716 @@ func execute(cmd *cobra.Command, args []string) {
 	remote, url := args[0], args[1]
 	log.Debug().Msgf("%s %s %s", binaryName, remote, url)
 
-	c := handleIAPAuthCookieFor(url, false)
-	git.PassThruRemoteHTTPSHelper(remote, url, c.Cookie.Token.Raw)
+	if strings.HasPrefix(url, sshScheme+"://") {
+		executeSSH(remote, url)
+		return
+	}
+
+	c := handleIAPAuthCookieFor(url, iap.AuthOptions{})
+	httpsURL, err := iap.ToHTTPSURL(url)
+	if err != nil {
+		log.Fatal().Msgf("Could not convert %s in https://: %s", url, err)
+	}
+	httpsURL = resolveRedirects(httpsURL, c)
+
+	header := iap.AuthHeader(httpsURL, c.RawToken)
+	username, password := backendCredentials(httpsURL, header)
+
+	code := 0
+	// git-remote-https is kept for servers the native client does not serve, such as dumb HTTP ones
+	if native, err := strconv.ParseBool(git.ConfigTryGetURLMatch("iap.nativeHTTP", httpsURL)); native || err != nil {
+		helper := &smarthttp.Helper{URL: httpsURL, Username: username, Password: password, Header: func() string {
+			// the token may expire during long fetches and pushes
+			return iap.AuthHeader(httpsURL, handleIAPAuthCookieFor(url, iap.AuthOptions{}).RawToken)
+		}}
+		code = helper.Serve(os.Stdin, os.Stdout)
+	} else {
+		code = git.PassThruRemoteHTTPSHelper(remote, httpsURL, header, git.BasicAuthHeader(username, password))
+	}
+	if code != 0 {
+		handleAccessDenied(url, c)
+		os.Exit(code)
+	}
+}
+
+// backendCredentials returns the basic credentials of the git server behind IAP, from the credential helper
+// of iap.backendCredentialHelper, or empty ones when it is not set and git asks its own helpers on 401.
+// The IAP token must then be sent in another header than Authorization.
+func backendCredentials(httpsURL, header string) (string, string) {
+	helper := git.ConfigTryGetURLMatch("iap.backendCredentialHelper", httpsURL)
+	if helper == "" {
+		return "", ""
+	}
+	if strings.HasPrefix(header, "Authorization:") {
+		log.Fatal().Msgf("iap.backendCredentialHelper of %s needs the IAP token in another header, set iap.authHeader to %s or %s", httpsURL, iap.HeaderProxyAuthorization, iap.HeaderCookie)
+	}
+	username, password, err := git.FillCredentialsWithHelper(httpsURL, helper)
+	if err != nil {
+		log.Fatal().Msgf("Could not get the credentials of %s from iap.backendCredentialHelper: %s", httpsURL, err)
+	}
+	return username, password
+}
+
+// resolveRedirects returns the url of the repository at httpsURL after the redirects of its host,
+// when iap.followRedirects is true, and exits with a readable error when it moved to another host.
+// It is opt-in, as it costs an authenticated request before every fetch and push.
+func resolveRedirects(httpsURL string, auth *iap.AuthState) string {
+	if follow, _ := strconv.ParseBool(git.ConfigTryGetURLMatch("iap.followRedirects", httpsURL)); !follow {
+		return httpsURL
+	}
+
+	resolved, err := iap.ResolveRedirects(httpsURL, auth.RawToken)
+	var redirectErr *iap.RedirectError
+	switch {
+	case errors.As(err, &redirectErr):
+		log.Error().Msg(err.Error())
+		os.Exit(128)
+	case err != nil:
+		// git-remote-https reports unreachable servers
+		log.Debug().Msgf("[resolveRedirects] %s", err)
+	case resolved != httpsURL:
+		log.Info().Msgf("%s redirects to %s, consider updating the url of the remote", httpsURL, resolved)
+	}
+	return resolved
+}
+
+// handleAccessDenied explains failures caused by IAP refusing the authenticated account,
+// which git would otherwise report as an opaque HTML error, and re-authenticates with
+// the account chooser when iap.reauthOnDenied is set.
+func handleAccessDenied(url string, auth *iap.AuthState) {
+	httpsURL, err := iap.ToHTTPSURL(url)
+	if err != nil {
+		return
+	}
+
+	denied, err := iap.IsAccessDenied(httpsURL, auth.RawToken)
+	if err != nil {
+		log.Debug().Msgf("[handleAccessDenied] %s", err)
+		return
+	}
+	if !denied {
+		return
+	}
+
+	log.Error().Msgf("IAP denied access to %s for the account you are logged in with. Ask for the 'IAP-secured Web App User' role, or log in with another account using: %s check --select-account %s", httpsURL, binaryName, url)
+
+	scope, err := toAuthScope(url)
+	if err != nil {
+		return
+	}
+	if reauth, _ := strconv.ParseBool(git.ConfigTryGetURLMatch("iap.reauthOnDenied", scope)); reauth {
+		log.Info().Msgf("Re-authenticating with account selection, retry the git command afterwards")
+		if _, err := iap.NewAuth(scope, iap.AuthOptions{ForceBrowserFlow: true, SelectAccount: true}); err != nil {
+			log.Error().Msgf("Re-authentication failed: %s", err)
+		}
+	}
 }
 
 func check(cmd *cobra.Command, args []string) {
-	remote, url := args[0], args[len(args)-1]
+	opts := iap.AuthOptions{
+		ForceBrowserFlow:          forcebrowser || selectAccount,
+		SelectAccount:             selectAccount,
+		NoBrowser:                 noBrowser,
+		KeyFile:                   keyFile,
+		ImpersonateServiceAccount: impersonateServiceAccount,
+	}
+	if checkAll {
+		checkEverywhere(opts)
+		return
+	}
+
+	remote, url := defaultRemote, defaultRemote
+	if len(args) > 0 {
+		remote, url = args[0], args[len(args)-1]
+	}
+	url = resolveRemote(url)
 	log.Debug().Msgf("%s check %s %s: forcebrowser=%s", binaryName, remote, url, strconv.FormatBool(forcebrowser))
 
-	handleIAPAuthCookieFor(url, forcebrowser)
+	auth := handleIAPAuthCookieFor(url, opts)
+	if jsonOutput {
+		scope, err := toAuthScope(url)
+		if err != nil {
+			log.Fatal().Msgf("Could not resolve the auth scope of %s: %s", url, err)
+		}
+		writeJSON(newIdentity(scope, auth))
+	}
+}
+
+// checkEverywhere refreshes the tokens of every configured host, then prints how each one went
+func checkEverywhere(opts iap.AuthOptions) {
+	domains := iap.ConfiguredDomains()
+	if len(domains) == 0 {
+		log.Fatal().Msgf("No host is configured for IAP, see %s configure", binaryName)
+	}
+
+	failed := 0
+	identities := []identity{}
+	for _, domain := range domains {
+		// reading the token of a host without cookie file would exit
+		_, err := iap.CheckCookieFile(domain)
+		var auth *iap.AuthState
+		if err == nil {
+			auth, err = authStateFor(domain, opts)
+		}
+		if err != nil {
+			failed++
+			identities = append(identities, identity{URL: domain, Error: err.Error()})
+			continue
+		}
+		identities = append(identities, newIdentity(domain, auth))
+	}
+
+	if jsonOutput {
+		writeJSON(identities)
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, id := range identities {
+			switch {
+			case id.Error != "":
+				fmt.Fprintf(w, "  FAIL\t%s\t%s\n", id.URL, id.Error)
+			case id.ExpiresAt != nil:
+				fmt.Fprintf(w, "  ok\t%s\tvalid until %s\n", id.URL, id.ExpiresAt.Local().Format(time.RFC3339))
+			default:
+				fmt.Fprintf(w, "  ok\t%s\t\n", id.URL)
+			}
+		}
+		w.Flush()
+	}
+	if failed > 0 {
+		log.Fatal().Msgf("Could not refresh the tokens of %d of %d hosts", failed, len(domains))
+	}
 }
 
 func print(cmd *cobra.Command, args []string) {
-	url := args[0]
+	url := resolveRemote(args[0])
 	log.Debug().Msgf("%s print %s", binaryName, url)
 
-	auth := handleIAPAuthCookieFor(url, false)
-	fmt.Printf("%s\n", auth.RawToken)
+	auth := handleIAPAuthCookieFor(url, iap.AuthOptions{
+		KeyFile:                   keyFile,
+		ImpersonateServiceAccount: impersonateServiceAccount,
+	})
+	scope, err := toAuthScope(url)
+	if err != nil {
+		log.Fatal().Msgf("Could not resolve the auth scope of %s: %s", url, err)
+	}
+	if printClaims {
+		printDecodedToken(auth)
+	}
+	switch printFormat {
+	case formatToken:
+		fmt.Printf("%s\n", auth.RawToken)
+	case formatCookieJar:
+		fmt.Print(auth.Cookie.CookieJar(auth.RawToken))
+	case formatExecCred:
+		printExecCredential(auth)
+	case formatHeader:
+		printHeader(scope, auth)
+	case formatCurl:
+		printCurl(scope, auth)
+	case formatJSON:
+		printJSON(scope, auth)
+	case formatNpmrc:
+		printNpmrc(url, auth)
+	case formatPip:
+		printPip(url, printProxy)
+	case formatBazel:
+		printBazel(scope, auth)
+	case formatK8sSecret:
+		printK8sSecret(secretName, auth)
+	case formatNetrc:
+		log.Fatal().Msgf("There is no %s format: tools reading ~/.netrc send the token as a basic authentication password, which IAP rejects. Reach the host through '%s proxy' instead", formatNetrc, binaryName)
+	default:
+		log.Fatal().Msgf("Unsupported format '%s', expected one of %s", printFormat, strings.Join([]string{formatToken, formatHeader, formatCurl, formatJSON, formatNpmrc, formatPip, formatBazel, formatK8sSecret, formatCookieJar, formatExecCred}, ", "))
+	}
+}
+
+// buildInfo is the provenance of the binary, printed by version
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"buildDate"`
+	GoVersion string `json:"goVersion"`
+	Platform  string `json:"platform"`
 }
 
 func printVersion(cmd *cobra.Command, args []string) {
-	fmt.Printf("%s %s\n", binaryName, version)
+	info := buildInfo{
+		Version:   orUnknown(version),
+		Commit:    orUnknown(commit),
+		BuildDate: orUnknown(buildDate),
+		GoVersion: runtime.Version(),
+		Platform:  fmt.Sprintf("%s/%s", runtime.GOOS, runtime.GOARCH),
+	}
+	if jsonOutput {
+		writeJSON(info)
+		return
+	}
+	fmt.Printf("%s %s\n", binaryName, info.Version)
+	fmt.Printf("  commit:   %s\n", info.Commit)
+	fmt.Printf("  built:    %s\n", info.BuildDate)
+	fmt.Printf("  go:       %s\n", info.GoVersion)
+	fmt.Printf("  platform: %s\n", info.Platform)
+}
+
+// orUnknown stands for the build information missing from binaries not built with the Makefile, e.g. go install
+func orUnknown(value string) string {
+	if value == "" {
+		return "unknown"
+	}
+	return value
 }
 
 func installGitProtocol(cmd *cobra.Command, args []string) {
-	p := strings.TrimLeft(binaryName, "git-remote-")
-	git.InstallProtocol(p)
-	log.Info().Msgf("%s protocol configured in git!", p)
+	protocols := args
+	if len(protocols) == 0 {
+		protocols = []string{strings.TrimPrefix(filepath.Base(binaryName), "git-remote-")}
+	}
+
+	for _, p := range protocols {
+		p = strings.TrimPrefix(p, "git-remote-")
+		git.InstallProtocol(p)
+		log.Info().Msgf("%s protocol configured in git!", p)
+
+		if installLink {
+			linkHelper(p)
+		}
+		if _, err := exec.LookPath(fmt.Sprintf("git-remote-%s", p)); err != nil {
+			log.Warn().Msgf("git-remote-%s is not in PATH, %s:// urls will not work until it is, e.g. with --link", p, p)
+		}
+	}
+}
+
+// linkHelper makes the binary available as the helper of another protocol, next to it.
+// All aliases share the same configuration and tokens, which are keyed by host.
+func linkHelper(protocol string) {
+	self, err := os.Executable()
+	if err != nil {
+		log.Fatal().Msgf("Could not locate %s: %s", binaryName, err)
+	}
+	name := fmt.Sprintf("git-remote-%s", protocol)
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	link := filepath.Join(filepath.Dir(self), name)
+	if link == self {
+		return
+	}
+	if _, err := os.Lstat(link); err == nil {
+		log.Debug().Msgf("%s already exists", link)
+		return
+	}
+	if err := os.Symlink(self, link); err != nil {
+		log.Fatal().Msgf("Could not link %s to %s: %s", link, self, err)
+	}
+	log.Info().Msgf("Linked %s to %s", link, self)
 }
 
 func configureIAP(cmd *cobra.Command, args []string) {
+	switch configureScope {
+	case git.ScopeGlobal, git.ScopeLocal, git.ScopeWorktree:
+	default:
+		log.Fatal().Msgf("Unknown --scope '%s'", configureScope)
+	}
+
+	if clientJSON != "" {
+		if helperID != "" {
+			log.Fatal().Msg("--client-json and --helperID are mutually exclusive")
+		}
+		helperID, helperSecret = readClientJSON(clientJSON)
+	}
+	if !iap.IsProvider(provider) {
+		log.Fatal().Msgf("Unknown --provider '%s'", provider)
+	}
+	if clientID == "" && (provider == iap.ProviderGoogle || provider == iap.ProviderAzure) {
+		log.Fatal().Msg("required flag \"clientID\" not set")
+	}
+	if helperID == "" && provider == iap.ProviderAzure {
+		log.Fatal().Msg("required flag \"helperID\" not set, the client ID of a public client application of Azure AD")
+	}
+	if provider == iap.ProviderOIDC && (issuer == "" || helperID == "") {
+		log.Fatal().Msg("required flags \"issuer\" and \"helperID\", the OAuth client of the helper at the issuer, not set")
+	}
+
 	repo, err := _url.Parse(repoURL)
-	https := fmt.Sprintf("https://%s", repo.Host)
 	if err != nil {
-		log.Error().Msgf("Could not convert %s in https://: %s", https, err)
+		log.Fatal().Msgf("Could not convert %s in https://: %s", repoURL, err)
+	}
+	host := iap.CanonicalHost(repo)
+	https := fmt.Sprintf("https://%s", host)
+	if repo.Scheme == "http" {
+		if !allowInsecureHTTP {
+			log.Fatal().Msgf("%s is served over plain http, where tokens are not encrypted: use --allowInsecureHTTP for local or staging proxies", repoURL)
+		}
+		// the configuration of the host is that of its http:// urls, rewritten to the helper too
+		https = fmt.Sprintf("http://%s", host)
+	}
+
+	// the IAP instance of a path prefix gets its own clientID and cookie file,
+	// while the helper and the rewrite of urls remain those of the host
+	scope, cookieFile := https, iap.CookieFile(host)
+	if prefix := strings.Trim(pathPrefix, "/"); prefix != "" {
+		scope = fmt.Sprintf("%s/%s", https, prefix)
+		cookieFile = iap.CookieFile(fmt.Sprintf("%s/%s", host, prefix))
+	}
+
+	if includeIf != "" {
+		configureIncludeFile(host)
+	}
+
+	log.Info().Msgf("Configure IAP for %s", scope)
+	if helperID != "" {
+		// the device flow of Azure AD only accepts public clients
+		if provider != iap.ProviderAzure {
+			helperSecret = readHelperSecret()
+		}
+		setConfig(https, "iap", "helperID", helperID)
+		if helperSecret != "" {
+			saveHelperSecret(https, helperSecret)
+		}
+	} else if provider != iap.ProviderGoogle {
+		// the helper is an OAuth client of Google, other providers have their own ways of logging in
+	} else if iap.BuiltinHelperID != "" {
+		log.Info().Msg("No helperID given, the helper embedded in this build will be used")
+	} else {
+		log.Info().Msg("No helperID given, application default credentials will be used")
+	}
+	if clientID != "" {
+		setConfig(scope, "iap", "clientID", clientID)
+	}
+	if provider != iap.ProviderGoogle {
+		setConfig(https, "iap", "provider", provider)
+	}
+	if azureTenant != "" {
+		setConfig(https, "iap", "azureTenant", azureTenant)
+	}
+	if issuer != "" {
+		setConfig(https, "iap", "issuer", issuer)
+	}
+	if repo.Scheme == "http" {
+		setConfig(https, "iap", "allowInsecureHTTP", "true")
+	}
+
+	switch configureMode {
+	case modeInsteadOf:
+		configureInsteadOf(https, host)
+	case modeCredential:
+		setConfig(https, "credential", "helper", fmt.Sprintf("!git-remote-%s credential", helperName))
+	case modeExtraHeader:
+		setConfig(scope, "iap", "cookieStore", iap.StoreExtraHeader)
+	default:
+		log.Fatal().Msgf("Unknown --mode '%s'", configureMode)
+	}
+	if configureLFS {
+		configureLFSAgent(https)
+	}
+
+	// set cookie path, the extra header replaces the cookie file
+	if configureMode != modeExtraHeader {
+		setConfig(scope, "http", "cookieFile", cookieFile)
+		// oauth2-proxy refreshes sessions by setting its cookie again, that git saves for the helper to read
+		if provider == iap.ProviderOAuth2Proxy {
+			setConfig(scope, "http", "saveCookies", "true")
+		}
+	}
+	if includeIf != "" {
+		includeConfig()
+	}
+}
+
+// setConfig writes a config of configure, in the git config selected by --scope
+func setConfig(url, section, key, value string) {
+	applyConfig(&git.GitConfig{Url: url, Section: section, Key: key, Value: value})
+}
+
+// applyConfig writes config, or only reports how it would change the git config with --dry-run
+func applyConfig(config *git.GitConfig) {
+	if !configureDryRun {
+		git.SetConfig(config, configureScope)
+		return
+	}
+
+	current, err := git.ConfigGetAllScoped(config.Name(), configureScope)
+	if err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+	value := config.Value
+	if config.Key == "helperSecret" {
+		value = "<secret>"
 	}
 
-	log.Info().Msgf("Configure IAP for %s", https)
-	git.SetGlobalConfig(https, "iap", "helperID", helperID)
-	git.SetGlobalConfig(https, "iap", "helperSecret", helperSecret)
-	git.SetGlobalConfig(https, "iap", "clientID", clientID)
+	switch {
+	case len(current) == 0:
+		fmt.Printf("+ %s = %s\n", config.Name(), value)
+	case len(current) == 1 && current[0] == config.Value:
+		fmt.Printf("= %s = %s (unchanged)\n", config.Name(), value)
+	case len(current) == 1 && config.Key == "helperSecret":
+		fmt.Printf("~ %s = %s (was another secret)\n", config.Name(), value)
+	case len(current) == 1:
+		fmt.Printf("~ %s = %s (was %s)\n", config.Name(), value, current[0])
+	default:
+		// git refuses to set a single value over several
+		fmt.Printf("! %s = %s (conflicts with %d existing values: %s)\n", config.Name(), value, len(current), strings.Join(current, ", "))
+	}
+}
+
+// saveHelperSecret keeps the helper secret in the keyring of refresh tokens, if one is selected, else in git config
+func saveHelperSecret(https, secret string) {
+	store := iap.HelperSecretStore(https)
+	switch {
+	case store == "":
+		setConfig(https, "iap", "helperSecret", secret)
+	case configureDryRun:
+		fmt.Printf("+ helper secret of %s, in %s\n", https, store)
+	default:
+		if err := iap.SaveHelperSecret(https, secret); err != nil {
+			log.Fatal().Msg(err.Error())
+		}
+	}
+}
 
-	// let users manipulate standard 'https://' urls
+// configureInsteadOf lets users manipulate standard 'https://' urls, rewritten to the remote helper
+func configureInsteadOf(https, host string) {
 	insteadOf := &git.GitConfig{
-		Url:     fmt.Sprintf("%s://%s", helperName, repo.Host),
+		Url:     fmt.Sprintf("%s://%s", helperName, host),
 		Section: "url",
 		Key:     "insteadOf",
 		Value:   https,
 	}
-	if strings.Contains(repo.Host, "*") {
+	if strings.Contains(host, "*") {
 		log.Warn().Msg("While config is valid for wildcard hosts, transparent support for https:// remotes require \"insteadOf\" config")
 		log.Info().Msg("Actual hosts must be manually configured as follows (with * replaced by subdomain):")
-		log.Info().Msg(insteadOf.CommandSuggestGlobal())
+		log.Info().Msg(insteadOf.CommandSuggest(configureScope))
+		log.Info().Msgf("or with '%s configure expand-wildcard --repoURL https://%s --hosts ...'", binaryName, host)
 	} else {
-		git.SetConfigGlobal(insteadOf)
+		warnOtherAliases(https)
+		applyConfig(insteadOf)
+	}
+}
+
+// warnOtherAliases warns when another helper alias already rewrites https, as git would only use one of them.
+// Aliases share configuration and tokens anyway: they are keyed by host, not by helperName.
+func warnOtherAliases(https string) {
+	configs, _ := git.ConfigListScoped(configureScope)
+	for _, config := range configs {
+		name, value := config[0], config[1]
+		if value != https || !strings.HasPrefix(name, "url.") || !strings.HasSuffix(name, ".insteadof") {
+			continue
+		}
+		if alias := strings.SplitN(strings.TrimPrefix(name, "url."), "://", 2)[0]; alias != helperName {
+			log.Warn().Msgf("%s is already rewritten to the %s helper, see 'git config --get-regexp ^url\\..*\\.insteadof'", https, alias)
+		}
+	}
+}
+
+// readHelperSecret returns the helper secret given by --helperSecret, --helperSecret-file or
+// --helperSecret-stdin, or else typed at a prompt. An empty secret is fine for public clients.
+func readHelperSecret() string {
+	switch {
+	case helperSecret != "":
+		return helperSecret
+	case clientJSON != "":
+		// a public client, whose file has no secret
+		return ""
+	case helperSecretFile != "":
+		data, err := os.ReadFile(helperSecretFile)
+		if err != nil {
+			log.Fatal().Msgf("Could not read %s: %s", helperSecretFile, err)
+		}
+		return strings.TrimSpace(string(data))
+	case helperSecretStdin:
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			log.Fatal().Msgf("Could not read the helper secret from stdin: %s", err)
+		}
+		return strings.TrimSpace(line)
+	}
+
+	secret, err := iap.ReadSecret("OAuth Client Secret of the helper (leave empty for public clients): ")
+	if err != nil {
+		log.Debug().Msgf("[readHelperSecret] %s", err)
+		return ""
+	}
+	return secret
+}
+
+// readClientJSON returns the client ID and secret of an OAuth client file downloaded from the
+// Google Cloud console, of a desktop, web, or TVs and limited input devices application
+func readClientJSON(path string) (string, string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatal().Msgf("Could not read %s: %s", path, err)
 	}
+	config, err := google.ConfigFromJSON(data)
+	if err != nil {
+		log.Fatal().Msgf("Could not read the OAuth client of %s: %s", path, err)
+	}
+	if config.ClientID == "" {
+		log.Fatal().Msgf("%s has no client_id", path)
+	}
+	return config.ClientID, config.ClientSecret
+}
 
-	// set cookie path
-	domainSlug := strings.ReplaceAll(repo.Host, ".", "-")
-	domainSlug = strings.ReplaceAll(domainSlug, "*", "_wildcard_")
-	cookiePath := fmt.Sprintf("~/.config/gcp-iap/%s.cookie", domainSlug)
-	git.SetGlobalConfig(https, "http", "cookieFile", cookiePath)
+func handleIAPAuthCookieFor(url string, opts iap.AuthOptions) *iap.AuthState {
+	auth, err := authStateFor(url, opts)
+	if err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+	return auth
 }
 
-func handleIAPAuthCookieFor(url string, forcebrowserflow bool) *iap.AuthState {
+// authStateFor returns a valid token for url, from this process, the environment or the cache,
+// or after authenticating again, like handleIAPAuthCookieFor, but returns errors instead of exiting
+func authStateFor(url string, opts iap.AuthOptions) (*iap.AuthState, error) {
 	// All our work will be based on the basedomain of the provided URL
-	// as IAP would be setup for the whole domain.
-	url, err := toHTTPSBaseDomain(url)
+	// as IAP would be setup for the whole domain, unless a path of the domain
+	// has been mapped to another IAP instance, or remotes are isolated by iap.tokenScope.
+	url, err := toAuthScope(url)
 	if err != nil {
 		log.Error().Msgf("[handleIAPAuthCookieFor] Could not convert %s in https://: %s", url, err)
 	}
 
 	log.Debug().Msgf("[handleIAPAuthCookieFor] Manage IAP auth for %s", url)
 
+	if auth := memoizedAuthState(url, opts); auth != nil {
+		log.Debug().Msgf("[handleIAPAuthCookieFor] Token already obtained by this process, valid until %s", time.Unix(auth.Cookie.Claims.ExpiresAt, 0))
+		return auth, nil
+	}
+
+	if auth, err := iap.ReadAuthStateFromEnv(url); auth != nil || err != nil {
+		if err != nil {
+			return nil, err
+		}
+		log.Debug().Msgf("[handleIAPAuthCookieFor] Using token from the environment, valid until %s", time.Unix(auth.Cookie.Claims.ExpiresAt, 0))
+		iap.RecordAudit(url, iap.AuditUse, auth)
+		return auth, nil
+	}
+
 	auth, err := iap.ReadAuthState(url)
 	switch {
 	case err != nil:
 		log.Debug().Msgf("[handleIAPAuthCookieFor] Could not read IAP cookie for %s: %s", url, err.Error())
-		auth, err = iap.NewAuth(url, forcebrowserflow)
-		if err != nil {
-			log.Debug().Msgf("[handleIAPAuthCookieFor] Retrying with forcebrowserflow: true")
-			auth, err = iap.NewAuth(url, true)
-		}
+		auth, err = newAuthWithRetry(url, opts)
+	case opts.SelectAccount:
+		log.Debug().Msgf("[handleIAPAuthCookieFor] Account selection requested for %s", url)
+		auth, err = newAuthWithRetry(url, opts)
 	case auth.Cookie.Expired():
 		log.Debug().Msgf("[handleIAPAuthCookieFor] IAP cookie for %s has expired", url)
-		auth, err = iap.NewAuth(url, forcebrowserflow)
-		if err != nil {
-			log.Debug().Msgf("[handleIAPAuthCookieFor] Retrying with forcebrowserflow: true")
-			auth, err = iap.NewAuth(url, true)
-		}
+		auth, err = newAuthWithRetry(url, opts)
 	case !auth.Cookie.Expired():
 		log.Debug().Msgf("[handleIAPAuthCookieFor] IAP Cookie still valid until %s", time.Unix(auth.Cookie.Claims.ExpiresAt, 0))
 	}
 
 	if err != nil {
-		log.Fatal().Msg(err.Error())
+		return nil, err
 	}
 
-	return auth
+	iap.RecordAudit(url, iap.AuditUse, auth)
+	authStatesMu.Lock()
+	authStates[url] = auth
+	authStatesMu.Unlock()
+	return auth, nil
+}
+
+// memoizedAuthState returns the unexpired token of an auth scope already obtained by this process,
+// e.g. by the LFS agent, which authenticates every request
+func memoizedAuthState(scope string, opts iap.AuthOptions) *iap.AuthState {
+	if opts.ForceBrowserFlow || opts.SelectAccount {
+		return nil
+	}
+
+	authStatesMu.Lock()
+	defer authStatesMu.Unlock()
+	if auth, ok := authStates[scope]; ok && !auth.Cookie.Expired() {
+		return auth
+	}
+	return nil
+}
+
+// newAuthWithRetry falls back to the browser flow when the first attempt failed,
+// e.g. because the cached refresh token has been revoked.
+func newAuthWithRetry(url string, opts iap.AuthOptions) (*iap.AuthState, error) {
+	auth, err := iap.NewAuth(url, opts)
+	if err != nil && !opts.ForceBrowserFlow {
+		log.Debug().Msgf("[handleIAPAuthCookieFor] Retrying with forcebrowserflow: true")
+		opts.ForceBrowserFlow = true
+		auth, err = iap.NewAuth(url, opts)
+	}
+	return auth, err
+}
+
+// resolveRemote returns the https:// url of a remote of the current repository when addr names one,
+// e.g. origin, and addr otherwise. The url of the remote is mapped back from that of the helper
+// when an insteadOf rule rewrites it.
+func resolveRemote(addr string) string {
+	if strings.Contains(addr, "://") {
+		return addr
+	}
+	url, err := git.RemoteURL(addr)
+	if err != nil {
+		if addr == defaultRemote {
+			log.Fatal().Msgf("No url given, and %s", err)
+		}
+		log.Debug().Msgf("[resolveRemote] %s is not a remote, using it as a url: %s", addr, err)
+		return addr
+	}
+	https, err := iap.ToHTTPSURL(url)
+	if err != nil {
+		log.Fatal().Msgf("Could not convert %s, the url of remote %s, in https://: %s", url, addr, err)
+	}
+	log.Debug().Msgf("[resolveRemote] Remote %s is %s", addr, https)
+	return https
 }
 
 func toHTTPSBaseDomain(addr string) (string, error) {
+	addr = iap.FromIAPScheme(addr)
 	u, err := _url.Parse(addr)
 	if err != nil {
 		return "", err
 	}
-	return fmt.Sprintf("https://%s", u.Host), nil
+	host := iap.CanonicalHost(u)
+	return fmt.Sprintf("%s://%s", iap.TransportScheme(host), host), nil
+}
+
+// toAuthScope returns the url whose IAP configuration applies to addr: the longest
+// path prefix of addr having its own iap.clientID, or its basedomain.
+// This allows a single host to serve paths protected by IAP instances of different projects.
+// With iap.tokenScope set to "remote", the remote url itself is the scope.
+func toAuthScope(addr string) (string, error) {
+	addr = iap.FromIAPScheme(addr)
+	base, err := toHTTPSBaseDomain(addr)
+	if err != nil {
+		return "", err
+	}
+
+	u, err := _url.Parse(addr)
+	if err != nil {
+		return "", err
+	}
+	target := base + u.Path
+
+	if git.ConfigTryGetURLMatch("iap.tokenScope", target) == iap.TokenScopeRemote {
+		scope := strings.TrimSuffix(strings.TrimSuffix(target, "/"), ".git")
+		log.Debug().Msgf("[toAuthScope] %s has a token of its own (iap.tokenScope)", scope)
+		return scope, nil
+	}
+
+	scope := base
+	for _, candidate := range git.ConfigURLsWithKey("iap", "clientID") {
+		c, err := _url.Parse(candidate)
+		if err != nil || !strings.EqualFold(iap.CanonicalHost(c), iap.CanonicalHost(u)) {
+			continue
+		}
+		prefix := base + strings.TrimSuffix(c.Path, "/")
+		if len(prefix) <= len(scope) {
+			continue
+		}
+		if target == prefix || strings.HasPrefix(target, prefix+"/") {
+			scope = prefix
+		}
+	}
+
+	if scope != base {
+		log.Debug().Msgf("[toAuthScope] %s is mapped to the IAP configuration of %s", addr, scope)
+	}
+	return scope, nil
 }
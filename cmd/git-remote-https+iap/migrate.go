@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+
+	"github.com/adohkan/git-remote-https-iap/internal/iap"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Upgrade the configuration written by older versions to the current layout",
+	Long: `Upgrade the configuration written by older versions to the current layout, and report what changed.
+
+- Configs written for urls with the default port, e.g. iap.https://git.domain.acme:443.clientID,
+  are renamed without it, as tokens of the same host are now shared whatever its url. Only the
+  iap configs, the http configs of IAP urls and the insteadOf rules of helper schemes are renamed.
+- Cookie files are created in GIT_IAP_CACHE_DIR, or in gcp-iap under the XDG state directory.
+  Cookie files configured elsewhere, e.g. in ~/.config/gcp-iap, are moved there and the
+  http.<url>.cookieFile git config of their hosts is updated.
+- Plaintext iap.helperSecret configs are moved to the keyring of refresh tokens, when
+  iap.refreshTokenStore or iap.credentialStore selects one.
+
+Only the global git config is upgraded. Running migrate again is harmless.`,
+	Args: cobra.NoArgs,
+	Run:  migrate,
+}
+
+func init() {
+	rootCmd.AddCommand(migrateCmd)
+}
+
+func migrate(cmd *cobra.Command, args []string) {
+	changed := 0
+
+	renamed, err := iap.MigrateDefaultPorts()
+	for _, r := range renamed {
+		switch {
+		case r.Value != r.NewValue && r.Superseded:
+			inform(os.Stdout, "removed %s = %s, superseded by %s\n", r.Name, r.Value, r.NewValue)
+		case r.Value != r.NewValue:
+			inform(os.Stdout, "changed %s from %s to %s\n", r.Name, r.Value, r.NewValue)
+		case r.Superseded:
+			inform(os.Stdout, "removed %s, superseded by %s\n", r.Name, r.NewName)
+		default:
+			inform(os.Stdout, "renamed %s to %s\n", r.Name, r.NewName)
+		}
+	}
+	changed += len(renamed)
+	if err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+
+	moved, err := iap.MigrateCookieFiles()
+	for _, m := range moved {
+		inform(os.Stdout, "%s: moved %s to %s\n", m.URL, m.From, m.To)
+	}
+	changed += len(moved)
+	if err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+
+	secrets, err := iap.MigrateHelperSecrets()
+	for _, s := range secrets {
+		if s.Store == "" {
+			inform(os.Stdout, "%s: iap.helperSecret is kept in git config, set iap.refreshTokenStore to a keyring to move it\n", s.URL)
+			continue
+		}
+		inform(os.Stdout, "%s: moved iap.helperSecret to %s\n", s.URL, s.Store)
+		changed++
+	}
+	if err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+
+	if changed == 0 {
+		inform(os.Stdout, "The configuration is up to date, with cookie files in %s\n", iap.CacheDir())
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	_url "net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/adohkan/git-remote-https-iap/internal/iap"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// npmUserConfigEnv is the user config of npm, replaced by exec --format npmrc
+	npmUserConfigEnv = "NPM_CONFIG_USERCONFIG"
+
+	// the index, proxy and CA bundle of pip, set by exec --format pip
+	pipIndexURLEnv = "PIP_INDEX_URL"
+	pipProxyEnv    = "PIP_PROXY"
+	pipCertEnv     = "PIP_CERT"
+)
+
+// only used in execCmd
+var execFormat string
+
+var execCmd = &cobra.Command{
+	Use:   "exec url --format npmrc|pip|bazel -- command [args...]",
+	Short: "Refresh the token of url if needed, then run a tool with it",
+	Long: `Refresh the token of url if needed, then run a tool with it, so that long-lived
+configs never hold expired tokens:
+
+  --format npmrc  runs npm with a user config of ~/.npmrc and the token of the registry at url
+  --format pip    runs pip with the index at url, reached through a local proxy adding the token,
+                  as pip only sends credentials as basic authentication, which IAP rejects
+  --format bazel  runs bazel with a --remote_header option sending the token to the cache at url`,
+	Args: cobra.MinimumNArgs(2),
+	Run:  execWithToken,
+}
+
+func init() {
+	execCmd.Flags().StringVar(&execFormat, "format", "", "Config to run the command with: \"npmrc\", \"pip\" or \"bazel\" (required)")
+	execCmd.MarkFlagRequired("format")
+	rootCmd.AddCommand(execCmd)
+}
+
+// printNpmrc prints the line of .npmrc sending the token to the npm registry at url, which npm sends
+// in the Authorization header
+func printNpmrc(url string, auth *iap.AuthState) {
+	fmt.Println(npmrcAuthLine(url, auth))
+}
+
+// printPip prints a pip.conf using the index at url through the local proxy at addr, which adds the token:
+// pip only sends credentials as basic authentication, which IAP rejects
+func printPip(url, addr string) {
+	secret := os.Getenv(proxySecretEnv)
+	if secret == "" {
+		log.Fatal().Msgf("The local proxy has a random password: set %s, for both print and proxy", proxySecretEnv)
+	}
+	if _, err := iap.LoadProxyCA(); err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+	fmt.Printf("[global]\nindex-url = %s\nproxy = %s\ncert = %s\n", parsePackageURL(url), localProxyURL(secret, addr), iap.ExpandHome(iap.ProxyCAFile()))
+}
+
+// npmrcAuthLine returns the _authToken of the registry at url, whose path npm matches by prefix
+func npmrcAuthLine(url string, auth *iap.AuthState) string {
+	u := parsePackageURL(url)
+	path := u.EscapedPath()
+	if !strings.HasSuffix(path, "/") {
+		path += "/"
+	}
+	return fmt.Sprintf("//%s%s:_authToken=%s", u.Host, path, auth.RawToken)
+}
+
+func parsePackageURL(url string) *_url.URL {
+	u, err := _url.Parse(iap.FromIAPScheme(url))
+	if err != nil {
+		log.Fatal().Msgf("Could not parse %s: %s", url, err)
+	}
+	u.Scheme = "https"
+	return u
+}
+
+func execWithToken(cmd *cobra.Command, args []string) {
+	url, command := args[0], args[1:]
+	log.Debug().Msgf("%s exec %s %v", binaryName, url, command)
+
+	auth := handleIAPAuthCookieFor(url, iap.AuthOptions{})
+	env := os.Environ()
+	switch execFormat {
+	case formatNpmrc:
+		userConfig, err := writeNpmUserConfig(url, auth)
+		if err != nil {
+			log.Fatal().Msgf("Could not write the npm user config: %s", err)
+		}
+		env = append(env, fmt.Sprintf("%s=%s", npmUserConfigEnv, userConfig))
+		code := runCommand(command, env)
+		os.Remove(userConfig)
+		os.Exit(code)
+	case formatPip:
+		proxyURL, err := startLocalProxy()
+		if err != nil {
+			log.Fatal().Msgf("Could not start the local proxy: %s", err)
+		}
+		env = append(env,
+			fmt.Sprintf("%s=%s", pipIndexURLEnv, parsePackageURL(url)),
+			fmt.Sprintf("%s=%s", pipProxyEnv, proxyURL),
+			fmt.Sprintf("%s=%s", pipCertEnv, iap.ExpandHome(iap.ProxyCAFile())))
+		os.Exit(runCommand(command, env))
+	case formatBazel:
+		scope, err := toAuthScope(url)
+		if err != nil {
+			log.Fatal().Msgf("Could not resolve the auth scope of %s: %s", url, err)
+		}
+		os.Exit(runCommand(withBazelRemoteHeader(command, bazelRemoteHeader(scope, auth)), env))
+	default:
+		log.Fatal().Msgf("Unsupported format '%s', expected %s, %s or %s", execFormat, formatNpmrc, formatPip, formatBazel)
+	}
+}
+
+// runCommand runs command with env and the standard streams of the helper, and returns its exit code
+func runCommand(command, env []string) int {
+	c := exec.Command(command[0], command[1:]...)
+	c.Env = env
+	c.Stdin = os.Stdin
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	if err := c.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return exitErr.ExitCode()
+		}
+		log.Error().Msgf("Could not run %s: %s", command[0], err)
+		return 1
+	}
+	return 0
+}
+
+// writeNpmUserConfig writes a private copy of the npm user config with the token of url, and returns its path
+func writeNpmUserConfig(url string, auth *iap.AuthState) (string, error) {
+	userConfig := os.Getenv(npmUserConfigEnv)
+	if userConfig == "" {
+		home, _ := os.UserHomeDir()
+		userConfig = filepath.Join(home, ".npmrc")
+	}
+	config, err := os.ReadFile(userConfig)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	if len(config) > 0 && !strings.HasSuffix(string(config), "\n") {
+		config = append(config, '\n')
+	}
+	config = append(config, npmrcAuthLine(url, auth)+"\n"...)
+
+	f, err := os.CreateTemp("", "npmrc-iap-")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := f.Write(config); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/adohkan/git-remote-https-iap/internal/iap"
+	"github.com/rs/zerolog/log"
+)
+
+// printedToken is the token printed with --format json
+type printedToken struct {
+	Token     string     `json:"token"`
+	Header    string     `json:"header,omitempty"`
+	ExpiresAt string     `json:"expiresAt,omitempty"`
+	Claims    iap.Claims `json:"claims"`
+}
+
+// printHeader prints the header sending the token to scope, as selected by iap.authHeader
+func printHeader(scope string, auth *iap.AuthState) {
+	fmt.Println(printableHeader(scope, auth))
+}
+
+// printCurl prints the arguments of curl sending the token, quoted for a shell, e.g. for eval
+func printCurl(scope string, auth *iap.AuthState) {
+	fmt.Printf("-H %s\n", shellQuote(printableHeader(scope, auth)))
+}
+
+func printJSON(scope string, auth *iap.AuthState) {
+	token := printedToken{
+		Token:  auth.RawToken,
+		Header: iap.AuthHeader(scope, auth.RawToken),
+		Claims: auth.Cookie.Claims,
+	}
+	if auth.Cookie.Claims.ExpiresAt != 0 {
+		token.ExpiresAt = time.Unix(auth.Cookie.Claims.ExpiresAt, 0).UTC().Format(time.RFC3339)
+	}
+	writeJSON(token)
+}
+
+// writeJSON prints the results of a command in its --json output
+func writeJSON(v interface{}) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		log.Fatal().Msgf("Could not print the JSON output: %s", err)
+	}
+}
+
+// decodedToken is the token printed with --claims
+type decodedToken struct {
+	Header map[string]interface{} `json:"header,omitempty"`
+	Claims interface{}            `json:"claims"`
+	// Expires is the time left before expiry, for humans
+	Expires string `json:"expires,omitempty"`
+}
+
+// printDecodedToken prints the header and claims of the token to stderr, leaving stdout to the token
+// itself. The claims of tokens that are not JWTs are those their provider knows of.
+func printDecodedToken(auth *iap.AuthState) {
+	decoded := decodedToken{Claims: auth.Cookie.Claims}
+	if header, claims, err := iap.DecodeToken(auth.RawToken); err == nil {
+		decoded.Header, decoded.Claims = header, claims
+	} else {
+		log.Debug().Msg(err.Error())
+	}
+	if expiresAt := auth.Cookie.Claims.ExpiresAt; expiresAt != 0 {
+		if remaining := time.Until(time.Unix(expiresAt, 0)); remaining > 0 {
+			decoded.Expires = fmt.Sprintf("in %s", remaining.Round(time.Second))
+		} else {
+			decoded.Expires = fmt.Sprintf("%s ago", (-remaining).Round(time.Second))
+		}
+	}
+
+	encoder := json.NewEncoder(os.Stderr)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(decoded); err != nil {
+		log.Fatal().Msgf("Could not print the claims: %s", err)
+	}
+}
+
+// printableHeader returns the header of the token, which iap.authHeader must not disable
+func printableHeader(scope string, auth *iap.AuthState) string {
+	header := iap.AuthHeader(scope, auth.RawToken)
+	if header == "" {
+		log.Fatal().Msgf("iap.authHeader of %s is none, there is no header to print", scope)
+	}
+	return header
+}
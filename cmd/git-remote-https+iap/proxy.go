@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/adohkan/git-remote-https-iap/internal/iap"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var (
+	// only used in proxyCmd
+	proxyListen string
+
+	proxyCmd = &cobra.Command{
+		Use:   "proxy",
+		Short: "Run a local forward proxy adding IAP tokens to the requests of configured hosts",
+		Long: `Run a local forward proxy adding IAP tokens to the requests of configured hosts,
+so that any tool reaches them through HTTP_PROXY and HTTPS_PROXY, e.g. pip, npm or terraform,
+or the proxies of the docker daemon, for registries behind IAP.
+
+The https traffic of configured hosts is decrypted with the certificates of a local CA, created
+on first use, that these tools must trust. The traffic of other hosts is tunneled untouched.
+The proxy runs in the foreground, and logs in when a token can not be refreshed.
+
+As any user of the machine can connect to the proxy, clients must give its password, random unless
+set with GIT_IAP_PROXY_SECRET, in the proxy url: http://iap:<password>@127.0.0.1:8118.`,
+		Args: cobra.NoArgs,
+		Run:  proxy,
+	}
+)
+
+func init() {
+	proxyCmd.Flags().StringVar(&proxyListen, "listen", defaultProxyListen, "Address to listen on, which should stay local: requests get the tokens of the user")
+
+	rootCmd.AddCommand(proxyCmd)
+}
+
+// hopHeaders are the headers of a single connection, that proxies do not forward
+var hopHeaders = []string{"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Te", "Trailer", "Transfer-Encoding", "Upgrade"}
+
+const (
+	// proxySecretEnv sets the password of the local proxies, which is otherwise random for each run
+	proxySecretEnv = "GIT_IAP_PROXY_SECRET"
+
+	// defaultProxyListen is the address of the proxy command, unless --listen is set
+	defaultProxyListen = "127.0.0.1:8118"
+)
+
+// iapProxy is the forward proxy of the proxy command
+type iapProxy struct {
+	ca        *iap.ProxyCA
+	transport *http.Transport
+	// secret is the password clients give in Proxy-Authorization
+	secret string
+}
+
+// localProxySecret returns the password of a local proxy, which other users of the machine could reach
+func localProxySecret() string {
+	if secret := os.Getenv(proxySecretEnv); secret != "" {
+		return secret
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatal().Msgf("Could not generate a password: %s", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// hasSecret tells whether the Basic credentials of an Authorization or Proxy-Authorization header
+// carry secret as password, whatever the user name
+func hasSecret(header, secret string) bool {
+	r := &http.Request{Header: http.Header{"Authorization": {header}}}
+	_, password, ok := r.BasicAuth()
+	return ok && subtle.ConstantTimeCompare([]byte(password), []byte(secret)) == 1
+}
+
+func proxy(cmd *cobra.Command, args []string) {
+	ca, err := iap.LoadProxyCA()
+	if err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+	p := &iapProxy{ca: ca, transport: newProxyTransport(), secret: localProxySecret()}
+
+	listener, err := net.Listen("tcp", proxyListen)
+	if err != nil {
+		log.Fatal().Msgf("Could not listen on %s: %s", proxyListen, err)
+	}
+
+	inform(os.Stderr, "%s proxy: listening on %s, tools must trust the CA %s\n\n", binaryName, listener.Addr(), iap.ExpandHome(iap.ProxyCAFile()))
+	// the password is the result of the command, printed even with --quiet
+	proxyURL := localProxyURL(p.secret, listener.Addr().String())
+	fmt.Fprintf(os.Stderr, "  export HTTP_PROXY=%s HTTPS_PROXY=%s\n", proxyURL, proxyURL)
+	inform(os.Stderr, "  export NODE_EXTRA_CA_CERTS=%s PIP_CERT=%s\n\n", iap.ExpandHome(iap.ProxyCAFile()), iap.ExpandHome(iap.ProxyCAFile()))
+	serveUntilSignal(listener, p, "proxy")
+}
+
+// startLocalProxy serves the proxy on a random local port until the helper exits, e.g. for the tool run by exec,
+// and returns its url
+func startLocalProxy() (string, error) {
+	ca, err := iap.LoadProxyCA()
+	if err != nil {
+		return "", err
+	}
+	p := &iapProxy{ca: ca, transport: newProxyTransport(), secret: localProxySecret()}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	go http.Serve(listener, p)
+	return localProxyURL(p.secret, listener.Addr().String()), nil
+}
+
+// localProxyURL returns the url of a local proxy, with its password
+func localProxyURL(secret, addr string) string {
+	return fmt.Sprintf("http://iap:%s@%s", secret, addr)
+}
+
+// newProxyTransport returns the transport of local proxies, whose requests go straight to the hosts,
+// as HTTPS_PROXY is likely the proxy itself
+func newProxyTransport() *http.Transport {
+	return &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        100,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+}
+
+// serveUntilSignal serves handler on listener until an interrupt or SIGTERM
+func serveUntilSignal(listener net.Listener, handler http.Handler, name string) {
+	server := &http.Server{Handler: handler}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+		log.Fatal().Msg(err.Error())
+	}
+	log.Info().Msgf("%s %s: stopping", binaryName, name)
+}
+
+func (p *iapProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !hasSecret(r.Header.Get("Proxy-Authorization"), p.secret) {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="git-remote-https+iap"`)
+		http.Error(w, "The password of the proxy is missing, see its output", http.StatusProxyAuthRequired)
+		return
+	}
+	if r.Method == http.MethodConnect {
+		p.connect(w, r)
+		return
+	}
+	if !r.URL.IsAbs() {
+		http.Error(w, "This is a forward proxy, set it in HTTP_PROXY", http.StatusBadRequest)
+		return
+	}
+
+	p.forward(w, r)
+}
+
+// forward sends an absolute-form request to its host, and copies the response back to the client
+func (p *iapProxy) forward(w http.ResponseWriter, r *http.Request) {
+	resp, err := p.roundTrip(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// connect tunnels the https traffic of a host, which it decrypts to add tokens when the host is configured
+func (p *iapProxy) connect(w http.ResponseWriter, r *http.Request) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Tunnels are not supported", http.StatusInternalServerError)
+		return
+	}
+	scope, err := toAuthScope("https://" + r.Host)
+	configured := err == nil && iap.Configured(scope)
+
+	var upstream net.Conn
+	if !configured {
+		if upstream, err = net.DialTimeout("tcp", r.Host, 30*time.Second); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer upstream.Close()
+	}
+
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		log.Error().Msgf("[proxy] Could not take over the connection: %s", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		return
+	}
+
+	if !configured {
+		go io.Copy(upstream, buffered)
+		io.Copy(conn, upstream)
+		return
+	}
+
+	log.Debug().Msgf("[proxy] Decrypting the traffic of %s", r.Host)
+	hostname, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		// no port, e.g. CONNECT git.domain.acme
+		hostname = strings.Trim(r.Host, "[]")
+	}
+	tlsConn := tls.Server(&bufferedConn{Conn: conn, reader: buffered.Reader}, &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return p.ca.Certificate(hostname)
+		},
+		NextProtos: []string{"http/1.1"},
+	})
+	defer tlsConn.Close()
+
+	reader := bufio.NewReader(tlsConn)
+	for {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		req.URL.Scheme, req.URL.Host = "https", r.Host
+
+		resp, err := p.roundTrip(req)
+		if err != nil {
+			resp = &http.Response{
+				StatusCode: http.StatusBadGateway,
+				ProtoMajor: 1,
+				ProtoMinor: 1,
+				Header:     http.Header{"Content-Type": {"text/plain"}},
+				Body:       io.NopCloser(strings.NewReader(err.Error())),
+			}
+		}
+		err = resp.Write(tlsConn)
+		resp.Body.Close()
+		if err != nil || req.Close || resp.Close {
+			return
+		}
+	}
+}
+
+// roundTrip sends a request to its host, with the token of the host when it is configured.
+// Tokens are only sent over https, or over http to hosts opted in with iap.allowInsecureHTTP.
+func (p *iapProxy) roundTrip(r *http.Request) (*http.Response, error) {
+	req := r.Clone(r.Context())
+	req.RequestURI = ""
+	for _, name := range hopHeaders {
+		req.Header.Del(name)
+	}
+
+	sendToken := req.URL.Scheme == "https" || (req.URL.Scheme == "http" && iap.TransportScheme(iap.CanonicalHost(req.URL)) == "http")
+	if scope, err := toAuthScope(req.URL.String()); err == nil && sendToken && iap.Configured(scope) {
+		header, err := proxyAuthHeader(scope)
+		if err != nil {
+			return nil, err
+		}
+		if parts := strings.SplitN(header, ": ", 2); len(parts) == 2 {
+			if parts[0] == "Cookie" {
+				req.Header.Add(parts[0], parts[1])
+			} else {
+				req.Header.Set(parts[0], parts[1])
+			}
+		}
+	}
+
+	resp, err := p.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range hopHeaders {
+		resp.Header.Del(name)
+	}
+	return resp, nil
+}
+
+// proxyAuthHeader returns the header of the token of an auth scope, which it refreshes when needed.
+// Unlike handleIAPAuthCookieFor, failures are returned to the client instead of stopping the proxy.
+func proxyAuthHeader(scope string) (string, error) {
+	auth, err := iap.ReadAuthState(scope)
+	if err != nil || auth.Cookie.Expired() {
+		if auth, err = iap.NewAuth(scope, iap.AuthOptions{}); err != nil {
+			log.Error().Msgf("[proxy] Could not get a token for %s: %s", scope, err)
+			return "", fmt.Errorf("could not get a token for %s: %w", scope, err)
+		}
+	}
+	iap.RecordAudit(scope, iap.AuditUse, auth)
+	return iap.AuthHeader(scope, auth.RawToken), nil
+}
+
+// bufferedConn reads what the http server buffered before the connection was taken over
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	"github.com/adohkan/git-remote-https-iap/internal/iap"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var (
+	// only used in renewCmd
+	renewAll    bool
+	renewMargin time.Duration
+
+	renewCmd = &cobra.Command{
+		Use:   "renew [url]",
+		Short: "Silently refresh the token of a host, or of every configured host, then exit",
+		Long: `Silently refresh the token of a host, or of every configured host with --all, then exit.
+
+Tokens are only renewed from refresh tokens or machine credentials, never with an interactive login,
+so that renew suits a cron job, or a launchd agent or systemd timer run at login. Hosts whose refresh
+token is missing or revoked are reported, and need a regular 'check' to log in again.`,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if renewAll {
+				return cobra.NoArgs(cmd, args)
+			}
+			return cobra.ExactArgs(1)(cmd, args)
+		},
+		Run: renew,
+	}
+)
+
+func init() {
+	renewCmd.Flags().BoolVar(&renewAll, "all", false, "Refresh the tokens of all configured hosts")
+	renewCmd.Flags().DurationVar(&renewMargin, "margin", 15*time.Minute, "Refresh tokens expiring within this duration")
+
+	rootCmd.AddCommand(renewCmd)
+}
+
+func renew(cmd *cobra.Command, args []string) {
+	domains := iap.ConfiguredDomains()
+	if !renewAll {
+		scope, err := toAuthScope(withScheme(args[0]))
+		if err != nil {
+			log.Fatal().Msgf("Could not convert %s in https://: %s", args[0], err)
+		}
+		domains = []string{scope}
+	}
+
+	failed := 0
+	for _, domain := range domains {
+		if err := refreshInBackground(domain, renewMargin); err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		log.Fatal().Msgf("Could not refresh the tokens of %d of %d hosts, run '%s check <url>' to log in again", failed, len(domains), binaryName)
+	}
+	if renewAll {
+		inform(os.Stdout, "Tokens of %d hosts are fresh\n", len(domains))
+	}
+}
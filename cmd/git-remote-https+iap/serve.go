@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/adohkan/git-remote-https-iap/internal/iap"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var (
+	// only used in serveCmd
+	serveRefreshFile           string
+	serveInterval, serveMargin time.Duration
+
+	serveCmd = &cobra.Command{
+		Use:   "serve url --refresh-file path",
+		Short: "Keep a cookie file of the token of url fresh, e.g. as a sidecar of in-cluster jobs",
+		Long: `Keep a cookie file of the token of url fresh, e.g. as a sidecar of in-cluster jobs sharing
+a volume with git, whose http.cookieFile is the refreshed file.
+
+It runs in the foreground and never starts an interactive login: the token comes from non-interactive
+sources, such as the metadata server of Workload Identity, or a service account key.
+The file is replaced atomically, readable by the user of the sidecar only.`,
+		Args: cobra.ExactArgs(1),
+		Run:  serve,
+	}
+)
+
+func init() {
+	serveCmd.Flags().StringVar(&serveRefreshFile, "refresh-file", "", "Cookie file to keep fresh (required)")
+	serveCmd.MarkFlagRequired("refresh-file")
+	serveCmd.Flags().DurationVar(&serveInterval, "interval", time.Minute, "How often the token is checked")
+	serveCmd.Flags().DurationVar(&serveMargin, "margin", 15*time.Minute, "Refresh the token when it expires within this duration")
+
+	rootCmd.AddCommand(serveCmd)
+}
+
+func serve(cmd *cobra.Command, args []string) {
+	scope, err := toAuthScope(args[0])
+	if err != nil {
+		log.Fatal().Msgf("Could not resolve the auth scope of %s: %s", args[0], err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	log.Info().Msgf("%s serve: keeping %s fresh for %s", binaryName, serveRefreshFile, scope)
+	ticker := time.NewTicker(serveInterval)
+	defer ticker.Stop()
+
+	written := ""
+	for {
+		if refreshInBackground(scope, serveMargin) == nil {
+			if auth, err := iap.ReadAuthState(scope); err != nil {
+				log.Error().Msgf("Could not read the token of %s: %s", scope, err)
+			} else if auth.RawToken != written {
+				if err := writeRefreshFile(serveRefreshFile, auth); err != nil {
+					log.Error().Msgf("Could not write %s: %s", serveRefreshFile, err)
+				} else {
+					written = auth.RawToken
+					log.Info().Msgf("Wrote the token of %s to %s", scope, serveRefreshFile)
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Info().Msgf("%s serve: stopping", binaryName)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// writeRefreshFile replaces path with the cookie file of auth, so that git never reads a partial file
+func writeRefreshFile(path string, auth *iap.AuthState) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.WriteString(auth.Cookie.CookieJar(auth.RawToken)); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	_url "net/url"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/adohkan/git-remote-https-iap/internal/git"
+	"github.com/rs/zerolog/log"
+)
+
+// sshScheme is the scheme of remotes reached with ssh through an IAP TCP forwarding tunnel,
+// served by this binary once installed as git-remote-ssh+iap
+const sshScheme = "ssh+iap"
+
+// executeSSH serves a ssh+iap:// remote with the connect capability: git talks to git-upload-pack
+// or git-receive-pack on the instance, through ssh, whose connection goes through IAP with the tunnel command.
+// see: https://git-scm.com/docs/gitremote-helpers#_capabilities_for_pushing
+func executeSSH(remote, url string) {
+	u, err := _url.Parse(url)
+	if err != nil {
+		log.Fatal().Msgf("Could not parse %s: %s", url, err)
+	}
+
+	// git waits for each answer, no command is left in the reader when ssh takes over stdin
+	stdin := bufio.NewReader(os.Stdin)
+	for {
+		line, err := stdin.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSuffix(line, "\n")
+		log.Debug().Msgf("[executeSSH] < %s", line)
+
+		switch {
+		case line == "":
+			return
+		case line == "capabilities":
+			fmt.Print("connect\n\n")
+		case line == "connect git-upload-pack" || line == "connect git-receive-pack":
+			fmt.Println()
+			os.Exit(runSSH(u, strings.TrimPrefix(line, "connect ")))
+		default:
+			log.Fatal().Msgf("Unsupported command '%s' for %s:// remotes", line, sshScheme)
+		}
+	}
+}
+
+// runSSH runs a git service on the instance of u, connected to the standard input and output of the helper
+func runSSH(u *_url.URL, service string) int {
+	// a host, user or instance starting with a dash would be read as an option, see CVE-2017-1000117
+	if strings.HasPrefix(u.Hostname(), "-") || (u.User != nil && strings.HasPrefix(u.User.Username(), "-")) {
+		log.Error().Msgf("Refusing %s: its host or user starts with a dash", u.Redacted())
+		return 128
+	}
+	base := fmt.Sprintf("%s://%s", sshScheme, u.Host)
+	instance := git.ConfigTryGetURLMatch("iap.instance", base)
+	if instance == "" {
+		instance = u.Hostname()
+	}
+	if strings.HasPrefix(instance, "-") {
+		log.Error().Msgf("Refusing instance %s of %s: it starts with a dash", instance, u.Redacted())
+		return 128
+	}
+	project := git.ConfigGetURLMatch("iap.project", base)
+	zone := git.ConfigGetURLMatch("iap.zone", base)
+	port := u.Port()
+	if port == "" {
+		port = "22"
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		executable = binaryName
+	}
+	// ssh expands %-tokens of the ProxyCommand before handing it to the shell
+	proxy := fmt.Sprintf("%s tunnel %s %s --project=%s --zone=%s", shellQuote(executable), shellQuote(instance), port, shellQuote(project), shellQuote(zone))
+	proxy = strings.ReplaceAll(proxy, "%", "%%")
+	target := u.Hostname()
+	if u.User != nil {
+		target = fmt.Sprintf("%s@%s", u.User.Username(), target)
+	}
+	args := []string{"-o", fmt.Sprintf("ProxyCommand=%s", proxy), "--", target, fmt.Sprintf("%s %s", service, shellQuote(u.Path))}
+	log.Debug().Msgf("[runSSH] ssh %v", args)
+
+	cmd := exec.Command("ssh", args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return exitErr.ExitCode()
+		}
+		log.Error().Msgf("Could not run ssh: %s", err)
+		return 1
+	}
+	return 0
+}
+
+// shellQuote quotes s for POSIX shells, e.g. the path of a repository for the shell of the instance, as git does for ssh remotes
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/adohkan/git-remote-https-iap/internal/iap"
+	"github.com/spf13/cobra"
+)
+
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the state of the token of every configured host",
+	Long: `Show the state of the token of every configured host: whether one is cached, until when it is valid,
+the account it was issued to, where it is kept and whether a refresh token lets the helper mint a new one
+without a browser. No token is minted or refreshed.`,
+	Args: cobra.NoArgs,
+	Run:  status,
+}
+
+func init() {
+	rootCmd.AddCommand(statusCmd)
+}
+
+func status(cmd *cobra.Command, args []string) {
+	statuses := []iap.HostStatus{}
+	for _, domain := range iap.ConfiguredDomains() {
+		statuses = append(statuses, iap.GetHostStatus(domain))
+	}
+
+	if jsonOutput {
+		writeJSON(statuses)
+		return
+	}
+
+	if len(statuses) == 0 {
+		inform(os.Stderr, "No host is configured for IAP, see %s configure\n", binaryName)
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tTOKEN\tEXPIRES\tACCOUNT\tSTORE\tREFRESH TOKEN")
+	for _, s := range statuses {
+		token, expires, account := "none", "-", "-"
+		switch {
+		case s.Error != "":
+			token = "error: " + s.Error
+		case s.HasToken && s.Expired:
+			token = "expired"
+		case s.HasToken:
+			token = "valid"
+		}
+		if s.ExpiresAt != nil {
+			expires = s.ExpiresAt.Local().Format(time.RFC3339)
+		}
+		if s.Account != "" {
+			account = s.Account
+		}
+		store := s.Store
+		if s.CookieFile != "" {
+			store = fmt.Sprintf("%s (%s)", s.Store, s.CookieFile)
+		}
+		refreshToken := "no"
+		if s.RefreshToken {
+			refreshToken = "yes"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", s.Domain, token, expires, account, store, refreshToken)
+	}
+	w.Flush()
+}
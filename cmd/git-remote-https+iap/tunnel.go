@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/adohkan/git-remote-https-iap/internal/git"
+	"github.com/adohkan/git-remote-https-iap/internal/iap"
+	"github.com/adohkan/git-remote-https-iap/internal/tunnel"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+// tunnelTokenLifetime is how long access tokens are reused for the connections of a tunnel, well within their hour
+const tunnelTokenLifetime = 30 * time.Minute
+
+var (
+	// only used in tunnelCmd
+	tunnelLocal, tunnelProject, tunnelZone string
+
+	tunnelCmd = &cobra.Command{
+		Use:   "tunnel instance port",
+		Short: "Forward a TCP port of an instance through IAP, without gcloud",
+		Long: `Forward a TCP port of an instance through IAP TCP forwarding, like gcloud compute start-iap-tunnel,
+with the credentials of the helper: a browser login asking for the cloud-platform scope, service account keys,
+or application default credentials.
+
+Without --local, the connection is the standard input and output, e.g. for the ProxyCommand of ssh:
+
+  ssh -o ProxyCommand='git-remote-https+iap tunnel %h %p' git-server
+
+The project and the zone of the instance come from the flags, or from the iap.project and iap.zone git config
+of iap-tunnel://<instance>.`,
+		Args: cobra.ExactArgs(2),
+		Run:  runTunnel,
+	}
+)
+
+func init() {
+	tunnelCmd.Flags().StringVar(&tunnelLocal, "local", "", "Local port or address to listen on, e.g. 2222, instead of the standard input and output")
+	tunnelCmd.Flags().StringVar(&tunnelProject, "project", "", "Project of the instance, instead of iap.project")
+	tunnelCmd.Flags().StringVar(&tunnelZone, "zone", "", "Zone of the instance, instead of iap.zone")
+
+	rootCmd.AddCommand(tunnelCmd)
+}
+
+// tunnelDialer connects to the target of a tunnel, reusing the access token of its previous connections
+type tunnelDialer struct {
+	domain string
+	target tunnel.Target
+
+	mu          sync.Mutex
+	accessToken string
+	mintedAt    time.Time
+}
+
+func runTunnel(cmd *cobra.Command, args []string) {
+	instance := args[0]
+	port, err := strconv.Atoi(args[1])
+	if err != nil {
+		log.Fatal().Msgf("Invalid port '%s'", args[1])
+	}
+
+	domain := fmt.Sprintf("%s://%s", iap.TunnelScheme, instance)
+	project, zone := tunnelProject, tunnelZone
+	if project == "" {
+		project = git.ConfigGetURLMatch("iap.project", domain)
+	}
+	if zone == "" {
+		zone = git.ConfigGetURLMatch("iap.zone", domain)
+	}
+	d := &tunnelDialer{domain: domain, target: tunnel.Target{
+		Project:  project,
+		Zone:     zone,
+		Instance: instance,
+		Port:     port,
+		Relay:    git.ConfigTryGetURLMatch("iap.tunnelHost", domain),
+	}}
+
+	if tunnelLocal == "" {
+		conn, err := d.dial()
+		if err != nil {
+			log.Fatal().Msg(err.Error())
+		}
+		// the relay has no half-close: the instance ends the connection, e.g. once ssh exits
+		go io.Copy(conn, os.Stdin)
+		if _, err := io.Copy(os.Stdout, conn); err != nil {
+			log.Fatal().Msgf("Tunnel to %s failed: %s", d.target, err)
+		}
+		return
+	}
+
+	address := tunnelLocal
+	if _, err := strconv.Atoi(address); err == nil {
+		address = net.JoinHostPort("127.0.0.1", address)
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Fatal().Msgf("Could not listen on %s: %s", address, err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	inform(os.Stderr, "%s tunnel: forwarding %s to %s\n", binaryName, listener.Addr(), d.target)
+	for {
+		local, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Error().Msgf("[tunnel] %s", err)
+			}
+			break
+		}
+		go d.forward(local)
+	}
+	log.Info().Msgf("%s tunnel: stopping", binaryName)
+}
+
+// forward relays a local connection to the target, until either side closes
+func (d *tunnelDialer) forward(local net.Conn) {
+	defer local.Close()
+	conn, err := d.dial()
+	if err != nil {
+		log.Error().Msg(err.Error())
+		return
+	}
+	defer conn.Close()
+	log.Debug().Msgf("[tunnel] Forwarding %s to %s", local.RemoteAddr(), d.target)
+
+	go func() {
+		io.Copy(conn, local)
+		conn.Close()
+	}()
+	io.Copy(local, conn)
+}
+
+func (d *tunnelDialer) dial() (*tunnel.Conn, error) {
+	d.mu.Lock()
+	if d.accessToken == "" || time.Since(d.mintedAt) > tunnelTokenLifetime {
+		accessToken, err := iap.GetTunnelAccessToken(d.domain, iap.AuthOptions{})
+		if err != nil {
+			d.mu.Unlock()
+			return nil, err
+		}
+		d.accessToken, d.mintedAt = accessToken, time.Now()
+	}
+	accessToken := d.accessToken
+	d.mu.Unlock()
+
+	return tunnel.Dial(d.target, accessToken)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	_url "net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/adohkan/git-remote-https-iap/internal/git"
+	"github.com/adohkan/git-remote-https-iap/internal/iap"
+	"github.com/adohkan/git-remote-https-iap/internal/lfs"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var (
+	// only used in unconfigureCmd
+	unconfigureLogout bool
+
+	unconfigureCmd = &cobra.Command{
+		Use:   "unconfigure host",
+		Short: "Remove the IAP configuration of a host, undoing configure",
+		Long: `Remove the IAP configuration of a host, undoing configure: its iap.* keys, including those of its path prefixes,
+the insteadOf rewrites to the helper, its cookie files, credential helper and LFS agent configs, its cached tokens, including the extra header
+written for it, and the helper secret kept in a keyring. Other configs of the host, such as your own
+http.extraHeader, are left untouched.
+
+Refresh tokens are kept, so that configuring the host again does not need a browser, unless --logout is given.`,
+		Args: cobra.ExactArgs(1),
+		Run:  unconfigure,
+	}
+)
+
+func init() {
+	unconfigureCmd.Flags().BoolVar(&unconfigureLogout, "logout", false, "Also revoke and forget the refresh token of the host")
+	unconfigureCmd.Flags().BoolVar(&configureDryRun, "dry-run", false, "Print the git config that would be removed, without removing it")
+	unconfigureCmd.Flags().StringVar(&configureScope, "scope", git.ScopeGlobal, "Git config to remove from: \"global\", \"local\" to the current repository, or \"worktree\"")
+	rootCmd.AddCommand(unconfigureCmd)
+}
+
+func unconfigure(cmd *cobra.Command, args []string) {
+	u, err := _url.Parse(withScheme(args[0]))
+	if err != nil {
+		log.Fatal().Msgf("Could not convert %s in https://: %s", args[0], err)
+	}
+	host := iap.CanonicalHost(u)
+
+	configs, err := git.ConfigListScoped(configureScope)
+	if err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+
+	// tokens first, as their store is selected by the config about to be removed
+	if !configureDryRun {
+		forgetTokens(host)
+	}
+
+	failed := false
+	for _, config := range configs {
+		name, value := config[0], config[1]
+		if !isConfigOf(host, name, value) {
+			continue
+		}
+		if configureDryRun {
+			fmt.Printf("- %s = %s\n", name, redactConfig(name, value))
+			continue
+		}
+		inform(os.Stdout, "- %s = %s\n", name, redactConfig(name, value))
+		if err := git.UnsetConfig(name, fmt.Sprintf("^%s$", regexp.QuoteMeta(value)), configureScope); err != nil {
+			log.Error().Msg(err.Error())
+			failed = true
+		}
+	}
+	if failed {
+		log.Fatal().Msgf("Could not remove every config of %s", host)
+	}
+}
+
+// forgetTokens deletes the tokens of the auth scopes of host and its helper secret, and its refresh token with --logout
+func forgetTokens(host string) {
+	for _, domain := range iap.ConfiguredDomains() {
+		d, err := _url.Parse(domain)
+		if err != nil || !strings.EqualFold(iap.CanonicalHost(d), host) {
+			continue
+		}
+
+		root := strings.Trim(d.Path, "/") == ""
+		if root {
+			if err := iap.DeleteHelperSecret(domain); err != nil {
+				log.Warn().Msg(err.Error())
+			}
+		}
+		if unconfigureLogout && root {
+			err = iap.Logout(domain)
+		} else {
+			err = iap.DeleteCookie(domain)
+		}
+		if err != nil {
+			log.Warn().Msg(err.Error())
+		}
+	}
+}
+
+// isConfigOf tells whether a config, as listed by git, was written by configure for host. Extra headers
+// are not, as tokens are kept in iap.ExtraHeadersFile and deleted by forgetTokens.
+func isConfigOf(host, name, value string) bool {
+	first, last := strings.Index(name, "."), strings.LastIndex(name, ".")
+	if first == last {
+		return false
+	}
+	section, url, key := name[:first], name[first+1:last], name[last+1:]
+
+	switch {
+	case section == "url" && key == "insteadof":
+		// the helper's url has the helperName as scheme, the rewritten one is https
+		return hasHost(value, host) && hasHost(url, host) && !strings.HasPrefix(url, "https://")
+	case !hasHost(url, host):
+		return false
+	case section == "iap":
+		return true
+	case section == "http" && key == "cookiefile":
+		return true
+	case section == "credential" && key == "helper":
+		return strings.HasPrefix(value, "!git-remote-") && strings.HasSuffix(value, " credential")
+	case section == "lfs" && key == "standalonetransferagent":
+		return value == lfs.AgentName
+	}
+	return false
+}
+
+func hasHost(url, host string) bool {
+	u, err := _url.Parse(url)
+	return err == nil && strings.EqualFold(iap.CanonicalHost(u), host)
+}
+
+// redactConfig hides the secrets of the configs about to be removed
+func redactConfig(name, value string) string {
+	if strings.HasSuffix(name, ".helpersecret") {
+		return "<secret>"
+	}
+	return value
+}
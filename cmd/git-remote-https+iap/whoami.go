@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/adohkan/git-remote-https-iap/internal/iap"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var (
+	// only used in whoamiCmd
+	whoamiRefresh bool
+
+	whoamiCmd = &cobra.Command{
+		Use:   "whoami [url]",
+		Short: "Show the identity of the cached token of a url, or of every configured host",
+		Long: `Show the identity of the cached token of a url, or of every configured host: the email and subject
+it was issued to, its audience, and when it was issued and expires, to confirm which account reaches IAP.
+
+The cached token is only decoded, unless --refresh is given, which mints a new one when it expired.`,
+		Args: cobra.MaximumNArgs(1),
+		Run:  whoami,
+	}
+)
+
+func init() {
+	whoamiCmd.Flags().BoolVar(&whoamiRefresh, "refresh", false, "Refresh the token if needed, as check does")
+	rootCmd.AddCommand(whoamiCmd)
+}
+
+// identity is the account of the token of a url, in the --json output of whoami and check
+type identity struct {
+	URL          string     `json:"url"`
+	Email        string     `json:"email,omitempty"`
+	Subject      string     `json:"subject,omitempty"`
+	HostedDomain string     `json:"hostedDomain,omitempty"`
+	Audience     []string   `json:"audience,omitempty"`
+	Issuer       string     `json:"issuer,omitempty"`
+	IssuedAt     *time.Time `json:"issuedAt,omitempty"`
+	ExpiresAt    *time.Time `json:"expiresAt,omitempty"`
+	Error        string     `json:"error,omitempty"`
+}
+
+func newIdentity(url string, auth *iap.AuthState) identity {
+	claims := auth.Cookie.Claims
+	id := identity{
+		URL:          url,
+		Email:        claims.Email,
+		Subject:      claims.Subject,
+		HostedDomain: claims.HostedDomain,
+		Audience:     claims.Audience,
+		Issuer:       claims.Issuer,
+	}
+	if claims.IssuedAt != 0 {
+		issuedAt := time.Unix(claims.IssuedAt, 0).UTC()
+		id.IssuedAt = &issuedAt
+	}
+	if claims.ExpiresAt != 0 {
+		expiresAt := time.Unix(claims.ExpiresAt, 0).UTC()
+		id.ExpiresAt = &expiresAt
+	}
+	return id
+}
+
+func whoami(cmd *cobra.Command, args []string) {
+	domains := iap.ConfiguredDomains()
+	if len(args) == 1 {
+		scope, err := toAuthScope(withScheme(args[0]))
+		if err != nil {
+			log.Fatal().Msgf("Could not convert %s in https://: %s", args[0], err)
+		}
+		domains = []string{scope}
+	}
+	if len(domains) == 0 {
+		log.Fatal().Msgf("No host is configured for IAP, see %s configure", binaryName)
+	}
+
+	failed := false
+	identities := []identity{}
+	for _, domain := range domains {
+		if whoamiRefresh {
+			identities = append(identities, newIdentity(domain, handleIAPAuthCookieFor(domain, iap.AuthOptions{})))
+		} else if auth, err := iap.ReadAuthState(domain); err != nil {
+			identities = append(identities, identity{URL: domain, Error: err.Error()})
+			failed = true
+		} else {
+			identities = append(identities, newIdentity(domain, auth))
+		}
+	}
+
+	if jsonOutput {
+		writeJSON(identities)
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for i, id := range identities {
+			if i > 0 {
+				fmt.Fprintln(w)
+			}
+			printIdentity(w, id)
+		}
+		w.Flush()
+	}
+	if failed && len(args) == 1 {
+		os.Exit(1)
+	}
+}
+
+// printIdentity prints the claims of a token identifying its account
+func printIdentity(w *tabwriter.Writer, id identity) {
+	fmt.Fprintln(w, id.URL)
+	if id.Error != "" {
+		fmt.Fprintf(w, "  no token\t%s\n", id.Error)
+		return
+	}
+	fmt.Fprintf(w, "  email\t%s\n", orDash(id.Email))
+	fmt.Fprintf(w, "  subject\t%s\n", orDash(id.Subject))
+	if id.HostedDomain != "" {
+		fmt.Fprintf(w, "  hosted domain\t%s\n", id.HostedDomain)
+	}
+	fmt.Fprintf(w, "  audience\t%s\n", orDash(strings.Join(id.Audience, ",")))
+	fmt.Fprintf(w, "  issuer\t%s\n", orDash(id.Issuer))
+	if id.IssuedAt != nil {
+		fmt.Fprintf(w, "  issued\t%s (%s ago)\n", id.IssuedAt.Local().Format(time.RFC3339), time.Since(*id.IssuedAt).Round(time.Second))
+	}
+	if id.ExpiresAt != nil {
+		if remaining := time.Until(*id.ExpiresAt); remaining > 0 {
+			fmt.Fprintf(w, "  expires\t%s (in %s)\n", id.ExpiresAt.Local().Format(time.RFC3339), remaining.Round(time.Second))
+		} else {
+			fmt.Fprintf(w, "  expires\t%s (expired)\n", id.ExpiresAt.Local().Format(time.RFC3339))
+		}
+	}
+}
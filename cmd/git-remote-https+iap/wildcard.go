@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	_url "net/url"
+	"path"
+	"strings"
+
+	"github.com/adohkan/git-remote-https-iap/internal/git"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var (
+	// only used in expandWildcardCmd
+	wildcardHosts    []string
+	wildcardDiscover bool
+
+	expandWildcardCmd = &cobra.Command{
+		Use:   "expand-wildcard [repository...]",
+		Short: "Write the insteadOf config of the subdomains of a wildcard host",
+		Long: `Write the insteadOf config of the subdomains of a wildcard host, configured with 'configure --repoURL https://*.domain.acme'.
+
+Subdomains are given with --hosts, or discovered with --discover from the remotes of the given repositories,
+by default of the current repository.`,
+		Run: expandWildcard,
+	}
+)
+
+func init() {
+	expandWildcardCmd.Flags().StringVar(&repoURL, "repoURL", "", "URL with the wildcard host, as given to configure (required)")
+	expandWildcardCmd.MarkFlagRequired("repoURL")
+	expandWildcardCmd.Flags().StringSliceVar(&wildcardHosts, "hosts", nil, "Comma-separated subdomains of the wildcard host")
+	expandWildcardCmd.Flags().BoolVar(&wildcardDiscover, "discover", false, "Configure the hosts of remotes matching the wildcard host")
+	expandWildcardCmd.Flags().StringVar(&helperName, "helperName", "https+iap", "Name of the gitremote-helper, as given to configure")
+	expandWildcardCmd.Flags().StringVar(&configureScope, "scope", git.ScopeGlobal, "Git config written to: \"global\", \"local\" to the current repository, or \"worktree\"")
+	configureCmd.AddCommand(expandWildcardCmd)
+}
+
+func expandWildcard(cmd *cobra.Command, args []string) {
+	repo, err := _url.Parse(repoURL)
+	if err != nil || !strings.Contains(repo.Host, "*") {
+		log.Fatal().Msgf("--repoURL %s has no wildcard host", repoURL)
+	}
+
+	hosts := wildcardHosts
+	if wildcardDiscover {
+		hosts = append(hosts, discoverHosts(repo.Host, args)...)
+	}
+	if len(hosts) == 0 {
+		log.Fatal().Msg("No host to configure, use --hosts or --discover")
+	}
+
+	seen := map[string]bool{}
+	for _, host := range hosts {
+		if seen[host] {
+			continue
+		}
+		seen[host] = true
+		if match, _ := path.Match(repo.Host, host); !match {
+			log.Warn().Msgf("Skipping %s, which does not match %s", host, repo.Host)
+			continue
+		}
+		log.Info().Msgf("Configure insteadOf for %s", host)
+		configureInsteadOf(fmt.Sprintf("https://%s", host), host)
+	}
+}
+
+// discoverHosts returns the hosts of https:// remotes of repositories matching pattern
+func discoverHosts(pattern string, repositories []string) []string {
+	if len(repositories) == 0 {
+		repositories = []string{""}
+	}
+
+	var hosts []string
+	for _, repository := range repositories {
+		urls, err := git.RemoteURLs(repository)
+		if err != nil {
+			log.Warn().Msg(err.Error())
+			continue
+		}
+		for _, url := range urls {
+			u, err := _url.Parse(url)
+			if err != nil || u.Scheme != "https" {
+				continue
+			}
+			if match, _ := path.Match(pattern, u.Host); match {
+				log.Debug().Msgf("Discovered %s from %s", u.Host, url)
+				hosts = append(hosts, u.Host)
+			}
+		}
+	}
+	return hosts
+}
@@ -0,0 +1,140 @@
+package git
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultsFile is a YAML file whose keys apply when git config does not set them,
+// e.g. the defaults of the helper kept out of the user's ~/.gitconfig. Its top-level keys are
+// the sections of git config, holding keys, or urls mapped to the keys of their subsection:
+//
+//	iap:
+//	  authFlow: device
+//	  https://git.domain.acme:
+//	    refreshMargin: 20m
+var DefaultsFile string
+
+var (
+	defaultsOnce   sync.Once
+	defaultsConfig string
+	defaultsErr    error
+
+	configNameRegexp = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9-]*$`)
+)
+
+// readDefaults runs 'git config' with args against DefaultsFile, and tells whether the key was found
+func readDefaults(args ...string) (string, bool, error) {
+	config, err := loadDefaults()
+	if err != nil || config == "" {
+		return "", false, err
+	}
+	return runConfig(strings.NewReader(config), append([]string{"--file", "-"}, args...)...)
+}
+
+// loadDefaults reads DefaultsFile once, and returns it in the syntax of git config
+func loadDefaults() (string, error) {
+	defaultsOnce.Do(func() {
+		if DefaultsFile == "" {
+			return
+		}
+		data, err := os.ReadFile(DefaultsFile)
+		if os.IsNotExist(err) {
+			return
+		}
+		if err == nil {
+			defaultsConfig, err = defaultsToConfig(data)
+		}
+		if err != nil {
+			defaultsErr = fmt.Errorf("could not read %s: %w", DefaultsFile, err)
+		}
+	})
+	return defaultsConfig, defaultsErr
+}
+
+// defaultsToConfig turns the YAML of DefaultsFile into the syntax of git config
+func defaultsToConfig(data []byte) (string, error) {
+	var sections map[string]interface{}
+	if err := yaml.Unmarshal(data, &sections); err != nil {
+		return "", err
+	}
+
+	var config strings.Builder
+	for _, section := range sortedKeys(sections) {
+		if !configNameRegexp.MatchString(section) {
+			return "", fmt.Errorf("invalid section '%s'", section)
+		}
+		if sections[section] == nil {
+			continue
+		}
+		keys, ok := sections[section].(map[string]interface{})
+		if !ok {
+			return "", fmt.Errorf("invalid section '%s', a mapping of keys is expected", section)
+		}
+		var subsections []string
+		fmt.Fprintf(&config, "[%s]\n", section)
+		for _, key := range sortedKeys(keys) {
+			if _, ok := keys[key].(map[string]interface{}); ok {
+				subsections = append(subsections, key)
+				continue
+			}
+			if err := writeConfigValues(&config, section, key, keys[key]); err != nil {
+				return "", err
+			}
+		}
+		for _, url := range subsections {
+			fmt.Fprintf(&config, "[%s %s]\n", section, quoteConfigValue(url))
+			values := keys[url].(map[string]interface{})
+			for _, key := range sortedKeys(values) {
+				if err := writeConfigValues(&config, section+"."+url, key, values[key]); err != nil {
+					return "", err
+				}
+			}
+		}
+	}
+	return config.String(), nil
+}
+
+// writeConfigValues writes the value of a key, or every value of a multi-valued key such as http.extraHeader
+func writeConfigValues(config *strings.Builder, prefix, key string, value interface{}) error {
+	if !configNameRegexp.MatchString(key) {
+		return fmt.Errorf("invalid key '%s.%s'", prefix, key)
+	}
+	values, ok := value.([]interface{})
+	if !ok {
+		values = []interface{}{value}
+	}
+	for _, v := range values {
+		switch v.(type) {
+		case map[string]interface{}, []interface{}:
+			return fmt.Errorf("invalid value of '%s.%s', a scalar or a list of scalars is expected", prefix, key)
+		case nil:
+			v = ""
+		}
+		fmt.Fprintf(config, "\t%s = %s\n", key, quoteConfigValue(fmt.Sprint(v)))
+	}
+	return nil
+}
+
+// quoteConfigValue quotes a value, or the name of a subsection, for git config
+func quoteConfigValue(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+	value = strings.ReplaceAll(value, "\n", `\n`)
+	return `"` + value + `"`
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -2,11 +2,14 @@ package git
 
 import (
 	"bytes"
+	"encoding/base64"
 	"fmt"
+	"io"
 	_url "net/url"
 	"os"
 	"os/exec"
 	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/rs/zerolog/log"
@@ -15,8 +18,44 @@ import (
 const (
 	// GitBinary defines the name of the git client's binary on the system
 	GitBinary = "git"
+
+	// ScopeGlobal writes config to the user's ~/.gitconfig, or to GIT_CONFIG_GLOBAL
+	ScopeGlobal = "global"
+	// ScopeLocal writes config to the .git/config of the current repository
+	ScopeLocal = "local"
+	// ScopeWorktree writes config to the current worktree, which requires extensions.worktreeConfig
+	ScopeWorktree = "worktree"
+)
+
+// GlobalConfigEnv and SystemConfigEnv override the files of the global and system git config,
+// e.g. in sandboxed environments
+const (
+	GlobalConfigEnv = "GIT_CONFIG_GLOBAL"
+	SystemConfigEnv = "GIT_CONFIG_SYSTEM"
 )
 
+// scopeFlag returns the option of git config selecting scope. When GIT_CONFIG_GLOBAL is set, the global
+// config is selected by its file, so that git versions older than 2.32, which ignore it, write the same file.
+func scopeFlag(scope string) string {
+	if path := os.Getenv(GlobalConfigEnv); scope == ScopeGlobal && path != "" {
+		return fmt.Sprintf("--file=%s", path)
+	}
+	return fmt.Sprintf("--%s", scope)
+}
+
+// GlobalConfigFile returns the file of the global git config, for messages
+func GlobalConfigFile() string {
+	if path := os.Getenv(GlobalConfigEnv); path != "" {
+		return path
+	}
+	return "~/.gitconfig"
+}
+
+// ScopeFile is the scope writing config to a file of its own, e.g. one included by the user's ~/.gitconfig
+func ScopeFile(path string) string {
+	return fmt.Sprintf("file=%s", path)
+}
+
 type GitConfig struct {
 	Url     string
 	Section string
@@ -29,33 +68,133 @@ func (c *GitConfig) Name() string {
 }
 
 func (c *GitConfig) ArgsGlobal() []string {
-	return []string{"config", "--global", c.Name(), c.Value}
+	return c.Args(ScopeGlobal)
+}
+
+// Args returns the arguments of git setting the config in scope, ScopeGlobal, ScopeLocal, ScopeWorktree or a ScopeFile
+func (c *GitConfig) Args(scope string) []string {
+	return []string{"config", scopeFlag(scope), c.Name(), c.Value}
 }
 
 func (c *GitConfig) CommandSuggestGlobal() string {
-	return fmt.Sprintf("git %s", strings.Join(c.ArgsGlobal(), " "))
+	return c.CommandSuggest(ScopeGlobal)
+}
+
+func (c *GitConfig) CommandSuggest(scope string) string {
+	return fmt.Sprintf("git %s", strings.Join(c.Args(scope), " "))
 }
 
 // ConfigGetURLMatch call 'git config --get-urlmatch' underneath
 func ConfigGetURLMatch(key, url string) string {
+	value, found, err := getURLMatch(key, url)
+	if err == nil && !found {
+		err = fmt.Errorf("not set")
+	}
+	if err != nil {
+		log.Fatal().Msgf("ConfigGetURLMatch - could not read config '%s' for '%s' (%s)", key, url, err)
+	}
+	return value
+}
+
+// ConfigTryGetURLMatch behaves like ConfigGetURLMatch, but returns an empty string
+// instead of exiting when the key is not set for the given url.
+func ConfigTryGetURLMatch(key, url string) string {
+	value, _, err := getURLMatch(key, url)
+	if err != nil {
+		log.Fatal().Msgf("ConfigTryGetURLMatch - could not read config '%s' for '%s' (%s)", key, url, err)
+	}
+	return value
+}
+
+// ConfigTryGet returns the value of a config name, such as "http.https://acme.com.cookieFile",
+// or an empty string when it is not set
+func ConfigTryGet(name string) string {
+	value, found, err := readConfig("--get", name)
+	if err == nil && !found {
+		value, _, err = readDefaults("--get", name)
+	}
+	if err != nil {
+		log.Fatal().Msgf("ConfigTryGet - could not read config '%s' (%s)", name, err)
+	}
+	return value
+}
+
+// getURLMatch reads the value of key for url in git config, then in DefaultsFile, and tells whether it is set
+func getURLMatch(key, url string) (string, bool, error) {
+	value, found, err := readConfig("--get-urlmatch", key, url)
+	if err == nil && !found {
+		return readDefaults("--get-urlmatch", key, url)
+	}
+	return value, found, err
+}
+
+// readConfig runs 'git config' with args, and tells whether the key was found
+func readConfig(args ...string) (string, bool, error) {
+	return runConfig(nil, args...)
+}
+
+// runConfig runs 'git config' with args and stdin, e.g. the config read with '--file -', and tells whether the key was found
+func runConfig(stdin io.Reader, args ...string) (string, bool, error) {
 	var stdout bytes.Buffer
 
-	args := []string{"config", "--get-urlmatch", key, url}
-	cmd := exec.Command(GitBinary, args...)
+	cmd := exec.Command(GitBinary, append([]string{"config"}, args...)...)
+	cmd.Stdin = stdin
 	cmd.Stdout = &stdout
 
 	if err := cmd.Run(); err != nil {
-		log.Fatal().Msgf("ConfigGetURLMatch - could not read config '%s' for '%s' (%s)", key, url, err)
+		// git exits with 1 when the key is not found
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+			return "", false, nil
+		}
+		return "", false, err
 	}
+	return strings.TrimSpace(stdout.String()), true, nil
+}
+
+// ConfigURLsWithKey lists the urls for which '<section>.<url>.<key>' is set in git config, or in DefaultsFile.
+func ConfigURLsWithKey(section, key string) []string {
+	// git matches the regexp against names with lowercased section and key
+	pattern := fmt.Sprintf("^%s\\..+\\.%s$", regexp.QuoteMeta(strings.ToLower(section)), regexp.QuoteMeta(strings.ToLower(key)))
 
-	return strings.TrimSpace(string(stdout.Bytes()))
+	names, _, err := readConfig("--name-only", "--get-regexp", pattern)
+	if err != nil {
+		log.Fatal().Msgf("ConfigURLsWithKey - could not list config '%s' (%s)", pattern, err)
+	}
+	defaults, _, err := readDefaults("--name-only", "--get-regexp", pattern)
+	if err != nil {
+		log.Fatal().Msgf("ConfigURLsWithKey - could not list config '%s' (%s)", pattern, err)
+	}
+
+	var urls []string
+	seen := map[string]bool{}
+	for _, name := range strings.Split(names+"\n"+defaults, "\n") {
+		// section and key are lowercased by git, the url keeps its case
+		if len(name) <= len(section)+len(key)+2 {
+			continue
+		}
+		url := name[len(section)+1 : len(name)-len(key)-1]
+		if !seen[url] {
+			seen[url] = true
+			urls = append(urls, url)
+		}
+	}
+	return urls
 }
 
 // SetConfigGlobal is a new signature for SetGlobalConfig
 func SetConfigGlobal(config *GitConfig) {
-	cmd := exec.Command(GitBinary, config.ArgsGlobal()...)
+	SetConfig(config, ScopeGlobal)
+}
+
+// SetConfig sets config in scope, ScopeGlobal, ScopeLocal, ScopeWorktree or a ScopeFile.
+// The application exits in case of error.
+func SetConfig(config *GitConfig, scope string) {
+	var stderr bytes.Buffer
+
+	cmd := exec.Command(GitBinary, config.Args(scope)...)
+	cmd.Stderr = &stderr
 	if err := cmd.Run(); err != nil {
-		log.Fatal().Msgf("SetGlobalConfig - could not set config '%s': %s", config.Name(), err)
+		log.Fatal().Msgf("SetConfig - could not set %s config '%s': %s (%s)", scope, config.Name(), err, strings.TrimSpace(stderr.String()))
 	}
 }
 
@@ -72,15 +211,10 @@ func SetGlobalConfig(url, section, key, value string) {
 
 // PassThruRemoteHTTPSHelper exec the git-remote-https helper,
 // which allows the caller to transparently pass-thru it.
-func PassThruRemoteHTTPSHelper(remote, url string, token string) {
-	u, err := _url.Parse(url)
-	if err != nil {
-		log.Fatal().Msgf("passThruRemoteHTTPSHelper - could not parse %s: %s", url, err.Error())
-	}
-	u.Scheme = "https"
-	extraHeader := fmt.Sprintf("http.extraHeader=Proxy-Authorization: Bearer %s", token)
-
-	args := []string{"git", "-c", extraHeader, "remote-https", remote, u.String()}
+// headers, such as "Proxy-Authorization: Bearer <token>", are added to every request, unless empty.
+// It returns the exit code of the helper.
+func PassThruRemoteHTTPSHelper(remote, url string, headers ...string) int {
+	args := remoteHTTPSArgs(remote, url)
 	log.Debug().Msgf("passThruRemoteHTTPSHelper exec: %v", args)
 
 	binary, err := exec.LookPath(GitBinary)
@@ -88,7 +222,7 @@ func PassThruRemoteHTTPSHelper(remote, url string, token string) {
 		log.Fatal().Msgf("passThruRemoteHTTPSHelper - %s", err.Error())
 	}
 
-	procAttr := &os.ProcAttr{Env: os.Environ(), Files: []*os.File{os.Stdin, os.Stdout, os.Stderr}}
+	procAttr := &os.ProcAttr{Env: extraHeadersEnv(os.Environ(), headers), Files: []*os.File{os.Stdin, os.Stdout, os.Stderr}}
 	process, err := os.StartProcess(binary, args, procAttr)
 	if err != nil {
 		log.Fatal().Msgf("passThruRemoteHTTPSHelper: failed starting remote-https - %s", err.Error())
@@ -99,17 +233,62 @@ func PassThruRemoteHTTPSHelper(remote, url string, token string) {
 		log.Fatal().Msgf("passThruRemoteHTTPSHelper: failed waiting on remote-https - %s", err.Error())
 	}
 
-	if !processState.Success() {
-		os.Exit(processState.ExitCode())
+	return processState.ExitCode()
+}
+
+// remoteHTTPSArgs returns the command line of git-remote-https
+func remoteHTTPSArgs(remote, url string) []string {
+	u, err := _url.Parse(url)
+	if err != nil {
+		log.Fatal().Msgf("remoteHTTPSArgs - could not parse %s: %s", url, err.Error())
 	}
+	// plain http is kept for hosts opted into it with iap.allowInsecureHTTP
+	if u.Scheme != "http" {
+		u.Scheme = "https"
+	}
+	return []string{"git", "remote-https", remote, u.String()}
+}
+
+// extraHeadersEnv returns env with headers added as http.extraHeader, through the GIT_CONFIG_COUNT
+// variables rather than -c arguments, so that tokens and passwords stay out of the process list.
+// The entries env already has, such as those of git -c, are kept.
+func extraHeadersEnv(env []string, headers []string) []string {
+	count := 0
+	var kept []string
+	for _, variable := range env {
+		if value := strings.TrimPrefix(variable, "GIT_CONFIG_COUNT="); value != variable {
+			count, _ = strconv.Atoi(value)
+			continue
+		}
+		kept = append(kept, variable)
+	}
+	env = kept
+	for _, header := range headers {
+		if header != "" {
+			env = append(env,
+				fmt.Sprintf("GIT_CONFIG_KEY_%d=http.extraHeader", count),
+				fmt.Sprintf("GIT_CONFIG_VALUE_%d=%s", count, header))
+			count++
+		}
+	}
+	return append(env, fmt.Sprintf("GIT_CONFIG_COUNT=%d", count))
+}
+
+// credentialStoreArgs returns the arguments of a git-credential-store operation,
+// on file, or on ~/.git-credentials when file is empty
+func credentialStoreArgs(file, operation string) []string {
+	if file == "" {
+		return []string{"credential-store", operation}
+	}
+	return []string{"credential-store", "--file", file, operation}
 }
 
 // StoreCredentials persists credentials on disk, using the built-in
 // git-credential-store helper.
-func StoreCredentials(protocol, host, username, password string) error {
+func StoreCredentials(file, protocol, host, username, password string) error {
 	var stdin bytes.Buffer
 
-	cmd := exec.Command(GitBinary, "credential-store", "store")
+	cmd := exec.Command(GitBinary, credentialStoreArgs(file, "store")...)
 	// see: https://git-scm.com/docs/git-credential
 	params := fmt.Sprintf("protocol=%s\nhost=%s\nusername=%s\npassword=%s\n", protocol, host, username, password)
 	if _, err := stdin.Write([]byte(params)); err != nil {
@@ -124,10 +303,10 @@ func StoreCredentials(protocol, host, username, password string) error {
 }
 
 // GetCredentials retrieves credentials from the built-in git-credential-store helper.
-func GetCredentials(protocol, host, username string) (string, error) {
+func GetCredentials(file, protocol, host, username string) (string, error) {
 	var stdin, stdout bytes.Buffer
 
-	cmd := exec.Command(GitBinary, "credential-store", "get")
+	cmd := exec.Command(GitBinary, credentialStoreArgs(file, "get")...)
 	// see: https://git-scm.com/docs/git-credential
 	params := fmt.Sprintf("protocol=%s\nhost=%s\nusername=%s\n", protocol, host, username)
 	stdin.Write([]byte(params))
@@ -146,12 +325,290 @@ func GetCredentials(protocol, host, username string) (string, error) {
 	return "", fmt.Errorf("[GetCredentials] Not found for protocol=%s,host=%s,username=%s", protocol, host, username)
 }
 
+// EraseCredentials removes credentials from the built-in git-credential-store helper.
+func EraseCredentials(file, protocol, host, username string) error {
+	var stdin bytes.Buffer
+
+	cmd := exec.Command(GitBinary, credentialStoreArgs(file, "erase")...)
+	// see: https://git-scm.com/docs/git-credential
+	params := fmt.Sprintf("protocol=%s\nhost=%s\nusername=%s\n", protocol, host, username)
+	stdin.Write([]byte(params))
+	cmd.Stdin = &stdin
+	res := cmd.Run()
+	if res == nil {
+		log.Debug().Msgf("EraseCredentials - credentials erased for protocol=%s,host=%s,username=%s", protocol, host, username)
+	}
+	return res
+}
+
 // InstallProtocol configure Git to allow a given protocol on the system.
 func InstallProtocol(protocol string) {
 	protocol = fmt.Sprintf("protocol.%s.allow", protocol)
-	args := []string{"config", "--global", protocol, "always"}
+	args := []string{"config", scopeFlag(ScopeGlobal), protocol, "always"}
 	cmd := exec.Command(GitBinary, args...)
 	if err := cmd.Run(); err != nil {
 		log.Fatal().Msgf("InstallProtocol - %s", err)
 	}
 }
+
+// BasicAuthHeader returns the Authorization header of basic credentials, or an empty string without them
+func BasicAuthHeader(username, password string) string {
+	if username == "" {
+		return ""
+	}
+	return "Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
+
+// FillCredentials asks the configured credential helpers, or the user, for the username
+// and password of an url, with 'git credential fill'
+func FillCredentials(url string) (string, string, error) {
+	return fillCredentials(url, "credential", "fill")
+}
+
+// FillCredentialsWithHelper asks a single credential helper, such as "store --file ~/.backend-credentials",
+// for the username and password of an url, instead of the configured ones
+func FillCredentialsWithHelper(url, helper string) (string, string, error) {
+	// the empty value resets the list of helpers
+	return fillCredentials(url, "-c", "credential.helper=", "-c", fmt.Sprintf("credential.helper=%s", helper), "credential", "fill")
+}
+
+func fillCredentials(url string, args ...string) (string, string, error) {
+	var stdin, stdout bytes.Buffer
+
+	u, err := _url.Parse(url)
+	if err != nil {
+		return "", "", err
+	}
+	cmd := exec.Command(GitBinary, args...)
+	params := fmt.Sprintf("protocol=%s\nhost=%s\npath=%s\n", u.Scheme, u.Host, strings.TrimPrefix(u.Path, "/"))
+	stdin.Write([]byte(params))
+	cmd.Stdin = &stdin
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", "", fmt.Errorf("[FillCredentials] No credentials for %s: %w", u.Host, err)
+	}
+
+	var username, password string
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		if strings.HasPrefix(line, "username=") {
+			username = strings.TrimPrefix(line, "username=")
+		}
+		if strings.HasPrefix(line, "password=") {
+			password = strings.TrimPrefix(line, "password=")
+		}
+	}
+	return username, password, nil
+}
+
+// ConfigTryGetAll returns the values of a multi-valued config name, such as "http.https://acme.com.extraHeader"
+func ConfigTryGetAll(name string) []string {
+	var stdout bytes.Buffer
+
+	cmd := exec.Command(GitBinary, "config", scopeFlag(ScopeGlobal), "--get-all", name)
+	cmd.Stdout = &stdout
+
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+			return nil
+		}
+		log.Fatal().Msgf("ConfigTryGetAll - could not read config '%s' (%s)", name, err)
+	}
+
+	return strings.Split(strings.TrimSpace(stdout.String()), "\n")
+}
+
+// ReplaceGlobalConfig sets a value of a multi-valued global config name, in place of the values
+// matching valueRegex, leaving the others untouched
+func ReplaceGlobalConfig(name, value, valueRegex string) error {
+	cmd := exec.Command(GitBinary, "config", scopeFlag(ScopeGlobal), "--replace-all", name, value, valueRegex)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ReplaceGlobalConfig - could not set config '%s': %w", name, err)
+	}
+	return nil
+}
+
+// RenameGlobalSection renames a section of the global config, e.g. "iap.https://acme.com:443",
+// keeping the case of its keys
+func RenameGlobalSection(name, newName string) error {
+	var stderr bytes.Buffer
+
+	cmd := exec.Command(GitBinary, "config", scopeFlag(ScopeGlobal), "--rename-section", name, newName)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("RenameGlobalSection - could not rename '%s': %w (%s)", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// UnsetGlobalConfig removes the values of a global config name matching valueRegex
+func UnsetGlobalConfig(name, valueRegex string) error {
+	return UnsetConfig(name, valueRegex, ScopeGlobal)
+}
+
+// UnsetConfig removes the values of a config name in scope matching valueRegex
+func UnsetConfig(name, valueRegex, scope string) error {
+	cmd := exec.Command(GitBinary, "config", scopeFlag(scope), "--unset-all", name, valueRegex)
+	if err := cmd.Run(); err != nil {
+		// git exits with 5 when nothing matches
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 5 {
+			return nil
+		}
+		return fmt.Errorf("UnsetConfig - could not unset %s config '%s': %w", scope, name, err)
+	}
+	return nil
+}
+
+// ConfigListScoped returns the name and value of every config in scope, ScopeGlobal, ScopeLocal or ScopeWorktree.
+// Sections and keys of names are lowercased by git.
+func ConfigListScoped(scope string) ([][2]string, error) {
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.Command(GitBinary, "config", scopeFlag(scope), "--list", "-z")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		// a missing config file is an empty config
+		if strings.Contains(stderr.String(), "No such file or directory") {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("ConfigListScoped - could not list %s config: %w (%s)", scope, err, strings.TrimSpace(stderr.String()))
+	}
+
+	var configs [][2]string
+	// with -z, names end with a newline and values with a NUL
+	for _, entry := range strings.Split(stdout.String(), "\x00") {
+		if parts := strings.SplitN(entry, "\n", 2); len(parts) == 2 {
+			configs = append(configs, [2]string{parts[0], parts[1]})
+		}
+	}
+	return configs, nil
+}
+
+// RemoteURLs lists the urls of the remotes of the repository in dir, or of the current repository
+// when dir is empty
+func RemoteURLs(dir string) ([]string, error) {
+	var stdout bytes.Buffer
+
+	args := []string{"config", "--get-regexp", `^remote\..*\.url$`}
+	if dir != "" {
+		args = append([]string{"-C", dir}, args...)
+	}
+	cmd := exec.Command(GitBinary, args...)
+	cmd.Stdout = &stdout
+
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("RemoteURLs - could not list remotes of '%s': %w", dir, err)
+	}
+
+	var urls []string
+	for _, line := range strings.Split(strings.TrimSpace(stdout.String()), "\n") {
+		if parts := strings.SplitN(line, " ", 2); len(parts) == 2 {
+			urls = append(urls, parts[1])
+		}
+	}
+	return urls, nil
+}
+
+// RemoteURL returns the url of a remote of the current repository, rewritten by the insteadOf rules
+// as git fetches it
+func RemoteURL(name string) (string, error) {
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.Command(GitBinary, "remote", "get-url", name)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("RemoteURL - could not get the url of remote '%s': %w (%s)", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// ConfigGetAllScoped returns the values of a config name in scope, ScopeGlobal, ScopeLocal or ScopeWorktree
+func ConfigGetAllScoped(name, scope string) ([]string, error) {
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.Command(GitBinary, "config", scopeFlag(scope), "--get-all", name)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("ConfigGetAllScoped - could not read %s config '%s': %w (%s)", scope, name, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return strings.Split(strings.TrimSpace(stdout.String()), "\n"), nil
+}
+
+// ConfigOrigin returns the scope of the file setting a config name, as a ScopeFile, or "" when it is
+// not set or set outside of a file, e.g. with "git -c"
+func ConfigOrigin(name string) (string, error) {
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.Command(GitBinary, "config", "--show-origin", "--get", name)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+			return "", nil
+		}
+		return "", fmt.Errorf("ConfigOrigin - could not read config '%s': %w (%s)", name, err, strings.TrimSpace(stderr.String()))
+	}
+
+	// the origin is followed by a tab, e.g. "file:/home/me/.gitconfig\tvalue", and quoted when it has special characters
+	origin := strings.SplitN(stdout.String(), "\t", 2)[0]
+	if !strings.HasPrefix(origin, "file:") {
+		return "", nil
+	}
+	path := strings.TrimPrefix(origin, "file:")
+	if strings.HasPrefix(path, `"`) {
+		unquoted, err := strconv.Unquote(path)
+		if err != nil {
+			return "", fmt.Errorf("ConfigOrigin - could not read the origin of config '%s': %w", name, err)
+		}
+		path = unquoted
+	}
+	return ScopeFile(path), nil
+}
+
+// ConfigGetRegexp returns the name and value of the configs whose name matches pattern, in every scope
+func ConfigGetRegexp(pattern string) [][2]string {
+	var stdout bytes.Buffer
+
+	cmd := exec.Command(GitBinary, "config", "--get-regexp", pattern)
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+			return nil
+		}
+		log.Fatal().Msgf("ConfigGetRegexp - could not list config '%s' (%s)", pattern, err)
+	}
+
+	var configs [][2]string
+	for _, line := range strings.Split(strings.TrimSpace(stdout.String()), "\n") {
+		if parts := strings.SplitN(line, " ", 2); len(parts) == 2 {
+			configs = append(configs, [2]string{parts[0], parts[1]})
+		}
+	}
+	return configs
+}
+
+// VersionAtLeast tells whether the git client is at least of version major.minor
+func VersionAtLeast(major, minor int) bool {
+	out, err := exec.Command(GitBinary, "version").Output()
+	if err != nil {
+		return false
+	}
+
+	// e.g. "git version 2.39.5" or "git version 2.37.1 (Apple Git-137.1)"
+	var maj, min int
+	if _, err := fmt.Sscanf(string(out), "git version %d.%d", &maj, &min); err != nil {
+		return false
+	}
+	return maj > major || (maj == major && min >= minor)
+}
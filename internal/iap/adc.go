@@ -0,0 +1,73 @@
+package iap
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	authorizedUserType = "authorized_user"
+
+	adcFileName = "application_default_credentials.json"
+)
+
+// authorizedUserCredentials holds the fields of the file written by 'gcloud auth application-default login'
+type authorizedUserCredentials struct {
+	Type         string `json:"type"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// wellKnownADCFile returns the path where gcloud stores Application Default Credentials.
+// see: https://cloud.google.com/docs/authentication/application-default-credentials#personal
+func wellKnownADCFile() string {
+	if dir := os.Getenv("CLOUDSDK_CONFIG"); dir != "" {
+		return filepath.Join(dir, adcFileName)
+	}
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("APPDATA"), "gcloud", adcFileName)
+	}
+	return filepath.Join(os.Getenv("HOME"), ".config", "gcloud", adcFileName)
+}
+
+// findADCFile returns the well-known Application Default Credentials file, if it exists.
+func findADCFile() string {
+	path := wellKnownADCFile()
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
+
+// GetADCIDToken mints an IAP auth token from gcloud user credentials.
+// The OAuth client of the credentials, which is gcloud's own unless customized, needs to be
+// allowlisted for programmatic access on the IAP instance.
+// see: https://cloud.google.com/iap/docs/sharing-oauth-clients#programmatic_access
+// It returns a raw IAP auth token and any error encountered.
+func GetADCIDToken(credentialsFile, IAPclientID string) (string, error) {
+	data, err := os.ReadFile(expandHome(credentialsFile))
+	if err != nil {
+		return "", err
+	}
+
+	var creds authorizedUserCredentials
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return "", fmt.Errorf("[GetADCIDToken] Could not parse %s: %w", credentialsFile, err)
+	}
+	if creds.Type != authorizedUserType {
+		return "", fmt.Errorf("[GetADCIDToken] Unsupported credentials type '%s' in %s", creds.Type, credentialsFile)
+	}
+
+	log.Debug().Msgf("[GetADCIDToken] Using refresh token of OAuth client %s", creds.ClientID)
+	result, err := exchangeRefreshToken(creds.ClientID, creds.ClientSecret, creds.RefreshToken, IAPclientID)
+	if err != nil {
+		return "", err
+	}
+	return result.IDToken, nil
+}
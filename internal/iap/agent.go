@@ -0,0 +1,204 @@
+package iap
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// StoreAgent keeps tokens and refresh tokens in the memory of a running agent, so that they never touch disk
+	StoreAgent = "agent"
+
+	// AgentSocketEnvVariable points to the socket of a running agent, like SSH_AUTH_SOCK does for ssh-agent.
+	// Setting it selects the agent store, unless iap.credentialStore says otherwise.
+	AgentSocketEnvVariable = "GIT_IAP_AGENT_SOCK"
+
+	agentOpGet    = "get"
+	agentOpPut    = "put"
+	agentOpDelete = "delete"
+	agentOpList   = "list"
+
+	agentTimeout = 5 * time.Second
+)
+
+// agentRequest is a line sent to the agent
+type agentRequest struct {
+	Op     string `json:"op"`
+	Kind   string `json:"kind"`
+	Key    string `json:"key"`
+	Secret string `json:"secret,omitempty"`
+}
+
+// agentResponse is the line the agent answers with
+type agentResponse struct {
+	Secret string   `json:"secret,omitempty"`
+	Keys   []string `json:"keys,omitempty"`
+	Found  bool     `json:"found"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// AgentSocket returns the socket of the agent: GIT_IAP_AGENT_SOCK, or a socket in XDG_RUNTIME_DIR,
+// falling back to the directory of the cookie files.
+// Unix sockets are also available on Windows 10 and later, where they replace named pipes.
+func AgentSocket() string {
+	if socket := os.Getenv(AgentSocketEnvVariable); socket != "" {
+		return socket
+	}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, storeService, "agent.sock")
+	}
+	return filepath.Join(expandHome(CacheDir()), "agent.sock")
+}
+
+// ServeAgent holds secrets in memory and serves them on a unix socket, only accessible by the user,
+// until ctx is done. Secrets are forgotten when the agent stops.
+func ServeAgent(ctx context.Context, socket string) error {
+	if err := os.MkdirAll(filepath.Dir(socket), 0700); err != nil {
+		return err
+	}
+
+	if conn, err := net.DialTimeout("unix", socket, agentTimeout); err == nil {
+		conn.Close()
+		return fmt.Errorf("[ServeAgent] An agent is already listening on %s", socket)
+	}
+	// a stale socket is left behind when an agent gets killed
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	listener, err := listenPrivate(socket)
+	if err != nil {
+		return fmt.Errorf("[ServeAgent] Could not listen on %s: %w", socket, err)
+	}
+	defer listener.Close()
+	ensurePrivate(socket)
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	var mu sync.Mutex
+	secrets := map[string]string{}
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("[ServeAgent] %w", err)
+		}
+
+		go func() {
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(agentTimeout))
+
+			var req agentRequest
+			var resp agentResponse
+			if err := json.NewDecoder(conn).Decode(&req); err != nil {
+				log.Debug().Msgf("[ServeAgent] Invalid request: %s", err)
+				return
+			}
+			id := req.Kind + "\x00" + req.Key
+
+			mu.Lock()
+			switch req.Op {
+			case agentOpGet:
+				resp.Secret, resp.Found = secrets[id]
+			case agentOpPut:
+				secrets[id] = req.Secret
+				resp.Found = true
+			case agentOpDelete:
+				_, resp.Found = secrets[id]
+				delete(secrets, id)
+			case agentOpList:
+				for stored := range secrets {
+					if parts := strings.SplitN(stored, "\x00", 2); parts[0] == req.Kind {
+						resp.Keys = append(resp.Keys, parts[1])
+					}
+				}
+			default:
+				resp.Error = fmt.Sprintf("unknown operation '%s'", req.Op)
+			}
+			mu.Unlock()
+			log.Debug().Msgf("[ServeAgent] %s %s %s", req.Op, req.Kind, req.Key)
+
+			json.NewEncoder(conn).Encode(resp)
+		}()
+	}
+}
+
+// agentStore is the client side of the agent, for a kind of secret
+type agentStore struct {
+	socket string
+	kind   string
+}
+
+func (s *agentStore) call(req agentRequest) (*agentResponse, error) {
+	req.Kind = s.kind
+
+	conn, err := net.DialTimeout("unix", s.socket, agentTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("[agentStore] No agent listening on %s, start one with 'git-remote-https+iap agent': %w", s.socket, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(agentTimeout))
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, err
+	}
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("[agentStore] No answer from the agent: %w", err)
+	}
+
+	var resp agentResponse
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return &resp, nil
+}
+
+func (s *agentStore) Get(key string) (string, error) {
+	resp, err := s.call(agentRequest{Op: agentOpGet, Key: key})
+	if err != nil {
+		return "", err
+	}
+	if !resp.Found {
+		return "", ErrNotFound
+	}
+	return resp.Secret, nil
+}
+
+func (s *agentStore) Put(key, secret string) error {
+	_, err := s.call(agentRequest{Op: agentOpPut, Key: key, Secret: secret})
+	return err
+}
+
+func (s *agentStore) Delete(key string) error {
+	_, err := s.call(agentRequest{Op: agentOpDelete, Key: key})
+	return err
+}
+
+func (s *agentStore) List() ([]string, error) {
+	resp, err := s.call(agentRequest{Op: agentOpList})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Keys, nil
+}
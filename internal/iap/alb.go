@@ -0,0 +1,175 @@
+package iap
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// ProviderALB is the OIDC authentication of AWS Application Load Balancers
+	// see: https://docs.aws.amazon.com/elasticloadbalancing/latest/application/listener-authenticate-users.html
+	ProviderALB = "aws-alb"
+
+	// ALBCookieName is the session cookie of ALBs, sharded in AWSELBAuthSessionCookie-0, -1... when larger than 4KB
+	ALBCookieName = "AWSELBAuthSessionCookie"
+
+	// DefaultALBSessionTimeout is the default SessionTimeout of the authentication of ALBs, see iap.cookieExpire
+	DefaultALBSessionTimeout = 7 * 24 * time.Hour
+
+	// albLoginCookieName records the time of the login along the session, whose cookies are encrypted by the ALB
+	albLoginCookieName = "git-remote-iap-login"
+
+	// albCallbackParam is in the redirect_uri of the requests ALBs send to identity providers
+	albCallbackParam = "oauth2%2Fidpresponse"
+)
+
+func init() {
+	RegisterProvider(ProviderALB, albProvider{})
+}
+
+// albProvider sends the session cookies an ALB sets once the browser completed its OIDC flow with the identity
+// provider. Tokens are the "AWSELBAuthSessionCookie-0=value; ..." of a Cookie header, along with the time of the login.
+type albProvider struct{}
+
+// Token asks the user to log in with the browser, and to paste the session cookies the ALB set
+func (albProvider) Token(domain string, opts AuthOptions) (string, error) {
+	if opts.NonInteractive {
+		return "", fmt.Errorf("[albProvider] Interactive login required for %s", domain)
+	}
+
+	base := baseDomain(domain)
+	countInteractiveFlow(domain)
+	fmt.Fprintf(os.Stderr, "Log in to %s in the browser, at:\n\n  %s/\n\n", base, base)
+	if err := openBrowser(domain, base+"/"); err != nil {
+		log.Debug().Msgf("[albProvider] Could not open the browser: %s", err)
+	}
+	fmt.Fprintf(os.Stderr, "Once logged in, paste the Cookie header of a request to %s, from the network tab of the developer tools of the browser: ", strings.SplitN(base, "://", 2)[1])
+
+	terminal, err := openTerminal()
+	if err != nil {
+		return "", fmt.Errorf("[albProvider] Could not open the terminal: %w", err)
+	}
+	defer terminal.Close()
+	input, err := bufio.NewReader(terminal).ReadString('\n')
+	if err != nil && input == "" {
+		return "", fmt.Errorf("[albProvider] Could not read the cookies: %w", err)
+	}
+
+	session, err := parseALBSession(input)
+	if err != nil {
+		return "", err
+	}
+	if err := checkALBSession(base, session); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s; %s=%d", session, albLoginCookieName, time.Now().Unix()), nil
+}
+
+// Claims tells the expiry of a session from the time of its login
+func (albProvider) Claims(domain, rawToken string) (Claims, error) {
+	var claims Claims
+	for _, pair := range strings.Split(rawToken, "; ") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] != albLoginCookieName {
+			continue
+		}
+		login, err := strconv.ParseInt(kv[1], 10, 64)
+		if err != nil {
+			return claims, fmt.Errorf("[albProvider] Invalid time of login: %w", err)
+		}
+		claims.IssuedAt = login
+		claims.ExpiresAt = time.Unix(login, 0).Add(getCookieExpire(domain, DefaultALBSessionTimeout)).Unix()
+		return claims, nil
+	}
+	return claims, fmt.Errorf("[albProvider] Not a session of an ALB")
+}
+
+// Verify has nothing to check: only the ALB can decrypt its sessions
+func (albProvider) Verify(domain, rawToken string, claims Claims) error {
+	return nil
+}
+
+func (albProvider) Header(domain, rawToken string) string {
+	return fmt.Sprintf("Cookie: %s", rawToken)
+}
+
+func (albProvider) CookieName() string {
+	return ALBCookieName
+}
+
+// parseALBSession returns the "AWSELBAuthSessionCookie-0=value; ..." of the session cookies in a Cookie header,
+// ordered by shard, or of the value of a session held by a single cookie
+func parseALBSession(input string) (string, error) {
+	input = strings.TrimSpace(input)
+	if len(input) > len("cookie:") && strings.EqualFold(input[:len("cookie:")], "cookie:") {
+		input = strings.TrimSpace(input[len("cookie:"):])
+	}
+	if input == "" {
+		return "", fmt.Errorf("[parseALBSession] No session cookie provided")
+	}
+	if !strings.Contains(input, "=") {
+		return fmt.Sprintf("%s-0=%s", ALBCookieName, input), nil
+	}
+
+	shards := map[int]string{}
+	for _, pair := range strings.Split(input, ";") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 || !strings.HasPrefix(kv[0], ALBCookieName+"-") {
+			continue
+		}
+		shard, err := strconv.Atoi(strings.TrimPrefix(kv[0], ALBCookieName+"-"))
+		if err != nil {
+			continue
+		}
+		shards[shard] = kv[1]
+	}
+	if _, ok := shards[0]; !ok {
+		return "", fmt.Errorf("[parseALBSession] No %s-0 cookie found", ALBCookieName)
+	}
+
+	var indexes []int
+	for shard := range shards {
+		indexes = append(indexes, shard)
+	}
+	sort.Ints(indexes)
+	var pairs []string
+	for _, shard := range indexes {
+		pairs = append(pairs, fmt.Sprintf("%s-%d=%s", ALBCookieName, shard, shards[shard]))
+	}
+	return strings.Join(pairs, "; "), nil
+}
+
+// checkALBSession asks the ALB whether session cookies are valid: it redirects the requests of invalid
+// sessions to the identity provider
+func checkALBSession(base, session string) error {
+	client := http.Client{
+		Timeout: 30 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	req, err := http.NewRequest("GET", base+"/", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Cookie", session)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("[checkALBSession] Could not request %s: %w", req.URL, err)
+	}
+	resp.Body.Close()
+	location, err := resp.Location()
+	if resp.StatusCode == http.StatusUnauthorized || err == nil && !strings.EqualFold(CanonicalHost(location), CanonicalHost(req.URL)) {
+		return fmt.Errorf("[checkALBSession] The ALB of %s did not accept the session cookies (%s)", base, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package iap
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/adohkan/git-remote-https-iap/internal/git"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// AuditLogin records a token minted after an interactive flow, in a browser or a terminal
+	AuditLogin = "login"
+	// AuditRefresh records a token minted without user interaction: refresh token, service account, command...
+	AuditRefresh = "refresh"
+	// AuditUse records a token handed to git or printed
+	AuditUse = "use"
+
+	auditFileName = "audit.log"
+)
+
+// interactiveFlows counts the interactive flows of this process by host, so that NewAuth can tell logins
+// from refreshes. NewAuth runs concurrently for different hosts, e.g. in the proxy, while the refresh lock
+// of a host serializes its own flows.
+var interactiveFlows = struct {
+	sync.Mutex
+	count map[string]int
+}{count: map[string]int{}}
+
+// countInteractiveFlow records an interactive flow for the host of domain
+func countInteractiveFlow(domain string) {
+	interactiveFlows.Lock()
+	defer interactiveFlows.Unlock()
+	interactiveFlows.count[baseDomain(domain)]++
+}
+
+// interactiveFlowCount returns the number of interactive flows run for the host of domain
+func interactiveFlowCount(domain string) int {
+	interactiveFlows.Lock()
+	defer interactiveFlows.Unlock()
+	return interactiveFlows.count[baseDomain(domain)]
+}
+
+// AuditEvent is a line of the audit log
+type AuditEvent struct {
+	Time      time.Time  `json:"time"`
+	Event     string     `json:"event"`
+	Host      string     `json:"host"`
+	Account   string     `json:"account,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// AuditFile returns the path of the audit log, in CacheDir
+func AuditFile() string {
+	return filepath.Join(expandHome(CacheDir()), auditFileName)
+}
+
+// auditEnabled reads the iap.audit git config of a domain, which defaults to true
+func auditEnabled(domain string) bool {
+	value := git.ConfigTryGetURLMatch("iap.audit", domain)
+	if value == "" {
+		return true
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Warn().Msgf("[auditEnabled] Ignoring invalid iap.audit '%s'", value)
+		return true
+	}
+	return enabled
+}
+
+// RecordAudit appends an event about the token of a domain to the audit log.
+// Failures are only logged: auditing never prevents git from working.
+func RecordAudit(domain, event string, auth *AuthState) {
+	if !auditEnabled(domain) {
+		return
+	}
+
+	e := AuditEvent{
+		Time:    time.Now().UTC(),
+		Event:   event,
+		Host:    domain,
+		Account: auth.Cookie.Claims.Email,
+	}
+	if auth.Cookie.Claims.ExpiresAt != 0 {
+		expiresAt := time.Unix(auth.Cookie.Claims.ExpiresAt, 0).UTC()
+		e.ExpiresAt = &expiresAt
+	}
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	path := AuditFile()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		log.Debug().Msgf("[RecordAudit] Could not create %s: %s", filepath.Dir(path), err)
+		return
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Debug().Msgf("[RecordAudit] Could not open %s: %s", path, err)
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		log.Debug().Msgf("[RecordAudit] Could not write %s: %s", path, err)
+	}
+}
+
+// ReadAuditLog returns the events of the audit log, oldest first
+func ReadAuditLog() ([]AuditEvent, error) {
+	f, err := os.Open(AuditFile())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var events []AuditEvent
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			log.Warn().Msgf("[ReadAuditLog] Skipping invalid line: %s", scanner.Text())
+			continue
+		}
+		events = append(events, e)
+	}
+	return events, scanner.Err()
+}
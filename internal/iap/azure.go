@@ -0,0 +1,241 @@
+package iap
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/adohkan/git-remote-https-iap/internal/git"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// ProviderAzure is Azure AD Application Proxy, with Azure AD pre-authentication
+	// see: https://learn.microsoft.com/en-us/entra/identity/app-proxy/application-proxy-configure-native-client-application
+	ProviderAzure = "azure"
+
+	// DefaultAzureAuthority is the login endpoint of the Azure public cloud, see iap.azureAuthority
+	DefaultAzureAuthority = "https://login.microsoftonline.com"
+
+	// DefaultAzureTenant accepts the work accounts of any tenant, see iap.azureTenant
+	DefaultAzureTenant = "organizations"
+
+	azureScopeSuffix = "/user_impersonation"
+)
+
+func init() {
+	RegisterProvider(ProviderAzure, azureProvider{})
+}
+
+// azureProvider gets access tokens of Azure AD for the Application Proxy application, whose App ID URI is
+// iap.clientID, with the device code flow of the public client application iap.helperID. Its refresh token
+// is cached like the one of Google.
+type azureProvider struct{}
+
+type azureDeviceCode struct {
+	DeviceCode      string `json:"device_code"`
+	UserCode        string `json:"user_code"`
+	VerificationURI string `json:"verification_uri"`
+	ExpiresIn       int    `json:"expires_in"`
+	Interval        int    `json:"interval"`
+	Message         string `json:"message"`
+}
+
+func (azureProvider) Token(domain string, opts AuthOptions) (string, error) {
+	helperID := git.ConfigTryGetURLMatch("iap.helperID", domain)
+	if helperID == "" {
+		return "", fmt.Errorf("[azureProvider] iap.helperID of %s must be the client ID of a public client application", domain)
+	}
+	scope := getAzureScope(domain)
+
+	if refreshToken, err := getRefreshTokenFromCache(domain); err == nil && !opts.ForceBrowserFlow {
+		result, err := requestAzureToken(domain, url.Values{
+			"client_id":     {helperID},
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {refreshToken},
+			"scope":         {scope},
+		})
+		if err == nil {
+			cacheAzureRefreshToken(domain, refreshToken, result)
+			return result.AccessToken, nil
+		}
+		if !errors.Is(err, errInvalidGrant) {
+			return "", err
+		}
+		log.Debug().Msgf("[azureProvider] Cached refresh token for %s was rejected, restarting device flow", domain)
+		if err := eraseRefreshToken(domain); err != nil {
+			log.Warn().Msgf("[azureProvider] Could not erase refresh token for %s: %s", domain, err.Error())
+		}
+	}
+
+	if opts.NonInteractive {
+		return "", fmt.Errorf("[azureProvider] Interactive login required for %s", domain)
+	}
+	result, err := getAzureTokenFromDeviceFlow(domain, helperID, scope)
+	if err != nil {
+		return "", err
+	}
+	countInteractiveFlow(domain)
+	cacheAzureRefreshToken(domain, "", result)
+	return result.AccessToken, nil
+}
+
+func (azureProvider) Verify(domain, rawToken string, claims Claims) error {
+	authority, tenant := getAzureAuthority(domain)
+	certsURL := fmt.Sprintf("%s/%s/discovery/v2.0/keys", authority, tenant)
+	cacheFile := fmt.Sprintf("azure-certs-%s.json", hostSlug(tenant))
+	if err := verifyJWKSSignature(domain, rawToken, certsURL, cacheFile, "Azure AD"); err != nil {
+		return err
+	}
+	return checkAudience(domain, claims)
+}
+
+// Header sends the token as an Authorization bearer, the only place Application Proxy reads it from
+func (azureProvider) Header(domain, rawToken string) string {
+	return fmt.Sprintf("Authorization: Bearer %s", rawToken)
+}
+
+func (azureProvider) CookieName() string {
+	return IAPCookieName
+}
+
+// getAzureAuthority returns the login endpoint and the tenant of a domain, from the iap.azureAuthority
+// and iap.azureTenant git configs
+func getAzureAuthority(domain string) (string, string) {
+	authority := strings.TrimSuffix(git.ConfigTryGetURLMatch("iap.azureAuthority", domain), "/")
+	if authority == "" {
+		authority = DefaultAzureAuthority
+	}
+	tenant := git.ConfigTryGetURLMatch("iap.azureTenant", domain)
+	if tenant == "" {
+		tenant = DefaultAzureTenant
+	}
+	return authority, tenant
+}
+
+// getAzureScope returns the scopes requested for the Application Proxy application: its user_impersonation,
+// unless iap.audience or iap.clientID is already a scope, and a refresh token
+func getAzureScope(domain string) string {
+	scope := strings.TrimSuffix(resolveAudience(domain), "/")
+	if !strings.HasSuffix(scope, azureScopeSuffix) && !strings.HasSuffix(scope, "/.default") {
+		scope += azureScopeSuffix
+	}
+	return scope + " offline_access"
+}
+
+// getAzureTokenFromDeviceFlow runs the device code flow of Azure AD: the user is asked to visit a URL
+// on any device and enter a code, while we poll for the resulting tokens.
+func getAzureTokenFromDeviceFlow(domain, helperID, scope string) (*token, error) {
+	var code azureDeviceCode
+	var errorMesg httpError
+
+	authority, tenant := getAzureAuthority(domain)
+	resp, err := http.PostForm(fmt.Sprintf("%s/%s/oauth2/v2.0/devicecode", authority, tenant), url.Values{
+		"client_id": {helperID},
+		"scope":     {scope},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("[getAzureTokenFromDeviceFlow] Could not request device code: %s", err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		json.NewDecoder(resp.Body).Decode(&errorMesg)
+		return nil, fmt.Errorf("[getAzureTokenFromDeviceFlow] Could not request device code: %s (%s)", errorMesg.Error, errorMesg.ErrorDesc)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&code); err != nil {
+		return nil, fmt.Errorf("[getAzureTokenFromDeviceFlow] Could not decode device code: %s", err.Error())
+	}
+
+	// stdout belongs to git when running as a remote helper
+	if code.Message != "" {
+		fmt.Fprintln(os.Stderr, code.Message)
+	} else {
+		fmt.Fprintf(os.Stderr, "To authenticate, visit %s and enter the code: %s\n", code.VerificationURI, code.UserCode)
+	}
+
+	interval := time.Duration(code.Interval) * time.Second
+	if interval == 0 {
+		interval = 5 * time.Second
+	}
+	deadline := time.Now().Add(time.Duration(code.ExpiresIn) * time.Second)
+
+	for time.Now().Before(deadline) {
+		time.Sleep(interval)
+
+		result, err := requestAzureToken(domain, url.Values{
+			"client_id":   {helperID},
+			"device_code": {code.DeviceCode},
+			"grant_type":  {deviceCodeGrantType},
+		})
+		var pending *azurePendingError
+		switch {
+		case err == nil:
+			return result, nil
+		case errors.As(err, &pending) && pending.code == "authorization_pending":
+			continue
+		case errors.As(err, &pending) && pending.code == "slow_down":
+			interval += 5 * time.Second
+			continue
+		default:
+			return nil, err
+		}
+	}
+
+	return nil, fmt.Errorf("[getAzureTokenFromDeviceFlow] Device code expired before authorization was granted")
+}
+
+// azurePendingError is returned by requestAzureToken while the user has not completed the device flow
+type azurePendingError struct {
+	code string
+}
+
+func (e *azurePendingError) Error() string {
+	return fmt.Sprintf("device authorization %s", e.code)
+}
+
+// requestAzureToken redeems a grant at the token endpoint of Azure AD
+func requestAzureToken(domain string, params url.Values) (*token, error) {
+	var result token
+	var errorMesg httpError
+
+	authority, tenant := getAzureAuthority(domain)
+	resp, err := http.PostForm(fmt.Sprintf("%s/%s/oauth2/v2.0/token", authority, tenant), params)
+	if err != nil {
+		return nil, fmt.Errorf("[requestAzureToken] Could not request a token of Azure AD: %s", err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		json.NewDecoder(resp.Body).Decode(&errorMesg)
+		switch errorMesg.Error {
+		case "authorization_pending", "slow_down":
+			return nil, &azurePendingError{code: errorMesg.Error}
+		case errInvalidGrant.Error():
+			return nil, fmt.Errorf("[requestAzureToken] Azure AD rejected the refresh token: %s: %w", errorMesg.ErrorDesc, errInvalidGrant)
+		}
+		return nil, fmt.Errorf("[requestAzureToken] Could not get a token of Azure AD: %s (%s)", errorMesg.Error, errorMesg.ErrorDesc)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("[requestAzureToken] Could not decode the token of Azure AD: %s", err.Error())
+	}
+	if result.AccessToken == "" {
+		return nil, fmt.Errorf("[requestAzureToken] Azure AD returned no access token")
+	}
+	return &result, nil
+}
+
+// cacheAzureRefreshToken caches the refresh token of a token response, which Azure AD rotates on every use
+func cacheAzureRefreshToken(domain, previous string, result *token) {
+	if result.RefreshToken == "" || result.RefreshToken == previous {
+		return
+	}
+	if err := cacheRefreshToken(domain, result.RefreshToken); err != nil {
+		log.Warn().Msgf("[azureProvider] Could not cache refresh token for %s: %s", domain, err.Error())
+	}
+}
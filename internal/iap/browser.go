@@ -0,0 +1,98 @@
+package iap
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/adohkan/git-remote-https-iap/internal/git"
+	"github.com/pkg/browser"
+	"github.com/rs/zerolog/log"
+)
+
+// BrowserEnvVariable is the name of the environment variable overriding the command used to open URLs
+const BrowserEnvVariable = "GIT_IAP_BROWSER"
+
+// getBrowserCommand returns the command used to open the consent URL, if any is configured:
+// GIT_IAP_BROWSER wins over the iap.browser git config, which wins over the conventional BROWSER.
+func getBrowserCommand(domain string) string {
+	if command := os.Getenv(BrowserEnvVariable); command != "" {
+		return command
+	}
+	if command := git.ConfigTryGetURLMatch("iap.browser", domain); command != "" {
+		return command
+	}
+	return os.Getenv("BROWSER")
+}
+
+// openBrowser opens url with the configured browser command, or the OS default opener.
+// A '%s' in the command is replaced by the url, which is appended otherwise.
+func openBrowser(domain, url string) error {
+	command := getBrowserCommand(domain)
+	if command == "" {
+		if isWSL() {
+			return openWSLBrowser(url)
+		}
+		return browser.OpenURL(url)
+	}
+
+	args := strings.Fields(command)
+	substituted := false
+	for i, arg := range args {
+		if strings.Contains(arg, "%s") {
+			args[i] = strings.ReplaceAll(arg, "%s", url)
+			substituted = true
+		}
+	}
+	if !substituted {
+		args = append(args, url)
+	}
+
+	log.Debug().Msgf("[openBrowser] Running %v", args)
+	cmd := exec.Command(args[0], args[1:]...)
+	// stdout belongs to git when running as a remote helper
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("[openBrowser] Could not run browser command '%s': %w", command, err)
+	}
+
+	// some browsers only return when closed, do not block the flow on them
+	go cmd.Wait()
+	return nil
+}
+
+// isWSL reports whether we run inside the Windows Subsystem for Linux
+func isWSL() bool {
+	if runtime.GOOS != "linux" {
+		return false
+	}
+	if os.Getenv("WSL_DISTRO_NAME") != "" || os.Getenv("WSL_INTEROP") != "" {
+		return true
+	}
+	release, err := os.ReadFile("/proc/sys/kernel/osrelease")
+	return err == nil && strings.Contains(strings.ToLower(string(release)), "microsoft")
+}
+
+// openWSLBrowser opens url with the Windows default browser, as WSL usually has no Linux one.
+// wslview, from wslu, is preferred when installed.
+func openWSLBrowser(url string) error {
+	var cmd *exec.Cmd
+	if path, err := exec.LookPath("wslview"); err == nil {
+		cmd = exec.Command(path, url)
+	} else {
+		// single quotes are escaped by doubling them in PowerShell
+		cmd = exec.Command("powershell.exe", "-NoProfile", "-NonInteractive", "-Command",
+			fmt.Sprintf("Start-Process '%s'", strings.ReplaceAll(url, "'", "''")))
+	}
+
+	log.Debug().Msgf("[openWSLBrowser] Running %v", cmd.Args)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("[openWSLBrowser] Could not open the Windows browser: %w", err)
+	}
+	return nil
+}
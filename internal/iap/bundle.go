@@ -0,0 +1,188 @@
+package iap
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	// BundlePassphraseEnvVariable holds the passphrase of cache bundles
+	BundlePassphraseEnvVariable = "GIT_IAP_CACHE_PASSPHRASE"
+
+	bundleHeader     = "git-remote-https+iap bundle v1"
+	bundleSaltSize   = 16
+	bundleIterations = 600000
+)
+
+// bundle holds the secrets of a cache export, by domain
+type bundle struct {
+	Cookies       map[string]string `json:"cookies"`
+	RefreshTokens map[string]string `json:"refresh_tokens"`
+}
+
+// ExportCache collects the cookies and refresh tokens of the configured domains, from their stores,
+// into a bundle encrypted with a key derived from passphrase.
+func ExportCache(passphrase string) ([]byte, error) {
+	b := bundle{Cookies: map[string]string{}, RefreshTokens: map[string]string{}}
+
+	for _, domain := range cookieKeys() {
+		if store, err := getStore(domain, StoreKindCookie); err == nil {
+			if token, err := store.Get(domain); err == nil {
+				b.Cookies[domain] = token
+			}
+		}
+		if token, err := getRefreshTokenFromCache(baseDomain(domain)); err == nil {
+			b.RefreshTokens[baseDomain(domain)] = token
+		}
+	}
+	if len(b.Cookies) == 0 && len(b.RefreshTokens) == 0 {
+		return nil, fmt.Errorf("[ExportCache] No cached token found for configured hosts")
+	}
+	log.Debug().Msgf("[ExportCache] Exporting %d cookies and %d refresh tokens", len(b.Cookies), len(b.RefreshTokens))
+
+	plaintext, err := json.Marshal(b)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, bundleSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	aead, err := bundleAEAD(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	sealed := append(append(salt, nonce...), aead.Seal(nil, nonce, plaintext, []byte(bundleHeader))...)
+	return []byte(bundleHeader + "\n" + base64.StdEncoding.EncodeToString(sealed) + "\n"), nil
+}
+
+// ImportCache saves the secrets of a bundle in the stores of their domains.
+// Domains must be configured beforehand, as stores depend on their configuration.
+// It returns the domains whose secrets were imported.
+func ImportCache(data []byte, passphrase string) ([]string, error) {
+	lines := strings.SplitN(strings.TrimSpace(string(data)), "\n", 2)
+	if len(lines) != 2 || lines[0] != bundleHeader {
+		return nil, fmt.Errorf("[ImportCache] Not a cache bundle")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil {
+		return nil, fmt.Errorf("[ImportCache] Could not decode bundle: %w", err)
+	}
+	if len(sealed) < bundleSaltSize {
+		return nil, fmt.Errorf("[ImportCache] Bundle is truncated")
+	}
+
+	aead, err := bundleAEAD(passphrase, sealed[:bundleSaltSize])
+	if err != nil {
+		return nil, err
+	}
+	rest := sealed[bundleSaltSize:]
+	if len(rest) < aead.NonceSize() {
+		return nil, fmt.Errorf("[ImportCache] Bundle is truncated")
+	}
+	plaintext, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], []byte(bundleHeader))
+	if err != nil {
+		return nil, fmt.Errorf("[ImportCache] Could not decrypt bundle, is the passphrase right?")
+	}
+
+	var b bundle
+	if err := json.Unmarshal(plaintext, &b); err != nil {
+		return nil, fmt.Errorf("[ImportCache] Could not parse bundle: %w", err)
+	}
+
+	var imported []string
+	var errs []error
+	for domain, token := range b.Cookies {
+		if !Configured(domain) {
+			log.Warn().Msgf("Skipping %s, which is not configured on this machine", domain)
+			continue
+		}
+		store, err := getStore(domain, StoreKindCookie)
+		if err == nil {
+			err = store.Put(domain, token)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("[ImportCache] Could not import token of %s: %w", domain, err))
+			continue
+		}
+		imported = append(imported, domain)
+	}
+	for domain, token := range b.RefreshTokens {
+		if !Configured(domain) {
+			log.Warn().Msgf("Skipping refresh token of %s, which is not configured on this machine", domain)
+			continue
+		}
+		if err := cacheRefreshToken(domain, token); err != nil {
+			errs = append(errs, fmt.Errorf("[ImportCache] Could not import refresh token of %s: %w", domain, err))
+			continue
+		}
+		imported = append(imported, domain+" (refresh token)")
+	}
+
+	if len(errs) > 0 {
+		return imported, errs[0]
+	}
+	return imported, nil
+}
+
+// cookieKeys returns the configured domains, along with the keys of their cookie stores under an IAP url,
+// such as the auth scopes of path prefixes or of remotes isolated by iap.tokenScope
+func cookieKeys() []string {
+	keys := ConfiguredDomains()
+	seen := map[string]bool{}
+	for _, key := range keys {
+		seen[key] = true
+	}
+	listed := map[string]bool{}
+	for _, domain := range ConfiguredDomains() {
+		name := StoreName(domain, StoreKindCookie)
+		if listed[name] {
+			continue
+		}
+		listed[name] = true
+
+		store, err := getStore(domain, StoreKindCookie)
+		if err != nil {
+			continue
+		}
+		stored, err := store.List()
+		if err != nil {
+			log.Debug().Msgf("[cookieKeys] Could not list the tokens of %s: %s", name, err)
+			continue
+		}
+		for _, key := range stored {
+			if !seen[key] && Configured(key) {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+func bundleAEAD(passphrase string, salt []byte) (cipher.AEAD, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("a passphrase is required, set %s", BundlePassphraseEnvVariable)
+	}
+	block, err := aes.NewCipher(pbkdf2.Key([]byte(passphrase), salt, bundleIterations, 32, sha256.New))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
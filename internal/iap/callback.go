@@ -0,0 +1,84 @@
+package iap
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/rs/zerolog/log"
+)
+
+// callbackPage is shown in the browser once the helper got what it waited for
+const callbackPage = "<html><body>You are logged in, you can close this window and return to git.</body></html>"
+
+// waitForCallback serves the local callback of a browser login to a proxy, such as Pomerium's: it listens on
+// the callback addresses of a domain, opens the browser at the url loginURL returns for the callback url,
+// and returns the query of the first request to the callback having the param.
+// It gives up after iap.browserTimeout.
+func waitForCallback(domain, param string, loginURL func(callback string) (string, error)) (url.Values, error) {
+	listener, err := listenCallback(domain)
+	if err != nil {
+		return nil, err
+	}
+	defer listener.Close()
+	callback := fmt.Sprintf("http://%s/callback", listener.Addr().String())
+
+	login, err := loginURL(callback)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := getBrowserTimeout(domain)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	result := make(chan url.Values, 1)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get(param) == "" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, callbackPage)
+		select {
+		case result <- query:
+		default:
+		}
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	countInteractiveFlow(domain)
+	fmt.Fprintf(os.Stderr, "Log in to %s in the browser, or open %s\n", domain, login)
+	if err := openBrowser(domain, login); err != nil {
+		log.Error().Msgf("[waitForCallback] Could not open the browser: %s", err)
+	}
+
+	select {
+	case query := <-result:
+		return query, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("[waitForCallback] Gave up waiting for the login to %s in the browser after %s (see iap.browserTimeout)", domain, timeout)
+	}
+}
+
+// listenCallback listens on the first free address of iap.callbackPorts, or on any port
+func listenCallback(domain string) (net.Listener, error) {
+	addresses, err := getCallbackAddresses(domain)
+	if err != nil {
+		return nil, err
+	}
+	if len(addresses) == 0 {
+		addresses = []string{"127.0.0.1:0"}
+	}
+	for _, address := range addresses {
+		if listener, err := net.Listen("tcp", address); err == nil {
+			return listener, nil
+		}
+	}
+	return nil, fmt.Errorf("[listenCallback] None of the iap.callbackPorts of %s is free", domain)
+}
@@ -0,0 +1,161 @@
+package iap
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/adohkan/git-remote-https-iap/internal/git"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// ProviderCloudflare is Cloudflare Access, of Cloudflare Zero Trust
+	// see: https://developers.cloudflare.com/cloudflare-one/identity/authorization-cookie/
+	ProviderCloudflare = "cloudflare"
+
+	// CloudflareCookieName is the cookie of Cloudflare Access tokens
+	CloudflareCookieName = "CF_Authorization"
+
+	// CloudflareClientIDEnvVariable and CloudflareClientSecretEnvVariable carry a service token,
+	// in place of the iap.cloudflareClientID and iap.cloudflareClientSecret git configs
+	CloudflareClientIDEnvVariable     = "CF_ACCESS_CLIENT_ID"
+	CloudflareClientSecretEnvVariable = "CF_ACCESS_CLIENT_SECRET"
+
+	// cloudflareTeamSuffix is the domain of the team domains of Cloudflare Access, signing its tokens
+	cloudflareTeamSuffix = ".cloudflareaccess.com"
+	cloudflaredBinary    = "cloudflared"
+)
+
+func init() {
+	RegisterProvider(ProviderCloudflare, cloudflareProvider{})
+}
+
+// cloudflareProvider gets Cloudflare Access tokens, whose audience is the AUD tag of the Access application,
+// configured as iap.clientID. Machines use a service token, and users log in with cloudflared.
+type cloudflareProvider struct{}
+
+func (cloudflareProvider) Token(domain string, opts AuthOptions) (string, error) {
+	clientID := git.ConfigTryGetURLMatch("iap.cloudflareClientID", domain)
+	if clientID == "" {
+		clientID = os.Getenv(CloudflareClientIDEnvVariable)
+	}
+	if clientID != "" {
+		clientSecret := git.ConfigTryGetURLMatch("iap.cloudflareClientSecret", domain)
+		if clientSecret == "" {
+			clientSecret = os.Getenv(CloudflareClientSecretEnvVariable)
+		}
+		return getCloudflareServiceToken(baseDomain(domain), clientID, clientSecret)
+	}
+	return getCloudflaredToken(baseDomain(domain), opts)
+}
+
+func (cloudflareProvider) Verify(domain, rawToken string, claims Claims) error {
+	if certsURL := cloudflareCertsURL(domain, claims); certsURL != "" {
+		cacheFile := fmt.Sprintf("cloudflare-certs-%s.json", hostSlug(strings.TrimSuffix(strings.TrimPrefix(certsURL, "https://"), "/cdn-cgi/access/certs")))
+		if err := verifyJWKSSignature(domain, rawToken, certsURL, cacheFile, "Cloudflare Access"); err != nil {
+			return err
+		}
+	}
+	return checkAudience(domain, claims)
+}
+
+func (cloudflareProvider) Header(domain, rawToken string) string {
+	return fmt.Sprintf("cf-access-token: %s", rawToken)
+}
+
+func (cloudflareProvider) CookieName() string {
+	return CloudflareCookieName
+}
+
+// cloudflareCertsURL returns the keys signing the tokens of the team domain set in iap.cloudflareTeam,
+// e.g. acme.cloudflareaccess.com, or in the issuer of the token, as long as it is a Cloudflare Access one
+func cloudflareCertsURL(domain string, claims Claims) string {
+	team := git.ConfigTryGetURLMatch("iap.cloudflareTeam", domain)
+	if team == "" {
+		issuer, err := url.Parse(claims.Issuer)
+		if err != nil || issuer.Scheme != "https" || !strings.HasSuffix(issuer.Host, cloudflareTeamSuffix) {
+			log.Debug().Msgf("[cloudflareCertsURL] No iap.cloudflareTeam for %s, the signature of its token is not verified", domain)
+			return ""
+		}
+		team = issuer.Host
+	}
+	if !strings.Contains(team, ".") {
+		team += cloudflareTeamSuffix
+	}
+	return fmt.Sprintf("https://%s/cdn-cgi/access/certs", strings.TrimPrefix(team, "https://"))
+}
+
+// getCloudflareServiceToken exchanges a service token for the CF_Authorization cookie of a domain
+// see: https://developers.cloudflare.com/cloudflare-one/identity/service-tokens/
+func getCloudflareServiceToken(domain, clientID, clientSecret string) (string, error) {
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	req, err := http.NewRequest("GET", domain, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("CF-Access-Client-Id", clientID)
+	req.Header.Set("CF-Access-Client-Secret", clientSecret)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("[getCloudflareServiceToken] Could not request %s: %w", domain, err)
+	}
+	resp.Body.Close()
+
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == CloudflareCookieName {
+			return cookie.Value, nil
+		}
+	}
+	return "", fmt.Errorf("[getCloudflareServiceToken] Cloudflare Access did not accept the service token %s for %s (%s)", clientID, domain, resp.Status)
+}
+
+// getCloudflaredToken returns the token cloudflared keeps for a domain, and logs in with the browser
+// through cloudflared when it has none, unless opts is non-interactive
+func getCloudflaredToken(domain string, opts AuthOptions) (string, error) {
+	if _, err := exec.LookPath(cloudflaredBinary); err != nil {
+		return "", fmt.Errorf("[getCloudflaredToken] Logging in to Cloudflare Access requires %s, or a service token in iap.cloudflareClientID", cloudflaredBinary)
+	}
+
+	if !opts.ForceBrowserFlow && !opts.SelectAccount {
+		if token, err := runCloudflared("access", "token", fmt.Sprintf("-app=%s", domain)); err == nil && token != "" {
+			return token, nil
+		}
+	}
+	if opts.NonInteractive {
+		return "", fmt.Errorf("[getCloudflaredToken] No token of %s for %s, log in interactively", cloudflaredBinary, domain)
+	}
+
+	// cloudflared opens the browser and waits for the login, its messages are meant for the user
+	countInteractiveFlow(domain)
+	login := exec.Command(cloudflaredBinary, "access", "login", domain)
+	login.Stdin = os.Stdin
+	login.Stdout = os.Stderr
+	login.Stderr = os.Stderr
+	if err := login.Run(); err != nil {
+		return "", fmt.Errorf("[getCloudflaredToken] %s access login %s: %w", cloudflaredBinary, domain, err)
+	}
+	return runCloudflared("access", "token", fmt.Sprintf("-app=%s", domain))
+}
+
+func runCloudflared(args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(cloudflaredBinary, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("[runCloudflared] %s %s: %w (%s)", cloudflaredBinary, strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
@@ -0,0 +1,47 @@
+package iap
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// GetCommandIDToken runs a user-provided command and uses its output as IAP auth token,
+// similar to kubectl exec plugins. The command runs in a shell, with the domain and the
+// IAP clientID exposed as GIT_IAP_URL and GIT_IAP_CLIENT_ID environment variables.
+// It returns a raw IAP auth token and any error encountered.
+func GetCommandIDToken(command, domain, IAPclientID string) (string, error) {
+	var stdout bytes.Buffer
+
+	cmd := shellCommand(command)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("GIT_IAP_URL=%s", domain),
+		fmt.Sprintf("GIT_IAP_CLIENT_ID=%s", IAPclientID),
+	)
+	cmd.Stdout = &stdout
+	// stdin and stdout belong to git when running as a remote helper
+	cmd.Stderr = os.Stderr
+
+	log.Debug().Msgf("[GetCommandIDToken] Running %s", command)
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("[GetCommandIDToken] Token command '%s' failed: %w", command, err)
+	}
+
+	rawToken := strings.TrimSpace(stdout.String())
+	if rawToken == "" {
+		return "", fmt.Errorf("[GetCommandIDToken] Token command '%s' printed nothing", command)
+	}
+	return rawToken, nil
+}
+
+func shellCommand(command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/C", command)
+	}
+	return exec.Command("sh", "-c", command)
+}
@@ -2,6 +2,7 @@ package iap
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"net/url"
 	"os"
@@ -19,6 +20,17 @@ const (
 	// IAPCookieName is the name of the HTTP Cookie that will be used to send the IAP Token.
 	// see: https://cloud.google.com/blog/products/gcp/getting-started-with-cloud-identity-aware-proxy
 	IAPCookieName = "GCP_IAAP_AUTH_TOKEN"
+
+	// IDTokenEnvVariable is the name of the environment variable carrying a pre-issued IAP auth token,
+	// e.g. obtained by a CI pipeline. It bypasses the cookie cache and every authentication flow.
+	IDTokenEnvVariable = "GIT_IAP_ID_TOKEN"
+
+	// TokenEnvVariable carries a raw token used as is for a single invocation, without any validation,
+	// for debugging or for wrapper scripts managing tokens themselves. It takes precedence over GIT_IAP_ID_TOKEN.
+	TokenEnvVariable = "GIT_IAP_TOKEN"
+
+	// DefaultClockSkew is the drift tolerated between the local clock and IAP's, see iap.clockSkew
+	DefaultClockSkew = 60 * time.Second
 )
 
 // A Cookie holds pieces of information required to manage the IAP cookie
@@ -27,39 +39,157 @@ type AuthState struct {
 	RawToken string
 }
 
+// AuthOptions tunes how NewAuth obtains a fresh IAP token
+type AuthOptions struct {
+	// ForceBrowserFlow ignores any cached refresh token and runs the browser flow
+	ForceBrowserFlow bool
+	// SelectAccount makes the browser show the account chooser, even when a single account is logged in
+	SelectAccount bool
+	// NonInteractive fails instead of asking the user to log in, e.g. when refreshing in the background
+	NonInteractive bool
+	// NoBrowser replaces the browser flow by the manual flow, where the user pastes the authorization code
+	NoBrowser bool
+	// KeyFile is a service account JSON key, or a workload identity federation config,
+	// used instead of the browser flow
+	KeyFile string
+	// ImpersonateServiceAccount is the email of a service account to mint the token for,
+	// using the caller's credentials
+	ImpersonateServiceAccount string
+}
+
 type Cookie struct {
 	JarPath string
 	Domain  string
-	Token   jwt.Token
-	Claims  jwt.StandardClaims
+	// Name is the name of the cookie in the cookie file, IAPCookieName unless iap.cookieName is set
+	Name   string
+	Token  jwt.Token
+	Claims Claims
+	// RefreshMargin makes the cookie expire early, so that it does not expire during a long git operation
+	RefreshMargin time.Duration
+	// ClockSkew is the tolerated drift between the local clock and IAP's, which also makes the cookie expire early
+	ClockSkew time.Duration
+
+	// store keeps the token under storeKey, in the cookie file of JarPath unless another store is configured
+	store    Store
+	storeKey string
 }
 
-func ReadAuthState(domain string) (*AuthState, error) {
+// Claims holds the claims of a Google-signed ID token, or of the token of another Provider
+type Claims struct {
+	jwt.StandardClaims
+	// Audience replaces that of StandardClaims, which some providers send as a list
+	Audience     Audience `json:"aud,omitempty"`
+	Email        string   `json:"email"`
+	HostedDomain string   `json:"hd"`
+}
+
+// Audience is the audience of a token, a single value or a list of them
+type Audience []string
+
+func (a *Audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = Audience{single}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+// Contains tells whether audience is one of a token's
+func (a Audience) Contains(audience string) bool {
+	for _, value := range a {
+		if value == audience {
+			return true
+		}
+	}
+	return false
+}
+
+func (a Audience) String() string {
+	return strings.Join(a, ",")
+}
 
-	cookieFile := git.ConfigGetURLMatch("http.cookieFile", domain)
+func ReadAuthState(domain string) (*AuthState, error) {
 
 	url, err := url.Parse(domain)
 	if err != nil {
 		return nil, err
 	}
 
-	c := Cookie{
-		JarPath: cookieFile,
-		Domain:  url.Host,
+	c, err := newCookie(domain, url.Hostname())
+	if err != nil {
+		return nil, err
 	}
 
-	rawToken, err := c.readRawTokenFromJar()
+	rawToken, err := c.readRawToken()
 	if err != nil {
 		return nil, err
 	}
 
-	token, claims, err := parseJWToken(rawToken)
+	token, claims, err := parseToken(domain, rawToken)
+	if err != nil {
+		return nil, err
+	}
+	provider, err := getProvider(domain)
 	if err != nil {
 		return nil, err
 	}
+	if err := provider.Verify(domain, rawToken, claims); err != nil {
+		return nil, fmt.Errorf("ReadAuthState - %w", err)
+	}
 
 	c.Token = token
 	c.Claims = claims
+	c.checkIssuedAt()
+
+	return &AuthState{
+		Cookie:   *c,
+		RawToken: rawToken,
+	}, nil
+}
+
+// ReadAuthStateFromEnv builds an AuthState from the token found in GIT_IAP_TOKEN or GIT_IAP_ID_TOKEN.
+// It returns nil without error when neither variable is set; the cookie jar is never touched.
+func ReadAuthStateFromEnv(domain string) (*AuthState, error) {
+	url, err := url.Parse(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	if rawToken := strings.TrimSpace(os.Getenv(TokenEnvVariable)); rawToken != "" {
+		log.Debug().Msgf("[ReadAuthStateFromEnv] Using the token of %s as is", TokenEnvVariable)
+		// the token may not even be a JWT, e.g. to see how IAP reacts to it
+		token, claims, _ := parseJWToken(rawToken)
+		return &AuthState{
+			Cookie:   Cookie{Domain: url.Hostname(), Token: token, Claims: claims},
+			RawToken: rawToken,
+		}, nil
+	}
+
+	rawToken := strings.TrimSpace(os.Getenv(IDTokenEnvVariable))
+	if rawToken == "" {
+		return nil, nil
+	}
+
+	token, claims, err := parseJWToken(rawToken)
+	if err != nil {
+		return nil, fmt.Errorf("ReadAuthStateFromEnv - invalid token in %s: %w", IDTokenEnvVariable, err)
+	}
+
+	if err := checkAudience(domain, claims); err != nil {
+		return nil, fmt.Errorf("ReadAuthStateFromEnv - token in %s: %w", IDTokenEnvVariable, err)
+	}
+
+	c := Cookie{
+		Domain:    url.Hostname(),
+		Token:     token,
+		Claims:    claims,
+		ClockSkew: getClockSkew(domain),
+	}
+	c.checkIssuedAt()
+	if c.Expired() {
+		return nil, fmt.Errorf("ReadAuthStateFromEnv - token in %s expired at %s", IDTokenEnvVariable, time.Unix(claims.ExpiresAt, 0))
+	}
 
 	return &AuthState{
 		Cookie:   c,
@@ -76,8 +206,38 @@ func ReadCookie(domain string) (*Cookie, error) {
 	return &a.Cookie, nil
 }
 
+// newCookie prepares the Cookie of a domain, backed by the configured store, by default its http.cookieFile
+func newCookie(domain, host string) (*Cookie, error) {
+	store, err := getStore(domain, StoreKindCookie)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Cookie{
+		Domain:        host,
+		Name:          CookieName(domain),
+		RefreshMargin: getRefreshMargin(domain),
+		ClockSkew:     getClockSkew(domain),
+		store:         store,
+		storeKey:      domain,
+	}
+	if _, ok := store.(*fileStore); ok {
+		c.JarPath = cookieFilePath(domain)
+	}
+	return c, nil
+}
+
+func (c *Cookie) readRawToken() (string, error) {
+	return c.store.Get(c.storeKey)
+}
+
+func (c *Cookie) save(token string) error {
+	return c.store.Put(c.storeKey, token)
+}
+
 func (c *Cookie) readRawTokenFromJar() (string, error) {
 	path := expandHome(c.JarPath)
+	ensurePrivate(path)
 
 	log.Debug().Msgf("Reading file %s", path)
 	file, err := os.Open(path)
@@ -86,9 +246,14 @@ func (c *Cookie) readRawTokenFromJar() (string, error) {
 	}
 	defer file.Close()
 
+	// the cookies of a sharded session are all those of the file, which holds nothing else
+	var pairs []string
+	sharded := false
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
 		line := scanner.Text()
+		// curl marks HttpOnly cookies as such when git saves them, see http.saveCookies
+		line = strings.TrimPrefix(line, "#HttpOnly_")
 		if strings.HasPrefix(line, "#") || line == "" {
 			continue
 		}
@@ -99,24 +264,63 @@ func (c *Cookie) readRawTokenFromJar() (string, error) {
 		}
 		// see: https://curl.haxx.se/docs/http-cookies.html
 		cookieName, cookieValue := fields[5], strings.TrimSpace(fields[6])
-		if cookieName != IAPCookieName {
+		if cookieName == c.name()+"-0" {
+			sharded = true
+		}
+		if cookieName != c.name() {
 			log.Debug().Msgf("readRawTokenFromJar - skip '%s' while parsing IAP cookie", cookieName)
+			pairs = append(pairs, fmt.Sprintf("%s=%s", cookieName, cookieValue))
 			continue
 		}
 
 		return cookieValue, nil
 	}
-	return "", fmt.Errorf("readRawTokenFromJar - %s not found", IAPCookieName)
+	if sharded {
+		return strings.Join(pairs, "; "), nil
+	}
+	return "", fmt.Errorf("readRawTokenFromJar - %s not found", c.name())
+}
+
+// cookies returns the cookies carrying a token: a single one named after the cookie, unless the token
+// is the "name-0=value; name-1=value" of a session sharded in several cookies, see ALB
+func (c *Cookie) cookies(token string) [][2]string {
+	if !strings.HasPrefix(token, c.name()+"-0=") {
+		return [][2]string{{c.name(), token}}
+	}
+	var cookies [][2]string
+	for _, pair := range strings.Split(token, "; ") {
+		if kv := strings.SplitN(pair, "=", 2); len(kv) == 2 {
+			cookies = append(cookies, [2]string{kv[0], kv[1]})
+		}
+	}
+	return cookies
 }
 
-func NewAuth(domain string, forcebrowserflow bool) (*AuthState, error) {
+func NewAuth(domain string, opts AuthOptions) (*AuthState, error) {
 
 	log.Debug().Msgf("[NewCookie] Attempting to get NewCookie")
 
-	helperID := git.ConfigGetURLMatch("iap.helperID", domain)
-	helperSecret := git.ConfigGetURLMatch("iap.helperSecret", domain)
-	IAPClientID := git.ConfigGetURLMatch("iap.clientID", domain)
-	cookieFile := git.ConfigGetURLMatch("http.cookieFile", domain)
+	unlock, waited := lockRefresh(domain)
+	defer unlock()
+	if waited && !opts.ForceBrowserFlow && !opts.SelectAccount {
+		// another process refreshed the token while we were waiting for the lock
+		if a, err := ReadAuthState(domain); err == nil && !a.Cookie.Expired() {
+			log.Debug().Msgf("[NewCookie] Reusing the token refreshed by another process")
+			return a, nil
+		}
+	}
+
+	// the scopes of a host share its refresh token: take the lock of the host too, so that
+	// e.g. submodules isolated by iap.tokenScope go through a single browser flow
+	if host := baseDomain(domain); host != domain {
+		unlockHost, _ := lockRefresh(host)
+		defer unlockHost()
+	}
+
+	provider, err := getProvider(domain)
+	if err != nil {
+		return nil, err
+	}
 
 	url, err := url.Parse(domain)
 	if err != nil {
@@ -124,9 +328,10 @@ func NewAuth(domain string, forcebrowserflow bool) (*AuthState, error) {
 		return nil, err
 	}
 
-	rawToken, err := GetIAPAuthToken(domain, helperID, helperSecret, IAPClientID, forcebrowserflow)
+	flows := interactiveFlowCount(domain)
+	rawToken, err := provider.Token(domain, opts)
 	if err != nil {
-		log.Debug().Msgf("[NewCookie] Failed to GetIAPAuthToken")
+		log.Debug().Msgf("[NewCookie] Failed to getRawToken")
 		return nil, err
 	}
 	if rawToken == "" {
@@ -134,28 +339,37 @@ func NewAuth(domain string, forcebrowserflow bool) (*AuthState, error) {
 	}
 	log.Debug().Msgf("rawToken: %+v", rawToken)
 
-	token, claims, err := parseJWToken(rawToken)
+	token, claims, err := parseToken(domain, rawToken)
 	if err != nil {
-		log.Debug().Msgf("[NewCookie] Failed to parseJWToken")
+		log.Debug().Msgf("[NewCookie] Failed to parseToken")
 		return nil, err
 	}
+	if err := provider.Verify(domain, rawToken, claims); err != nil {
+		return nil, fmt.Errorf("[NewCookie] %w", err)
+	}
 
-	c := Cookie{
-		JarPath: cookieFile,
-		Domain:  url.Host,
-		Token:   token,
-		Claims:  claims,
+	c, err := newCookie(domain, url.Hostname())
+	if err != nil {
+		return nil, err
 	}
+	c.Token = token
+	c.Claims = claims
+
 	a := &AuthState{
-		Cookie:   c,
+		Cookie:   *c,
 		RawToken: rawToken,
 	}
-	return a, c.write(token.Raw, claims.ExpiresAt)
+	if interactiveFlowCount(domain) > flows {
+		RecordAudit(domain, AuditLogin, a)
+	} else {
+		RecordAudit(domain, AuditRefresh, a)
+	}
+	return a, c.save(token.Raw)
 }
 
 // NewCookie takes care of the authentication workflow and creates the relevant IAP Cookie on the filesystem
-func NewCookie(domain string, forcebrowserflow bool) (*Cookie, error) {
-	a, err := NewAuth(domain, forcebrowserflow)
+func NewCookie(domain string, opts AuthOptions) (*Cookie, error) {
+	a, err := NewAuth(domain, opts)
 	if err != nil {
 		return nil, err
 	}
@@ -177,22 +391,82 @@ func (c *Cookie) write(token string, exp int64) error {
 	if err := os.Chmod(path, 0600); err != nil {
 		return err
 	}
+	ensurePrivate(path)
 
-	if _, err = f.WriteString(fmt.Sprintf("%s\tx\tx\tx\t%d\t%s\t%s\n", c.Domain, exp, IAPCookieName, token)); err != nil {
-		return err
+	for _, cookie := range c.cookies(token) {
+		if _, err = f.WriteString(fmt.Sprintf("%s\tx\tx\tx\t%d\t%s\t%s\n", c.Domain, exp, cookie[0], cookie[1])); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-// Expired returns a boolean that indicate if the expires-at claim is in the future
+// CookieJar returns rawToken as a Netscape cookie file, as read by curl, wget and most http libraries,
+// in which the cookie is sent over https to every path of the host until the token expires
+func (c *Cookie) CookieJar(rawToken string) string {
+	jar := "# Netscape HTTP Cookie File\n"
+	for _, cookie := range c.cookies(rawToken) {
+		jar += fmt.Sprintf("%s\tFALSE\t/\tTRUE\t%d\t%s\t%s\n", c.Domain, c.Claims.ExpiresAt, cookie[0], cookie[1])
+	}
+	return jar
+}
+
+func (c *Cookie) name() string {
+	if c.Name == "" {
+		return IAPCookieName
+	}
+	return c.Name
+}
+
+// Expired returns a boolean that indicate if the expires-at claim is in the future,
+// or closer than the refresh margin and the clock skew
 func (c *Cookie) Expired() bool {
-	return c.Claims.ExpiresAt < time.Now().Unix()
+	return c.Claims.ExpiresAt < time.Now().Add(c.RefreshMargin+c.ClockSkew).Unix()
+}
+
+// checkIssuedAt warns when the token was issued in the future beyond the clock skew,
+// which means that the local clock is late, and that IAP may see the token expire early
+func (c *Cookie) checkIssuedAt() {
+	if c.Claims.IssuedAt == 0 {
+		return
+	}
+	if ahead := time.Until(time.Unix(c.Claims.IssuedAt, 0)); ahead > c.ClockSkew {
+		log.Warn().Msgf("Token of %s was issued %s in the future: is the local clock late? Raise iap.clockSkew if it drifts", c.Domain, ahead.Round(time.Second))
+	}
+}
+
+// getRefreshMargin reads the iap.refreshMargin git config (e.g. "10m") of a domain
+func getRefreshMargin(domain string) time.Duration {
+	value := git.ConfigTryGetURLMatch("iap.refreshMargin", domain)
+	if value == "" {
+		return 0
+	}
+	margin, err := time.ParseDuration(value)
+	if err != nil || margin < 0 {
+		log.Warn().Msgf("[getRefreshMargin] Ignoring invalid iap.refreshMargin '%s'", value)
+		return 0
+	}
+	return margin
+}
+
+// getClockSkew reads the iap.clockSkew git config (e.g. "2m") of a domain, which defaults to DefaultClockSkew
+func getClockSkew(domain string) time.Duration {
+	value := git.ConfigTryGetURLMatch("iap.clockSkew", domain)
+	if value == "" {
+		return DefaultClockSkew
+	}
+	skew, err := time.ParseDuration(value)
+	if err != nil || skew < 0 {
+		log.Warn().Msgf("[getClockSkew] Ignoring invalid iap.clockSkew '%s'", value)
+		return DefaultClockSkew
+	}
+	return skew
 }
 
-func parseJWToken(rawToken string) (jwt.Token, jwt.StandardClaims, error) {
+func parseJWToken(rawToken string) (jwt.Token, Claims, error) {
 	var p jwt.Parser
-	var claims jwt.StandardClaims
+	var claims Claims
 
 	if len(rawToken) < 50 {
 		log.Warn().Msgf("Short jwt token: %s", rawToken)
@@ -200,11 +474,56 @@ func parseJWToken(rawToken string) (jwt.Token, jwt.StandardClaims, error) {
 
 	token, _, err := p.ParseUnverified(rawToken, &claims)
 	if err != nil {
-		log.Debug().Msgf("Token parse failed. It might not have refreshed properly. Is your account locked or invalid? If not: Try clearing ~/.git-credentials and ~/.config/gcp-iap/*.cookie")
+		log.Debug().Msgf("Token parse failed. It might not have refreshed properly. Is your account locked or invalid? If not: Try clearing ~/.git-credentials and %s", filepath.Join(CacheDir(), "*.cookie"))
+	}
+	if token == nil {
+		return jwt.Token{}, claims, err
 	}
 	return *token, claims, err
 }
 
+// DecodeToken returns the header and all the claims of a JWT, without verifying it
+func DecodeToken(rawToken string) (map[string]interface{}, map[string]interface{}, error) {
+	var p jwt.Parser
+	claims := jwt.MapClaims{}
+
+	token, _, err := p.ParseUnverified(rawToken, claims)
+	if err != nil {
+		return nil, nil, fmt.Errorf("[DecodeToken] Token is not a JWT: %w", err)
+	}
+	return token.Header, claims, nil
+}
+
+// checkAudience verifies that a token was issued for the IAP instance of a domain, so that a token
+// cached before iap.clientID or iap.audience changed is not sent to IAP.
+// Pre-issued tokens may be used without any configuration, with nothing to check against.
+func checkAudience(domain string, claims Claims) error {
+	audience := git.ConfigTryGetURLMatch("iap.audience", domain)
+	if audience == "" {
+		audience = git.ConfigTryGetURLMatch("iap.clientID", domain)
+	}
+	if audience == "" {
+		return nil
+	}
+	if !claims.Audience.Contains(audience) {
+		return fmt.Errorf("token was issued for audience '%s' instead of '%s'", claims.Audience, audience)
+	}
+	return nil
+}
+
+// checkHostedDomain verifies that a user token was issued for an account of the Google Workspace
+// domain set in the iap.hostedDomain git config, if any. Service accounts have no such domain.
+func checkHostedDomain(domain string, claims Claims) error {
+	hostedDomain := git.ConfigTryGetURLMatch("iap.hostedDomain", domain)
+	if hostedDomain == "" || strings.HasSuffix(claims.Email, ".gserviceaccount.com") {
+		return nil
+	}
+	if !strings.EqualFold(claims.HostedDomain, hostedDomain) {
+		return fmt.Errorf("token of %s does not belong to the %s domain (iap.hostedDomain)", claims.Email, hostedDomain)
+	}
+	return nil
+}
+
 func expandHome(path string) string {
 	if len(path) == 0 || path[0] != '~' {
 		return path
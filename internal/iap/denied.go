@@ -0,0 +1,52 @@
+package iap
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// iapGeneratedResponseHeader is set by IAP on the responses it generates itself, as opposed to the backend's
+const iapGeneratedResponseHeader = "X-Goog-IAP-Generated-Response"
+
+// IsAccessDenied probes a git repository url with rawToken, and reports whether IAP itself
+// refused the request: the user is authenticated, but the account lacks access to the resource.
+func IsAccessDenied(repoURL, rawToken string) (bool, error) {
+	probe := fmt.Sprintf("%s/info/refs?service=git-upload-pack", strings.TrimSuffix(repoURL, "/"))
+
+	req, err := http.NewRequest("GET", probe, nil)
+	if err != nil {
+		return false, err
+	}
+	if header := AuthHeader(repoURL, rawToken); header != "" {
+		parts := strings.SplitN(header, ": ", 2)
+		req.Header.Set(parts[0], parts[1])
+	}
+
+	// a redirect is not a denial, and following it could send the token to another host
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("[IsAccessDenied] Could not probe %s: %w", probe, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusForbidden {
+		return false, nil
+	}
+	if resp.Header.Get(iapGeneratedResponseHeader) == "true" {
+		log.Debug().Msgf("[IsAccessDenied] IAP denied access to %s", probe)
+		return true, nil
+	}
+
+	// older IAP deployments only show their access denied page
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	return strings.Contains(string(body), "You don't have access"), nil
+}
@@ -0,0 +1,163 @@
+package iap
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/adohkan/git-remote-https-iap/internal/git"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	// deviceCodeURL is Google's device authorization endpoint.
+	// see: https://developers.google.com/identity/protocols/oauth2/limited-input-device
+	deviceCodeURL       = "https://oauth2.googleapis.com/device/code"
+	deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+	// AuthFlowBrowser, AuthFlowDevice and AuthFlowManual are the accepted values of the iap.authFlow git config
+	AuthFlowBrowser = "browser"
+	AuthFlowDevice  = "device"
+	AuthFlowManual  = "manual"
+)
+
+type deviceCode struct {
+	DeviceCode      string `json:"device_code"`
+	UserCode        string `json:"user_code"`
+	VerificationURL string `json:"verification_url"`
+	ExpiresIn       int    `json:"expires_in"`
+	Interval        int    `json:"interval"`
+}
+
+type deviceToken struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// browserAvailable guesses whether a browser can be opened on the user's screen
+func browserAvailable() bool {
+	graphical := os.Getenv("DISPLAY") != "" || os.Getenv("WAYLAND_DISPLAY") != ""
+	if os.Getenv("SSH_CONNECTION") != "" || os.Getenv("SSH_TTY") != "" {
+		// only X forwarding brings the browser back to the user
+		return graphical
+	}
+	if isWSL() {
+		// the Windows browser is used, see openWSLBrowser
+		return true
+	}
+	if runtime.GOOS == "linux" || runtime.GOOS == "freebsd" {
+		return graphical
+	}
+	return true
+}
+
+// getAuthFlow returns the interactive flow to use: the manual flow when asked for, the iap.authFlow
+// git config when set, and otherwise the device flow when no browser seems to be available.
+func getAuthFlow(domain string, opts AuthOptions) string {
+	if opts.NoBrowser {
+		return AuthFlowManual
+	}
+
+	switch flow := git.ConfigTryGetURLMatch("iap.authFlow", domain); flow {
+	case AuthFlowBrowser, AuthFlowDevice, AuthFlowManual:
+		return flow
+	case "":
+	default:
+		log.Warn().Msgf("[getAuthFlow] Ignoring unknown iap.authFlow '%s'", flow)
+	}
+
+	if !browserAvailable() {
+		return AuthFlowDevice
+	}
+	return AuthFlowBrowser
+}
+
+// getRefreshTokenFromDeviceFlow runs the OAuth 2.0 device authorization grant: the user is asked to
+// visit a URL on any device and enter a code, while we poll for the resulting refresh token.
+// Google only allows this flow for OAuth clients of type 'TVs and Limited Input devices'.
+func getRefreshTokenFromDeviceFlow(domain, helperID, helperSecret string) (string, error) {
+	var code deviceCode
+	var errorMesg httpError
+
+	resp, err := http.PostForm(deviceCodeURL, url.Values{
+		"client_id": {helperID},
+		"scope":     {strings.Join(append([]string{"openid", "email"}, getAdditionalScopes(domain)...), " ")},
+	})
+	if err != nil {
+		return "", fmt.Errorf("[getRefreshTokenFromDeviceFlow] Could not request device code: %s", err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		json.NewDecoder(resp.Body).Decode(&errorMesg)
+		return "", fmt.Errorf("[getRefreshTokenFromDeviceFlow] Could not request device code: %s (%s)", errorMesg.Error, errorMesg.ErrorDesc)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&code); err != nil {
+		return "", fmt.Errorf("[getRefreshTokenFromDeviceFlow] Could not decode device code: %s", err.Error())
+	}
+
+	// stdout belongs to git when running as a remote helper
+	fmt.Fprintf(os.Stderr, "To authenticate, visit %s and enter the code: %s\n", code.VerificationURL, code.UserCode)
+
+	interval := time.Duration(code.Interval) * time.Second
+	if interval == 0 {
+		interval = 5 * time.Second
+	}
+	deadline := time.Now().Add(time.Duration(code.ExpiresIn) * time.Second)
+
+	for time.Now().Before(deadline) {
+		time.Sleep(interval)
+
+		refreshToken, status, err := pollDeviceToken(helperID, helperSecret, code.DeviceCode)
+		switch status {
+		case "":
+			log.Debug().Msgf("[getRefreshTokenFromDeviceFlow] refreshToken: %s", refreshToken)
+			return refreshToken, err
+		case "authorization_pending":
+			continue
+		case "slow_down":
+			interval += 5 * time.Second
+			continue
+		default:
+			return "", err
+		}
+	}
+
+	return "", fmt.Errorf("[getRefreshTokenFromDeviceFlow] Device code expired before authorization was granted")
+}
+
+// pollDeviceToken checks once whether the user has completed the device flow.
+// It returns the refresh token when granted, or the OAuth error code with an error otherwise.
+func pollDeviceToken(helperID, helperSecret, code string) (string, string, error) {
+	var result deviceToken
+	var errorMesg httpError
+
+	params := url.Values{
+		"client_id":   {helperID},
+		"device_code": {code},
+		"grant_type":  {deviceCodeGrantType},
+	}
+	if helperSecret != "" {
+		params.Set("client_secret", helperSecret)
+	}
+	resp, err := http.PostForm(google.Endpoint.TokenURL, params)
+	if err != nil {
+		return "", "request_failed", fmt.Errorf("[pollDeviceToken] Could not poll for device authorization: %s", err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		json.NewDecoder(resp.Body).Decode(&errorMesg)
+		return "", errorMesg.Error, fmt.Errorf("[pollDeviceToken] Device authorization failed: %s (%s)", errorMesg.Error, errorMesg.ErrorDesc)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", "invalid_response", fmt.Errorf("[pollDeviceToken] Could not decode device token: %s", err.Error())
+	}
+
+	return result.RefreshToken, "", nil
+}
@@ -0,0 +1,213 @@
+package iap
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/adohkan/git-remote-https-iap/internal/git"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// CacheDirEnvVariable overrides the directory where cookie files are created
+	CacheDirEnvVariable = "GIT_IAP_CACHE_DIR"
+
+	cacheDirName = "gcp-iap"
+
+	// ConfigFileEnvVariable overrides the file of the defaults of the helper
+	ConfigFileEnvVariable = "GIT_IAP_CONFIG"
+
+	configDirName  = "git-remote-https+iap"
+	configFileName = "config.yaml"
+
+	// TokenScopeHost shares a token between all remotes of a host (or of a path mapped to its own clientID)
+	TokenScopeHost = "host"
+	// TokenScopeRemote isolates the token of each remote url, e.g. when repositories of a host sit behind
+	// IAP instances of different audiences
+	TokenScopeRemote = "remote"
+)
+
+// MovedFile describes a cookie file relocated by MigrateCookieFiles
+type MovedFile struct {
+	URL  string
+	From string
+	To   string
+}
+
+// CacheDir returns the directory of cookie files: GIT_IAP_CACHE_DIR, or gcp-iap in the XDG state directory
+// ($XDG_STATE_HOME, defaulting to ~/.local/state), or in %LOCALAPPDATA% on Windows.
+// Paths in the home directory are returned with a leading ~, so that git config stays valid across machines.
+func CacheDir() string {
+	if dir := os.Getenv(CacheDirEnvVariable); dir != "" {
+		return unexpandHome(dir)
+	}
+	if runtime.GOOS == "windows" {
+		if dir := os.Getenv("LOCALAPPDATA"); dir != "" {
+			return filepath.Join(dir, cacheDirName)
+		}
+	}
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return unexpandHome(filepath.Join(dir, cacheDirName))
+	}
+	return filepath.Join("~", ".local", "state", cacheDirName)
+}
+
+// ConfigFile returns the YAML file of the defaults of the helper: GIT_IAP_CONFIG,
+// or git-remote-https+iap/config.yaml in the XDG config directory ($XDG_CONFIG_HOME, defaulting to ~/.config),
+// or in %APPDATA% on Windows. Its keys apply to the hosts whose git config does not set them.
+func ConfigFile() string {
+	if path := os.Getenv(ConfigFileEnvVariable); path != "" {
+		return expandHome(path)
+	}
+	if runtime.GOOS == "windows" {
+		if dir := os.Getenv("APPDATA"); dir != "" {
+			return filepath.Join(dir, configDirName, configFileName)
+		}
+	}
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, configDirName, configFileName)
+	}
+	return expandHome(filepath.Join("~", ".config", configDirName, configFileName))
+}
+
+// CookieFile returns the path of the cookie file of a host, or of a path prefix of a host
+// such as git.domain.acme/team-b, in CacheDir
+func CookieFile(host string) string {
+	return filepath.Join(CacheDir(), fmt.Sprintf("%s.cookie", hostSlug(host)))
+}
+
+// ConfigFragment returns the path of a git config file holding the IAP configuration of a host,
+// included by the user's git config under conditions, e.g. for the repositories of a directory
+func ConfigFragment(host string) string {
+	return filepath.Join("~", ".config", "git", cacheDirName, fmt.Sprintf("%s.gitconfig", hostSlug(host)))
+}
+
+// ExpandHome resolves a path starting with ~, as git does for the paths of its config
+func ExpandHome(path string) string {
+	return expandHome(path)
+}
+
+// inCacheDir tells whether a path sits in CacheDir, whose files were all written by the helper
+func inCacheDir(path string) bool {
+	rel, err := filepath.Rel(expandHome(CacheDir()), expandHome(path))
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// hostSlug turns a host, or a host with a path prefix, into a file name
+func hostSlug(host string) string {
+	slug := strings.ReplaceAll(strings.Trim(host, "/"), ".", "-")
+	slug = strings.ReplaceAll(slug, "/", "-")
+	slug = strings.ReplaceAll(slug, "*", "_wildcard_")
+	// colons are not allowed in file names on Windows
+	return strings.ReplaceAll(slug, ":", "_")
+}
+
+// cookieFilePath returns the cookie file of an auth scope: its http.cookieFile, suffixed with the path
+// of the remote when iap.tokenScope isolates remotes
+func cookieFilePath(domain string) string {
+	path := git.ConfigGetURLMatch("http.cookieFile", domain)
+	if git.ConfigTryGetURLMatch("iap.tokenScope", domain) != TokenScopeRemote {
+		return path
+	}
+
+	u, err := url.Parse(domain)
+	if err != nil || strings.Trim(u.Path, "/") == "" {
+		return path
+	}
+	slug := strings.ReplaceAll(strings.Trim(u.Path, "/"), "/", "-")
+	return fmt.Sprintf("%s-%s.cookie", strings.TrimSuffix(path, ".cookie"), slug)
+}
+
+// MigrateCookieFiles moves the cookie files configured with http.<url>.cookieFile for IAP urls into CacheDir,
+// along with their encrypted counterparts, then points the git config, in the file setting it, to the new location.
+// Cookie files of other urls, such as ~/.gitcookies, are left where they are.
+func MigrateCookieFiles() ([]MovedFile, error) {
+	var moved []MovedFile
+
+	taken := map[string]bool{}
+	for _, url := range git.ConfigURLsWithKey("http", "cookieFile") {
+		name := fmt.Sprintf("http.%s.cookieFile", url)
+		from := git.ConfigTryGet(name)
+		if from == "" || inCacheDir(from) || !Configured(url) {
+			continue
+		}
+		scope, err := git.ConfigOrigin(name)
+		if err != nil {
+			return moved, fmt.Errorf("[MigrateCookieFiles] %w", err)
+		}
+		if scope == "" {
+			log.Debug().Msgf("[MigrateCookieFiles] Kept cookie file of %s, not configured in a file", url)
+			continue
+		}
+		to := uniqueCookieFile(url, taken)
+
+		for _, suffix := range []string{"", encryptedFileSuffix} {
+			if err := moveFile(expandHome(from)+suffix, expandHome(to)+suffix); err != nil {
+				return moved, fmt.Errorf("[MigrateCookieFiles] Could not move %s%s: %w", from, suffix, err)
+			}
+		}
+		git.SetConfig(&git.GitConfig{Url: url, Section: "http", Key: "cookieFile", Value: to}, scope)
+
+		log.Debug().Msgf("[MigrateCookieFiles] Moved cookie file of %s from %s to %s", url, from, to)
+		moved = append(moved, MovedFile{URL: url, From: from, To: to})
+	}
+	return moved, nil
+}
+
+// uniqueCookieFile returns the CookieFile of an url, numbered when that file exists or was taken by another url,
+// as cookie files of different directories may share their name
+func uniqueCookieFile(rawURL string, taken map[string]bool) string {
+	host := rawURL
+	if u, err := url.Parse(rawURL); err == nil && u.Host != "" {
+		host = u.Host + u.Path
+	}
+	base := strings.TrimSuffix(CookieFile(host), ".cookie")
+	to := base + ".cookie"
+	for n := 2; taken[to] || fileExists(expandHome(to)) || fileExists(expandHome(to)+encryptedFileSuffix); n++ {
+		to = fmt.Sprintf("%s-%d.cookie", base, n)
+	}
+	taken[to] = true
+	return to
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// moveFile renames a file, copying it across file systems, e.g. to a network home directory.
+// A missing source file is not an error: cookies are only written once a token was obtained.
+func moveFile(from, to string) error {
+	data, err := os.ReadFile(from)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(to), 0700); err != nil {
+		return err
+	}
+	if err := os.Rename(from, to); err == nil {
+		ensurePrivate(to)
+		return nil
+	}
+	if err := os.WriteFile(to, data, 0600); err != nil {
+		return err
+	}
+	ensurePrivate(to)
+	return os.Remove(from)
+}
+
+// unexpandHome is the reverse of expandHome
+func unexpandHome(path string) string {
+	home := os.Getenv("HOME")
+	if home == "" || !strings.HasPrefix(path, home+string(filepath.Separator)) {
+		return path
+	}
+	return filepath.Join("~", strings.TrimPrefix(path, home))
+}
@@ -0,0 +1,62 @@
+package iap
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/adohkan/git-remote-https-iap/internal/git"
+)
+
+// CheckCookieFile returns the cookie file of a domain, and an error when no token can be written to it.
+// The path is empty when the token of the domain is kept in another store.
+func CheckCookieFile(domain string) (string, error) {
+	store, err := getStore(domain, StoreKindCookie)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := store.(*fileStore); !ok {
+		return "", nil
+	}
+	if git.ConfigTryGetURLMatch("http.cookieFile", domain) == "" {
+		return "", fmt.Errorf("http.cookieFile is not set for %s", domain)
+	}
+
+	path := cookieFilePath(domain)
+	dir := filepath.Dir(expandHome(path))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return path, err
+	}
+	f, err := os.CreateTemp(dir, ".doctor-")
+	if err != nil {
+		return path, err
+	}
+	f.Close()
+	return path, os.Remove(f.Name())
+}
+
+// ProbeIAP requests a domain without any token, and reports whether IAP answered,
+// by redirecting to the Google sign-in page or with a response of its own
+func ProbeIAP(domain string) (bool, error) {
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get(domain)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	if resp.Header.Get(iapGeneratedResponseHeader) == "true" {
+		return true, nil
+	}
+	location, err := resp.Location()
+	// Cloudflare Access redirects to the team domain instead, and ALBs to their identity provider,
+	// which sends the browser back to the /oauth2/idpresponse of the ALB
+	return err == nil && (strings.EqualFold(location.Host, googleSignInHost) || strings.HasSuffix(location.Host, cloudflareTeamSuffix) ||
+		strings.Contains(location.RawQuery, albCallbackParam)), nil
+}
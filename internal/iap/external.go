@@ -0,0 +1,61 @@
+package iap
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/oauth2/google"
+)
+
+const externalAccountType = "external_account"
+
+// impersonationURLPattern extracts the service account email from a service_account_impersonation_url
+var impersonationURLPattern = regexp.MustCompile(`/serviceAccounts/([^/:]+):generateAccessToken$`)
+
+// externalAccountConfig holds the fields we need from a Workload Identity Federation credential configuration,
+// the rest of the file is handled by golang.org/x/oauth2/google.
+// see: https://cloud.google.com/iam/docs/workload-identity-federation-with-other-providers#create-cred-config
+type externalAccountConfig struct {
+	Type                           string `json:"type"`
+	ServiceAccountImpersonationURL string `json:"service_account_impersonation_url"`
+}
+
+// GetExternalAccountIDToken exchanges external OIDC, SAML or AWS credentials described by a
+// Workload Identity Federation credential configuration for an IAP auth token.
+// Google's STS only returns access tokens, so the configuration must impersonate a service account,
+// which is then used to generate the ID token.
+// It returns a raw IAP auth token and any error encountered.
+func GetExternalAccountIDToken(configFile, IAPclientID string) (string, error) {
+	data, err := os.ReadFile(expandHome(configFile))
+	if err != nil {
+		return "", err
+	}
+
+	var config externalAccountConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return "", fmt.Errorf("[GetExternalAccountIDToken] Could not parse %s: %w", configFile, err)
+	}
+
+	match := impersonationURLPattern.FindStringSubmatch(config.ServiceAccountImpersonationURL)
+	if match == nil {
+		return "", fmt.Errorf("[GetExternalAccountIDToken] %s must set 'service_account_impersonation_url' to mint ID tokens", configFile)
+	}
+	serviceAccount := match[1]
+
+	creds, err := google.CredentialsFromJSON(context.Background(), data, cloudPlatformScope)
+	if err != nil {
+		return "", fmt.Errorf("[GetExternalAccountIDToken] Could not load %s: %w", configFile, err)
+	}
+
+	accessToken, err := creds.TokenSource.Token()
+	if err != nil {
+		return "", fmt.Errorf("[GetExternalAccountIDToken] Could not exchange external credentials: %w", err)
+	}
+	log.Debug().Msgf("[GetExternalAccountIDToken] Exchanged external credentials, impersonating %s", serviceAccount)
+
+	return generateIDToken(accessToken, serviceAccount, IAPclientID)
+}
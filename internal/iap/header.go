@@ -0,0 +1,58 @@
+package iap
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/adohkan/git-remote-https-iap/internal/git"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// HeaderProxyAuthorization sends the token as a Proxy-Authorization bearer, which IAP strips
+	// before reaching the backend, so that the backend's own Authorization keeps working. It is the default of Google's IAP.
+	HeaderProxyAuthorization = "proxy-authorization"
+	// HeaderAuthorization sends the token as an Authorization bearer, for proxies expecting it there
+	HeaderAuthorization = "authorization"
+	// HeaderCookie sends the token as a cookie named after iap.cookieName
+	HeaderCookie = "cookie"
+	// HeaderNone sends no header: git only sends the cookie file
+	HeaderNone = "none"
+)
+
+// CookieName returns the name of the cookie carrying the token of a domain, from iap.cookieName,
+// for IAP-compatible proxies using another name than IAP, or that of its Provider
+func CookieName(domain string) string {
+	if name := git.ConfigTryGetURLMatch("iap.cookieName", domain); name != "" {
+		return name
+	}
+	if provider, err := getProvider(domain); err == nil {
+		return provider.CookieName()
+	}
+	return IAPCookieName
+}
+
+// AuthHeader returns the header sending rawToken to the IAP of a domain, in the "Name: value" form,
+// according to iap.authHeader. It returns an empty string when no header should be sent.
+func AuthHeader(domain, rawToken string) string {
+	placement := strings.ToLower(git.ConfigTryGetURLMatch("iap.authHeader", domain))
+
+	switch placement {
+	case "":
+		if provider, err := getProvider(domain); err == nil {
+			return provider.Header(domain, rawToken)
+		}
+		return fmt.Sprintf("Proxy-Authorization: Bearer %s", rawToken)
+	case HeaderProxyAuthorization:
+		return fmt.Sprintf("Proxy-Authorization: Bearer %s", rawToken)
+	case HeaderAuthorization:
+		return fmt.Sprintf("Authorization: Bearer %s", rawToken)
+	case HeaderCookie:
+		return fmt.Sprintf("Cookie: %s=%s", CookieName(domain), rawToken)
+	case HeaderNone:
+		return ""
+	default:
+		log.Warn().Msgf("[AuthHeader] Ignoring invalid iap.authHeader '%s'", placement)
+		return fmt.Sprintf("Proxy-Authorization: Bearer %s", rawToken)
+	}
+}
@@ -0,0 +1,80 @@
+package iap
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/adohkan/git-remote-https-iap/internal/git"
+	"github.com/rs/zerolog/log"
+)
+
+// keyringStores are the stores keeping secrets out of plaintext files, where helper secrets are saved
+var keyringStores = map[string]bool{
+	StoreKeychain:      true,
+	StoreWincred:       true,
+	StoreSecretService: true,
+	StoreKWallet:       true,
+}
+
+// HelperSecretStore returns the keyring keeping the helper secret of a domain, selected by
+// iap.refreshTokenStore or iap.credentialStore, or "" when it stays in the iap.helperSecret git config
+func HelperSecretStore(domain string) string {
+	name := StoreName(domain, StoreKindHelperSecret)
+	if !keyringStores[name] {
+		return ""
+	}
+	return name
+}
+
+// helperSecretFor returns the iap.helperSecret git config of a domain, or else the secret saved in its keyring
+func helperSecretFor(domain string) string {
+	if secret := git.ConfigTryGetURLMatch("iap.helperSecret", domain); secret != "" {
+		return secret
+	}
+	if HelperSecretStore(domain) == "" {
+		return ""
+	}
+
+	store, err := getStore(domain, StoreKindHelperSecret)
+	if err != nil {
+		log.Debug().Msgf("[helperSecretFor] %s", err)
+		return ""
+	}
+	secret, err := store.Get(baseDomain(domain))
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		log.Debug().Msgf("[helperSecretFor] Could not read helper secret for %s: %s", domain, err)
+	}
+	return secret
+}
+
+// SaveHelperSecret saves the helper secret of a domain in its keyring, see HelperSecretStore
+func SaveHelperSecret(domain, secret string) error {
+	store, err := getStore(domain, StoreKindHelperSecret)
+	if err != nil {
+		return err
+	}
+	if err := store.Put(baseDomain(domain), secret); err != nil {
+		return fmt.Errorf("[SaveHelperSecret] Could not save helper secret for %s: %w", domain, err)
+	}
+	log.Debug().Msgf("[SaveHelperSecret] Saved helper secret for %s", domain)
+	return nil
+}
+
+// DeleteHelperSecret deletes the helper secret of a domain from its keyring, if any
+func DeleteHelperSecret(domain string) error {
+	if HelperSecretStore(domain) == "" {
+		return nil
+	}
+
+	store, err := getStore(domain, StoreKindHelperSecret)
+	if err != nil {
+		return err
+	}
+	if _, err := store.Get(baseDomain(domain)); err != nil {
+		return nil
+	}
+	if err := store.Delete(baseDomain(domain)); err != nil {
+		return fmt.Errorf("[DeleteHelperSecret] Could not delete helper secret for %s: %w", domain, err)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package iap
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// generateIDTokenURL is the IAM Credentials API endpoint minting ID tokens for a service account.
+	// see: https://cloud.google.com/iam/docs/reference/credentials/rest/v1/projects.serviceAccounts/generateIdToken
+	generateIDTokenURL = "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/%s:generateIdToken"
+
+	cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+)
+
+type generateIDTokenRequest struct {
+	Audience     string `json:"audience"`
+	IncludeEmail bool   `json:"includeEmail"`
+}
+
+type generateIDTokenResponse struct {
+	Token string `json:"token"`
+}
+
+type googleAPIError struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// generateIDToken asks the IAM Credentials API for an ID token of serviceAccount, with IAPclientID as audience.
+// The caller, identified by accessToken, needs the 'Service Account OpenID Connect Identity Token Creator' role on serviceAccount.
+func generateIDToken(accessToken *oauth2.Token, serviceAccount, IAPclientID string) (string, error) {
+	var result generateIDTokenResponse
+	var errorMesg googleAPIError
+
+	body, err := json.Marshal(generateIDTokenRequest{
+		Audience:     IAPclientID,
+		IncludeEmail: true,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest("POST", fmt.Sprintf(generateIDTokenURL, serviceAccount), bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	accessToken.SetAuthHeader(req)
+
+	log.Debug().Msgf("[generateIDToken] Requesting ID token for %s", serviceAccount)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("[generateIDToken] Could not call generateIdToken for %s: %s", serviceAccount, err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		json.NewDecoder(resp.Body).Decode(&errorMesg)
+		return "", fmt.Errorf("[generateIDToken] Could not generate ID token for %s: HTTP %d: %s", serviceAccount, resp.StatusCode, errorMesg.Error.Message)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("[generateIDToken] Could not decode ID token for %s: %s", serviceAccount, err.Error())
+	}
+
+	return result.Token, nil
+}
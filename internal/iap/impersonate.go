@@ -0,0 +1,40 @@
+package iap
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/oauth2/google"
+)
+
+// GetImpersonatedIDToken mints an IAP auth token for serviceAccount using the caller's credentials:
+// keyFile when given, and otherwise Application Default Credentials (gcloud user, metadata server...).
+// It returns a raw IAP auth token and any error encountered.
+func GetImpersonatedIDToken(serviceAccount, keyFile, IAPclientID string) (string, error) {
+	ctx := context.Background()
+
+	var creds *google.Credentials
+	var err error
+	if keyFile != "" {
+		data, readErr := os.ReadFile(expandHome(keyFile))
+		if readErr != nil {
+			return "", readErr
+		}
+		creds, err = google.CredentialsFromJSON(ctx, data, cloudPlatformScope)
+	} else {
+		creds, err = google.FindDefaultCredentials(ctx, cloudPlatformScope)
+	}
+	if err != nil {
+		return "", fmt.Errorf("[GetImpersonatedIDToken] Could not load caller credentials: %w", err)
+	}
+
+	accessToken, err := creds.TokenSource.Token()
+	if err != nil {
+		return "", fmt.Errorf("[GetImpersonatedIDToken] Could not get access token for caller: %w", err)
+	}
+	log.Debug().Msgf("[GetImpersonatedIDToken] Impersonating %s", serviceAccount)
+
+	return generateIDToken(accessToken, serviceAccount, IAPclientID)
+}
@@ -0,0 +1,212 @@
+package iap
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt"
+	"github.com/rs/zerolog/log"
+
+	"github.com/adohkan/git-remote-https-iap/internal/git"
+)
+
+const (
+	// googleCertsURL publishes the keys signing Google ID tokens, as a JWKS
+	// see: https://developers.google.com/identity/openid-connect/openid-connect#validatinganidtoken
+	googleCertsURL = "https://www.googleapis.com/oauth2/v3/certs"
+
+	certsFileName      = "google-certs.json"
+	defaultCertsMaxAge = 6 * time.Hour
+)
+
+var (
+	maxAgeRegexp = regexp.MustCompile(`max-age=(\d+)`)
+
+	// errUnverifiable means that the signing keys could not be fetched
+	errUnverifiable = errors.New("signing keys unavailable")
+)
+
+// jwk is an RSA or P-256 public key of a JWKS
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// certsCache is the on-disk copy of a JWKS, such as Google's
+type certsCache struct {
+	Expires time.Time `json:"expires"`
+	Keys    []jwk     `json:"keys"`
+}
+
+// verifySignature checks that a token is signed by Google, unless iap.verifySignature is false
+func verifySignature(domain, rawToken string) error {
+	return verifyJWKSSignature(domain, rawToken, googleCertsURL, certsFileName, "Google")
+}
+
+// verifyJWKSSignature checks that a token is signed by one of the keys published at certsURL by issuer,
+// unless iap.verifySignature is false. Keys are cached in cacheFile of the storage directory, and fetched
+// again when they expire or when the token is signed by an unknown key. When keys cannot be fetched,
+// e.g. offline, the check is skipped.
+func verifyJWKSSignature(domain, rawToken, certsURL, cacheFile, issuer string) error {
+	if value := git.ConfigTryGetURLMatch("iap.verifySignature", domain); value != "" {
+		if verify, err := strconv.ParseBool(value); err == nil && !verify {
+			return nil
+		}
+	}
+
+	p := jwt.Parser{
+		ValidMethods: []string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodES256.Alg()},
+		// expiry is handled by the caller, expired tokens are still worth parsing
+		SkipClaimsValidation: true,
+	}
+
+	_, err := p.ParseWithClaims(rawToken, &Claims{}, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, err := publicKey(certsURL, cacheFile, kid)
+		if err != nil {
+			return nil, err
+		}
+		if key == nil {
+			return nil, errUnverifiable
+		}
+		return key, nil
+	})
+	if ve, ok := err.(*jwt.ValidationError); ok && ve.Inner == errUnverifiable {
+		log.Warn().Msgf("Could not fetch the signing keys of %s, the token of %s was not verified", issuer, domain)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("[verifySignature] Token of %s is not signed by %s: %w", domain, issuer, err)
+	}
+	return nil
+}
+
+// publicKey returns the key of a kid published at certsURL, from cacheFile or freshly fetched.
+// It returns nil without error when keys cannot be fetched.
+func publicKey(certsURL, cacheFile, kid string) (interface{}, error) {
+	path := filepath.Join(expandHome(CacheDir()), cacheFile)
+
+	var cache certsCache
+	if data, err := os.ReadFile(path); err == nil {
+		json.Unmarshal(data, &cache)
+	}
+	if time.Now().Before(cache.Expires) {
+		if key := cache.find(kid); key != nil {
+			return key.publicKey()
+		}
+	}
+
+	fresh, err := fetchCerts(certsURL)
+	if err != nil {
+		log.Debug().Msgf("[publicKey] %s", err)
+		if key := cache.find(kid); key != nil {
+			// stale keys are better than none
+			return key.publicKey()
+		}
+		return nil, nil
+	}
+	if data, err := json.Marshal(fresh); err == nil {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err == nil {
+			os.WriteFile(path, data, 0600)
+		}
+	}
+
+	key := fresh.find(kid)
+	if key == nil {
+		return nil, fmt.Errorf("unknown signing key '%s'", kid)
+	}
+	return key.publicKey()
+}
+
+func fetchCerts(certsURL string) (*certsCache, error) {
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(certsURL)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch %s: %w", certsURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("could not fetch %s: HTTP %d", certsURL, resp.StatusCode)
+	}
+
+	var certs certsCache
+	if err := json.NewDecoder(resp.Body).Decode(&certs); err != nil {
+		return nil, fmt.Errorf("could not decode %s: %w", certsURL, err)
+	}
+
+	maxAge := defaultCertsMaxAge
+	if match := maxAgeRegexp.FindStringSubmatch(resp.Header.Get("Cache-Control")); match != nil {
+		if seconds, err := strconv.Atoi(match[1]); err == nil {
+			maxAge = time.Duration(seconds) * time.Second
+		}
+	}
+	certs.Expires = time.Now().Add(maxAge)
+
+	log.Debug().Msgf("[fetchCerts] Fetched %d keys of %s, valid for %s", len(certs.Keys), certsURL, maxAge)
+	return &certs, nil
+}
+
+func (c *certsCache) find(kid string) *jwk {
+	for i := range c.Keys {
+		if c.Keys[i].Kid == kid {
+			return &c.Keys[i]
+		}
+	}
+	return nil
+}
+
+func (k *jwk) publicKey() (interface{}, error) {
+	switch {
+	case k.Kty == "RSA":
+		return k.rsaPublicKey()
+	case k.Kty == "EC" && k.Crv == "P-256":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type '%s'", strings.TrimSpace(k.Kty+" "+k.Crv))
+	}
+}
+
+func (k *jwk) rsaPublicKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, err
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}, nil
+}
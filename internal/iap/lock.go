@@ -0,0 +1,62 @@
+package iap
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const lockPollInterval = 100 * time.Millisecond
+
+// lockRefresh takes an exclusive lock on the auth scope of domain, so that when several git processes,
+// e.g. submodule fetches, find an expired token, a single one refreshes it.
+// It reports whether another process held the lock, in which case its token may be reused.
+// Waiting is bounded by the browser timeout: past it, the refresh goes on without the lock.
+func lockRefresh(domain string) (unlock func(), waited bool) {
+	noop := func() {}
+
+	dir := filepath.Join(expandHome(CacheDir()), "locks")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Debug().Msgf("[lockRefresh] Could not create %s: %s", dir, err)
+		return noop, false
+	}
+	sum := sha256.Sum256([]byte(domain))
+	path := filepath.Join(dir, hex.EncodeToString(sum[:8])+".lock")
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		log.Debug().Msgf("[lockRefresh] Could not open %s: %s", path, err)
+		return noop, false
+	}
+
+	deadline := time.Now().Add(getBrowserTimeout(domain) + 10*time.Second)
+	for {
+		locked, err := tryLockFile(f)
+		if err != nil {
+			log.Debug().Msgf("[lockRefresh] Could not lock %s: %s", path, err)
+			f.Close()
+			return noop, waited
+		}
+		if locked {
+			log.Debug().Msgf("[lockRefresh] Locked %s for %s", path, domain)
+			return func() {
+				unlockFile(f)
+				f.Close()
+			}, waited
+		}
+		if time.Now().After(deadline) {
+			log.Warn().Msgf("Gave up waiting for another process to refresh the token of %s", domain)
+			f.Close()
+			return noop, waited
+		}
+		if !waited {
+			log.Debug().Msgf("[lockRefresh] Waiting for another process to refresh the token of %s", domain)
+		}
+		waited = true
+		time.Sleep(lockPollInterval)
+	}
+}
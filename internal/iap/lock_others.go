@@ -0,0 +1,23 @@
+//go:build !windows
+// +build !windows
+
+package iap
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// tryLockFile takes an advisory lock on f without blocking, and reports whether it got it
+func tryLockFile(f *os.File) (bool, error) {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func unlockFile(f *os.File) {
+	syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,127 @@
+package iap
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/adohkan/git-remote-https-iap/internal/git"
+	"github.com/rs/zerolog/log"
+)
+
+// revokeURL is Google's OAuth token revocation endpoint.
+// see: https://developers.google.com/identity/protocols/oauth2/native-app#tokenrevoke
+const revokeURL = "https://oauth2.googleapis.com/revoke"
+
+// Logout forgets the credentials of a domain: the cached refresh token is revoked then erased,
+// and the cookie, from its file or keyring, is deleted.
+func Logout(domain string) error {
+	var errs []error
+
+	if refreshToken, err := getRefreshTokenFromCache(domain); err == nil {
+		if err := revokeToken(refreshToken); err != nil {
+			errs = append(errs, err)
+		}
+		if err := eraseRefreshToken(domain); err != nil {
+			errs = append(errs, fmt.Errorf("[Logout] Could not erase refresh token for %s: %w", domain, err))
+		}
+	} else {
+		log.Debug().Msgf("[Logout] No cached refresh token for %s", domain)
+	}
+
+	if err := DeleteCookie(domain); err != nil {
+		errs = append(errs, err)
+	}
+
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// DeleteCookie deletes the cached token of a domain, from its cookie file or store,
+// so that the next git command gets a new one
+func DeleteCookie(domain string) error {
+	store, err := getStore(domain, StoreKindCookie)
+	if err != nil {
+		return err
+	}
+	if err := store.Delete(domain); err != nil {
+		return fmt.Errorf("[DeleteCookie] Could not delete token for %s: %w", domain, err)
+	}
+	log.Debug().Msgf("[DeleteCookie] Deleted token for %s", domain)
+	return nil
+}
+
+// PurgeCookies deletes every cookie: the cookie files of the storage directory, including those of the
+// http.cookieFile git configs of IAP urls, and the tokens kept in keyrings for configured domains.
+// Refresh tokens are left untouched, see Logout. It returns what was deleted.
+func PurgeCookies() ([]string, error) {
+	var deleted []string
+	var errs []error
+
+	remove := func(path string) {
+		if err := os.Remove(path); err == nil {
+			deleted = append(deleted, path)
+		} else if !os.IsNotExist(err) {
+			errs = append(errs, fmt.Errorf("[PurgeCookies] Could not delete %s: %w", path, err))
+		}
+	}
+
+	for _, pattern := range []string{"*.cookie", "*.cookie" + encryptedFileSuffix} {
+		matches, _ := filepath.Glob(filepath.Join(expandHome(CacheDir()), pattern))
+		for _, path := range matches {
+			remove(path)
+		}
+	}
+	for _, url := range git.ConfigURLsWithKey("http", "cookieFile") {
+		path := expandHome(git.ConfigTryGet(fmt.Sprintf("http.%s.cookieFile", url)))
+		// other cookie jars, such as ~/.gitcookies, are not the helper's to delete
+		if !Configured(url) || !inCacheDir(path) {
+			log.Debug().Msgf("[PurgeCookies] Kept %s, not a cookie file of the helper", path)
+			continue
+		}
+		remove(path)
+		remove(path + encryptedFileSuffix)
+	}
+
+	for _, domain := range ConfiguredDomains() {
+		store, err := getStore(domain, StoreKindCookie)
+		if err != nil {
+			continue
+		}
+		switch store.(type) {
+		case *fileStore, *encryptedFileStore:
+			// already deleted with the files
+			continue
+		}
+		if err := store.Delete(domain); err == nil {
+			deleted = append(deleted, fmt.Sprintf("token of %s", domain))
+		} else {
+			log.Debug().Msgf("[PurgeCookies] No token to delete for %s: %s", domain, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return deleted, errs[0]
+	}
+	return deleted, nil
+}
+
+// revokeToken invalidates a refresh token, along with the access granted to the helper
+func revokeToken(refreshToken string) error {
+	resp, err := http.PostForm(revokeURL, url.Values{"token": {refreshToken}})
+	if err != nil {
+		return fmt.Errorf("[revokeToken] Could not revoke refresh token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// an already revoked or expired token is as good as a revoked one
+	if resp.StatusCode != 200 && resp.StatusCode != 400 {
+		return fmt.Errorf("[revokeToken] Could not revoke refresh token: HTTP %d", resp.StatusCode)
+	}
+	log.Debug().Msgf("[revokeToken] Refresh token revoked")
+	return nil
+}
@@ -0,0 +1,109 @@
+package iap
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/int128/oauth2cli/oauth2params"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// manualRedirectURL is a loopback address nothing listens on: once access is granted, the browser
+// fails to load it, and the user copies the URL, which carries the authorization code, from the address bar.
+// Google no longer supports the out-of-band 'urn:ietf:wg:oauth:2.0:oob' redirect.
+const manualRedirectURL = "http://localhost:1/"
+
+// getRefreshTokenFromManualFlow runs the authorization code flow without any local callback server:
+// the user opens the authorization URL on any machine, and pastes back the redirected URL or the code in the terminal.
+func getRefreshTokenFromManualFlow(domain, helperID, helperSecret string, authCodeOptions []oauth2.AuthCodeOption) (string, error) {
+	ctx := context.Background()
+
+	OAuthConfig := oauth2.Config{
+		ClientID:     helperID,
+		ClientSecret: helperSecret,
+		Endpoint:     google.Endpoint,
+		RedirectURL:  manualRedirectURL,
+		Scopes:       append([]string{"openid", "email"}, getAdditionalScopes(domain)...),
+	}
+
+	state, err := oauth2params.NewState()
+	if err != nil {
+		return "", fmt.Errorf("[getRefreshTokenFromManualFlow] Could not generate state: %w", err)
+	}
+	pkce, err := oauth2params.NewPKCE()
+	if err != nil {
+		return "", fmt.Errorf("[getRefreshTokenFromManualFlow] Could not generate PKCE parameters: %w", err)
+	}
+
+	authCodeOptions = append(authCodeOptions, oauth2.AccessTypeOffline)
+	authURL := OAuthConfig.AuthCodeURL(state, append(pkce.AuthCodeOptions(), authCodeOptions...)...)
+	fmt.Fprintf(os.Stderr, "Open the following URL in a browser:\n\n  %s\n\n", authURL)
+	fmt.Fprintf(os.Stderr, "Once access is granted, the browser fails to load a localhost page.\n")
+	fmt.Fprintf(os.Stderr, "Paste the URL from its address bar, or the value of its 'code' parameter: ")
+
+	terminal, err := openTerminal()
+	if err != nil {
+		return "", fmt.Errorf("[getRefreshTokenFromManualFlow] Could not open the terminal: %w", err)
+	}
+	defer terminal.Close()
+
+	input, err := bufio.NewReader(terminal).ReadString('\n')
+	if err != nil && input == "" {
+		return "", fmt.Errorf("[getRefreshTokenFromManualFlow] Could not read authorization code: %w", err)
+	}
+
+	code, err := parseAuthorizationCode(strings.TrimSpace(input), state)
+	if err != nil {
+		return "", err
+	}
+
+	token, err := OAuthConfig.Exchange(ctx, code, pkce.TokenRequestOptions()...)
+	if err != nil {
+		return "", fmt.Errorf("[getRefreshTokenFromManualFlow] Could not exchange authorization code: %w", err)
+	}
+
+	log.Debug().Msgf("[getRefreshTokenFromManualFlow] refreshToken: %s", token.RefreshToken)
+	return token.RefreshToken, nil
+}
+
+// openTerminal returns the controlling terminal, since stdin belongs to git when running as a remote helper
+func openTerminal() (*os.File, error) {
+	if runtime.GOOS == "windows" {
+		return os.Open("CONIN$")
+	}
+	return os.Open("/dev/tty")
+}
+
+// parseAuthorizationCode accepts either a bare code or the whole redirected URL,
+// in which case the state is verified.
+func parseAuthorizationCode(input, state string) (string, error) {
+	if input == "" {
+		return "", fmt.Errorf("[parseAuthorizationCode] No authorization code provided")
+	}
+	if !strings.HasPrefix(input, "http://") && !strings.HasPrefix(input, "https://") {
+		return input, nil
+	}
+
+	u, err := url.Parse(input)
+	if err != nil {
+		return "", fmt.Errorf("[parseAuthorizationCode] Could not parse %s: %w", input, err)
+	}
+	query := u.Query()
+	if errorCode := query.Get("error"); errorCode != "" {
+		return "", fmt.Errorf("[parseAuthorizationCode] Authorization failed: %s", errorCode)
+	}
+	if query.Get("state") != state {
+		return "", fmt.Errorf("[parseAuthorizationCode] State mismatch, the URL does not belong to this login attempt")
+	}
+	if query.Get("code") == "" {
+		return "", fmt.Errorf("[parseAuthorizationCode] No 'code' parameter in %s", input)
+	}
+	return query.Get("code"), nil
+}
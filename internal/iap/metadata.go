@@ -0,0 +1,87 @@
+package iap
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// MetadataHostEnvVariable overrides the address of the metadata server, as with the Google client libraries.
+	MetadataHostEnvVariable = "GCE_METADATA_HOST"
+
+	metadataIP      = "169.254.169.254"
+	metadataTimeout = time.Second
+)
+
+func metadataHost() string {
+	if host := os.Getenv(MetadataHostEnvVariable); host != "" {
+		return host
+	}
+	return metadataIP
+}
+
+// onGCE reports whether a GCE/GKE metadata server is reachable, answering with its Metadata-Flavor header,
+// as other clouds and networks may resolve metadata.google.internal or serve 169.254.169.254 too.
+func onGCE() bool {
+	if os.Getenv(MetadataHostEnvVariable) != "" {
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), metadataTimeout)
+	defer cancel()
+
+	req, _ := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("http://%s", metadataIP), nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Debug().Msgf("[onGCE] No metadata server: %s", err)
+		return false
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Metadata-Flavor") != "Google" {
+		log.Debug().Msgf("[onGCE] %s is not a metadata server of Google", metadataIP)
+		return false
+	}
+	log.Debug().Msgf("[onGCE] Metadata server detected")
+	return true
+}
+
+// GetMetadataIDToken fetches an IAP auth token for the default service account of the
+// GCE VM or GKE pod we are running on.
+// It returns a raw IAP auth token and any error encountered.
+func GetMetadataIDToken(IAPclientID string) (string, error) {
+	endpoint := fmt.Sprintf("http://%s/computeMetadata/v1/instance/service-accounts/default/identity?%s",
+		metadataHost(),
+		url.Values{"audience": {IAPclientID}, "format": {"full"}}.Encode())
+	log.Debug().Msgf("[GetMetadataIDToken] Requesting identity from %s", endpoint)
+
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("[GetMetadataIDToken] Could not reach metadata server: %s", err.Error())
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("[GetMetadataIDToken] Could not read metadata server response: %s", err.Error())
+	}
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("[GetMetadataIDToken] Metadata server returned HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	log.Debug().Msgf("[GetMetadataIDToken] Successfully fetched IAP Auth Token from metadata server")
+	return strings.TrimSpace(string(body)), nil
+}
@@ -0,0 +1,207 @@
+package iap
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/adohkan/git-remote-https-iap/internal/git"
+	"github.com/rs/zerolog/log"
+)
+
+// RenamedConfig is a global git config moved to its current name, or given its current value, by MigrateDefaultPorts
+type RenamedConfig struct {
+	Name    string
+	NewName string
+	// Value and NewValue only differ for insteadOf rules, whose values are urls too
+	Value    string
+	NewValue string
+	// Superseded tells that NewName was already set, so the legacy config was only removed
+	Superseded bool
+}
+
+// MigrateDefaultPorts renames the global git configs written for urls with the default port,
+// e.g. iap.https://git.domain.acme:443.clientID, as configure did before auth scopes dropped
+// the :443 of urls. Otherwise their tokens would be keyed apart from those of the same host.
+// Only the sections of IAP urls are renamed, see isIAPSection, other configs are left untouched.
+func MigrateDefaultPorts() ([]RenamedConfig, error) {
+	configs, err := git.ConfigListScoped(git.ScopeGlobal)
+	if err != nil {
+		return nil, fmt.Errorf("[MigrateDefaultPorts] %w", err)
+	}
+
+	// sections with another name, listed in order, and the names of the configs of each section
+	var sections []string
+	newSections := map[string]string{}
+	names := map[string][]string{}
+	for _, config := range configs {
+		name := config[0]
+		first, last := strings.Index(name, "."), strings.LastIndex(name, ".")
+		if first == last {
+			continue
+		}
+		section := name[:last]
+		names[section] = append(names[section], name)
+		if !isIAPSection(section) {
+			continue
+		}
+		if newSection := name[:first+1] + withoutDefaultPort(name[first+1:last]); newSection != section && newSections[section] == "" {
+			sections = append(sections, section)
+			newSections[section] = newSection
+		}
+	}
+
+	var renamed []RenamedConfig
+	for _, section := range sections {
+		newSection := newSections[section]
+		if len(names[newSection]) == 0 {
+			// git keeps the case of keys when renaming a whole section
+			if err := git.RenameGlobalSection(section, newSection); err != nil {
+				return renamed, fmt.Errorf("[MigrateDefaultPorts] %w", err)
+			}
+			for _, name := range names[section] {
+				renamed = append(renamed, RenamedConfig{Name: name, NewName: newSection + strings.TrimPrefix(name, section)})
+			}
+			log.Debug().Msgf("[MigrateDefaultPorts] Renamed %s to %s", section, newSection)
+			continue
+		}
+
+		// the section exists under both names: configs already set under the current name win
+		for _, config := range configs {
+			name, value := config[0], config[1]
+			if !strings.HasPrefix(name, section+".") || strings.Contains(strings.TrimPrefix(name, section+"."), ".") {
+				continue
+			}
+			r := RenamedConfig{Name: name, NewName: newSection + strings.TrimPrefix(name, section), Value: value, NewValue: value}
+			current, err := git.ConfigGetAllScoped(r.NewName, git.ScopeGlobal)
+			if err != nil {
+				return renamed, fmt.Errorf("[MigrateDefaultPorts] %w", err)
+			}
+			// insteadOf takes several values, unlike the other keys
+			r.Superseded = len(current) > 0 && !strings.HasPrefix(section, "url.")
+			if !r.Superseded {
+				if err := git.ReplaceGlobalConfig(r.NewName, value, exactValue(value)); err != nil {
+					return renamed, fmt.Errorf("[MigrateDefaultPorts] %w", err)
+				}
+			}
+			if err := git.UnsetGlobalConfig(name, exactValue(value)); err != nil {
+				return renamed, fmt.Errorf("[MigrateDefaultPorts] %w", err)
+			}
+			renamed = append(renamed, r)
+		}
+	}
+
+	// insteadOf rules rewrite urls, which lose their port too
+	for _, config := range configs {
+		name, value := config[0], config[1]
+		if !strings.HasPrefix(name, "url.") || !strings.HasSuffix(name, ".insteadof") || withoutDefaultPort(value) == value {
+			continue
+		}
+		section := strings.TrimSuffix(name, ".insteadof")
+		if !isIAPSection(section) {
+			continue
+		}
+		if newSection, ok := newSections[section]; ok {
+			section = newSection
+		}
+		r := RenamedConfig{Name: section + ".insteadOf", NewName: section + ".insteadOf", Value: value, NewValue: withoutDefaultPort(value)}
+		current, err := git.ConfigGetAllScoped(r.NewName, git.ScopeGlobal)
+		if err != nil {
+			return renamed, fmt.Errorf("[MigrateDefaultPorts] %w", err)
+		}
+		r.Superseded = contains(current, r.NewValue)
+		if r.Superseded {
+			err = git.UnsetGlobalConfig(r.Name, exactValue(r.Value))
+		} else {
+			err = git.ReplaceGlobalConfig(r.NewName, r.NewValue, exactValue(r.Value))
+		}
+		if err != nil {
+			return renamed, fmt.Errorf("[MigrateDefaultPorts] %w", err)
+		}
+		log.Debug().Msgf("[MigrateDefaultPorts] Rewrote %s to %s", r.Value, r.NewValue)
+		renamed = append(renamed, r)
+	}
+	return renamed, nil
+}
+
+// isIAPSection tells whether a section of git config, e.g. "http.https://git.domain.acme:443", belongs to an IAP url:
+// its iap configs, the http configs of IAP urls, and the insteadOf rules of helper schemes to IAP urls
+func isIAPSection(section string) bool {
+	i := strings.Index(section, ".")
+	if i < 0 {
+		return false
+	}
+	name, rawURL := section[:i], section[i+1:]
+	switch name {
+	case "iap":
+		return true
+	case "http":
+		return Configured(rawURL)
+	case "url":
+		u, err := url.Parse(rawURL)
+		return err == nil && u.Scheme != "https" && u.Scheme != "http" && u.Host != "" && Configured("https://"+u.Host+u.Path)
+	}
+	return false
+}
+
+// withoutDefaultPort removes the :443 port of an url, leaving the rest of it untouched
+func withoutDefaultPort(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Port() != "443" {
+		return rawURL
+	}
+	return strings.Replace(rawURL, u.Host, strings.TrimSuffix(u.Host, ":443"), 1)
+}
+
+func exactValue(value string) string {
+	return fmt.Sprintf("^%s$", regexp.QuoteMeta(value))
+}
+
+// MovedSecret is a helper secret moved from global git config to a keyring by MigrateHelperSecrets,
+// or kept in git config when Store is empty
+type MovedSecret struct {
+	URL   string
+	Store string
+}
+
+// MigrateHelperSecrets moves the plaintext iap.helperSecret of the global git config to the keyring
+// of refresh tokens, for the urls having one, see HelperSecretStore. Wildcard urls are left untouched.
+func MigrateHelperSecrets() ([]MovedSecret, error) {
+	var moved []MovedSecret
+	for _, domain := range git.ConfigURLsWithKey("iap", "helperSecret") {
+		name := fmt.Sprintf("iap.%s.helperSecret", domain)
+		values, err := git.ConfigGetAllScoped(name, git.ScopeGlobal)
+		if err != nil {
+			return moved, fmt.Errorf("[MigrateHelperSecrets] %w", err)
+		}
+		if len(values) != 1 || values[0] == "" {
+			continue
+		}
+
+		store := HelperSecretStore(domain)
+		if store == "" || strings.Contains(domain, "*") {
+			moved = append(moved, MovedSecret{URL: domain})
+			continue
+		}
+		if err := SaveHelperSecret(domain, values[0]); err != nil {
+			return moved, err
+		}
+		if err := git.UnsetGlobalConfig(name, exactValue(values[0])); err != nil {
+			return moved, fmt.Errorf("[MigrateHelperSecrets] %w", err)
+		}
+
+		log.Debug().Msgf("[MigrateHelperSecrets] Moved helper secret of %s to %s", domain, store)
+		moved = append(moved, MovedSecret{URL: domain, Store: store})
+	}
+	return moved, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
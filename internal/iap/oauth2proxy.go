@@ -0,0 +1,136 @@
+package iap
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adohkan/git-remote-https-iap/internal/git"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// ProviderOAuth2Proxy is oauth2-proxy, often in front of self-hosted GitLab or Gitea
+	// see: https://oauth2-proxy.github.io/oauth2-proxy/
+	ProviderOAuth2Proxy = "oauth2-proxy"
+
+	// OAuth2ProxyCookieName is the default name of the session cookie of oauth2-proxy
+	OAuth2ProxyCookieName = "_oauth2_proxy"
+
+	// DefaultOAuth2ProxyCookieExpire is the default lifetime of the sessions of oauth2-proxy, see iap.cookieExpire
+	DefaultOAuth2ProxyCookieExpire = 168 * time.Hour
+
+	oauth2ProxyStartPath    = "/oauth2/start"
+	oauth2ProxyUserInfoPath = "/oauth2/userinfo"
+)
+
+func init() {
+	RegisterProvider(ProviderOAuth2Proxy, oauth2ProxyProvider{})
+}
+
+// oauth2ProxyProvider sends the session cookie of oauth2-proxy. Its value is opaque, but signed with its
+// creation time, from which the expiry follows. oauth2-proxy refreshes sessions by setting the cookie again,
+// which git saves in the cookie file with http.saveCookies.
+type oauth2ProxyProvider struct{}
+
+// Token asks the user to log in with the browser, and to paste the session cookie it got
+func (oauth2ProxyProvider) Token(domain string, opts AuthOptions) (string, error) {
+	if opts.NonInteractive {
+		return "", fmt.Errorf("[oauth2ProxyProvider] Interactive login required for %s", domain)
+	}
+
+	base := baseDomain(domain)
+	name := CookieName(domain)
+	login := fmt.Sprintf("%s%s?rd=%s", base, oauth2ProxyStartPath, url.QueryEscape(oauth2ProxyUserInfoPath))
+	countInteractiveFlow(domain)
+	fmt.Fprintf(os.Stderr, "Log in to %s in the browser, at:\n\n  %s\n\n", base, login)
+	if err := openBrowser(domain, login); err != nil {
+		log.Debug().Msgf("[oauth2ProxyProvider] Could not open the browser: %s", err)
+	}
+	fmt.Fprintf(os.Stderr, "Once logged in, paste the value of the %s cookie of %s, from the developer tools of the browser: ", name, strings.SplitN(base, "://", 2)[1])
+
+	terminal, err := openTerminal()
+	if err != nil {
+		return "", fmt.Errorf("[oauth2ProxyProvider] Could not open the terminal: %w", err)
+	}
+	defer terminal.Close()
+	input, err := bufio.NewReader(terminal).ReadString('\n')
+	if err != nil && input == "" {
+		return "", fmt.Errorf("[oauth2ProxyProvider] Could not read the cookie: %w", err)
+	}
+	rawToken := strings.TrimPrefix(strings.TrimSpace(input), name+"=")
+
+	if err := checkOAuth2ProxySession(base, name, rawToken); err != nil {
+		return "", err
+	}
+	return rawToken, nil
+}
+
+// Claims tells the expiry of a session from its creation time, in the "value|timestamp|signature" cookie
+func (oauth2ProxyProvider) Claims(domain, rawToken string) (Claims, error) {
+	var claims Claims
+	parts := strings.Split(rawToken, "|")
+	if len(parts) != 3 {
+		return claims, fmt.Errorf("[oauth2ProxyProvider] Not a session cookie of oauth2-proxy")
+	}
+	created, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return claims, fmt.Errorf("[oauth2ProxyProvider] Invalid timestamp in the session cookie: %w", err)
+	}
+
+	claims.IssuedAt = created
+	claims.ExpiresAt = time.Unix(created, 0).Add(getCookieExpire(domain, DefaultOAuth2ProxyCookieExpire)).Unix()
+	return claims, nil
+}
+
+// Verify has nothing to check: only oauth2-proxy can read its sessions
+func (oauth2ProxyProvider) Verify(domain, rawToken string, claims Claims) error {
+	return nil
+}
+
+func (oauth2ProxyProvider) Header(domain, rawToken string) string {
+	return fmt.Sprintf("Cookie: %s=%s", CookieName(domain), rawToken)
+}
+
+func (oauth2ProxyProvider) CookieName() string {
+	return OAuth2ProxyCookieName
+}
+
+// getCookieExpire reads the iap.cookieExpire git config of a domain, the lifetime of the sessions of its proxy
+func getCookieExpire(domain string, fallback time.Duration) time.Duration {
+	value := git.ConfigTryGetURLMatch("iap.cookieExpire", domain)
+	if value == "" {
+		return fallback
+	}
+	expire, err := time.ParseDuration(value)
+	if err != nil || expire <= 0 {
+		log.Warn().Msgf("[getCookieExpire] Ignoring invalid iap.cookieExpire '%s'", value)
+		return fallback
+	}
+	return expire
+}
+
+// checkOAuth2ProxySession asks oauth2-proxy whether a session cookie is valid
+func checkOAuth2ProxySession(base, name, rawToken string) error {
+	client := http.Client{Timeout: 30 * time.Second}
+	req, err := http.NewRequest("GET", base+oauth2ProxyUserInfoPath, nil)
+	if err != nil {
+		return err
+	}
+	req.AddCookie(&http.Cookie{Name: name, Value: rawToken})
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("[checkOAuth2ProxySession] Could not request %s: %w", req.URL, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("[checkOAuth2ProxySession] oauth2-proxy of %s did not accept the session cookie (%s)", base, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,268 @@
+package iap
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/adohkan/git-remote-https-iap/internal/git"
+	"github.com/int128/oauth2cli/oauth2params"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// ProviderOIDC is any proxy accepting the tokens of an OpenID Connect issuer, e.g. Keycloak, Dex or Authentik
+	ProviderOIDC = "generic-oidc"
+
+	// OIDCTokenID and OIDCTokenAccess are the accepted values of the iap.oidcToken git config, the token sent
+	OIDCTokenID     = "id_token"
+	OIDCTokenAccess = "access_token"
+
+	oidcDiscoveryPath   = "/.well-known/openid-configuration"
+	oidcDiscoveryMaxAge = 24 * time.Hour
+)
+
+func init() {
+	RegisterProvider(ProviderOIDC, oidcProvider{})
+}
+
+// oidcProvider gets the tokens of the OpenID Connect issuer iap.issuer with the authorization code flow
+// and PKCE, as the OAuth client iap.helperID. Its refresh token is cached like the one of Google.
+type oidcProvider struct{}
+
+// oidcDiscovery is the part of the OpenID Provider metadata of an issuer used by oidcProvider
+type oidcDiscovery struct {
+	Issuer                string    `json:"issuer"`
+	AuthorizationEndpoint string    `json:"authorization_endpoint"`
+	TokenEndpoint         string    `json:"token_endpoint"`
+	JWKSURI               string    `json:"jwks_uri"`
+	Expires               time.Time `json:"expires,omitempty"`
+}
+
+func (oidcProvider) Token(domain string, opts AuthOptions) (string, error) {
+	discovery, err := discoverOIDC(domain)
+	if err != nil {
+		return "", err
+	}
+	helperID := git.ConfigTryGetURLMatch("iap.helperID", domain)
+	if helperID == "" {
+		return "", fmt.Errorf("[oidcProvider] iap.helperID of %s must be the client ID of the helper at %s", domain, discovery.Issuer)
+	}
+	helperSecret := helperSecretFor(domain)
+
+	if refreshToken, err := getRefreshTokenFromCache(domain); err == nil && !opts.ForceBrowserFlow {
+		params := url.Values{
+			"client_id":     {helperID},
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {refreshToken},
+		}
+		result, err := requestOIDCToken(discovery, helperSecret, params)
+		if err == nil {
+			cacheOIDCRefreshToken(domain, refreshToken, result)
+			return oidcToken(domain, result)
+		}
+		if !errors.Is(err, errInvalidGrant) {
+			return "", err
+		}
+		log.Debug().Msgf("[oidcProvider] Cached refresh token for %s was rejected, restarting the browser flow", domain)
+		if err := eraseRefreshToken(domain); err != nil {
+			log.Warn().Msgf("[oidcProvider] Could not erase refresh token for %s: %s", domain, err.Error())
+		}
+	}
+
+	if opts.NonInteractive {
+		return "", fmt.Errorf("[oidcProvider] Interactive login required for %s", domain)
+	}
+	result, err := getOIDCTokenFromBrowserFlow(domain, discovery, helperID, helperSecret, opts)
+	if err != nil {
+		return "", err
+	}
+	cacheOIDCRefreshToken(domain, "", result)
+	return oidcToken(domain, result)
+}
+
+func (oidcProvider) Verify(domain, rawToken string, claims Claims) error {
+	discovery, err := discoverOIDC(domain)
+	if err != nil {
+		return err
+	}
+	if claims.Issuer != discovery.Issuer {
+		return fmt.Errorf("token was issued by '%s' instead of '%s'", claims.Issuer, discovery.Issuer)
+	}
+	cacheFile := fmt.Sprintf("oidc-certs-%s.json", issuerSlug(discovery.Issuer))
+	if err := verifyJWKSSignature(domain, rawToken, discovery.JWKSURI, cacheFile, discovery.Issuer); err != nil {
+		return err
+	}
+
+	// ID tokens are issued for the client of the helper, when no other audience is expected
+	if git.ConfigTryGetURLMatch("iap.audience", domain) == "" && git.ConfigTryGetURLMatch("iap.clientID", domain) == "" {
+		if helperID := git.ConfigTryGetURLMatch("iap.helperID", domain); !claims.Audience.Contains(helperID) {
+			return fmt.Errorf("token was issued for audience '%s' instead of '%s'", claims.Audience, helperID)
+		}
+		return nil
+	}
+	return checkAudience(domain, claims)
+}
+
+func (oidcProvider) Header(domain, rawToken string) string {
+	return fmt.Sprintf("Authorization: Bearer %s", rawToken)
+}
+
+func (oidcProvider) CookieName() string {
+	return IAPCookieName
+}
+
+// oidcToken returns the token of a response selected by iap.oidcToken, the ID token by default
+func oidcToken(domain string, result *token) (string, error) {
+	switch kind := git.ConfigTryGetURLMatch("iap.oidcToken", domain); kind {
+	case OIDCTokenAccess:
+		return result.AccessToken, nil
+	case OIDCTokenID, "":
+		if result.IDToken == "" {
+			return "", fmt.Errorf("[oidcToken] The issuer returned no ID token, check that the openid scope is allowed")
+		}
+		return result.IDToken, nil
+	default:
+		return "", fmt.Errorf("[oidcToken] Unknown iap.oidcToken '%s'", kind)
+	}
+}
+
+// discoverOIDC returns the metadata of the iap.issuer of a domain, cached for a day in the cache directory
+func discoverOIDC(domain string) (*oidcDiscovery, error) {
+	issuer := strings.TrimSuffix(git.ConfigTryGetURLMatch("iap.issuer", domain), "/")
+	if issuer == "" {
+		return nil, fmt.Errorf("[discoverOIDC] iap.issuer of %s is not set", domain)
+	}
+	path := filepath.Join(expandHome(CacheDir()), fmt.Sprintf("oidc-%s.json", issuerSlug(issuer)))
+
+	var cached oidcDiscovery
+	if data, err := os.ReadFile(path); err == nil && json.Unmarshal(data, &cached) == nil &&
+		cached.Issuer == issuer && time.Now().Before(cached.Expires) {
+		return &cached, nil
+	}
+
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(issuer + oidcDiscoveryPath)
+	if err != nil {
+		return nil, fmt.Errorf("[discoverOIDC] Could not fetch the metadata of %s: %w", issuer, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("[discoverOIDC] Could not fetch the metadata of %s: HTTP %d", issuer, resp.StatusCode)
+	}
+
+	var discovery oidcDiscovery
+	if err := json.NewDecoder(resp.Body).Decode(&discovery); err != nil {
+		return nil, fmt.Errorf("[discoverOIDC] Could not decode the metadata of %s: %w", issuer, err)
+	}
+	// see: https://openid.net/specs/openid-connect-discovery-1_0.html#ProviderConfigurationValidation
+	if discovery.Issuer != issuer {
+		return nil, fmt.Errorf("[discoverOIDC] The metadata of %s are those of another issuer, %s", issuer, discovery.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, fmt.Errorf("[discoverOIDC] The metadata of %s lack an endpoint", issuer)
+	}
+
+	discovery.Expires = time.Now().Add(oidcDiscoveryMaxAge)
+	if data, err := json.Marshal(discovery); err == nil {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err == nil {
+			os.WriteFile(path, data, 0600)
+		}
+	}
+	return &discovery, nil
+}
+
+// issuerSlug names the cache files of an issuer, after its url without scheme
+func issuerSlug(issuer string) string {
+	if parts := strings.SplitN(issuer, "://", 2); len(parts) == 2 {
+		return hostSlug(parts[1])
+	}
+	return hostSlug(issuer)
+}
+
+// getOIDCTokenFromBrowserFlow runs the authorization code flow with PKCE in the browser, on the local callback
+func getOIDCTokenFromBrowserFlow(domain string, discovery *oidcDiscovery, helperID, helperSecret string, opts AuthOptions) (*token, error) {
+	state, err := oauth2params.NewState()
+	if err != nil {
+		return nil, fmt.Errorf("[getOIDCTokenFromBrowserFlow] Could not generate state: %w", err)
+	}
+	pkce, err := oauth2params.NewPKCE()
+	if err != nil {
+		return nil, fmt.Errorf("[getOIDCTokenFromBrowserFlow] Could not generate PKCE parameters: %w", err)
+	}
+
+	var redirectURL string
+	query, err := waitForCallback(domain, "code", func(callback string) (string, error) {
+		redirectURL = callback
+		config := oauth2.Config{
+			ClientID:    helperID,
+			Endpoint:    oauth2.Endpoint{AuthURL: discovery.AuthorizationEndpoint, TokenURL: discovery.TokenEndpoint},
+			RedirectURL: callback,
+			Scopes:      append([]string{"openid", "email", "offline_access"}, getAdditionalScopes(domain)...),
+		}
+		authCodeOptions := pkce.AuthCodeOptions()
+		if opts.SelectAccount {
+			authCodeOptions = append(authCodeOptions, oauth2.SetAuthURLParam("prompt", "select_account"))
+		}
+		return config.AuthCodeURL(state, authCodeOptions...), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if query.Get("state") != state {
+		return nil, fmt.Errorf("[getOIDCTokenFromBrowserFlow] The state of the callback does not match the one of the request")
+	}
+
+	return requestOIDCToken(discovery, helperSecret, url.Values{
+		"client_id":     {helperID},
+		"grant_type":    {"authorization_code"},
+		"code":          {query.Get("code")},
+		"redirect_uri":  {redirectURL},
+		"code_verifier": {pkce.CodeVerifier},
+	})
+}
+
+// requestOIDCToken redeems a grant at the token endpoint of an issuer
+func requestOIDCToken(discovery *oidcDiscovery, helperSecret string, params url.Values) (*token, error) {
+	var result token
+	var errorMesg httpError
+
+	// public clients have no secret
+	if helperSecret != "" {
+		params.Set("client_secret", helperSecret)
+	}
+	resp, err := http.PostForm(discovery.TokenEndpoint, params)
+	if err != nil {
+		return nil, fmt.Errorf("[requestOIDCToken] Could not request a token of %s: %s", discovery.Issuer, err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		json.NewDecoder(resp.Body).Decode(&errorMesg)
+		if errorMesg.Error == errInvalidGrant.Error() {
+			return nil, fmt.Errorf("[requestOIDCToken] %s rejected the grant: %s: %w", discovery.Issuer, errorMesg.ErrorDesc, errInvalidGrant)
+		}
+		return nil, fmt.Errorf("[requestOIDCToken] Could not get a token of %s: %s (%s)", discovery.Issuer, errorMesg.Error, errorMesg.ErrorDesc)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("[requestOIDCToken] Could not decode the token of %s: %s", discovery.Issuer, err.Error())
+	}
+	return &result, nil
+}
+
+// cacheOIDCRefreshToken caches the refresh token of a token response, when the issuer rotated it
+func cacheOIDCRefreshToken(domain, previous string, result *token) {
+	if result.RefreshToken == "" || result.RefreshToken == previous {
+		return
+	}
+	if err := cacheRefreshToken(domain, result.RefreshToken); err != nil {
+		log.Warn().Msgf("[oidcProvider] Could not cache refresh token for %s: %s", domain, err.Error())
+	}
+}
@@ -0,0 +1,61 @@
+//go:build !windows
+// +build !windows
+
+package iap
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	privateFileMode = 0600
+	privateDirMode  = 0700
+)
+
+// ensurePrivate verifies that a cookie file and its directory are only accessible by the user,
+// as ssh does for private keys. Wider permissions are reported, then repaired. Only directories in
+// CacheDir are repaired, never the directory of a cookie file configured elsewhere, such as $HOME.
+func ensurePrivate(path string) {
+	if dir := filepath.Dir(path); dir == expandHome(CacheDir()) || inCacheDir(dir) {
+		repairMode(dir, privateDirMode)
+	}
+	repairMode(path, privateFileMode)
+}
+
+// listenPrivate listens on a unix socket created only accessible by the user, so that it never exists
+// with wider permissions, even for the time of a chmod. The umask applies to the whole process, which
+// creates no other file meanwhile.
+func listenPrivate(socket string) (net.Listener, error) {
+	previous := syscall.Umask(0177)
+	defer syscall.Umask(previous)
+	return net.Listen("unix", socket)
+}
+
+func repairMode(path string, want os.FileMode) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+
+	mode := info.Mode().Perm()
+	if mode&^want == 0 {
+		return
+	}
+
+	if mode&0044 != 0 {
+		log.Error().Msgf("%s was readable by other users (mode %04o): its tokens may have been exposed, consider running logout", path, mode)
+	} else {
+		log.Warn().Msgf("%s had permissions %04o, expected %04o", path, mode, want)
+	}
+
+	if err := os.Chmod(path, want); err != nil {
+		log.Error().Msgf("Could not restrict permissions of %s: %s", path, err)
+		return
+	}
+	log.Debug().Msgf("[repairMode] Set permissions of %s to %04o", path, want)
+}
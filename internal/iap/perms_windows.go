@@ -0,0 +1,12 @@
+package iap
+
+import "net"
+
+// ensurePrivate is a no-op on Windows, where files under the user profile are protected by ACLs
+// rather than permission bits.
+func ensurePrivate(path string) {}
+
+// listenPrivate listens on a unix socket, which inherits the ACLs of its directory in the user profile
+func listenPrivate(socket string) (net.Listener, error) {
+	return net.Listen("unix", socket)
+}
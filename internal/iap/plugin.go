@@ -0,0 +1,199 @@
+package iap
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// PluginPrefix is the prefix of the executables of external providers: iap.provider = acme
+	// runs git-remote-iap-provider-acme, found in PATH, when no provider is built in under that name
+	PluginPrefix = "git-remote-iap-provider-"
+
+	// PluginProtocolVersion is the version of the JSON protocol spoken with external providers
+	PluginProtocolVersion = 1
+
+	// the operations of external providers, see pluginRequest
+	pluginDescribe = "describe"
+	pluginToken    = "token"
+	pluginVerify   = "verify"
+	pluginClaims   = "claims"
+)
+
+// pluginRequest is written on the stdin of an external provider, as a single JSON object
+type pluginRequest struct {
+	Version   int    `json:"version"`
+	Operation string `json:"operation"`
+	// URL is the auth scope, e.g. https://git.domain.acme
+	URL string `json:"url,omitempty"`
+	// Token is the token to verify or to tell the claims of
+	Token string `json:"token,omitempty"`
+	// Interactive tells whether the provider may ask the user to log in, on the terminal or in the browser
+	Interactive bool `json:"interactive,omitempty"`
+	// ForceLogin asks for a new login, instead of refreshing a session
+	ForceLogin bool `json:"forceLogin,omitempty"`
+}
+
+// pluginResponse is read from the stdout of an external provider, as a single JSON object
+type pluginResponse struct {
+	// Error fails the operation, with this message
+	Error string `json:"error,omitempty"`
+	// Token is the token obtained by the token operation
+	Token string `json:"token,omitempty"`
+	// LoggedIn tells that the user logged in interactively for the token, rather than it being refreshed
+	LoggedIn bool `json:"loggedIn,omitempty"`
+	// ExpiresAt and IssuedAt are the claims of opaque tokens, in seconds since the epoch
+	ExpiresAt int64 `json:"expiresAt,omitempty"`
+	IssuedAt  int64 `json:"issuedAt,omitempty"`
+	// HeaderName and HeaderPrefix tell how tokens are sent, "Authorization" and "Bearer " by default,
+	// and CookieName in which cookie, answering the describe operation
+	HeaderName   string `json:"headerName,omitempty"`
+	HeaderPrefix string `json:"headerPrefix,omitempty"`
+	CookieName   string `json:"cookieName,omitempty"`
+}
+
+// pluginProvider is an external provider, an executable speaking the JSON protocol of pluginRequest and
+// pluginResponse: each operation runs it once, with the request on stdin, the response on stdout and
+// messages to the user on stderr
+type pluginProvider struct {
+	name, path string
+
+	once        sync.Once
+	description pluginResponse
+}
+
+var (
+	pluginsMu sync.Mutex
+	plugins   = map[string]*pluginProvider{}
+)
+
+// lookupPlugin returns the external provider of a name, if its executable is in PATH
+func lookupPlugin(name string) (*pluginProvider, error) {
+	pluginsMu.Lock()
+	defer pluginsMu.Unlock()
+
+	if plugin, ok := plugins[name]; ok {
+		return plugin, nil
+	}
+	path, err := exec.LookPath(PluginPrefix + name)
+	if err != nil {
+		return nil, err
+	}
+	plugin := &pluginProvider{name: name, path: path}
+	plugins[name] = plugin
+	return plugin, nil
+}
+
+func (p *pluginProvider) call(request pluginRequest) (*pluginResponse, error) {
+	request.Version = PluginProtocolVersion
+	input, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	var stdout bytes.Buffer
+	cmd := exec.Command(p.path)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	// stdout belongs to git when running as a remote helper
+	cmd.Stderr = os.Stderr
+	log.Debug().Msgf("[pluginProvider] %s %s %s", p.path, request.Operation, request.URL)
+	runErr := cmd.Run()
+
+	var response pluginResponse
+	if err := json.Unmarshal(stdout.Bytes(), &response); err != nil {
+		if runErr != nil {
+			return nil, fmt.Errorf("[pluginProvider] %s failed to %s: %w", p.path, request.Operation, runErr)
+		}
+		return nil, fmt.Errorf("[pluginProvider] Could not decode the response of %s to %s: %w", p.path, request.Operation, err)
+	}
+	if response.Error != "" {
+		return nil, fmt.Errorf("[pluginProvider] %s", response.Error)
+	}
+	if runErr != nil {
+		return nil, fmt.Errorf("[pluginProvider] %s failed to %s: %w", p.path, request.Operation, runErr)
+	}
+	return &response, nil
+}
+
+// describe asks the plugin how its tokens are sent, once per process
+func (p *pluginProvider) describe() pluginResponse {
+	p.once.Do(func() {
+		response, err := p.call(pluginRequest{Operation: pluginDescribe})
+		if err != nil {
+			log.Warn().Msgf("[pluginProvider] %s, using the defaults", err)
+			return
+		}
+		p.description = *response
+	})
+	return p.description
+}
+
+func (p *pluginProvider) Token(domain string, opts AuthOptions) (string, error) {
+	response, err := p.call(pluginRequest{
+		Operation:   pluginToken,
+		URL:         domain,
+		Interactive: !opts.NonInteractive,
+		ForceLogin:  opts.ForceBrowserFlow,
+	})
+	if err != nil {
+		return "", err
+	}
+	if response.Token == "" {
+		return "", fmt.Errorf("[pluginProvider] %s returned no token for %s", p.path, domain)
+	}
+	if response.LoggedIn {
+		countInteractiveFlow(domain)
+	}
+	return response.Token, nil
+}
+
+// Claims parses JWTs, and asks the plugin for the claims of opaque tokens
+func (p *pluginProvider) Claims(domain, rawToken string) (Claims, error) {
+	if strings.Count(rawToken, ".") == 2 {
+		_, claims, err := parseJWToken(rawToken)
+		return claims, err
+	}
+
+	var claims Claims
+	response, err := p.call(pluginRequest{Operation: pluginClaims, URL: domain, Token: rawToken})
+	if err != nil {
+		return claims, err
+	}
+	if response.ExpiresAt == 0 {
+		return claims, fmt.Errorf("[pluginProvider] %s told no expiry of the token of %s", p.path, domain)
+	}
+	claims.ExpiresAt = response.ExpiresAt
+	claims.IssuedAt = response.IssuedAt
+	return claims, nil
+}
+
+func (p *pluginProvider) Verify(domain, rawToken string, claims Claims) error {
+	if _, err := p.call(pluginRequest{Operation: pluginVerify, URL: domain, Token: rawToken}); err != nil {
+		return err
+	}
+	return checkAudience(domain, claims)
+}
+
+func (p *pluginProvider) Header(domain, rawToken string) string {
+	description := p.describe()
+	name, prefix := description.HeaderName, description.HeaderPrefix
+	if name == "" {
+		name, prefix = "Authorization", "Bearer "
+	}
+	return fmt.Sprintf("%s: %s%s", name, prefix, rawToken)
+}
+
+func (p *pluginProvider) CookieName() string {
+	if name := p.describe().CookieName; name != "" {
+		return name
+	}
+	return IAPCookieName
+}
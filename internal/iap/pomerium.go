@@ -0,0 +1,84 @@
+package iap
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// ProviderPomerium is the Pomerium identity-aware proxy
+	// see: https://www.pomerium.com/docs/capabilities/programmatic-access
+	ProviderPomerium = "pomerium"
+
+	// PomeriumCookieName is the session cookie of Pomerium
+	PomeriumCookieName = "_pomerium"
+
+	pomeriumLoginPath = "/.pomerium/api/v1/login"
+	pomeriumJWKSPath  = "/.well-known/pomerium/jwks.json"
+)
+
+func init() {
+	RegisterProvider(ProviderPomerium, pomeriumProvider{})
+}
+
+// pomeriumProvider gets tokens with the programmatic login of Pomerium: the browser logs in, then Pomerium
+// redirects it to the local callback of the helper, with the token in the pomerium_jwt param
+type pomeriumProvider struct{}
+
+func (pomeriumProvider) Token(domain string, opts AuthOptions) (string, error) {
+	if opts.NonInteractive {
+		return "", fmt.Errorf("[pomeriumProvider] Interactive login required for %s", domain)
+	}
+
+	base := baseDomain(domain)
+	query, err := waitForCallback(domain, "pomerium_jwt", func(callback string) (string, error) {
+		return getPomeriumLoginURL(base, callback)
+	})
+	if err != nil {
+		return "", err
+	}
+	return query.Get("pomerium_jwt"), nil
+}
+
+func (pomeriumProvider) Verify(domain, rawToken string, claims Claims) error {
+	base := baseDomain(domain)
+	cacheFile := fmt.Sprintf("pomerium-certs-%s.json", hostSlug(strings.SplitN(base, "://", 2)[1]))
+	if err := verifyJWKSSignature(domain, rawToken, base+pomeriumJWKSPath, cacheFile, "Pomerium"); err != nil {
+		return err
+	}
+	return checkAudience(domain, claims)
+}
+
+// Header uses the header of Pomerium that leaves Authorization to the backend, e.g. for git credentials
+func (pomeriumProvider) Header(domain, rawToken string) string {
+	return fmt.Sprintf("X-Pomerium-Authorization: %s", rawToken)
+}
+
+func (pomeriumProvider) CookieName() string {
+	return PomeriumCookieName
+}
+
+// getPomeriumLoginURL asks the Pomerium of base for the url logging in the browser, which then
+// redirects to callback
+func getPomeriumLoginURL(base, callback string) (string, error) {
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(fmt.Sprintf("%s%s?pomerium_redirect_uri=%s", base, pomeriumLoginPath, url.QueryEscape(callback)))
+	if err != nil {
+		return "", fmt.Errorf("[getPomeriumLoginURL] Could not request the login url of %s: %w", base, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return "", err
+	}
+	login := strings.TrimSpace(string(body))
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(login, "http") {
+		return "", fmt.Errorf("[getPomeriumLoginURL] %s did not answer with a login url (%s), is it served by Pomerium?", base, resp.Status)
+	}
+	return login, nil
+}
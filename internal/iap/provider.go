@@ -0,0 +1,124 @@
+package iap
+
+import (
+	"fmt"
+	"sync"
+
+	jwt "github.com/golang-jwt/jwt"
+
+	"github.com/adohkan/git-remote-https-iap/internal/git"
+)
+
+// ProviderGoogle is Google Cloud's Identity-Aware Proxy, the default provider
+const ProviderGoogle = "google"
+
+// A Provider is an identity-aware proxy in front of git servers: it mints the tokens of its users,
+// and tells how to check and send them
+type Provider interface {
+	// Token returns a fresh raw token for the auth scope domain
+	Token(domain string, opts AuthOptions) (string, error)
+	// Verify checks the signature and the claims of a raw token of domain, before it is cached or sent
+	Verify(domain, rawToken string, claims Claims) error
+	// Header returns the header sending rawToken, in the "Name: value" form, when iap.authHeader is not set
+	Header(domain, rawToken string) string
+	// CookieName is the name of the cookie carrying tokens, when iap.cookieName is not set
+	CookieName() string
+}
+
+// An OpaqueTokenProvider is a Provider whose tokens are not JWTs, such as session cookies:
+// it tells their claims, of which at least the expiry
+type OpaqueTokenProvider interface {
+	Claims(domain, rawToken string) (Claims, error)
+}
+
+var (
+	providersMu sync.RWMutex
+	providers   = map[string]Provider{}
+)
+
+// RegisterProvider makes a Provider available under a name, for the iap.provider git config.
+// It panics when the name is already registered.
+func RegisterProvider(name string, provider Provider) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+
+	if _, exists := providers[name]; exists {
+		panic(fmt.Sprintf("iap: provider %s registered twice", name))
+	}
+	providers[name] = provider
+}
+
+func init() {
+	RegisterProvider(ProviderGoogle, googleProvider{})
+}
+
+// IsProvider tells whether a Provider is registered under name, or is the external provider of a plugin in PATH
+func IsProvider(name string) bool {
+	providersMu.RLock()
+	_, ok := providers[name]
+	providersMu.RUnlock()
+	if ok {
+		return true
+	}
+	_, err := lookupPlugin(name)
+	return err == nil
+}
+
+// getProvider returns the Provider selected by the iap.provider git config of a domain, Google's IAP by default.
+// Names that are not registered are those of external providers, see pluginProvider.
+func getProvider(domain string) (Provider, error) {
+	name := git.ConfigTryGetURLMatch("iap.provider", domain)
+	if name == "" {
+		name = ProviderGoogle
+	}
+
+	providersMu.RLock()
+	provider, ok := providers[name]
+	providersMu.RUnlock()
+	if ok {
+		return provider, nil
+	}
+	if plugin, err := lookupPlugin(name); err == nil {
+		return plugin, nil
+	}
+	return nil, fmt.Errorf("unknown iap.provider '%s' for %s, and no %s%s in PATH", name, domain, PluginPrefix, name)
+}
+
+// parseToken returns the claims of a raw token of domain, from its Provider for opaque tokens
+func parseToken(domain, rawToken string) (jwt.Token, Claims, error) {
+	if provider, err := getProvider(domain); err == nil {
+		if opaque, ok := provider.(OpaqueTokenProvider); ok {
+			claims, err := opaque.Claims(domain, rawToken)
+			return jwt.Token{Raw: rawToken}, claims, err
+		}
+	}
+	return parseJWToken(rawToken)
+}
+
+// googleProvider gets Google-signed ID tokens, whose audience is the clientID of the IAP instance
+type googleProvider struct{}
+
+func (googleProvider) Token(domain string, opts AuthOptions) (string, error) {
+	return getRawToken(domain, resolveAudience(domain), opts)
+}
+
+func (googleProvider) Verify(domain, rawToken string, claims Claims) error {
+	if err := verifySignature(domain, rawToken); err != nil {
+		return err
+	}
+	if err := checkAudience(domain, claims); err != nil {
+		return err
+	}
+	if err := checkHostedDomain(domain, claims); err != nil {
+		return fmt.Errorf("%w, log in with --select-account to pick another account", err)
+	}
+	return nil
+}
+
+func (googleProvider) Header(domain, rawToken string) string {
+	return fmt.Sprintf("Proxy-Authorization: Bearer %s", rawToken)
+}
+
+func (googleProvider) CookieName() string {
+	return IAPCookieName
+}
@@ -0,0 +1,221 @@
+package iap
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adohkan/git-remote-https-iap/internal/git"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	proxyCAValidity   = 10 * 365 * 24 * time.Hour
+	proxyLeafValidity = 30 * 24 * time.Hour
+)
+
+// ProxyCAFile returns the certificate of the local CA of the proxy command, which tools reaching
+// hosts behind IAP through the proxy must trust
+func ProxyCAFile() string {
+	return filepath.Join(CacheDir(), "proxy-ca.pem")
+}
+
+func proxyCAKeyFile() string {
+	return filepath.Join(CacheDir(), "proxy-ca-key.pem")
+}
+
+// ProxyCA issues the certificates of the hosts behind IAP, whose https traffic the proxy command
+// decrypts to add tokens. It is created on first use, and its key never leaves the storage directory.
+type ProxyCA struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+
+	mu     sync.Mutex
+	leaves map[string]*tls.Certificate
+}
+
+// LoadProxyCA reads the local CA of the proxy command, or creates it
+func LoadProxyCA() (*ProxyCA, error) {
+	certPEM, certErr := os.ReadFile(expandHome(ProxyCAFile()))
+	keyPEM, keyErr := os.ReadFile(expandHome(proxyCAKeyFile()))
+	if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+		return createProxyCA()
+	}
+	if certErr != nil {
+		return nil, fmt.Errorf("[LoadProxyCA] Could not read %s: %w", ProxyCAFile(), certErr)
+	}
+	if keyErr != nil {
+		return nil, fmt.Errorf("[LoadProxyCA] Could not read %s: %w", proxyCAKeyFile(), keyErr)
+	}
+	ensurePrivate(expandHome(proxyCAKeyFile()))
+
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("[LoadProxyCA] Invalid CA in %s: %w", CacheDir(), err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("[LoadProxyCA] Invalid CA in %s: %w", CacheDir(), err)
+	}
+	if time.Now().After(cert.NotAfter) {
+		return nil, fmt.Errorf("[LoadProxyCA] The CA of %s expired, delete it to create another one", ProxyCAFile())
+	}
+	if dnsDomains, ipRanges := proxyCAConstraints(); !reflect.DeepEqual(cert.PermittedDNSDomains, dnsDomains) || !reflect.DeepEqual(cidrs(cert.PermittedIPRanges), cidrs(ipRanges)) {
+		log.Warn().Msgf("[LoadProxyCA] Configured hosts changed, %s is replaced by a CA limited to them: re-import it where it was copied", ProxyCAFile())
+		return createProxyCA()
+	}
+	return &ProxyCA{cert: cert, key: pair.PrivateKey.(crypto.Signer), leaves: map[string]*tls.Certificate{}}, nil
+}
+
+func createProxyCA() (*ProxyCA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               pkix.Name{CommonName: "git-remote-https+iap proxy CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(proxyCAValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	// the key is kept on disk: name constraints keep it from issuing certificates of other sites
+	template.PermittedDNSDomains, template.PermittedIPRanges = proxyCAConstraints()
+	template.PermittedDNSDomainsCritical = true
+	if len(template.PermittedIPRanges) == 0 {
+		template.ExcludedIPRanges = []*net.IPNet{
+			{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
+			{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)},
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("[createProxyCA] Could not create the CA: %w", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := expandHome(CacheDir())
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(expandHome(proxyCAKeyFile()), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return nil, err
+	}
+	ensurePrivate(expandHome(proxyCAKeyFile()))
+	if err := os.WriteFile(expandHome(ProxyCAFile()), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return nil, err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &ProxyCA{cert: cert, key: key, leaves: map[string]*tls.Certificate{}}, nil
+}
+
+// proxyCAConstraints returns the names and addresses of the hosts configured for IAP, to which the CA is limited.
+// Wildcard hosts, e.g. https://*.domain.acme, permit the subdomains of their domain.
+func proxyCAConstraints() ([]string, []*net.IPNet) {
+	seen := map[string]bool{}
+	var dnsDomains []string
+	var ipRanges []*net.IPNet
+	for _, domain := range append(git.ConfigURLsWithKey("iap", "clientID"), git.ConfigURLsWithKey("iap", "provider")...) {
+		u, err := url.Parse(strings.Replace(domain, "*.", "", 1))
+		if err != nil || u.Hostname() == "" || seen[u.Hostname()] {
+			continue
+		}
+		seen[u.Hostname()] = true
+		if ip := net.ParseIP(u.Hostname()); ip != nil {
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			ipRanges = append(ipRanges, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		dnsDomains = append(dnsDomains, strings.ToLower(u.Hostname()))
+	}
+	sort.Strings(dnsDomains)
+	if len(dnsDomains) == 0 {
+		// an empty list would permit every name
+		dnsDomains = []string{"invalid"}
+	}
+	return dnsDomains, ipRanges
+}
+
+// cidrs returns the ranges in CIDR notation, sorted, to compare their addresses and masks in any order
+func cidrs(ranges []*net.IPNet) []string {
+	var notations []string
+	for _, r := range ranges {
+		notations = append(notations, r.String())
+	}
+	sort.Strings(notations)
+	return notations
+}
+
+// Certificate returns a certificate of host issued by the CA, valid for a month and kept in memory
+func (ca *ProxyCA) Certificate(host string) (*tls.Certificate, error) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	if leaf, ok := ca.leaves[host]; ok && time.Now().Before(leaf.Leaf.NotAfter.Add(-time.Hour)) {
+		return leaf, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(proxyLeafValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, fmt.Errorf("[ProxyCA] Could not issue a certificate of %s: %w", host, err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	cert := &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+	ca.leaves[host] = cert
+	return cert, nil
+}
+
+func randomSerial() *big.Int {
+	serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	return serial
+}
@@ -0,0 +1,79 @@
+package iap
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	maxRedirects = 5
+	infoRefs     = "/info/refs"
+
+	// googleSignInHost is where IAP redirects requests without a valid token
+	googleSignInHost = "accounts.google.com"
+)
+
+// RedirectError is returned by ResolveRedirects when a repository moved to another host,
+// where the token of its IAP must not be sent
+type RedirectError struct {
+	From, To string
+}
+
+func (e *RedirectError) Error() string {
+	u, err := url.Parse(e.To)
+	if err == nil && u.Host == googleSignInHost {
+		return fmt.Sprintf("IAP redirected %s to the Google sign-in page: the token was not accepted, check iap.clientID or log in again with 'check --forcebrowser'", e.From)
+	}
+	return fmt.Sprintf("%s redirects to another host, %s: update the url of the remote, then configure IAP for its host if needed", e.From, e.To)
+}
+
+// ResolveRedirects probes a git repository url with rawToken and follows the redirects of its host,
+// e.g. to add a missing .git suffix, sending the token again. It returns the url of the repository
+// after redirects, or a RedirectError when it moved to another host.
+func ResolveRedirects(repoURL, rawToken string) (string, error) {
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	current := strings.TrimSuffix(repoURL, "/")
+	for i := 0; i < maxRedirects; i++ {
+		probe := fmt.Sprintf("%s%s?service=git-upload-pack", current, infoRefs)
+		req, err := http.NewRequest("GET", probe, nil)
+		if err != nil {
+			return repoURL, err
+		}
+		// protocol v2 servers answer with their capabilities, instead of every ref
+		req.Header.Set("Git-Protocol", "version=2")
+		if header := AuthHeader(repoURL, rawToken); header != "" {
+			parts := strings.SplitN(header, ": ", 2)
+			req.Header.Set(parts[0], parts[1])
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return repoURL, fmt.Errorf("[ResolveRedirects] Could not probe %s: %w", probe, err)
+		}
+		resp.Body.Close()
+
+		location, err := resp.Location()
+		if err != nil {
+			// not a redirect
+			return current, nil
+		}
+		if location.Scheme != req.URL.Scheme || !strings.EqualFold(CanonicalHost(location), CanonicalHost(req.URL)) {
+			return repoURL, &RedirectError{From: repoURL, To: location.String()}
+		}
+
+		location.RawQuery = ""
+		next := strings.TrimSuffix(strings.TrimSuffix(location.String(), infoRefs), "/")
+		log.Debug().Msgf("[ResolveRedirects] %s redirects to %s", current, next)
+		current = next
+	}
+	return repoURL, fmt.Errorf("[ResolveRedirects] Too many redirects from %s", repoURL)
+}
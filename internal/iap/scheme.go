@@ -0,0 +1,60 @@
+package iap
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/adohkan/git-remote-https-iap/internal/git"
+	"github.com/rs/zerolog/log"
+)
+
+// iapScheme is the scheme of remotes that can only be reached through this binary, installed as
+// git-remote-iap, so that projects can commit their url without relying on insteadOf rules
+const iapScheme = "iap"
+
+// FromIAPScheme maps an iap://host/path url to the https:// endpoint configured for its host with
+// iap.endpoint, e.g. https://git.domain.acme/prefix, or to https://host without one.
+// Other urls are returned as is.
+func FromIAPScheme(addr string) string {
+	if !strings.HasPrefix(addr, iapScheme+"://") {
+		return addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return addr
+	}
+
+	base := fmt.Sprintf("%s://%s", iapScheme, u.Host)
+	endpoint := git.ConfigTryGetURLMatch("iap.endpoint", base)
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s", u.Host)
+	}
+	mapped := strings.TrimSuffix(endpoint, "/") + u.EscapedPath()
+	if u.RawQuery != "" {
+		mapped += "?" + u.RawQuery
+	}
+	log.Debug().Msgf("[FromIAPScheme] %s maps to %s", addr, mapped)
+	return mapped
+}
+
+// ToHTTPSURL rewrites the scheme of a remote url, such as https+iap://, to https://, and maps iap:// urls to their endpoint
+func ToHTTPSURL(addr string) (string, error) {
+	addr = FromIAPScheme(addr)
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", err
+	}
+	u.Scheme = TransportScheme(CanonicalHost(u))
+	return u.String(), nil
+}
+
+// TransportScheme returns the scheme of the requests to a host: https, unless iap.allowInsecureHTTP
+// opts the host into plain http, e.g. for local or staging proxies emulating IAP
+func TransportScheme(host string) string {
+	if insecure, _ := strconv.ParseBool(git.ConfigTryGetURLMatch("iap.allowInsecureHTTP", fmt.Sprintf("http://%s", host))); insecure {
+		return "http"
+	}
+	return "https"
+}
@@ -0,0 +1,33 @@
+package iap
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ReadSecret prompts for a secret on the terminal, without echoing what is typed,
+// so that it ends up neither in the shell history nor in the process list.
+func ReadSecret(prompt string) (string, error) {
+	tty, err := openTerminal()
+	if err != nil {
+		return "", fmt.Errorf("[ReadSecret] No terminal to read from: %w", err)
+	}
+	defer tty.Close()
+
+	restore, err := disableEcho(tty)
+	if err != nil {
+		return "", fmt.Errorf("[ReadSecret] Could not disable echo: %w", err)
+	}
+	defer restore()
+
+	fmt.Fprint(os.Stderr, prompt)
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	// the newline typed by the user was not echoed either
+	fmt.Fprintln(os.Stderr)
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
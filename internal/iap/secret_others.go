@@ -0,0 +1,22 @@
+//go:build !windows
+// +build !windows
+
+package iap
+
+import (
+	"os"
+	"os/exec"
+)
+
+// disableEcho turns off the echo of tty with stty, and returns how to turn it back on
+func disableEcho(tty *os.File) (func(), error) {
+	stty := func(arg string) error {
+		cmd := exec.Command("stty", arg)
+		cmd.Stdin = tty
+		return cmd.Run()
+	}
+	if err := stty("-echo"); err != nil {
+		return nil, err
+	}
+	return func() { stty("echo") }, nil
+}
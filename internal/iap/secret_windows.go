@@ -0,0 +1,24 @@
+package iap
+
+import (
+	"os"
+	"syscall"
+)
+
+const enableEchoInput = 0x4
+
+var procSetConsoleMode = kernel32.NewProc("SetConsoleMode")
+
+// disableEcho turns off the echo of the console input, and returns how to restore its mode
+func disableEcho(tty *os.File) (func(), error) {
+	handle := syscall.Handle(tty.Fd())
+
+	var mode uint32
+	if err := syscall.GetConsoleMode(handle, &mode); err != nil {
+		return nil, err
+	}
+	if r, _, err := procSetConsoleMode.Call(uintptr(handle), uintptr(mode&^enableEchoInput)); r == 0 {
+		return nil, err
+	}
+	return func() { procSetConsoleMode.Call(uintptr(handle), uintptr(mode)) }, nil
+}
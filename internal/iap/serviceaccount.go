@@ -0,0 +1,117 @@
+package iap
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	// CredentialsEnvVariable is the standard environment variable pointing to a Google credentials file.
+	// see: https://cloud.google.com/docs/authentication/application-default-credentials
+	CredentialsEnvVariable = "GOOGLE_APPLICATION_CREDENTIALS"
+
+	serviceAccountKeyType = "service_account"
+	jwtBearerGrantType    = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+)
+
+// serviceAccountKey holds the fields we need from a service account JSON key
+type serviceAccountKey struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// idTokenClaims are the claims of the self-signed JWT exchanged for an ID token.
+// see: https://cloud.google.com/iap/docs/authentication-howto#obtaining_an_oidc_token_from_a_local_service_account_key_file
+type idTokenClaims struct {
+	jwt.StandardClaims
+	TargetAudience string `json:"target_audience"`
+}
+
+func readServiceAccountKey(keyFile string) (*serviceAccountKey, error) {
+	data, err := os.ReadFile(expandHome(keyFile))
+	if err != nil {
+		return nil, err
+	}
+
+	var key serviceAccountKey
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, fmt.Errorf("[readServiceAccountKey] Could not parse %s: %w", keyFile, err)
+	}
+	if key.Type != serviceAccountKeyType {
+		return nil, fmt.Errorf("[readServiceAccountKey] Unsupported credentials type '%s' in %s", key.Type, keyFile)
+	}
+	if key.TokenURI == "" {
+		key.TokenURI = google.Endpoint.TokenURL
+	}
+
+	return &key, nil
+}
+
+// GetServiceAccountIDToken mints an IAP auth token from a service account JSON key,
+// without any user interaction.
+// It returns a raw IAP auth token and any error encountered.
+func GetServiceAccountIDToken(keyFile, IAPclientID string) (string, error) {
+	var result token
+	var errorMesg httpError
+
+	key, err := readServiceAccountKey(keyFile)
+	if err != nil {
+		return "", err
+	}
+	log.Debug().Msgf("[GetServiceAccountIDToken] Using service account %s from %s", key.ClientEmail, keyFile)
+
+	privateKey, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(key.PrivateKey))
+	if err != nil {
+		return "", fmt.Errorf("[GetServiceAccountIDToken] Could not parse private key from %s: %w", keyFile, err)
+	}
+
+	now := time.Now()
+	assertion := jwt.NewWithClaims(jwt.SigningMethodRS256, idTokenClaims{
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    key.ClientEmail,
+			Subject:   key.ClientEmail,
+			Audience:  key.TokenURI,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(time.Hour).Unix(),
+		},
+		TargetAudience: IAPclientID,
+	})
+	assertion.Header["kid"] = key.PrivateKeyID
+
+	signed, err := assertion.SignedString(privateKey)
+	if err != nil {
+		return "", fmt.Errorf("[GetServiceAccountIDToken] Could not sign assertion: %w", err)
+	}
+
+	resp, err := http.PostForm(key.TokenURI, url.Values{
+		"grant_type": {jwtBearerGrantType},
+		"assertion":  {signed},
+	})
+	if err != nil {
+		return "", fmt.Errorf("[GetServiceAccountIDToken] Could not exchange assertion for IAP Auth Token: %s", err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		json.NewDecoder(resp.Body).Decode(&errorMesg)
+		return "", fmt.Errorf("[GetServiceAccountIDToken] Could not exchange assertion for IAP Auth Token: %s (%s)", errorMesg.Error, errorMesg.ErrorDesc)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("[GetServiceAccountIDToken] Could not decode IAP Auth Token: %s", err.Error())
+	}
+
+	log.Debug().Msgf("[GetServiceAccountIDToken] Successfully exchanged assertion for IAP Auth Token")
+	return result.IDToken, nil
+}
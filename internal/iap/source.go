@@ -0,0 +1,195 @@
+package iap
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/adohkan/git-remote-https-iap/internal/git"
+	"github.com/rs/zerolog/log"
+)
+
+// BuiltinHelperID and BuiltinHelperSecret identify a desktop OAuth client embedded at build time, e.g.
+//
+//	make HELPER_ID=xxx HELPER_SECRET=yyy
+//
+// Secrets of desktop clients are not confidential, so organisations can distribute such a build
+// and only configure the IAP clientID of each domain.
+// see: https://developers.google.com/identity/protocols/oauth2#installed
+var (
+	BuiltinHelperID     string
+	BuiltinHelperSecret string
+)
+
+// getRawToken picks the most appropriate way to mint an IAP auth token for a domain.
+// Non-interactive sources are preferred, then the browser flow when a helper is configured,
+// and finally gcloud's application default credentials.
+// The audience is usually the IAP clientID, see resolveAudience.
+func getRawToken(domain, audience string, opts AuthOptions) (string, error) {
+	if command := git.ConfigTryGetURLMatch("iap.tokenCommand", domain); command != "" {
+		return GetCommandIDToken(command, domain, audience)
+	}
+
+	if serviceAccount := resolveImpersonatedServiceAccount(domain, opts); serviceAccount != "" {
+		return GetImpersonatedIDToken(serviceAccount, resolveKeyFile(domain, opts), audience)
+	}
+
+	if keyFile := resolveKeyFile(domain, opts); keyFile != "" {
+		return getRawTokenFromCredentialsFile(keyFile, audience)
+	}
+
+	if useMetadataServer(domain) {
+		log.Debug().Msgf("[getRawToken] Using metadata server")
+		return GetMetadataIDToken(audience)
+	}
+
+	helperID, helperSecret := resolveHelper(domain)
+	if helperID == "" {
+		if adcFile := findADCFile(); adcFile != "" {
+			log.Debug().Msgf("[getRawToken] No helperID for %s, using application default credentials %s", domain, adcFile)
+			return GetADCIDToken(adcFile, audience)
+		}
+		return "", fmt.Errorf("[getRawToken] No iap.helperID configured for %s, and no application default credentials found", domain)
+	}
+
+	// refresh tokens do not depend on the audience, they are shared by all paths of a host
+	return GetIAPAuthToken(baseDomain(domain), helperID, helperSecret, audience, opts)
+}
+
+// resolveHelper returns the OAuth client of the helper for a domain, the built-in one unless iap.helperID is set.
+// The secret is optional for public clients, which rely on PKCE.
+func resolveHelper(domain string) (string, string) {
+	helperID := git.ConfigTryGetURLMatch("iap.helperID", domain)
+	if helperID == "" {
+		helperID = BuiltinHelperID
+	}
+	helperSecret := helperSecretFor(domain)
+	if helperSecret == "" && helperID == BuiltinHelperID {
+		helperSecret = BuiltinHelperSecret
+	}
+	return helperID, helperSecret
+}
+
+// getRawTokenFromCredentialsFile dispatches on the type of a Google credentials file
+func getRawTokenFromCredentialsFile(keyFile, IAPClientID string) (string, error) {
+	var creds struct {
+		Type string `json:"type"`
+	}
+
+	data, err := os.ReadFile(expandHome(keyFile))
+	if err != nil {
+		return "", err
+	}
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return "", fmt.Errorf("[getRawTokenFromCredentialsFile] Could not parse %s: %w", keyFile, err)
+	}
+
+	switch creds.Type {
+	case serviceAccountKeyType:
+		log.Debug().Msgf("[getRawToken] Using service account key %s", keyFile)
+		return GetServiceAccountIDToken(keyFile, IAPClientID)
+	case authorizedUserType:
+		log.Debug().Msgf("[getRawToken] Using user credentials %s", keyFile)
+		return GetADCIDToken(keyFile, IAPClientID)
+	case externalAccountType:
+		log.Debug().Msgf("[getRawToken] Using workload identity federation config %s", keyFile)
+		return GetExternalAccountIDToken(keyFile, IAPClientID)
+	default:
+		return "", fmt.Errorf("[getRawTokenFromCredentialsFile] Unsupported credentials type '%s' in %s", creds.Type, keyFile)
+	}
+}
+
+// resolveKeyFile returns the service account key to use for a domain, if any.
+// An explicit option wins over the iap.keyFile git config, which wins over GOOGLE_APPLICATION_CREDENTIALS.
+func resolveKeyFile(domain string, opts AuthOptions) string {
+	if opts.KeyFile != "" {
+		return opts.KeyFile
+	}
+	if keyFile := git.ConfigTryGetURLMatch("iap.keyFile", domain); keyFile != "" {
+		return keyFile
+	}
+	return os.Getenv(CredentialsEnvVariable)
+}
+
+// resolveImpersonatedServiceAccount returns the service account to impersonate for a domain, if any.
+// An explicit option wins over the iap.impersonateServiceAccount git config.
+func resolveImpersonatedServiceAccount(domain string, opts AuthOptions) string {
+	if opts.ImpersonateServiceAccount != "" {
+		return opts.ImpersonateServiceAccount
+	}
+	return git.ConfigTryGetURLMatch("iap.impersonateServiceAccount", domain)
+}
+
+// useMetadataServer honors the iap.metadataServer git config when set, and otherwise probes for a metadata
+// server, only when no other source is configured: neither a helper for the browser flow in git config nor
+// application default credentials. The built-in helper does not count, as headless VMs cannot use a browser.
+func useMetadataServer(domain string) bool {
+	if enabled, err := strconv.ParseBool(git.ConfigTryGetURLMatch("iap.metadataServer", domain)); err == nil {
+		return enabled
+	}
+	if git.ConfigTryGetURLMatch("iap.helperID", domain) != "" || findADCFile() != "" {
+		return false
+	}
+	return onGCE()
+}
+
+// resolveAudience returns the audience of the tokens minted for a domain: the iap.audience git config
+// when set, for deployments expecting a non-default audience, and the IAP clientID otherwise.
+func resolveAudience(domain string) string {
+	if audience := git.ConfigTryGetURLMatch("iap.audience", domain); audience != "" {
+		return audience
+	}
+	return git.ConfigGetURLMatch("iap.clientID", domain)
+}
+
+// baseDomain strips the path from a url scoped to a part of a domain, e.g. by a per-path clientID mapping
+func baseDomain(domain string) string {
+	u, err := url.Parse(domain)
+	if err != nil || u.Host == "" {
+		return domain
+	}
+	return fmt.Sprintf("%s://%s", u.Scheme, CanonicalHost(u))
+}
+
+// CanonicalHost returns the host of an url with its port, e.g. git.domain.acme:8443, unless it is
+// the default port of its scheme, so that both forms share the same configuration and tokens
+func CanonicalHost(u *url.URL) string {
+	if port := u.Port(); port != "" && port == defaultPort(u.Scheme) {
+		return u.Hostname()
+	}
+	return u.Host
+}
+
+// defaultPort returns the port of urls of scheme without one: 80 for http, and 443 for https and
+// the schemes of the helper, such as https+iap or iap, which are reached over https
+func defaultPort(scheme string) string {
+	switch {
+	case scheme == "http":
+		return "80"
+	case scheme == "https" || scheme == iapScheme || strings.HasSuffix(scheme, "+iap"):
+		return "443"
+	}
+	return ""
+}
+
+// ConfiguredDomains lists the urls that have been configured for IAP, i.e. that have an iap.clientID,
+// or an iap.provider not requiring one. Wildcard hosts are skipped, as they cannot be authenticated against.
+func ConfiguredDomains() []string {
+	var domains []string
+	seen := map[string]bool{}
+	for _, domain := range append(git.ConfigURLsWithKey("iap", "clientID"), git.ConfigURLsWithKey("iap", "provider")...) {
+		if !strings.Contains(domain, "*") && !seen[domain] {
+			seen[domain] = true
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+// Configured tells whether an url, or an auth scope, has an iap.clientID or an iap.provider, and so is handled by the helper
+func Configured(url string) bool {
+	return git.ConfigTryGetURLMatch("iap.clientID", url) != "" || git.ConfigTryGetURLMatch("iap.provider", url) != ""
+}
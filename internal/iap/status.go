@@ -0,0 +1,62 @@
+package iap
+
+import (
+	"errors"
+	"time"
+
+	"github.com/adohkan/git-remote-https-iap/internal/git"
+)
+
+// HostStatus is the state of the credentials of a configured domain
+type HostStatus struct {
+	Domain string `json:"domain"`
+	// Store keeps the token, CookieFile being its file for the file stores
+	Store      string `json:"store"`
+	CookieFile string `json:"cookieFile,omitempty"`
+
+	HasToken  bool       `json:"hasToken"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	Expired   bool       `json:"expired"`
+	Account   string     `json:"account,omitempty"`
+	// RefreshToken tells whether a new token can be minted without a browser
+	RefreshToken bool `json:"refreshToken"`
+	// Error is why the cached token could not be read
+	Error string `json:"error,omitempty"`
+}
+
+// GetHostStatus reads the state of the credentials of a domain, without minting or refreshing any token
+func GetHostStatus(domain string) HostStatus {
+	status := HostStatus{Domain: domain, Store: StoreName(domain, StoreKindCookie)}
+	if status.Store == StoreFile || status.Store == StoreEncryptedFile {
+		if git.ConfigTryGetURLMatch("http.cookieFile", domain) == "" {
+			status.Error = "http.cookieFile is not set"
+			return status
+		}
+		status.CookieFile = cookieFilePath(domain)
+	}
+
+	if _, err := getRefreshTokenFromCache(domain); err == nil {
+		status.RefreshToken = true
+	}
+
+	auth, err := ReadAuthState(domain)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return status
+	case err != nil:
+		status.Error = err.Error()
+		return status
+	}
+
+	status.HasToken = true
+	status.Expired = auth.Cookie.Expired()
+	status.Account = auth.Cookie.Claims.Email
+	if status.Account == "" {
+		status.Account = auth.Cookie.Claims.Subject
+	}
+	if auth.Cookie.Claims.ExpiresAt != 0 {
+		expiresAt := time.Unix(auth.Cookie.Claims.ExpiresAt, 0)
+		status.ExpiresAt = &expiresAt
+	}
+	return status
+}
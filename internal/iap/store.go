@@ -0,0 +1,374 @@
+package iap
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/adohkan/git-remote-https-iap/internal/git"
+)
+
+const (
+	// StoreFile keeps cookies in the http.cookieFile of each domain, and refresh tokens in git-credential-store
+	StoreFile = "file"
+	// StoreKeychain uses the macOS Keychain
+	StoreKeychain = "keychain"
+	// StoreWincred uses the Windows Credential Manager
+	StoreWincred = "wincred"
+	// StoreSecretService uses libsecret (GNOME Keyring, KeePassXC...) through secret-tool
+	StoreSecretService = "secret-service"
+	// StoreKWallet uses KDE Wallet through kwallet-query
+	StoreKWallet = "kwallet"
+
+	// storeService prefixes the service name of the secrets saved in keyrings
+	storeService = "git-remote-https+iap"
+
+	// StoreKindCookie is the kind of the short-lived IAP tokens, keyed by auth scope
+	StoreKindCookie = "cookie"
+	// StoreKindRefreshToken is the kind of the long-lived refresh tokens, keyed by base domain
+	StoreKindRefreshToken = "refresh-token"
+	// StoreKindHelperSecret is the secret of the OAuth client of the helper, keyed by base domain
+	StoreKindHelperSecret = "helper-secret"
+)
+
+// storeConfigKeys are the git configs selecting the store of each kind of secret,
+// so that e.g. refresh tokens go to the keychain while short-lived cookies stay on disk
+var storeConfigKeys = map[string]string{
+	StoreKindCookie:       "iap.cookieStore",
+	StoreKindRefreshToken: "iap.refreshTokenStore",
+	// helper secrets are as long-lived as refresh tokens, and kept alongside them
+	StoreKindHelperSecret: "iap.refreshTokenStore",
+}
+
+// ErrNotFound is returned by a Store when no secret is saved for a key
+var ErrNotFound = errors.New("secret not found")
+
+// A Store persists secrets, such as IAP tokens or refresh tokens, by domain
+type Store interface {
+	Get(key string) (string, error)
+	Put(key, secret string) error
+	Delete(key string) error
+	// List returns the keys having a secret
+	List() ([]string, error)
+}
+
+// A StoreFactory returns the Store keeping a kind of secret of a domain, StoreKindCookie or StoreKindRefreshToken
+type StoreFactory func(domain, kind string) (Store, error)
+
+var (
+	storesMu sync.RWMutex
+	stores   = map[string]StoreFactory{}
+)
+
+// RegisterStore makes a Store available under a name, for the iap.credentialStore, iap.cookieStore
+// and iap.refreshTokenStore git configs. It panics when the name is already registered.
+// Forks can register their own backend, e.g. Vault, from an init function.
+func RegisterStore(name string, factory StoreFactory) {
+	storesMu.Lock()
+	defer storesMu.Unlock()
+
+	if _, exists := stores[name]; exists {
+		panic(fmt.Sprintf("iap: store %s registered twice", name))
+	}
+	stores[name] = factory
+}
+
+func init() {
+	RegisterStore(StoreFile, newDefaultStore)
+	RegisterStore(StoreKeychain, func(domain, kind string) (Store, error) {
+		return &keychainStore{service: storeServiceName(kind)}, nil
+	})
+	RegisterStore(StoreWincred, func(domain, kind string) (Store, error) {
+		return newWincredStore(storeServiceName(kind))
+	})
+	RegisterStore(StoreSecretService, func(domain, kind string) (Store, error) {
+		return &secretServiceStore{service: storeServiceName(kind)}, nil
+	})
+	RegisterStore(StoreKWallet, func(domain, kind string) (Store, error) {
+		return &kwalletStore{folder: storeServiceName(kind)}, nil
+	})
+	RegisterStore(StoreAgent, func(domain, kind string) (Store, error) {
+		return &agentStore{socket: AgentSocket(), kind: kind}, nil
+	})
+	RegisterStore(StoreHardware, func(domain, kind string) (Store, error) {
+		// cookies are short-lived, wrapping them is not worth a TPM operation per git command
+		if kind == StoreKindRefreshToken {
+			if store := newHardwareStore(); store != nil {
+				return store, nil
+			}
+		}
+		return newDefaultStore(domain, kind)
+	})
+	RegisterStore(StoreEncryptedFile, func(domain, kind string) (Store, error) {
+		// only cookies have files of their own
+		if kind == StoreKindCookie {
+			return newEncryptedFileStore(domain)
+		}
+		return newDefaultStore(domain, kind)
+	})
+}
+
+// StoreName returns the name of the Store selected for a kind of secret of a domain, see getStore
+func StoreName(domain, kind string) string {
+	name := git.ConfigTryGetURLMatch(storeConfigKeys[kind], domain)
+	if name == "" {
+		name = git.ConfigTryGetURLMatch("iap.credentialStore", domain)
+	}
+	if name == "" && os.Getenv(AgentSocketEnvVariable) != "" {
+		name = StoreAgent
+	}
+	if name == "" {
+		name = StoreFile
+	}
+	return name
+}
+
+func storeServiceName(kind string) string {
+	return fmt.Sprintf("%s %s", storeService, kind)
+}
+
+// newDefaultStore keeps cookies in their http.cookieFile, and refresh tokens with git-credential-store
+func newDefaultStore(domain, kind string) (Store, error) {
+	if kind == StoreKindCookie {
+		return &fileStore{}, nil
+	}
+
+	file := git.ConfigTryGetURLMatch("iap.refreshTokenFile", domain)
+	if file != "" {
+		file = expandHome(file)
+	}
+	return &gitCredentialStore{file: file}, nil
+}
+
+// getStore returns the Store selected for a kind of secret of a domain, by iap.cookieStore
+// or iap.refreshTokenStore, falling back to iap.credentialStore, then to the agent when
+// GIT_IAP_AGENT_SOCK is set, and finally to plaintext files.
+func getStore(domain, kind string) (Store, error) {
+	name := StoreName(domain, kind)
+
+	storesMu.RLock()
+	factory, ok := stores[name]
+	storesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("[getStore] Unknown %s store '%s'", kind, name)
+	}
+	return factory(domain, kind)
+}
+
+// runStoreCommand runs a keyring command line tool, feeding stdin, and returns its trimmed output
+func runStoreCommand(stdin string, name string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%s %s: %w (%s)", name, args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// keychainStore saves secrets as generic passwords in the macOS login keychain
+type keychainStore struct {
+	service string
+}
+
+func (s *keychainStore) Get(key string) (string, error) {
+	secret, err := runStoreCommand("", "security", "find-generic-password", "-s", s.service, "-a", key, "-w")
+	if err != nil {
+		return "", ErrNotFound
+	}
+	return secret, nil
+}
+
+func (s *keychainStore) Put(key, secret string) error {
+	// interactive mode keeps the secret out of the process list
+	command := fmt.Sprintf("add-generic-password -U -s %q -a %q -w %q\n", s.service, key, secret)
+	_, err := runStoreCommand(command, "security", "-i")
+	return err
+}
+
+func (s *keychainStore) Delete(key string) error {
+	_, err := runStoreCommand("", "security", "delete-generic-password", "-s", s.service, "-a", key)
+	return err
+}
+
+// List parses the attributes of the items dumped by security, which has no search command
+func (s *keychainStore) List() ([]string, error) {
+	out, err := runStoreCommand("", "security", "dump-keychain")
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, item := range strings.Split(out, "keychain: ") {
+		service := keychainAttribute(item, "svce")
+		account := keychainAttribute(item, "acct")
+		if service == s.service && account != "" {
+			keys = append(keys, account)
+		}
+	}
+	return keys, nil
+}
+
+// keychainAttribute extracts an attribute of an item dumped by security, e.g. "acct"<blob>="value"
+func keychainAttribute(item, name string) string {
+	prefix := fmt.Sprintf("\"%s\"<blob>=\"", name)
+	for _, line := range strings.Split(item, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, prefix) {
+			return strings.TrimSuffix(strings.TrimPrefix(line, prefix), "\"")
+		}
+	}
+	return ""
+}
+
+// secretServiceStore saves secrets through the freedesktop Secret Service API
+type secretServiceStore struct {
+	service string
+}
+
+func (s *secretServiceStore) Get(key string) (string, error) {
+	secret, err := runStoreCommand("", "secret-tool", "lookup", "service", s.service, "account", key)
+	if err != nil || secret == "" {
+		return "", ErrNotFound
+	}
+	return secret, nil
+}
+
+func (s *secretServiceStore) Put(key, secret string) error {
+	label := fmt.Sprintf("--label=%s %s", s.service, key)
+	_, err := runStoreCommand(secret, "secret-tool", "store", label, "service", s.service, "account", key)
+	return err
+}
+
+func (s *secretServiceStore) Delete(key string) error {
+	_, err := runStoreCommand("", "secret-tool", "clear", "service", s.service, "account", key)
+	return err
+}
+
+func (s *secretServiceStore) List() ([]string, error) {
+	out, err := runStoreCommand("", "secret-tool", "search", "--all", "service", s.service)
+	if err != nil {
+		// secret-tool fails when nothing matches
+		return nil, nil
+	}
+
+	var keys []string
+	for _, line := range strings.Split(out, "\n") {
+		if account := strings.TrimPrefix(line, "attribute.account = "); account != line {
+			keys = append(keys, account)
+		}
+	}
+	return keys, nil
+}
+
+// kwalletStore saves secrets as passwords of a folder in the default KDE wallet
+type kwalletStore struct {
+	folder string
+}
+
+const kwalletName = "kdewallet"
+
+func (s *kwalletStore) Get(key string) (string, error) {
+	secret, err := runStoreCommand("", "kwallet-query", "-r", key, "-f", s.folder, kwalletName)
+	if err != nil || secret == "" {
+		return "", ErrNotFound
+	}
+	return secret, nil
+}
+
+func (s *kwalletStore) Put(key, secret string) error {
+	_, err := runStoreCommand(secret, "kwallet-query", "-w", key, "-f", s.folder, kwalletName)
+	return err
+}
+
+// Delete blanks the secret, as kwallet-query cannot remove entries
+func (s *kwalletStore) Delete(key string) error {
+	return s.Put(key, "")
+}
+
+// List skips the entries blanked by Delete
+func (s *kwalletStore) List() ([]string, error) {
+	out, err := runStoreCommand("", "kwallet-query", "-l", "-f", s.folder, kwalletName)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, key := range strings.Split(out, "\n") {
+		if key == "" {
+			continue
+		}
+		if _, err := s.Get(key); err == nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// gitCredentialStore saves secrets with the built-in git-credential-store helper, in file
+// or in ~/.git-credentials when file is empty
+type gitCredentialStore struct {
+	file string
+}
+
+func (s *gitCredentialStore) Get(key string) (string, error) {
+	if s.file != "" {
+		ensurePrivate(s.file)
+	}
+	return git.GetCredentials(s.file, CacheProtocol, key, CacheUsername)
+}
+
+func (s *gitCredentialStore) Put(key, secret string) error {
+	if s.file != "" {
+		if err := os.MkdirAll(filepath.Dir(s.file), 0700); err != nil {
+			return err
+		}
+	}
+	return git.StoreCredentials(s.file, CacheProtocol, key, CacheUsername, secret)
+}
+
+func (s *gitCredentialStore) Delete(key string) error {
+	return git.EraseCredentials(s.file, CacheProtocol, key, CacheUsername)
+}
+
+// List parses the credentials file, whose lines look like iap://refresh-token:<token>@<escaped key>
+func (s *gitCredentialStore) List() ([]string, error) {
+	file := s.file
+	if file == "" {
+		file = expandHome("~/.git-credentials")
+	}
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	prefix := fmt.Sprintf("%s://%s:", CacheProtocol, CacheUsername)
+	for _, line := range strings.Split(string(data), "\n") {
+		at := strings.LastIndex(line, "@")
+		if !strings.HasPrefix(line, prefix) || at < 0 {
+			continue
+		}
+		if key, err := url.PathUnescape(line[at+1:]); err == nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// getRefreshTokenStore returns where the refresh tokens of a domain are kept
+func getRefreshTokenStore(domain string) (Store, error) {
+	return getStore(domain, StoreKindRefreshToken)
+}
@@ -0,0 +1,208 @@
+package iap
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/adohkan/git-remote-https-iap/internal/git"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// StoreEncryptedFile keeps cookies in files next to http.cookieFile, encrypted with a key kept in the OS keyring
+	StoreEncryptedFile = "encrypted-file"
+
+	encryptedFileSuffix  = ".enc"
+	encryptedFileVersion = "v1:"
+
+	storeKindEncryptionKey = "encryption-key"
+	encryptionKeyAccount   = "default"
+)
+
+// encryptedFileStore encrypts cookies with AES-256-GCM, so that tokens on disk cannot be read
+// by processes without access to the OS keyring. Existing plaintext cookie files are migrated on first read.
+type encryptedFileStore struct {
+	keyStore Store
+}
+
+// newEncryptedFileStore returns an encryptedFileStore whose key is kept in the keyring of the
+// iap.encryptionKeyStore git config, or in the default keyring of the OS.
+func newEncryptedFileStore(domain string) (Store, error) {
+	service := fmt.Sprintf("%s %s", storeService, storeKindEncryptionKey)
+
+	name := git.ConfigTryGetURLMatch("iap.encryptionKeyStore", domain)
+	if name == "" {
+		switch runtime.GOOS {
+		case "darwin":
+			name = StoreKeychain
+		case "windows":
+			name = StoreWincred
+		default:
+			name = StoreSecretService
+		}
+	}
+
+	var keyStore Store
+	var err error
+	switch name {
+	case StoreKeychain:
+		keyStore = &keychainStore{service: service}
+	case StoreWincred:
+		keyStore, err = newWincredStore(service)
+	case StoreSecretService:
+		keyStore = &secretServiceStore{service: service}
+	case StoreKWallet:
+		keyStore = &kwalletStore{folder: service}
+	default:
+		err = fmt.Errorf("[newEncryptedFileStore] Unknown iap.encryptionKeyStore '%s'", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptedFileStore{keyStore: keyStore}, nil
+}
+
+func encryptedFilePath(domain string) string {
+	return expandHome(cookieFilePath(domain)) + encryptedFileSuffix
+}
+
+// key returns the encryption key, generating it on first use
+func (s *encryptedFileStore) key() ([]byte, error) {
+	encoded, err := s.keyStore.Get(encryptionKeyAccount)
+	if err == nil && encoded != "" {
+		return base64.StdEncoding.DecodeString(encoded)
+	}
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	if err := s.keyStore.Put(encryptionKeyAccount, base64.StdEncoding.EncodeToString(key)); err != nil {
+		return nil, fmt.Errorf("[encryptedFileStore] Could not save encryption key: %w", err)
+	}
+	log.Debug().Msgf("[encryptedFileStore] Generated a new encryption key")
+	return key, nil
+}
+
+func (s *encryptedFileStore) aead() (cipher.AEAD, error) {
+	key, err := s.key()
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (s *encryptedFileStore) Get(domain string) (string, error) {
+	path := encryptedFilePath(domain)
+	ensurePrivate(path)
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s.migrate(domain)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	encoded := strings.TrimSpace(string(data))
+	if !strings.HasPrefix(encoded, encryptedFileVersion) {
+		return "", fmt.Errorf("[encryptedFileStore] Unsupported format in %s", path)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(encoded, encryptedFileVersion))
+	if err != nil {
+		return "", fmt.Errorf("[encryptedFileStore] Could not decode %s: %w", path, err)
+	}
+
+	aead, err := s.aead()
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("[encryptedFileStore] %s is truncated", path)
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+
+	// the domain is authenticated, so that files cannot be swapped between domains
+	token, err := aead.Open(nil, nonce, ciphertext, []byte(domain))
+	if err != nil {
+		return "", fmt.Errorf("[encryptedFileStore] Could not decrypt %s: %w", path, err)
+	}
+	return string(token), nil
+}
+
+func (s *encryptedFileStore) Put(domain, token string) error {
+	path := encryptedFilePath(domain)
+
+	aead, err := s.aead()
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(token), []byte(domain))
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	content := encryptedFileVersion + base64.StdEncoding.EncodeToString(sealed) + "\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		return err
+	}
+	ensurePrivate(path)
+	return nil
+}
+
+func (s *encryptedFileStore) Delete(domain string) error {
+	if err := os.Remove(encryptedFilePath(domain)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// List returns the domains whose cookie file has an encrypted counterpart
+func (s *encryptedFileStore) List() ([]string, error) {
+	var domains []string
+	for _, domain := range git.ConfigURLsWithKey("http", "cookieFile") {
+		if _, err := os.Stat(encryptedFilePath(domain)); err == nil {
+			domains = append(domains, domain)
+		}
+	}
+	return domains, nil
+}
+
+// migrate encrypts the plaintext cookie file of a domain, if any, then deletes it
+func (s *encryptedFileStore) migrate(domain string) (string, error) {
+	plain := &Cookie{JarPath: cookieFilePath(domain), Name: CookieName(domain)}
+
+	token, err := plain.readRawTokenFromJar()
+	if err != nil {
+		return "", ErrNotFound
+	}
+	if err := s.Put(domain, token); err != nil {
+		return "", fmt.Errorf("[encryptedFileStore] Could not migrate %s: %w", plain.JarPath, err)
+	}
+	if err := os.Remove(expandHome(plain.JarPath)); err != nil {
+		log.Warn().Msgf("[encryptedFileStore] Could not delete plaintext %s: %s", plain.JarPath, err)
+	}
+	log.Debug().Msgf("[encryptedFileStore] Migrated %s to an encrypted file", plain.JarPath)
+	return token, nil
+}
@@ -0,0 +1,57 @@
+package iap
+
+import (
+	"net/url"
+	"os"
+
+	"github.com/adohkan/git-remote-https-iap/internal/git"
+)
+
+// fileStore keeps each cookie in the http.cookieFile of its domain, in the format git reads
+type fileStore struct{}
+
+func (s *fileStore) Get(domain string) (string, error) {
+	c := &Cookie{JarPath: cookieFilePath(domain), Name: CookieName(domain)}
+
+	token, err := c.readRawTokenFromJar()
+	if os.IsNotExist(err) {
+		return "", ErrNotFound
+	}
+	return token, err
+}
+
+// Put writes the token with its expiry, which the cookie file format requires
+func (s *fileStore) Put(domain, token string) error {
+	u, err := url.Parse(domain)
+	if err != nil {
+		return err
+	}
+	_, claims, err := parseToken(domain, token)
+	if err != nil {
+		return err
+	}
+
+	c := &Cookie{JarPath: cookieFilePath(domain), Domain: u.Hostname(), Name: CookieName(domain)}
+	return c.write(token, claims.ExpiresAt)
+}
+
+func (s *fileStore) Delete(domain string) error {
+	if git.ConfigTryGetURLMatch("http.cookieFile", domain) == "" {
+		return nil
+	}
+	if err := os.Remove(expandHome(cookieFilePath(domain))); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// List returns the domains whose cookie file exists
+func (s *fileStore) List() ([]string, error) {
+	var domains []string
+	for _, domain := range git.ConfigURLsWithKey("http", "cookieFile") {
+		if _, err := os.Stat(expandHome(cookieFilePath(domain))); err == nil {
+			domains = append(domains, domain)
+		}
+	}
+	return domains, nil
+}
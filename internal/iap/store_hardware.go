@@ -0,0 +1,108 @@
+package iap
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// StoreHardware wraps refresh tokens with a key held by the TPM, so that the files left on disk
+	// are useless on another machine. It falls back to the default store when no TPM is available.
+	StoreHardware = "hardware"
+
+	hardwareDirName = "refresh-tokens"
+	hardwareSuffix  = ".tpm"
+)
+
+// keyWrapper encrypts secrets with a key that never leaves the hardware.
+// name binds a blob to its secret, so that blobs cannot be swapped between domains.
+type keyWrapper interface {
+	wrap(name string, secret []byte) ([]byte, error)
+	unwrap(name string, blob []byte) ([]byte, error)
+}
+
+// hardwareStore keeps secrets wrapped by a keyWrapper, in files of the storage directory
+type hardwareStore struct {
+	wrapper keyWrapper
+}
+
+// newHardwareStore returns a hardwareStore, or nil when this machine has no usable TPM
+func newHardwareStore() Store {
+	wrapper, err := newKeyWrapper()
+	if err != nil {
+		log.Warn().Msgf("Hardware protection of refresh tokens is not available, using the default store: %s", err)
+		return nil
+	}
+	return &hardwareStore{wrapper: wrapper}
+}
+
+func (s *hardwareStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(expandHome(CacheDir()), hardwareDirName, hex.EncodeToString(sum[:8])+hardwareSuffix)
+}
+
+func (s *hardwareStore) Get(key string) (string, error) {
+	path := s.path(key)
+	ensurePrivate(path)
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	blob, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return "", fmt.Errorf("[hardwareStore] Could not decode %s: %w", path, err)
+	}
+
+	secret, err := s.wrapper.unwrap(key, blob)
+	if err != nil {
+		return "", fmt.Errorf("[hardwareStore] Could not unwrap %s: %w", path, err)
+	}
+	return string(secret), nil
+}
+
+func (s *hardwareStore) Put(key, secret string) error {
+	path := s.path(key)
+
+	blob, err := s.wrapper.wrap(key, []byte(secret))
+	if err != nil {
+		return fmt.Errorf("[hardwareStore] Could not wrap secret of %s: %w", key, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(blob)+"\n"), 0600); err != nil {
+		return err
+	}
+	ensurePrivate(path)
+	return nil
+}
+
+func (s *hardwareStore) Delete(key string) error {
+	if err := os.Remove(s.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// List returns the configured domains having a wrapped secret, as file names are hashed
+func (s *hardwareStore) List() ([]string, error) {
+	var keys []string
+	for _, domain := range ConfiguredDomains() {
+		key := baseDomain(domain)
+		if _, err := os.Stat(s.path(key)); err == nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,43 @@
+package iap
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+const tpmDevice = "/dev/tpmrm0"
+
+// systemdCredsWrapper seals secrets to the TPM 2.0 with systemd-creds.
+// see: https://www.freedesktop.org/software/systemd/man/systemd-creds.html
+type systemdCredsWrapper struct{}
+
+func newKeyWrapper() (keyWrapper, error) {
+	if _, err := os.Stat(tpmDevice); err != nil {
+		return nil, fmt.Errorf("no TPM found at %s", tpmDevice)
+	}
+	if _, err := exec.LookPath("systemd-creds"); err != nil {
+		return nil, fmt.Errorf("systemd-creds is required to use the TPM: %w", err)
+	}
+	return &systemdCredsWrapper{}, nil
+}
+
+func (w *systemdCredsWrapper) wrap(name string, secret []byte) ([]byte, error) {
+	// systemd-creds reads and writes text, the secret goes through base64
+	out, err := runStoreCommand(base64.StdEncoding.EncodeToString(secret), "systemd-creds", "encrypt", "--with-key=tpm2", "--name="+credentialName(name), "-", "-")
+	return []byte(out), err
+}
+
+func (w *systemdCredsWrapper) unwrap(name string, blob []byte) ([]byte, error) {
+	out, err := runStoreCommand(string(blob), "systemd-creds", "decrypt", "--name="+credentialName(name), "-", "-")
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(out)
+}
+
+// credentialName turns a domain into a valid credential name, which cannot contain slashes
+func credentialName(name string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(name))
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package iap
+
+import "fmt"
+
+// The Secure Enclave of macOS can only be reached through the Security framework, which requires cgo.
+func newKeyWrapper() (keyWrapper, error) {
+	return nil, fmt.Errorf("no supported hardware key store on this platform, consider iap.refreshTokenStore keychain")
+}
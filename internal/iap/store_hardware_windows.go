@@ -0,0 +1,156 @@
+package iap
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	platformCryptoProvider = "Microsoft Platform Crypto Provider"
+	tpmKeyName             = "git-remote-https+iap refresh-token"
+
+	ncryptPadPKCS1Flag = 0x2
+	nteBadKeyset       = 0x80090016
+)
+
+var (
+	ncrypt                        = syscall.NewLazyDLL("ncrypt.dll")
+	procNCryptOpenStorageProvider = ncrypt.NewProc("NCryptOpenStorageProvider")
+	procNCryptOpenKey             = ncrypt.NewProc("NCryptOpenKey")
+	procNCryptCreatePersistedKey  = ncrypt.NewProc("NCryptCreatePersistedKey")
+	procNCryptFinalizeKey         = ncrypt.NewProc("NCryptFinalizeKey")
+	procNCryptEncrypt             = ncrypt.NewProc("NCryptEncrypt")
+	procNCryptDecrypt             = ncrypt.NewProc("NCryptDecrypt")
+	procNCryptFreeObject          = ncrypt.NewProc("NCryptFreeObject")
+)
+
+// ncryptWrapper wraps secrets with an RSA key of the TPM, through the Platform Crypto Provider.
+// The RSA key wraps a random AES key, which encrypts the secret, as RSA alone is limited in size.
+// see: https://learn.microsoft.com/en-us/windows/win32/seccng/key-storage-and-retrieval
+type ncryptWrapper struct{}
+
+func newKeyWrapper() (keyWrapper, error) {
+	key, err := openTPMKey()
+	if err != nil {
+		return nil, err
+	}
+	procNCryptFreeObject.Call(key)
+	return &ncryptWrapper{}, nil
+}
+
+// openTPMKey opens the RSA key of the helper in the TPM, creating it on first use
+func openTPMKey() (uintptr, error) {
+	provider, _ := syscall.UTF16PtrFromString(platformCryptoProvider)
+	name, _ := syscall.UTF16PtrFromString(tpmKeyName)
+	algorithm, _ := syscall.UTF16PtrFromString("RSA")
+
+	var prov, key uintptr
+	if r, _, _ := procNCryptOpenStorageProvider.Call(uintptr(unsafe.Pointer(&prov)), uintptr(unsafe.Pointer(provider)), 0); r != 0 {
+		return 0, fmt.Errorf("no TPM available (NCryptOpenStorageProvider: 0x%x)", r)
+	}
+	defer procNCryptFreeObject.Call(prov)
+
+	r, _, _ := procNCryptOpenKey.Call(prov, uintptr(unsafe.Pointer(&key)), uintptr(unsafe.Pointer(name)), 0, 0)
+	if r == 0 {
+		return key, nil
+	}
+	if r != nteBadKeyset {
+		return 0, fmt.Errorf("NCryptOpenKey: 0x%x", r)
+	}
+
+	if r, _, _ := procNCryptCreatePersistedKey.Call(prov, uintptr(unsafe.Pointer(&key)), uintptr(unsafe.Pointer(algorithm)), uintptr(unsafe.Pointer(name)), 0, 0); r != 0 {
+		return 0, fmt.Errorf("NCryptCreatePersistedKey: 0x%x", r)
+	}
+	if r, _, _ := procNCryptFinalizeKey.Call(key, 0); r != 0 {
+		procNCryptFreeObject.Call(key)
+		return 0, fmt.Errorf("NCryptFinalizeKey: 0x%x", r)
+	}
+	return key, nil
+}
+
+// ncryptCall runs NCryptEncrypt or NCryptDecrypt, first to size the output, then to fill it
+func ncryptCall(proc *syscall.LazyProc, key uintptr, input []byte) ([]byte, error) {
+	var size uint32
+	if r, _, _ := proc.Call(key, uintptr(unsafe.Pointer(&input[0])), uintptr(len(input)), 0, 0, 0, uintptr(unsafe.Pointer(&size)), ncryptPadPKCS1Flag); r != 0 {
+		return nil, fmt.Errorf("%s: 0x%x", proc.Name, r)
+	}
+	output := make([]byte, size)
+	if r, _, _ := proc.Call(key, uintptr(unsafe.Pointer(&input[0])), uintptr(len(input)), 0, uintptr(unsafe.Pointer(&output[0])), uintptr(size), uintptr(unsafe.Pointer(&size)), ncryptPadPKCS1Flag); r != 0 {
+		return nil, fmt.Errorf("%s: 0x%x", proc.Name, r)
+	}
+	return output[:size], nil
+}
+
+// wrap returns the wrapped AES key, prefixed by its length, then the nonce and the sealed secret
+func (w *ncryptWrapper) wrap(name string, secret []byte) ([]byte, error) {
+	key, err := openTPMKey()
+	if err != nil {
+		return nil, err
+	}
+	defer procNCryptFreeObject.Call(key)
+
+	aesKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, aesKey); err != nil {
+		return nil, err
+	}
+	wrappedKey, err := ncryptCall(procNCryptEncrypt, key, aesKey)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newGCM(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	blob := make([]byte, 2, 2+len(wrappedKey)+len(nonce)+len(secret)+aead.Overhead())
+	binary.BigEndian.PutUint16(blob, uint16(len(wrappedKey)))
+	blob = append(blob, wrappedKey...)
+	blob = append(blob, nonce...)
+	return aead.Seal(blob, nonce, secret, []byte(name)), nil
+}
+
+func (w *ncryptWrapper) unwrap(name string, blob []byte) ([]byte, error) {
+	if len(blob) < 2 || len(blob) < 2+int(binary.BigEndian.Uint16(blob)) {
+		return nil, fmt.Errorf("truncated blob")
+	}
+	wrappedKey := blob[2 : 2+binary.BigEndian.Uint16(blob)]
+	rest := blob[2+len(wrappedKey):]
+
+	key, err := openTPMKey()
+	if err != nil {
+		return nil, err
+	}
+	defer procNCryptFreeObject.Call(key)
+
+	aesKey, err := ncryptCall(procNCryptDecrypt, key, wrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) < aead.NonceSize() {
+		return nil, fmt.Errorf("truncated blob")
+	}
+	return aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], []byte(name))
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
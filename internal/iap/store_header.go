@@ -0,0 +1,165 @@
+package iap
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/adohkan/git-remote-https-iap/internal/git"
+	"github.com/rs/zerolog/log"
+)
+
+// StoreExtraHeader keeps each token in the http.<domain>.extraHeader of a private git config file,
+// included from the global git config, which git sends on plain https:// remotes. Only for cookies.
+const StoreExtraHeader = "extra-header"
+
+// extraHeaderPattern matches the headers written by extraHeaderStore, capturing the token
+var extraHeaderPattern = regexp.MustCompile(`^(?:(?:Proxy-)?Authorization: Bearer |Cookie: [^=]+=|cf-access-token: |X-Pomerium-Authorization: )(.+)$`)
+
+func init() {
+	RegisterStore(StoreExtraHeader, func(domain, kind string) (Store, error) {
+		if kind == StoreKindCookie {
+			return &extraHeaderStore{}, nil
+		}
+		return newDefaultStore(domain, kind)
+	})
+}
+
+// ExtraHeadersFile is the git config file of extraHeaderStore. Every header in it was written by the store,
+// so that the extra headers of the user are never touched, and tokens stay out of ~/.gitconfig, which is
+// often readable by others or tracked with dotfiles.
+func ExtraHeadersFile() string {
+	return filepath.Join(CacheDir(), "extra-headers.gitconfig")
+}
+
+// extraHeaderStore keeps the header of each domain, written whole by Put and Delete so that
+// tokens are never passed to git on its command line
+type extraHeaderStore struct{}
+
+func (s *extraHeaderStore) Get(domain string) (string, error) {
+	header, ok := readExtraHeaders()[domain]
+	if !ok {
+		return "", ErrNotFound
+	}
+	// the cookies of sharded sessions are the token, see ALB
+	if strings.HasPrefix(header, "Cookie: "+ALBCookieName+"-0=") {
+		return strings.TrimPrefix(header, "Cookie: "), nil
+	}
+	if match := extraHeaderPattern.FindStringSubmatch(header); match != nil {
+		return match[1], nil
+	}
+	return "", ErrNotFound
+}
+
+// Put writes the header selected by iap.authHeader, replacing the previous token
+func (s *extraHeaderStore) Put(domain, token string) error {
+	header := AuthHeader(domain, token)
+	if header == "" {
+		return fmt.Errorf("[extraHeaderStore] iap.authHeader of %s must not be none", domain)
+	}
+	if err := includeExtraHeaders(); err != nil {
+		return err
+	}
+	return updateExtraHeaders(func(headers map[string]string) {
+		headers[domain] = header
+	})
+}
+
+func (s *extraHeaderStore) Delete(domain string) error {
+	return updateExtraHeaders(func(headers map[string]string) {
+		delete(headers, domain)
+	})
+}
+
+func (s *extraHeaderStore) List() ([]string, error) {
+	var domains []string
+	for domain := range readExtraHeaders() {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	return domains, nil
+}
+
+// readExtraHeaders returns the header of each domain in ExtraHeadersFile
+func readExtraHeaders() map[string]string {
+	headers := map[string]string{}
+	file := expandHome(ExtraHeadersFile())
+	if _, err := os.Stat(file); err != nil {
+		return headers
+	}
+	configs, err := git.ConfigListScoped(git.ScopeFile(file))
+	if err != nil {
+		log.Debug().Msgf("[readExtraHeaders] %s", err)
+		return headers
+	}
+	for _, config := range configs {
+		name := config[0]
+		if strings.HasPrefix(name, "http.") && strings.HasSuffix(name, ".extraheader") {
+			headers[strings.TrimSuffix(strings.TrimPrefix(name, "http."), ".extraheader")] = config[1]
+		}
+	}
+	return headers
+}
+
+// updateExtraHeaders rewrites ExtraHeadersFile with the headers changed by update, under a lock
+// as several git processes may refresh the tokens of different hosts at once
+func updateExtraHeaders(update func(headers map[string]string)) error {
+	file := expandHome(ExtraHeadersFile())
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	lock, err := os.OpenFile(file+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return fmt.Errorf("[extraHeaderStore] Could not lock %s: %w", file, err)
+	}
+	defer lock.Close()
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(lockPollInterval) {
+		if locked, err := tryLockFile(lock); err != nil || locked || time.Now().After(deadline) {
+			break
+		}
+	}
+	defer unlockFile(lock)
+
+	headers := readExtraHeaders()
+	update(headers)
+
+	var domains []string
+	for domain := range headers {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	var b strings.Builder
+	b.WriteString("# Written by git-remote-https+iap for iap.cookieStore=extra-header, do not edit\n")
+	for _, domain := range domains {
+		fmt.Fprintf(&b, "[http %s]\n\textraHeader = %s\n", quoteConfig(domain), quoteConfig(headers[domain]))
+	}
+
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0600); err != nil {
+		return fmt.Errorf("[extraHeaderStore] Could not write %s: %w", tmp, err)
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		return fmt.Errorf("[extraHeaderStore] Could not write %s: %w", file, err)
+	}
+	ensurePrivate(file)
+	return nil
+}
+
+// includeExtraHeaders makes the global git config include ExtraHeadersFile
+func includeExtraHeaders() error {
+	for _, path := range git.ConfigTryGetAll("include.path") {
+		if path == ExtraHeadersFile() {
+			return nil
+		}
+	}
+	return git.ReplaceGlobalConfig("include.path", ExtraHeadersFile(), fmt.Sprintf("^%s$", regexp.QuoteMeta(ExtraHeadersFile())))
+}
+
+// quoteConfig quotes a subsection or value of a git config file
+func quoteConfig(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
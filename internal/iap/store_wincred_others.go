@@ -0,0 +1,10 @@
+//go:build !windows
+// +build !windows
+
+package iap
+
+import "fmt"
+
+func newWincredStore(service string) (Store, error) {
+	return nil, fmt.Errorf("[newWincredStore] The Windows Credential Manager is only available on Windows")
+}
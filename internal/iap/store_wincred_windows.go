@@ -0,0 +1,147 @@
+package iap
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	credTypeGeneric         = 1
+	credPersistLocalMachine = 2
+	errorNotFound           = syscall.Errno(1168)
+)
+
+var (
+	advapi32       = syscall.NewLazyDLL("advapi32.dll")
+	procCredReadW  = advapi32.NewProc("CredReadW")
+	procCredWriteW = advapi32.NewProc("CredWriteW")
+	procCredDelete = advapi32.NewProc("CredDeleteW")
+	procCredFree   = advapi32.NewProc("CredFree")
+	procCredEnum   = advapi32.NewProc("CredEnumerateW")
+)
+
+// credential mirrors the CREDENTIALW structure.
+// see: https://learn.microsoft.com/en-us/windows/win32/api/wincred/ns-wincred-credentialw
+type credential struct {
+	Flags              uint32
+	Type               uint32
+	TargetName         *uint16
+	Comment            *uint16
+	LastWritten        syscall.Filetime
+	CredentialBlobSize uint32
+	CredentialBlob     *byte
+	Persist            uint32
+	AttributeCount     uint32
+	Attributes         uintptr
+	TargetAlias        *uint16
+	UserName           *uint16
+}
+
+// wincredStore saves secrets as generic credentials of the Windows Credential Manager
+type wincredStore struct {
+	service string
+}
+
+func newWincredStore(service string) (Store, error) {
+	return &wincredStore{service: service}, nil
+}
+
+func (s *wincredStore) target(key string) (*uint16, error) {
+	return syscall.UTF16PtrFromString(fmt.Sprintf("%s:%s", s.service, key))
+}
+
+func (s *wincredStore) Get(key string) (string, error) {
+	target, err := s.target(key)
+	if err != nil {
+		return "", err
+	}
+
+	var cred *credential
+	ret, _, err := procCredReadW.Call(uintptr(unsafe.Pointer(target)), credTypeGeneric, 0, uintptr(unsafe.Pointer(&cred)))
+	if ret == 0 {
+		if err == errorNotFound {
+			return "", ErrNotFound
+		}
+		return "", fmt.Errorf("[wincredStore] CredReadW: %w", err)
+	}
+	defer procCredFree.Call(uintptr(unsafe.Pointer(cred)))
+
+	blob := unsafe.Slice(cred.CredentialBlob, cred.CredentialBlobSize)
+	return string(blob), nil
+}
+
+func (s *wincredStore) Put(key, secret string) error {
+	target, err := s.target(key)
+	if err != nil {
+		return err
+	}
+	user, err := syscall.UTF16PtrFromString(key)
+	if err != nil {
+		return err
+	}
+
+	blob := []byte(secret)
+	cred := credential{
+		Type:               credTypeGeneric,
+		TargetName:         target,
+		CredentialBlobSize: uint32(len(blob)),
+		Persist:            credPersistLocalMachine,
+		UserName:           user,
+	}
+	if len(blob) > 0 {
+		cred.CredentialBlob = &blob[0]
+	}
+
+	if ret, _, err := procCredWriteW.Call(uintptr(unsafe.Pointer(&cred)), 0); ret == 0 {
+		return fmt.Errorf("[wincredStore] CredWriteW: %w", err)
+	}
+	return nil
+}
+
+func (s *wincredStore) Delete(key string) error {
+	target, err := s.target(key)
+	if err != nil {
+		return err
+	}
+	if ret, _, err := procCredDelete.Call(uintptr(unsafe.Pointer(target)), credTypeGeneric, 0); ret == 0 && err != errorNotFound {
+		return fmt.Errorf("[wincredStore] CredDeleteW: %w", err)
+	}
+	return nil
+}
+
+// List enumerates the credentials whose target starts with the service, the user name being the key
+func (s *wincredStore) List() ([]string, error) {
+	filter, err := syscall.UTF16PtrFromString(s.service + ":*")
+	if err != nil {
+		return nil, err
+	}
+
+	var count uint32
+	var creds **credential
+	ret, _, err := procCredEnum.Call(uintptr(unsafe.Pointer(filter)), 0, uintptr(unsafe.Pointer(&count)), uintptr(unsafe.Pointer(&creds)))
+	if ret == 0 {
+		if err == errorNotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("[wincredStore] CredEnumerateW: %w", err)
+	}
+	defer procCredFree.Call(uintptr(unsafe.Pointer(creds)))
+
+	var keys []string
+	for _, cred := range unsafe.Slice(creds, count) {
+		if cred.UserName != nil {
+			keys = append(keys, utf16PtrToString(cred.UserName))
+		}
+	}
+	return keys, nil
+}
+
+// utf16PtrToString reads a NUL terminated UTF-16 string
+func utf16PtrToString(p *uint16) string {
+	var chars []uint16
+	for ptr := unsafe.Pointer(p); *(*uint16)(ptr) != 0; ptr = unsafe.Pointer(uintptr(ptr) + 2) {
+		chars = append(chars, *(*uint16)(ptr))
+	}
+	return syscall.UTF16ToString(chars)
+}
@@ -3,15 +3,18 @@ package iap
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/adohkan/git-remote-https-iap/internal/git"
 	"github.com/int128/oauth2cli"
-	"github.com/pkg/browser"
+	"github.com/int128/oauth2cli/oauth2params"
 	"github.com/rs/zerolog/log"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
@@ -26,14 +29,21 @@ const (
 	// CacheUsername is the username used when saving the refresh-token in git-credential-store.
 	// It can be an arbitrary value.
 	CacheUsername = "refresh-token"
+
+	// DefaultBrowserTimeout is how long we wait for the user to complete the browser flow
+	DefaultBrowserTimeout = 120 * time.Second
 )
 
+// errInvalidGrant is returned when Google rejects a refresh token, e.g. because it was revoked or has expired
+var errInvalidGrant = errors.New("invalid_grant")
+
 type token struct {
-	AccessToken string `json:"access_token"`
-	ExpiresIn   int    `json:"expires_in"`
-	Scope       string `json:"scope"`
-	TokenType   string `json:"token_type"`
-	IDToken     string `json:"id_token"`
+	AccessToken  string `json:"access_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	Scope        string `json:"scope"`
+	TokenType    string `json:"token_type"`
+	IDToken      string `json:"id_token"`
+	RefreshToken string `json:"refresh_token"`
 }
 
 type httpError struct {
@@ -41,18 +51,74 @@ type httpError struct {
 	ErrorDesc string `json:"error_description"`
 }
 
-func getAdditionalScopes() []string {
-	env := os.Getenv("GIT_IAP_ADDITIONAL_SCOPES")
-	if env == "" {
-		return []string{}
+// getAdditionalScopes returns the scopes requested on top of 'openid' and 'email',
+// from the iap.scopes git config of the domain and the GIT_IAP_ADDITIONAL_SCOPES environment variable.
+// Tunnels, whose access tokens are sent to Google APIs, also need the cloud-platform scope.
+func getAdditionalScopes(domain string) []string {
+	scopes := strings.Fields(git.ConfigTryGetURLMatch("iap.scopes", domain))
+	if strings.HasPrefix(domain, TunnelScheme+"://") {
+		scopes = append(scopes, cloudPlatformScope)
+	}
+	return append(scopes, strings.Fields(os.Getenv("GIT_IAP_ADDITIONAL_SCOPES"))...)
+}
+
+// getBrowserTimeout returns how long to wait for the user to complete the browser flow,
+// from the iap.browserTimeout git config (e.g. "5m").
+func getBrowserTimeout(domain string) time.Duration {
+	value := git.ConfigTryGetURLMatch("iap.browserTimeout", domain)
+	if value == "" {
+		return DefaultBrowserTimeout
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		log.Warn().Msgf("[getBrowserTimeout] Ignoring invalid iap.browserTimeout '%s'", value)
+		return DefaultBrowserTimeout
 	}
-	return strings.Fields(env)
+	return timeout
+}
+
+// getCallbackAddresses returns the candidate addresses of the local callback server, from the
+// iap.callbackPorts git config: a comma separated list of ports or ranges, e.g. "8400-8420".
+// The first free port is used, and any port is picked when the config is not set.
+func getCallbackAddresses(domain string) ([]string, error) {
+	var addresses []string
+
+	spec := git.ConfigTryGetURLMatch("iap.callbackPorts", domain)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		bounds := strings.SplitN(part, "-", 2)
+		first, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+		if err != nil {
+			return nil, fmt.Errorf("[getCallbackAddresses] Invalid iap.callbackPorts '%s': %w", spec, err)
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(strings.TrimSpace(bounds[1])); err != nil {
+				return nil, fmt.Errorf("[getCallbackAddresses] Invalid iap.callbackPorts '%s': %w", spec, err)
+			}
+		}
+		if first < 1 || last > 65535 || first > last {
+			return nil, fmt.Errorf("[getCallbackAddresses] Invalid iap.callbackPorts '%s': %s is out of range", spec, part)
+		}
+
+		for port := first; port <= last; port++ {
+			addresses = append(addresses, fmt.Sprintf("127.0.0.1:%d", port))
+		}
+	}
+
+	return addresses, nil
 }
 
 // getRefreshTokenFromBrowserFlow initialize an OAuth login workflow via the browser and returns a refresh token valid for a given url
 // see: https://github.com/int128/oauth2cli/blob/master/example/main.go
-func getRefreshTokenFromBrowserFlow(domain, helperID, helperSecret string) (string, error) {
-	ctx := context.Background()
+func getRefreshTokenFromBrowserFlow(domain, helperID, helperSecret string, authCodeOptions []oauth2.AuthCodeOption) (string, error) {
+	timeout := getBrowserTimeout(domain)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 	ready := make(chan string, 1)
 
 	var eg errgroup.Group
@@ -62,7 +128,7 @@ func getRefreshTokenFromBrowserFlow(domain, helperID, helperSecret string) (stri
 	scopes := append([]string{
 		"openid",
 		"email",
-	}, getAdditionalScopes()[:]...)
+	}, getAdditionalScopes(domain)[:]...)
 
 	var OAuthConfig = oauth2.Config{
 		ClientID:     helperID,
@@ -78,24 +144,42 @@ func getRefreshTokenFromBrowserFlow(domain, helperID, helperSecret string) (stri
 				return nil
 			}
 			log.Debug().Msgf("[getRefreshTokenFromBrowserFlow] Open %s", url)
-			if err := browser.OpenURL(url); err != nil {
+			if err := openBrowser(domain, url); err != nil {
 				log.Error().Msgf("[getRefreshTokenFromBrowserFlow] Could not open the browser: %s", err)
 			}
 			return nil
-		case err := <-ctx.Done():
-			return fmt.Errorf("[getRefreshTokenFromBrowserFlow] Context done while waiting for authorization: %w", err)
+		case <-ctx.Done():
+			return fmt.Errorf("[getRefreshTokenFromBrowserFlow] Context done while waiting for authorization: %w", ctx.Err())
 		}
 	})
 
+	bindAddresses, err := getCallbackAddresses(domain)
+	if err != nil {
+		return "", err
+	}
+
+	// PKCE lets the helper be registered as a public client, without a confidential helperSecret
+	// see: https://www.rfc-editor.org/rfc/rfc7636
+	pkce, err := oauth2params.NewPKCE()
+	if err != nil {
+		return "", fmt.Errorf("[getRefreshTokenFromBrowserFlow] Could not generate PKCE parameters: %w", err)
+	}
+
 	eg.Go(func() error {
 		defer close(ready)
 
 		cfg := oauth2cli.Config{
-			OAuth2Config:         OAuthConfig,
-			LocalServerReadyChan: ready,
+			OAuth2Config:           OAuthConfig,
+			AuthCodeOptions:        append(pkce.AuthCodeOptions(), authCodeOptions...),
+			TokenRequestOptions:    pkce.TokenRequestOptions(),
+			LocalServerBindAddress: bindAddresses,
+			LocalServerReadyChan:   ready,
 		}
 
 		token, err = oauth2cli.GetToken(ctx, cfg)
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("[getRefreshTokenFromBrowserFlow] Gave up waiting for authorization in the browser after %s (see iap.browserTimeout)", timeout)
+		}
 		if err != nil {
 			return fmt.Errorf("[getRefreshTokenFromBrowserFlow] Could not get 'access_token' for the desktop-app: %w", err)
 		}
@@ -112,67 +196,182 @@ func getRefreshTokenFromBrowserFlow(domain, helperID, helperSecret string) (stri
 	return token.RefreshToken, nil
 }
 
+// getAuthCodeOptions returns the extra parameters of the authorization request:
+// the account pre-selected by the iap.loginHint git config, the Workspace domain of iap.hostedDomain,
+// and the account chooser when asked for.
+func getAuthCodeOptions(domain string, opts AuthOptions) []oauth2.AuthCodeOption {
+	var options []oauth2.AuthCodeOption
+	if loginHint := git.ConfigTryGetURLMatch("iap.loginHint", domain); loginHint != "" {
+		options = append(options, oauth2.SetAuthURLParam("login_hint", loginHint))
+	}
+	if hostedDomain := git.ConfigTryGetURLMatch("iap.hostedDomain", domain); hostedDomain != "" {
+		// only a hint for the consent screen, checkHostedDomain enforces it
+		options = append(options, oauth2.SetAuthURLParam("hd", hostedDomain))
+	}
+	if opts.SelectAccount {
+		options = append(options, oauth2.SetAuthURLParam("prompt", "select_account"))
+	}
+	return options
+}
+
+// getRefreshTokenInteractively asks the user to log in, via the browser, the device or the manual flow
+func getRefreshTokenInteractively(domain, helperID, helperSecret string, opts AuthOptions) (string, error) {
+	if opts.NonInteractive {
+		return "", fmt.Errorf("[getRefreshTokenInteractively] Interactive login required for %s", domain)
+	}
+
+	switch flow := getAuthFlow(domain, opts); flow {
+	case AuthFlowDevice:
+		log.Debug().Msgf("[getRefreshTokenInteractively] Using device flow for %s", domain)
+		return getRefreshTokenFromDeviceFlow(domain, helperID, helperSecret)
+	case AuthFlowManual:
+		log.Debug().Msgf("[getRefreshTokenInteractively] Using manual flow for %s", domain)
+		return getRefreshTokenFromManualFlow(domain, helperID, helperSecret, getAuthCodeOptions(domain, opts))
+	default:
+		return getRefreshTokenFromBrowserFlow(domain, helperID, helperSecret, getAuthCodeOptions(domain, opts))
+	}
+}
+
 func cacheRefreshToken(key, token string) error {
-	return git.StoreCredentials(CacheProtocol, key, CacheUsername, token)
+	store, err := getRefreshTokenStore(key)
+	if err != nil {
+		return err
+	}
+	return store.Put(key, token)
 }
 
 func getRefreshTokenFromCache(key string) (string, error) {
-	return git.GetCredentials(CacheProtocol, key, CacheUsername)
+	store, err := getRefreshTokenStore(key)
+	if err != nil {
+		return "", err
+	}
+	return store.Get(key)
+}
+
+func eraseRefreshToken(key string) error {
+	store, err := getRefreshTokenStore(key)
+	if err != nil {
+		return err
+	}
+	return store.Delete(key)
 }
 
 // GetIAPAuthToken take care of the IAP Authentication process when relevant.
 // It optmize this workflow by detecting cases where an existing IAP auth token is already available,
 // and caching a refresh-token.
 // It returns a raw IAP auth token and any error encountered.
-func GetIAPAuthToken(domain, helperID, helperSecret, IAPclientID string, forcebrowserflow bool) (string, error) {
-	var result token
-	var errorMesg httpError
+func GetIAPAuthToken(domain, helperID, helperSecret, IAPclientID string, opts AuthOptions) (string, error) {
+	result, err := refreshTokens(domain, helperID, helperSecret, IAPclientID, opts)
+	if err != nil {
+		return "", err
+	}
+	return result.IDToken, nil
+}
 
+// refreshTokens exchanges the cached refresh token of domain, or a new one after logging in, for fresh
+// ID and access tokens. The ID token has the given audience, unless empty.
+func refreshTokens(domain, helperID, helperSecret, IAPclientID string, opts AuthOptions) (*token, error) {
 	refreshToken, err := getRefreshTokenFromCache(domain)
+	fromCache := err == nil && !opts.ForceBrowserFlow
+
+	if !fromCache {
+		if opts.ForceBrowserFlow {
+			log.Debug().Msgf("[refreshTokens] Forcing getRefreshTokenInteractively")
+		} else {
+			log.Debug().Msgf("[refreshTokens] No cached refresh token for %s: %s", domain, err.Error())
+		}
 
-	if forcebrowserflow {
-		log.Debug().Msgf("[GetIAPAuthToken] Forcing getRefreshTokenFromBrowserFlow")
-		refreshToken, err = getRefreshTokenFromBrowserFlow(domain, helperID, helperSecret)
+		refreshToken, err = renewRefreshToken(domain, helperID, helperSecret, opts)
+		if err != nil {
+			return nil, err
+		}
 	}
+	log.Debug().Msgf("[refreshTokens] refreshToken is: %s", refreshToken)
 
-	if err != nil {
-		log.Debug().Msgf("[GetIAPAuthToken] No cached refresh token for %s: %s", domain, err.Error())
+	// exchange our refreshToken for an id_token that we can use as GCP_IAAP_AUTH_TOKEN
+	result, err := exchangeRefreshToken(helperID, helperSecret, refreshToken, IAPclientID)
+	if errors.Is(err, errInvalidGrant) && fromCache {
+		// the cached refresh token has been revoked or has expired: restart the consent flow, once
+		log.Debug().Msgf("[refreshTokens] Cached refresh token for %s was rejected, restarting consent flow", domain)
+		if err := eraseRefreshToken(domain); err != nil {
+			log.Warn().Msgf("[refreshTokens] Could not erase refresh token for %s: %s", domain, err.Error())
+		}
 
-		refreshToken, err = getRefreshTokenFromBrowserFlow(domain, helperID, helperSecret)
+		refreshToken, err = renewRefreshToken(domain, helperID, helperSecret, opts)
 		if err != nil {
-			log.Debug().Msgf("[GetIAPAuthToken] getRefreshTokenFromBrowserFlow Failed")
-			return "", err
+			return nil, err
 		}
-		if err := cacheRefreshToken(domain, refreshToken); err != nil {
-			log.Warn().Msgf("[GetIAPAuthToken] Could not cache refresh token for %s: %s", domain, err.Error())
+		result, err = exchangeRefreshToken(helperID, helperSecret, refreshToken, IAPclientID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Google may rotate the refresh token along with the exchange
+	if result.RefreshToken != "" && result.RefreshToken != refreshToken {
+		log.Debug().Msgf("[refreshTokens] Refresh token for %s has been rotated", domain)
+		if err := cacheRefreshToken(domain, result.RefreshToken); err != nil {
+			log.Warn().Msgf("[refreshTokens] Could not cache refresh token for %s: %s", domain, err.Error())
 		}
 	}
-	log.Debug().Msgf("[GetIAPAuthToken] refreshToken is: %s", refreshToken)
 
-	// exchange our refreshToken for an id_token that we can use as GCP_IAAP_AUTH_TOKEN
-	log.Debug().Msgf("[GetIAPAuthToken] Google Endpoint is: %s", google.Endpoint.TokenURL)
-	resp, err := http.PostForm(google.Endpoint.TokenURL, url.Values{
-		"client_id":     {helperID},
-		"client_secret": {helperSecret},
+	return result, nil
+}
+
+// renewRefreshToken runs the interactive flow and caches the resulting refresh token
+func renewRefreshToken(domain, helperID, helperSecret string, opts AuthOptions) (string, error) {
+	refreshToken, err := getRefreshTokenInteractively(domain, helperID, helperSecret, opts)
+	if err != nil {
+		log.Debug().Msgf("[GetIAPAuthToken] getRefreshTokenInteractively Failed")
+		return "", err
+	}
+	countInteractiveFlow(domain)
+	if err := cacheRefreshToken(domain, refreshToken); err != nil {
+		log.Warn().Msgf("[GetIAPAuthToken] Could not cache refresh token for %s: %s", domain, err.Error())
+	}
+	return refreshToken, nil
+}
+
+// exchangeRefreshToken redeems a refresh token for an ID token with the given audience.
+// It returns the token response, which may include a rotated refresh token, and any error encountered.
+func exchangeRefreshToken(clientID, clientSecret, refreshToken, audience string) (*token, error) {
+	var result token
+	var errorMesg httpError
+
+	log.Debug().Msgf("[exchangeRefreshToken] Google Endpoint is: %s", google.Endpoint.TokenURL)
+	params := url.Values{
+		"client_id":     {clientID},
 		"refresh_token": {refreshToken},
 		"grant_type":    {"refresh_token"},
-		"audience":      {IAPclientID},
-	})
+	}
+	// access tokens alone are requested without audience
+	if audience != "" {
+		params.Set("audience", audience)
+	}
+	// public clients have no secret
+	if clientSecret != "" {
+		params.Set("client_secret", clientSecret)
+	}
+	resp, err := http.PostForm(google.Endpoint.TokenURL, params)
 
 	if err != nil {
-		return "", fmt.Errorf("[GetIAPAuthToken] Could not get exchange 'refresh_token' for IAP Auth Token: %s", err.Error())
+		return nil, fmt.Errorf("[exchangeRefreshToken] Could not get exchange 'refresh_token' for IAP Auth Token: %s", err.Error())
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
 		json.NewDecoder(resp.Body).Decode(&errorMesg)
-		return "", fmt.Errorf("[GetIAPAuthToken] Could not get exchange 'refresh_token' for IAP Auth Token: HTTP Error Code: %s .... Error Description: %s", errorMesg.ErrorDesc, errorMesg.Error)
+		if errorMesg.Error == errInvalidGrant.Error() {
+			return nil, fmt.Errorf("[exchangeRefreshToken] Could not get exchange 'refresh_token' for IAP Auth Token: %s: %w", errorMesg.ErrorDesc, errInvalidGrant)
+		}
+		return nil, fmt.Errorf("[exchangeRefreshToken] Could not get exchange 'refresh_token' for IAP Auth Token: HTTP Error Code: %s .... Error Description: %s", errorMesg.ErrorDesc, errorMesg.Error)
 	}
 
-	log.Debug().Msgf("[GetIAPAuthToken] Successfully used 'refresh_token' to claim IAP Auth Token")
+	log.Debug().Msgf("[exchangeRefreshToken] Successfully used 'refresh_token' to claim IAP Auth Token")
 
 	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return "", fmt.Errorf("[GetIAPAuthToken] Could not get exchange 'refresh_token' for IAP Auth Token: %s", err.Error())
+		return nil, fmt.Errorf("[exchangeRefreshToken] Could not get exchange 'refresh_token' for IAP Auth Token: %s", err.Error())
 	}
 
-	return result.IDToken, nil
+	return &result, nil
 }
@@ -0,0 +1,51 @@
+package iap
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/oauth2/google"
+)
+
+// TunnelScheme is the scheme of the git config of instances reached with IAP TCP forwarding,
+// e.g. iap.iap-tunnel://bastion.project, which also keys the refresh token of their logins
+const TunnelScheme = "iap-tunnel"
+
+// GetTunnelAccessToken returns an OAuth access token of the cloud-platform scope for the IAP TCP forwarding
+// of domain, an iap-tunnel:// url. It comes from the service account key or workload identity federation
+// config of the domain, or from the browser flow of the helper, whose login asks for that scope, and
+// otherwise from application default credentials, including the metadata server.
+func GetTunnelAccessToken(domain string, opts AuthOptions) (string, error) {
+	ctx := context.Background()
+
+	var creds *google.Credentials
+	var err error
+	if keyFile := resolveKeyFile(domain, opts); keyFile != "" {
+		data, readErr := os.ReadFile(expandHome(keyFile))
+		if readErr != nil {
+			return "", readErr
+		}
+		log.Debug().Msgf("[GetTunnelAccessToken] Using credentials %s", keyFile)
+		creds, err = google.CredentialsFromJSON(ctx, data, cloudPlatformScope)
+	} else if helperID, helperSecret := resolveHelper(domain); helperID != "" {
+		result, err := refreshTokens(domain, helperID, helperSecret, "", opts)
+		if err != nil {
+			return "", err
+		}
+		return result.AccessToken, nil
+	} else {
+		log.Debug().Msgf("[GetTunnelAccessToken] No helperID for %s, using application default credentials", domain)
+		creds, err = google.FindDefaultCredentials(ctx, cloudPlatformScope)
+	}
+	if err != nil {
+		return "", fmt.Errorf("[GetTunnelAccessToken] Could not load credentials for %s: %w", domain, err)
+	}
+
+	accessToken, err := creds.TokenSource.Token()
+	if err != nil {
+		return "", fmt.Errorf("[GetTunnelAccessToken] Could not get an access token for %s: %w", domain, err)
+	}
+	return accessToken.AccessToken, nil
+}
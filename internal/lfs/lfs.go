@@ -0,0 +1,349 @@
+// Package lfs implements a git-lfs standalone custom transfer agent, talking to the LFS batch API
+// of servers behind IAP, which git-lfs itself cannot reach through the remote helper.
+// see: https://github.com/git-lfs/git-lfs/blob/main/docs/custom-transfers.md
+package lfs
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	_url "net/url"
+	"os"
+	"strings"
+
+	"github.com/adohkan/git-remote-https-iap/internal/git"
+	"github.com/adohkan/git-remote-https-iap/internal/iap"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// AgentName is the name of the custom transfer agent in git config, lfs.customtransfer.<AgentName>
+	AgentName = "iap"
+
+	mediaType = "application/vnd.git-lfs+json"
+
+	// maxRedirects is the limit of net/http, e.g. from the LFS server to the storage of objects
+	maxRedirects = 10
+)
+
+// AuthHeaderFunc returns the header, in the "Name: value" form, authenticating a request to url
+// with IAP, or an empty string
+type AuthHeaderFunc func(url string) string
+
+// event is a line sent by git-lfs to the agent
+type event struct {
+	Event     string `json:"event"`
+	Operation string `json:"operation"`
+	Remote    string `json:"remote"`
+	Oid       string `json:"oid"`
+	Size      int64  `json:"size"`
+	Path      string `json:"path"`
+}
+
+// reply is a line sent back to git-lfs
+type reply struct {
+	Event string      `json:"event,omitempty"`
+	Oid   string      `json:"oid,omitempty"`
+	Path  string      `json:"path,omitempty"`
+	Error *replyError `json:"error,omitempty"`
+}
+
+type replyError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// batch API messages, see: https://github.com/git-lfs/git-lfs/blob/main/docs/api/batch.md
+type batchObject struct {
+	Oid     string                 `json:"oid"`
+	Size    int64                  `json:"size"`
+	Actions map[string]batchAction `json:"actions,omitempty"`
+	Error   *replyError            `json:"error,omitempty"`
+}
+
+type batchAction struct {
+	Href   string            `json:"href"`
+	Header map[string]string `json:"header"`
+}
+
+type batchRequest struct {
+	Operation string        `json:"operation"`
+	Transfers []string      `json:"transfers"`
+	Objects   []batchObject `json:"objects"`
+}
+
+type batchResponse struct {
+	Objects []batchObject `json:"objects"`
+}
+
+// agent transfers the objects of a remote, one at a time
+type agent struct {
+	operation string
+	endpoint  string
+	auth      AuthHeaderFunc
+	client    *http.Client
+
+	// basic credentials of the backend, filled once it answers 401
+	username, password string
+}
+
+// Serve runs the transfer agent, reading events from in and writing replies to out, until git-lfs terminates it
+func Serve(in io.Reader, out io.Writer, auth AuthHeaderFunc) error {
+	var a *agent
+	encoder := json.NewEncoder(out)
+
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		var e event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return fmt.Errorf("[lfs.Serve] Invalid event: %w", err)
+		}
+		log.Debug().Msgf("[lfs.Serve] %s %s", e.Event, e.Oid)
+
+		var r reply
+		switch e.Event {
+		case "init":
+			endpoint, err := Endpoint(e.Remote)
+			if err != nil {
+				r.Error = &replyError{Code: 1, Message: err.Error()}
+				break
+			}
+			a = &agent{operation: e.Operation, endpoint: endpoint, auth: auth, client: &http.Client{}}
+		case "download", "upload":
+			r = reply{Event: "complete", Oid: e.Oid}
+			path, err := a.transfer(e)
+			if err != nil {
+				r.Error = &replyError{Code: 2, Message: err.Error()}
+			}
+			if e.Event == "download" {
+				r.Path = path
+			}
+		case "terminate":
+			return nil
+		default:
+			log.Debug().Msgf("[lfs.Serve] Ignoring event %s", e.Event)
+			continue
+		}
+		if err := encoder.Encode(r); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// Endpoint returns the LFS server of a remote: lfs.url, remote.<name>.lfsurl,
+// or info/lfs under the url of the remote, as git-lfs does
+func Endpoint(remote string) (string, error) {
+	if url := git.ConfigTryGet("lfs.url"); url != "" {
+		return url, nil
+	}
+	if url := git.ConfigTryGet(fmt.Sprintf("remote.%s.lfsurl", remote)); url != "" {
+		return url, nil
+	}
+
+	url := git.ConfigTryGet(fmt.Sprintf("remote.%s.url", remote))
+	if url == "" {
+		// remote is an url when git-lfs is called with one
+		url = remote
+	}
+	// remotes of the helper, such as https+iap:// or iap://, map to the https endpoint git talks to
+	u, err := _url.Parse(url)
+	if err != nil || !(u.Scheme == "https" || u.Scheme == "iap" || strings.HasSuffix(u.Scheme, "+iap")) {
+		return "", fmt.Errorf("[lfs.Endpoint] Unsupported url for remote %s: %s", remote, url)
+	}
+	if url, err = iap.ToHTTPSURL(url); err != nil {
+		return "", fmt.Errorf("[lfs.Endpoint] %w", err)
+	}
+	url = strings.TrimSuffix(url, "/")
+	if !strings.HasSuffix(url, ".git") {
+		url += ".git"
+	}
+	return url + "/info/lfs", nil
+}
+
+// transfer downloads or uploads an object, returning the path of downloaded objects
+func (a *agent) transfer(e event) (string, error) {
+	if a == nil {
+		return "", fmt.Errorf("[lfs.transfer] No init event")
+	}
+
+	object, err := a.batch(batchObject{Oid: e.Oid, Size: e.Size})
+	if err != nil {
+		return "", err
+	}
+	if object.Error != nil {
+		return "", fmt.Errorf("[lfs.transfer] %s (%d)", object.Error.Message, object.Error.Code)
+	}
+
+	if e.Event == "download" {
+		action, ok := object.Actions["download"]
+		if !ok {
+			return "", fmt.Errorf("[lfs.transfer] No download action for %s", e.Oid)
+		}
+		return a.download(e.Oid, action)
+	}
+
+	action, ok := object.Actions["upload"]
+	if !ok {
+		// the server already has the object
+		return "", nil
+	}
+	if err := a.upload(e.Path, e.Size, action); err != nil {
+		return "", err
+	}
+	if verify, ok := object.Actions["verify"]; ok {
+		body, _ := json.Marshal(batchObject{Oid: e.Oid, Size: e.Size})
+		resp, err := a.do("POST", verify, bytes.NewReader(body), mediaType)
+		if err != nil {
+			return "", err
+		}
+		resp.Body.Close()
+	}
+	return "", nil
+}
+
+// batch asks the batch API where to transfer an object, with the backend's basic credentials when required
+func (a *agent) batch(object batchObject) (*batchObject, error) {
+	body, err := json.Marshal(batchRequest{Operation: a.operation, Transfers: []string{"basic"}, Objects: []batchObject{object}})
+	if err != nil {
+		return nil, err
+	}
+	action := batchAction{Href: a.endpoint + "/objects/batch", Header: map[string]string{"Accept": mediaType}}
+
+	resp, err := a.do("POST", action, bytes.NewReader(body), mediaType)
+	if err == errUnauthorized && a.username == "" {
+		if a.username, a.password, err = git.FillCredentials(a.endpoint); err != nil {
+			return nil, err
+		}
+		resp, err = a.do("POST", action, bytes.NewReader(body), mediaType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var batch batchResponse
+	if err := json.NewDecoder(resp.Body).Decode(&batch); err != nil {
+		return nil, fmt.Errorf("[lfs.batch] Invalid response: %w", err)
+	}
+	if len(batch.Objects) != 1 {
+		return nil, fmt.Errorf("[lfs.batch] Expected one object, got %d", len(batch.Objects))
+	}
+	return &batch.Objects[0], nil
+}
+
+// download saves an object to a temporary file, checking its sha256
+func (a *agent) download(oid string, action batchAction) (string, error) {
+	resp, err := a.do("GET", action, nil, "")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	file, err := os.CreateTemp("", "git-lfs-iap-")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(file, hash), resp.Body); err != nil {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("[lfs.download] %w", err)
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != oid {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("[lfs.download] Expected sha256 %s, got %s", oid, sum)
+	}
+	return file.Name(), nil
+}
+
+// upload sends an object from its file
+func (a *agent) upload(path string, size int64, action batchAction) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	resp, err := a.do("PUT", action, file, "application/octet-stream")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+var errUnauthorized = fmt.Errorf("[lfs.do] Unauthorized")
+
+// do sends a request with the headers of an action, adding the IAP header to the requests reaching
+// the host of the endpoint, as IAP would reject them, while storage urls, e.g. signed GCS urls, must not get it
+func (a *agent) do(method string, action batchAction, body io.Reader, contentType string) (*http.Response, error) {
+	req, err := http.NewRequest(method, action.Href, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if file, ok := body.(*os.File); ok {
+		if info, err := file.Stat(); err == nil {
+			req.ContentLength = info.Size()
+		}
+	}
+
+	// the headers of the endpoint, which must not follow redirects to other hosts
+	var credentials []string
+	if a.onEndpoint(req.URL) {
+		if header := a.auth(a.endpoint); header != "" {
+			parts := strings.SplitN(header, ": ", 2)
+			req.Header.Set(parts[0], parts[1])
+			credentials = append(credentials, parts[0])
+		}
+		if a.username != "" {
+			req.SetBasicAuth(a.username, a.password)
+			credentials = append(credentials, "Authorization")
+		}
+	}
+	for name, value := range action.Header {
+		req.Header.Set(name, value)
+	}
+
+	client := *a.client
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxRedirects)
+		}
+		if !a.onEndpoint(req.URL) {
+			for _, name := range credentials {
+				req.Header.Del(name)
+			}
+		}
+		return nil
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("[lfs.do] %s %s: %w", method, action.Href, err)
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		resp.Body.Close()
+		return nil, errUnauthorized
+	}
+	if resp.StatusCode >= 300 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("[lfs.do] %s %s: %s", method, action.Href, resp.Status)
+	}
+	return resp, nil
+}
+
+// onEndpoint tells whether a request url reaches the host of the endpoint, with its scheme: https,
+// unless iap.allowInsecureHTTP opted the host into plain http, so that credentials are never sent in cleartext
+func (a *agent) onEndpoint(u *_url.URL) bool {
+	endpoint, err := _url.Parse(a.endpoint)
+	return err == nil && u.Scheme == endpoint.Scheme && strings.EqualFold(iap.CanonicalHost(u), iap.CanonicalHost(endpoint))
+}
@@ -0,0 +1,49 @@
+// Package redact scrubs credentials from log output, so that debug traces can be shared safely.
+package redact
+
+import (
+	"io"
+	"regexp"
+)
+
+// Placeholder replaces every redacted secret
+const Placeholder = "[REDACTED]"
+
+var patterns = []*regexp.Regexp{
+	// JWTs, such as IAP tokens and signed assertions
+	regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`),
+	// Google refresh tokens, access tokens and authorization codes
+	regexp.MustCompile(`1//[A-Za-z0-9_-]{20,}`),
+	regexp.MustCompile(`ya29\.[A-Za-z0-9_.-]+`),
+	regexp.MustCompile(`4/[A-Za-z0-9_-]{20,}`),
+	// Google OAuth client secrets
+	regexp.MustCompile(`GOCSPX-[A-Za-z0-9_-]+`),
+}
+
+// keyValue matches secrets passed as parameters or headers, whatever their format
+var keyValue = regexp.MustCompile(`(?i)(\b(?:client_secret|refresh_token|access_token|id_token|password|helperSecret|secret)["']?\s*[=:]\s*["']?|\bcode=|\bBearer\s+)[^\s"'&,}\\]+`)
+
+// String returns s without any credential it contains
+func String(s string) string {
+	for _, p := range patterns {
+		s = p.ReplaceAllString(s, Placeholder)
+	}
+	return keyValue.ReplaceAllString(s, "${1}"+Placeholder)
+}
+
+type writer struct {
+	w io.Writer
+}
+
+// NewWriter returns a writer scrubbing credentials before writing to w.
+// Each write is redacted on its own, which suits loggers writing a line at a time.
+func NewWriter(w io.Writer) io.Writer {
+	return &writer{w: w}
+}
+
+func (r *writer) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(r.w, String(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,714 @@
+// Package smarthttp is a git remote helper speaking the smart HTTP protocol itself, sending the IAP
+// token with each request, instead of delegating to git-remote-https and its cookie file.
+// Fetches go through protocol v2 with the stateless-connect capability, when the server speaks it.
+// Otherwise, refs are listed from the protocol v0 advertisement, and fetches and pushes run
+// git fetch-pack and git send-pack in --stateless-rpc mode, whose requests are posted to the server.
+// see: https://git-scm.com/docs/gitremote-helpers and https://git-scm.com/docs/gitprotocol-http
+package smarthttp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/adohkan/git-remote-https-iap/internal/git"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	uploadPack  = "git-upload-pack"
+	receivePack = "git-receive-pack"
+
+	// pkt-lines of special meaning
+	flushPkt       = "0000"
+	delimPkt       = "0001"
+	responseEndPkt = "0002"
+
+	// postBuffer is the size of the largest request sent at once, as http.postBuffer of git-remote-https;
+	// larger ones, such as the packs of pushes, are streamed
+	postBuffer = 1 << 20
+)
+
+// Helper serves the commands of git for a remote
+type Helper struct {
+	// URL is the https:// url of the repository
+	URL string
+	// Header returns the header, in the "Name: value" form, sending a fresh IAP token, or an empty string
+	Header func() string
+
+	// Verbosity is 0 for git --quiet, 1 by default, and more for each --verbose
+	Verbosity int
+
+	// Username and Password are the basic credentials of the backend, asked to git once it answers 401 when empty
+	Username, Password string
+
+	client  *http.Client
+	options options
+	// protocol is the Git-Protocol header of requests, set while fetching through protocol v2
+	protocol string
+	// advertised are the protocol v0 advertisements of the services, by name
+	advertised map[string][]byte
+}
+
+// options are those git gave to the helper, for fetch-pack and send-pack
+// see: https://git-scm.com/docs/gitremote-helpers#_options
+type options struct {
+	progress, followTags, dryRun, checkConnectivity, cloning, updateShallow      bool
+	deepenRelative, fromPromisor, refetch, atomic, forceIfIncludes, objectFormat bool
+	depth, deepenSince, filter, pushCert                                         string
+	deepenNot, pushOptions, cas                                                  []string
+}
+
+// Serve answers the commands git writes to in, until it is done, and returns the exit code of the helper
+func (h *Helper) Serve(in io.Reader, out io.Writer) int {
+	h.client = &http.Client{
+		// the IAP token must stay on the host of the repository, whose redirects were resolved beforehand
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if req.URL.Host != via[0].URL.Host || req.URL.Scheme != via[0].URL.Scheme {
+				return fmt.Errorf("redirected to another host, %s", req.URL.Host)
+			}
+			return nil
+		},
+	}
+	h.Verbosity = 1
+	h.advertised = map[string][]byte{}
+	reader := bufio.NewReader(in)
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			return 0
+		}
+		if err != nil {
+			log.Error().Msgf("[smarthttp] %s", err)
+			return 1
+		}
+		line = strings.TrimSuffix(line, "\n")
+		log.Debug().Msgf("[smarthttp] < %s", line)
+
+		switch {
+		case line == "":
+			return 0
+		case line == "capabilities":
+			fmt.Fprint(out, "stateless-connect\nfetch\npush\noption\ncheck-connectivity\nobject-format\n\n")
+		case strings.HasPrefix(line, "option "):
+			fmt.Fprintln(out, h.setOption(line))
+		case line == "stateless-connect "+uploadPack:
+			advertisement, err := h.advertisement()
+			if err != nil {
+				log.Debug().Msgf("[smarthttp] Falling back to protocol v0: %s", err)
+				fmt.Fprintln(out, "fallback")
+				continue
+			}
+			if h.Verbosity > 1 {
+				fmt.Fprintf(os.Stderr, "Fetching from %s with protocol v2\n", h.URL)
+			}
+			fmt.Fprintln(out)
+			out.Write(advertisement)
+			return h.statelessRPC(reader, out)
+		case line == "list" || line == "list for-push":
+			service := uploadPack
+			if line == "list for-push" {
+				service = receivePack
+			}
+			if err := h.list(service, out); err != nil {
+				log.Error().Msg(err.Error())
+				return 128
+			}
+		case strings.HasPrefix(line, "fetch "):
+			batch, err := readBatch(line, reader)
+			if err == nil {
+				err = h.fetch(batch, out)
+			}
+			if err != nil {
+				log.Error().Msg(err.Error())
+				return 128
+			}
+		case strings.HasPrefix(line, "push "):
+			batch, err := readBatch(line, reader)
+			if err == nil {
+				err = h.push(batch, out)
+			}
+			if err != nil {
+				log.Error().Msg(err.Error())
+				return 128
+			}
+		default:
+			log.Error().Msgf("[smarthttp] Unknown command '%s'", line)
+			return 1
+		}
+	}
+}
+
+// setOption answers an option of git, as git-remote-https would
+// see: https://git-scm.com/docs/gitremote-helpers#_options
+func (h *Helper) setOption(line string) string {
+	parts := strings.SplitN(strings.TrimPrefix(line, "option "), " ", 2)
+	name, value := parts[0], ""
+	if len(parts) == 2 {
+		value = parts[1]
+	}
+
+	// boolean options, such as object-format, are enabled without a value
+	flags := map[string]*bool{
+		"progress": &h.options.progress, "followtags": &h.options.followTags, "dry-run": &h.options.dryRun,
+		"check-connectivity": &h.options.checkConnectivity, "cloning": &h.options.cloning,
+		"update-shallow": &h.options.updateShallow, "deepen-relative": &h.options.deepenRelative,
+		"from-promisor": &h.options.fromPromisor, "refetch": &h.options.refetch, "atomic": &h.options.atomic,
+		"force-if-includes": &h.options.forceIfIncludes, "object-format": &h.options.objectFormat,
+	}
+	if flag, ok := flags[name]; ok {
+		if value == "" {
+			value = "true"
+		}
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Sprintf("error invalid %s", name)
+		}
+		*flag = enabled
+		return "ok"
+	}
+
+	if len(parts) != 2 {
+		return "error missing value"
+	}
+	// values may be quoted in the style of C
+	if strings.HasPrefix(value, `"`) {
+		unquoted, err := strconv.Unquote(value)
+		if err != nil {
+			return fmt.Sprintf("error invalid %s", name)
+		}
+		value = unquoted
+	}
+	switch name {
+	case "verbosity":
+		verbosity, err := strconv.Atoi(value)
+		if err != nil {
+			return "error invalid verbosity"
+		}
+		h.Verbosity = verbosity
+	case "depth":
+		if _, err := strconv.ParseUint(value, 10, 32); err != nil {
+			return "error invalid depth"
+		}
+		h.options.depth = value
+	case "deepen-since":
+		h.options.deepenSince = value
+	case "deepen-not":
+		h.options.deepenNot = append(h.options.deepenNot, value)
+	case "filter":
+		h.options.filter = value
+	case "pushcert":
+		switch value {
+		case "true":
+			h.options.pushCert = "yes"
+		case "if-asked":
+			h.options.pushCert = value
+		case "false":
+			h.options.pushCert = ""
+		default:
+			return "error invalid pushcert"
+		}
+	case "push-option":
+		h.options.pushOptions = append(h.options.pushOptions, value)
+	case "cas":
+		h.options.cas = append(h.options.cas, value)
+	default:
+		return "unsupported"
+	}
+	return "ok"
+}
+
+// advertisement returns the protocol v2 capabilities of the server, or an error when it does not speak
+// protocol v2, whose protocol v0 advertisement is then kept for the list command
+func (h *Helper) advertisement() ([]byte, error) {
+	h.protocol = "version=2"
+	body, err := h.infoRefs(uploadPack)
+	if err != nil {
+		h.protocol = ""
+		return nil, err
+	}
+	if len(body) < 4 || !bytes.HasPrefix(body[4:], []byte("version 2")) {
+		h.protocol = ""
+		h.advertised[uploadPack] = body
+		return nil, fmt.Errorf("[smarthttp] %s does not speak protocol v2", h.URL)
+	}
+	return body, nil
+}
+
+// refs returns the protocol v0 advertisement of the service, asked to the server once
+func (h *Helper) refs(service string) ([]byte, error) {
+	if body, ok := h.advertised[service]; ok {
+		return body, nil
+	}
+	body, err := h.infoRefs(service)
+	if err != nil {
+		return nil, err
+	}
+	h.advertised[service] = body
+	return body, nil
+}
+
+// infoRefs returns the advertisement of the service, without the "# service" header of smart HTTP servers
+func (h *Helper) infoRefs(service string) ([]byte, error) {
+	url := fmt.Sprintf("%s/info/refs?service=%s", h.URL, service)
+	resp, err := h.do("GET", url, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("[smarthttp] GET %s: %w", url, err)
+	}
+
+	if len(body) > 4 && bytes.HasPrefix(body[4:], []byte("# service=")) {
+		size, err := strconv.ParseUint(string(body[:4]), 16, 16)
+		if err != nil || int(size)+4 > len(body) {
+			return nil, fmt.Errorf("[smarthttp] Invalid advertisement")
+		}
+		return bytes.TrimPrefix(body[size:], []byte(flushPkt)), nil
+	}
+	if resp.Header.Get("Content-Type") != fmt.Sprintf("application/x-%s-advertisement", service) {
+		return nil, fmt.Errorf("[smarthttp] %s does not speak the smart HTTP protocol", h.URL)
+	}
+	return body, nil
+}
+
+// list writes the refs of the protocol v0 advertisement of the service, as git-remote-https would
+func (h *Helper) list(service string, out io.Writer) error {
+	body, err := h.refs(service)
+	if err != nil {
+		return err
+	}
+
+	type ref struct{ oid, name string }
+	var refs []ref
+	objectFormat := "sha1"
+	symrefs := map[string]string{}
+	reader := bufio.NewReader(bytes.NewReader(body))
+	for {
+		pkt, err := readPkt(reader)
+		if err != nil {
+			return fmt.Errorf("[smarthttp] Invalid advertisement: %w", err)
+		}
+		if string(pkt) == flushPkt {
+			break
+		}
+		line := strings.TrimSuffix(string(pkt[4:]), "\n")
+		if strings.HasPrefix(line, "version ") || strings.HasPrefix(line, "shallow ") {
+			continue
+		}
+
+		// the first ref carries the capabilities of the server
+		if i := strings.IndexByte(line, 0); i >= 0 {
+			for _, capability := range strings.Fields(line[i+1:]) {
+				if value := strings.TrimPrefix(capability, "object-format="); value != capability {
+					objectFormat = value
+				}
+				if value := strings.TrimPrefix(capability, "symref="); value != capability {
+					if parts := strings.SplitN(value, ":", 2); len(parts) == 2 {
+						symrefs[parts[0]] = parts[1]
+					}
+				}
+			}
+			line = line[:i]
+		}
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("[smarthttp] Invalid ref '%s'", line)
+		}
+		// empty repositories only advertise their capabilities
+		if parts[1] == "capabilities^{}" {
+			continue
+		}
+		// pushes only update refs, not their peeled tags
+		if service == receivePack && (!strings.HasPrefix(parts[1], "refs/") || strings.HasSuffix(parts[1], "^{}")) {
+			continue
+		}
+		refs = append(refs, ref{parts[0], parts[1]})
+	}
+
+	if h.options.objectFormat {
+		fmt.Fprintf(out, ":object-format %s\n", objectFormat)
+	}
+	for _, r := range refs {
+		if target, ok := symrefs[r.name]; ok && service == uploadPack {
+			fmt.Fprintf(out, "@%s %s\n", target, r.name)
+		} else {
+			fmt.Fprintf(out, "%s %s\n", r.oid, r.name)
+		}
+	}
+	fmt.Fprintln(out)
+	return nil
+}
+
+// readBatch returns the commands of a batch starting with line, up to the blank line ending it
+func readBatch(line string, in *bufio.Reader) ([]string, error) {
+	batch := []string{line}
+	for {
+		line, err := in.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("[smarthttp] Truncated batch: %w", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		log.Debug().Msgf("[smarthttp] < %s", line)
+		if line == "" {
+			return batch, nil
+		}
+		batch = append(batch, line)
+	}
+}
+
+// fetch runs git fetch-pack on the refs of a batch of fetch commands
+func (h *Helper) fetch(batch []string, out io.Writer) error {
+	body, err := h.refs(uploadPack)
+	if err != nil {
+		return err
+	}
+
+	args := []string{"fetch-pack", "--stateless-rpc", "--stdin", "--lock-pack", "--thin"}
+	if h.options.followTags {
+		args = append(args, "--include-tag")
+	}
+	if h.options.checkConnectivity {
+		args = append(args, "--check-self-contained-and-connected")
+	}
+	if h.options.cloning {
+		args = append(args, "--cloning")
+	}
+	if h.options.updateShallow {
+		args = append(args, "--update-shallow")
+	}
+	if !h.options.progress {
+		args = append(args, "--no-progress")
+	}
+	if h.Verbosity >= 3 {
+		args = append(args, "-v", "-v")
+	}
+	if h.options.depth != "" {
+		args = append(args, "--depth="+h.options.depth)
+	}
+	if h.options.deepenSince != "" {
+		args = append(args, "--shallow-since="+h.options.deepenSince)
+	}
+	for _, rev := range h.options.deepenNot {
+		args = append(args, "--shallow-exclude="+rev)
+	}
+	if h.options.deepenRelative {
+		args = append(args, "--deepen-relative")
+	}
+	if h.options.fromPromisor {
+		args = append(args, "--from-promisor")
+	}
+	if h.options.refetch {
+		args = append(args, "--refetch")
+	}
+	if h.options.filter != "" {
+		args = append(args, "--filter="+h.options.filter)
+	}
+	args = append(args, h.URL+"/")
+
+	var preamble bytes.Buffer
+	for _, command := range batch {
+		writePkt(&preamble, strings.TrimPrefix(command, "fetch ")+"\n")
+	}
+	preamble.WriteString(flushPkt)
+	preamble.Write(body)
+
+	result, err := h.rpc(uploadPack, args, preamble.Bytes())
+	if err != nil {
+		return err
+	}
+	out.Write(result)
+	fmt.Fprintln(out)
+	return nil
+}
+
+// push runs git send-pack on the refspecs of a batch of push commands, whose status it reports to git
+func (h *Helper) push(batch []string, out io.Writer) error {
+	body, err := h.refs(receivePack)
+	if err != nil {
+		return err
+	}
+
+	args := []string{"send-pack", "--stateless-rpc", "--helper-status", "--thin"}
+	if h.options.dryRun {
+		args = append(args, "--dry-run")
+	}
+	if h.options.pushCert != "" {
+		args = append(args, "--signed="+h.options.pushCert)
+	}
+	if h.options.atomic {
+		args = append(args, "--atomic")
+	}
+	if h.Verbosity == 0 {
+		args = append(args, "--quiet")
+	} else if h.Verbosity > 1 {
+		args = append(args, "--verbose")
+	}
+	for _, option := range h.options.pushOptions {
+		args = append(args, "--push-option="+option)
+	}
+	if h.options.progress {
+		args = append(args, "--progress")
+	} else {
+		args = append(args, "--no-progress")
+	}
+	for _, lease := range h.options.cas {
+		args = append(args, "--force-with-lease="+lease)
+	}
+	if h.options.forceIfIncludes {
+		args = append(args, "--force-if-includes")
+	}
+	args = append(args, "--stdin", h.URL+"/")
+
+	var preamble bytes.Buffer
+	for _, command := range batch {
+		writePkt(&preamble, strings.TrimPrefix(command, "push ")+"\n")
+	}
+	preamble.WriteString(flushPkt)
+	preamble.Write(body)
+
+	result, err := h.rpc(receivePack, args, preamble.Bytes())
+	// rejected refs make send-pack fail, after reporting their status
+	if _, rejected := err.(*exec.ExitError); err != nil && !rejected {
+		return err
+	}
+	out.Write(result)
+	fmt.Fprintln(out)
+	return nil
+}
+
+// rpc runs a git command in --stateless-rpc mode, starting with preamble on its input, posts each
+// of its requests to the service, and returns its output once it is done.
+// An *exec.ExitError is returned, along with the output, when the command fails.
+func (h *Helper) rpc(service string, args []string, preamble []byte) ([]byte, error) {
+	log.Debug().Msgf("[smarthttp] git %v", args)
+	cmd := exec.Command(git.GitBinary, args...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("[smarthttp] %s", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("[smarthttp] %s", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("[smarthttp] Could not start git %s: %s", args[0], err)
+	}
+	abort := func(err error) ([]byte, error) {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, err
+	}
+
+	if _, err := stdin.Write(preamble); err != nil {
+		return abort(fmt.Errorf("[smarthttp] git %s: %s", args[0], err))
+	}
+	reader := bufio.NewReader(stdout)
+	for {
+		// each request is written in pkt-lines, ended by a flush-pkt, and an empty one ends the exchange
+		pkt, err := readPkt(reader)
+		if err != nil {
+			return abort(fmt.Errorf("[smarthttp] git %s: %s", args[0], err))
+		}
+		if string(pkt) == flushPkt {
+			break
+		}
+
+		resp, err := h.post(service, &requestReader{in: reader, payload: pkt[4:]})
+		if err != nil {
+			return abort(err)
+		}
+		_, err = io.Copy(stdin, resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return abort(fmt.Errorf("[smarthttp] git %s: %s", args[0], err))
+		}
+	}
+	stdin.Close()
+
+	result, err := io.ReadAll(reader)
+	if err != nil {
+		return abort(fmt.Errorf("[smarthttp] git %s: %s", args[0], err))
+	}
+	return result, cmd.Wait()
+}
+
+// requestReader reads the payloads of the pkt-lines of a request, up to the flush-pkt ending it
+type requestReader struct {
+	in      *bufio.Reader
+	payload []byte
+	done    bool
+}
+
+func (r *requestReader) Read(p []byte) (int, error) {
+	for len(r.payload) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		pkt, err := readPkt(r.in)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		if string(pkt) == flushPkt {
+			r.done = true
+			continue
+		}
+		r.payload = pkt[4:]
+	}
+	n := copy(p, r.payload)
+	r.payload = r.payload[n:]
+	return n, nil
+}
+
+// statelessRPC posts each request of git to the server, until git closes the connection
+func (h *Helper) statelessRPC(in *bufio.Reader, out io.Writer) int {
+	for {
+		request, err := readRequest(in)
+		if err == io.EOF {
+			return 0
+		}
+		if err != nil {
+			log.Error().Msgf("[smarthttp] %s", err)
+			return 1
+		}
+
+		resp, err := h.post(uploadPack, bytes.NewReader(request))
+		if err != nil {
+			log.Error().Msg(err.Error())
+			return 1
+		}
+		_, err = io.Copy(out, resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			log.Error().Msgf("[smarthttp] %s", err)
+			return 1
+		}
+		// tells git the response is complete, as it cannot know from a stateless connection
+		fmt.Fprint(out, responseEndPkt)
+	}
+}
+
+// readRequest reads pkt-lines up to the flush-pkt ending a protocol v2 request
+func readRequest(in *bufio.Reader) ([]byte, error) {
+	var request bytes.Buffer
+	for {
+		pkt, err := readPkt(in)
+		if err != nil {
+			if err == io.ErrUnexpectedEOF || (err == io.EOF && request.Len() > 0) {
+				return nil, fmt.Errorf("truncated request")
+			}
+			return nil, err
+		}
+		request.Write(pkt)
+		if string(pkt) == flushPkt {
+			return request.Bytes(), nil
+		}
+	}
+}
+
+// readPkt returns the next pkt-line, with its length, which is all of the flush-pkt and other special pkt-lines
+func readPkt(in *bufio.Reader) ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(in, header); err != nil {
+		return nil, err
+	}
+	switch string(header) {
+	case flushPkt, delimPkt, responseEndPkt:
+		return header, nil
+	}
+	size, err := strconv.ParseUint(string(header), 16, 16)
+	if err != nil || size < 4 {
+		return nil, fmt.Errorf("invalid pkt-line length %q", header)
+	}
+	pkt := make([]byte, size)
+	copy(pkt, header)
+	if _, err := io.ReadFull(in, pkt[4:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return pkt, nil
+}
+
+// writePkt writes payload as a pkt-line
+func writePkt(w io.Writer, payload string) {
+	fmt.Fprintf(w, "%04x%s", len(payload)+4, payload)
+}
+
+// post sends a request to the service, streaming those larger than postBuffer
+func (h *Helper) post(service string, request io.Reader) (*http.Response, error) {
+	url := fmt.Sprintf("%s/%s", h.URL, service)
+	contentType := fmt.Sprintf("application/x-%s-request", service)
+	body, err := io.ReadAll(io.LimitReader(request, postBuffer+1))
+	if err != nil {
+		return nil, fmt.Errorf("[smarthttp] POST %s: %w", url, err)
+	}
+	if len(body) <= postBuffer {
+		return h.do("POST", url, body, contentType)
+	}
+	// a streamed request cannot be sent again with credentials, which the advertisement already asked for
+	resp, err := h.try("POST", url, io.MultiReader(bytes.NewReader(body), request), contentType)
+	return checkResponse("POST", url, resp, err)
+}
+
+// do sends a request with the IAP header, and the backend's basic credentials once it asked for them
+func (h *Helper) do(method, url string, body []byte, contentType string) (*http.Response, error) {
+	resp, err := h.try(method, url, bytes.NewReader(body), contentType)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized && h.Username == "" {
+		resp.Body.Close()
+		if h.Username, h.Password, err = git.FillCredentials(h.URL); err != nil {
+			return nil, err
+		}
+		resp, err = h.try(method, url, bytes.NewReader(body), contentType)
+	}
+	return checkResponse(method, url, resp, err)
+}
+
+// checkResponse returns the response when successful, or an error
+func checkResponse(method, url string, resp *http.Response, err error) (*http.Response, error) {
+	if err != nil {
+		return nil, fmt.Errorf("[smarthttp] %s %s: %w", method, url, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("[smarthttp] %s %s: %s", method, url, resp.Status)
+	}
+	return resp, nil
+}
+
+func (h *Helper) try(method, url string, body io.Reader, contentType string) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if h.protocol != "" {
+		req.Header.Set("Git-Protocol", h.protocol)
+	}
+	req.Header.Set("User-Agent", "git/git-remote-https+iap")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Accept", strings.Replace(contentType, "-request", "-result", 1))
+	}
+	if header := h.Header(); header != "" {
+		parts := strings.SplitN(header, ": ", 2)
+		req.Header.Set(parts[0], parts[1])
+	}
+	if h.Username != "" {
+		req.SetBasicAuth(h.Username, h.Password)
+	}
+	return h.client.Do(req)
+}
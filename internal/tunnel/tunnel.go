@@ -0,0 +1,212 @@
+// Package tunnel reaches TCP ports of instances through IAP TCP forwarding, speaking the relay protocol
+// of gcloud compute start-iap-tunnel over a WebSocket, without gcloud.
+// see: https://cloud.google.com/iap/docs/using-tcp-forwarding
+package tunnel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// DefaultRelay is the host of the relay of Google
+	DefaultRelay = "tunnel.cloudproxy.app"
+
+	relayPath     = "/v4/connect"
+	relayProtocol = "relay.tunnel.cloudproxy.app"
+	relayOrigin   = "bot:iap-tunneler"
+
+	// tags of the messages of the relay protocol, each followed by its fields
+	tagConnectSuccessSID   = 0x0001
+	tagReconnectSuccessAck = 0x0002
+	tagData                = 0x0004
+	tagAck                 = 0x0007
+
+	// maxDataFrameSize is the largest data of a message
+	maxDataFrameSize = 16384
+)
+
+// A Target is a port of a Compute Engine instance, reached through IAP
+type Target struct {
+	Project  string
+	Zone     string
+	Instance string
+	// Interface is the network interface of the instance, nic0 by default
+	Interface string
+	Port      int
+	// Relay is the host of the relay, DefaultRelay unless reached with Private Service Connect
+	Relay string
+}
+
+func (t Target) String() string {
+	return fmt.Sprintf("%s:%d (project %s, zone %s)", t.Instance, t.Port, t.Project, t.Zone)
+}
+
+// Conn is a TCP connection through IAP. Dropped connections are not resumed.
+type Conn struct {
+	ws  *wsConn
+	sid string
+
+	// data of the last message not read yet
+	pending []byte
+	// received counts the data bytes read, acknowledged counts those the relay knows of
+	received, acknowledged uint64
+
+	closeOnce sync.Once
+}
+
+// Dial connects to target with accessToken, an OAuth access token of the cloud-platform scope of a user
+// allowed to use IAP TCP forwarding on the instance
+func Dial(target Target, accessToken string) (*Conn, error) {
+	iface := target.Interface
+	if iface == "" {
+		iface = "nic0"
+	}
+	relay := target.Relay
+	if relay == "" {
+		relay = DefaultRelay
+	}
+	u := &url.URL{Scheme: "wss", Host: relay, Path: relayPath, RawQuery: url.Values{
+		"project":   {target.Project},
+		"zone":      {target.Zone},
+		"instance":  {target.Instance},
+		"interface": {iface},
+		"port":      {strconv.Itoa(target.Port)},
+	}.Encode()}
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+accessToken)
+	header.Set("Origin", relayOrigin)
+	header.Set("Sec-WebSocket-Protocol", relayProtocol)
+	header.Set("User-Agent", "git-remote-https+iap")
+
+	log.Debug().Msgf("[tunnel.Dial] Connecting to %s", target)
+	ws, err := dialWebSocket(u, header)
+	if err != nil {
+		return nil, fmt.Errorf("[tunnel.Dial] Could not connect to %s through IAP: %w", target, err)
+	}
+
+	// the relay confirms the connection to the instance before any data
+	message, err := ws.readMessage()
+	if err != nil {
+		ws.close()
+		return nil, fmt.Errorf("[tunnel.Dial] Could not connect to %s through IAP: %w", target, err)
+	}
+	tag, body, err := splitMessage(message)
+	if err != nil || tag != tagConnectSuccessSID {
+		ws.close()
+		return nil, fmt.Errorf("[tunnel.Dial] Unexpected first message of the relay for %s, of tag %d", target, tag)
+	}
+	sid, err := readField(body)
+	if err != nil {
+		ws.close()
+		return nil, fmt.Errorf("[tunnel.Dial] Invalid session of the relay for %s: %w", target, err)
+	}
+	log.Debug().Msgf("[tunnel.Dial] Connected to %s", target)
+	return &Conn{ws: ws, sid: string(sid)}, nil
+}
+
+// Read returns the data sent by the instance, acknowledging it to the relay
+func (c *Conn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		message, err := c.ws.readMessage()
+		if err != nil {
+			if closeErr, ok := err.(*CloseError); ok && closeErr.Code == 1000 {
+				return 0, io.EOF
+			}
+			return 0, err
+		}
+		tag, body, err := splitMessage(message)
+		if err != nil {
+			return 0, err
+		}
+
+		switch tag {
+		case tagData:
+			data, err := readField(body)
+			if err != nil {
+				return 0, err
+			}
+			c.pending = data
+			c.received += uint64(len(data))
+		case tagAck, tagReconnectSuccessAck:
+			// acknowledgements of the data sent, which is not resent on reconnections
+		default:
+			log.Debug().Msgf("[tunnel] Ignoring a message of tag %d", tag)
+		}
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	if c.received-c.acknowledged >= 2*maxDataFrameSize {
+		if err := c.ack(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Write sends data to the instance, in messages of at most maxDataFrameSize
+func (c *Conn) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := len(b)
+		if n > maxDataFrameSize {
+			n = maxDataFrameSize
+		}
+		message := make([]byte, 6+n)
+		binary.BigEndian.PutUint16(message, tagData)
+		binary.BigEndian.PutUint32(message[2:], uint32(n))
+		copy(message[6:], b[:n])
+		if err := c.ws.writeMessage(message); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Close closes the connection to the relay, and so to the instance
+func (c *Conn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		err = c.ws.close()
+	})
+	return err
+}
+
+func (c *Conn) ack() error {
+	message := make([]byte, 10)
+	binary.BigEndian.PutUint16(message, tagAck)
+	binary.BigEndian.PutUint64(message[2:], c.received)
+	c.acknowledged = c.received
+	return c.ws.writeMessage(message)
+}
+
+// splitMessage returns the tag of a message of the relay, and its fields
+func splitMessage(message []byte) (uint16, []byte, error) {
+	if len(message) < 2 {
+		return 0, nil, fmt.Errorf("message of the relay without tag")
+	}
+	return binary.BigEndian.Uint16(message), message[2:], nil
+}
+
+// readField returns a field of the relay protocol, prefixed with its length
+func readField(body []byte) ([]byte, error) {
+	if len(body) < 4 {
+		return nil, fmt.Errorf("truncated message of the relay")
+	}
+	length := binary.BigEndian.Uint32(body)
+	if uint64(len(body)-4) < uint64(length) {
+		return nil, fmt.Errorf("truncated message of the relay")
+	}
+	return body[4 : 4+length], nil
+}